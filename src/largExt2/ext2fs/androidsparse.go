@@ -0,0 +1,272 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	ANDROID_SPARSE_MAGIC     = 0xED26FF3A
+	ANDROID_CHUNK_RAW        = 0xCAC1
+	ANDROID_CHUNK_FILL       = 0xCAC2
+	ANDROID_CHUNK_DONT_CARE  = 0xCAC3
+	ANDROID_CHUNK_CRC32      = 0xCAC4
+	androidSparseHeaderSize  = 28
+	androidSparseChunkHeader = 12
+)
+
+type androidSparseHeader struct {
+	Magic         uint32
+	MajorVersion  uint16
+	MinorVersion  uint16
+	FileHdrSz     uint16
+	ChunkHdrSz    uint16
+	BlkSz         uint32
+	TotalBlks     uint32
+	TotalChunks   uint32
+	ImageChecksum uint32
+}
+
+type androidChunkHeader struct {
+	ChunkType uint16
+	Reserved  uint16
+	ChunkSz   uint32
+	TotalSz   uint32
+}
+
+// androidChunk maps size bytes of the expanded image starting at start.
+type androidChunk struct {
+	start   int64
+	size    int64
+	kind    uint16
+	dataOff int64
+	fill    [4]byte
+}
+
+// androidCheck is a CRC32 chunk, the checksum of the first end bytes.
+type androidCheck struct {
+	end int64
+	crc uint32
+}
+
+// AndroidSparseImage expands an Android sparse image (simg) into the raw
+// image it stands for. DONT_CARE chunks read as zeros.
+type AndroidSparseImage struct {
+	BlockSize int64
+	r         io.ReaderAt
+	chunks    []androidChunk
+	checks    []androidCheck
+	size      int64
+	checksum  uint32
+}
+
+// IsAndroidSparse reports whether r starts with the Android sparse image
+// magic number.
+func IsAndroidSparse(r io.ReaderAt) bool {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint32(magic) == ANDROID_SPARSE_MAGIC
+}
+
+// NewAndroidSparseImage indexes the chunks of the Android sparse image r.
+func NewAndroidSparseImage(r io.ReaderAt) (*AndroidSparseImage, error) {
+	buf := make([]byte, androidSparseHeaderSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+
+	header := androidSparseHeader{}
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header)
+
+	if header.Magic != ANDROID_SPARSE_MAGIC {
+		return nil, errors.New("Not an Android sparse image")
+	}
+
+	if header.MajorVersion != 1 {
+		return nil, errors.New(fmt.Sprintf("Android sparse image version %d is not supported", header.MajorVersion))
+	}
+
+	if header.FileHdrSz < androidSparseHeaderSize || header.ChunkHdrSz < androidSparseChunkHeader {
+		return nil, errors.New("Bad Android sparse image header")
+	}
+
+	if header.BlkSz == 0 || header.BlkSz%4 != 0 {
+		return nil, errors.New(fmt.Sprintf("Bad Android sparse block size %d", header.BlkSz))
+	}
+
+	s := &AndroidSparseImage{BlockSize: int64(header.BlkSz), r: r, checksum: header.ImageChecksum}
+
+	off := int64(header.FileHdrSz)
+	chunkBuf := make([]byte, androidSparseChunkHeader)
+	for i := uint32(0); i < header.TotalChunks; i++ {
+		if _, err := r.ReadAt(chunkBuf, off); err != nil {
+			return nil, err
+		}
+
+		chunkHeader := androidChunkHeader{}
+		binary.Read(bytes.NewReader(chunkBuf), binary.LittleEndian, &chunkHeader)
+
+		chunk := androidChunk{
+			start:   s.size,
+			size:    int64(chunkHeader.ChunkSz) * s.BlockSize,
+			kind:    chunkHeader.ChunkType,
+			dataOff: off + int64(header.ChunkHdrSz),
+		}
+		dataSize := int64(chunkHeader.TotalSz) - int64(header.ChunkHdrSz)
+
+		switch chunk.kind {
+		case ANDROID_CHUNK_RAW:
+			if dataSize != chunk.size {
+				return nil, errors.New(fmt.Sprintf("Android sparse RAW chunk %d has %d bytes for %d", i, dataSize, chunk.size))
+			}
+		case ANDROID_CHUNK_FILL, ANDROID_CHUNK_CRC32:
+			if dataSize != 4 {
+				return nil, errors.New(fmt.Sprintf("Android sparse chunk %d has %d bytes of data instead of 4", i, dataSize))
+			}
+
+			value := make([]byte, 4)
+			if _, err := r.ReadAt(value, chunk.dataOff); err != nil {
+				return nil, err
+			}
+			copy(chunk.fill[:], value)
+		case ANDROID_CHUNK_DONT_CARE:
+		default:
+			return nil, errors.New(fmt.Sprintf("Unknown Android sparse chunk type 0x%04X", chunk.kind))
+		}
+
+		//A CRC32 chunk checks the data before it and maps no blocks
+		if chunk.kind == ANDROID_CHUNK_CRC32 {
+			s.checks = append(s.checks, androidCheck{end: s.size, crc: binary.LittleEndian.Uint32(chunk.fill[:])})
+		} else if chunk.size > 0 {
+			s.chunks = append(s.chunks, chunk)
+			s.size += chunk.size
+		}
+		off += int64(chunkHeader.TotalSz)
+	}
+
+	if s.size != int64(header.TotalBlks)*s.BlockSize {
+		return nil, errors.New(fmt.Sprintf("Android sparse chunks map %d bytes instead of %d blocks", s.size, header.TotalBlks))
+	}
+
+	return s, nil
+}
+
+// OpenAndroidSparseImage opens an Android sparse image file.
+func OpenAndroidSparseImage(path string) (*AndroidSparseImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := NewAndroidSparseImage(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return image, nil
+}
+
+func (s *AndroidSparseImage) Size() int64 {
+	return s.size
+}
+
+func (s *AndroidSparseImage) Chunks() int {
+	return len(s.chunks)
+}
+
+func (s *AndroidSparseImage) String() string {
+	return fmt.Sprintf("Android sparse image, %d bytes in %d chunks of %d byte blocks", s.size, len(s.chunks), s.BlockSize)
+}
+
+func (s *AndroidSparseImage) Close() error {
+	if closer, ok := s.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *AndroidSparseImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= s.size {
+			return n, io.EOF
+		}
+
+		//Last chunk starting at or before pos
+		i := sort.Search(len(s.chunks), func(i int) bool {
+			return s.chunks[i].start > pos
+		}) - 1
+		chunk := &s.chunks[i]
+
+		inner := pos - chunk.start
+		piece := p[n:]
+		if int64(len(piece)) > chunk.size-inner {
+			piece = piece[:chunk.size-inner]
+		}
+
+		switch chunk.kind {
+		case ANDROID_CHUNK_RAW:
+			read, err := s.r.ReadAt(piece, chunk.dataOff+inner)
+			if err != nil && !(err == io.EOF && read == len(piece)) {
+				return n + read, err
+			}
+		case ANDROID_CHUNK_FILL:
+			for j := range piece {
+				piece[j] = chunk.fill[(inner+int64(j))%4]
+			}
+		default:
+			zero(piece)
+		}
+
+		n += len(piece)
+	}
+
+	return n, nil
+}
+
+// Verify expands the whole image and checks it against its CRC32 chunks
+// and the image checksum of the header, when those are present.
+func (s *AndroidSparseImage) Verify() error {
+	var crc uint32
+	buf := make([]byte, 1024*1024)
+	checks := append(append([]androidCheck{}, s.checks...), androidCheck{end: s.size, crc: s.checksum})
+
+	pos := int64(0)
+	for i, check := range checks {
+		for pos < check.end {
+			piece := buf
+			if int64(len(piece)) > check.end-pos {
+				piece = piece[:check.end-pos]
+			}
+
+			if _, err := s.ReadAt(piece, pos); err != nil {
+				return err
+			}
+			crc = crc32.Update(crc, crc32.IEEETable, piece)
+			pos += int64(len(piece))
+		}
+
+		if i == len(s.checks) {
+			if check.crc != 0 && check.crc != crc {
+				return errors.New(fmt.Sprintf("Android sparse image checksum mismatch, 0x%08X computed, 0x%08X stored", crc, check.crc))
+			}
+		} else if check.crc != crc {
+			return errors.New(fmt.Sprintf("Android sparse CRC32 chunk at %d mismatch, 0x%08X computed, 0x%08X stored", check.end, crc, check.crc))
+		}
+	}
+
+	return nil
+}
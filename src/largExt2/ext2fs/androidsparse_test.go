@@ -0,0 +1,229 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const simgTestBlock = 1024
+
+type simgTestChunk struct {
+	kind   uint16
+	blocks int
+	data   []byte //Raw data, or the fill pattern
+}
+
+// simgTestImage returns an Android sparse image of chunks and the data it
+// expands to. CRC32 chunks get the checksum of the data before them, the
+// header the checksum of all the data.
+func simgTestImage(chunks []simgTestChunk) ([]byte, []byte) {
+	var expanded, body bytes.Buffer
+	blocks := 0
+
+	for _, chunk := range chunks {
+		header := androidChunkHeader{ChunkType: chunk.kind, ChunkSz: uint32(chunk.blocks)}
+		data := chunk.data
+
+		switch chunk.kind {
+		case ANDROID_CHUNK_RAW:
+			expanded.Write(data)
+		case ANDROID_CHUNK_FILL:
+			expanded.Write(bytes.Repeat(data, chunk.blocks*simgTestBlock/4))
+		case ANDROID_CHUNK_DONT_CARE:
+			expanded.Write(make([]byte, chunk.blocks*simgTestBlock))
+		case ANDROID_CHUNK_CRC32:
+			data = make([]byte, 4)
+			binary.LittleEndian.PutUint32(data, crc32.ChecksumIEEE(expanded.Bytes()))
+		}
+
+		header.TotalSz = uint32(androidSparseChunkHeader + len(data))
+		binary.Write(&body, binary.LittleEndian, header)
+		body.Write(data)
+		blocks += chunk.blocks
+	}
+
+	header := androidSparseHeader{
+		Magic:         ANDROID_SPARSE_MAGIC,
+		MajorVersion:  1,
+		FileHdrSz:     androidSparseHeaderSize,
+		ChunkHdrSz:    androidSparseChunkHeader,
+		BlkSz:         simgTestBlock,
+		TotalBlks:     uint32(blocks),
+		TotalChunks:   uint32(len(chunks)),
+		ImageChecksum: crc32.ChecksumIEEE(expanded.Bytes()),
+	}
+
+	var image bytes.Buffer
+	binary.Write(&image, binary.LittleEndian, header)
+	image.Write(body.Bytes())
+	return image.Bytes(), expanded.Bytes()
+}
+
+func simgTestChunks() []simgTestChunk {
+	rng := rand.New(rand.NewSource(5))
+	raw := func(blocks int) simgTestChunk {
+		data := make([]byte, blocks*simgTestBlock)
+		rng.Read(data)
+		return simgTestChunk{ANDROID_CHUNK_RAW, blocks, data}
+	}
+
+	return []simgTestChunk{
+		raw(3),
+		{ANDROID_CHUNK_FILL, 2, []byte{1, 2, 3, 4}},
+		{ANDROID_CHUNK_CRC32, 0, nil},
+		{ANDROID_CHUNK_DONT_CARE, 4, nil},
+		raw(1),
+		{ANDROID_CHUNK_FILL, 1, []byte{0xA0, 0xB0, 0xC0, 0xD0}},
+		raw(2),
+	}
+}
+
+func TestAndroidSparse(t *testing.T) {
+	image, data := simgTestImage(simgTestChunks())
+
+	if !IsAndroidSparse(memImage(image)) {
+		t.Fatal("sparse image not recognized")
+	}
+
+	s, err := NewAndroidSparseImage(memImage(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The CRC32 chunk maps no blocks
+	if s.Size() != 13*simgTestBlock || s.Chunks() != 6 {
+		t.Fatalf("read %s", s)
+	}
+	checkRandomReads(t, s, data)
+
+	//Reads from the middle of a pattern, and across the start and end of
+	//both FILL chunks
+	fill := int64(3 * simgTestBlock)
+	reads := []struct {
+		off  int64
+		size int
+	}{
+		{fill + 1, 6},
+		{fill - 3, 10},
+		{fill + 2*simgTestBlock - 5, 12},
+		{8*simgTestBlock - 2, simgTestBlock + 7},
+	}
+	for _, read := range reads {
+		buf := make([]byte, read.size)
+		if _, err := s.ReadAt(buf, read.off); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data[read.off:read.off+int64(read.size)]) {
+			t.Fatalf("read %x at %d, want %x", buf, read.off, data[read.off:read.off+int64(read.size)])
+		}
+	}
+
+	if err := s.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAndroidSparseVerify(t *testing.T) {
+	chunks := simgTestChunks()
+	image, _ := simgTestImage(chunks)
+
+	//The data of the first RAW chunk follows its chunk header
+	rawStart := androidSparseHeaderSize + androidSparseChunkHeader
+	corrupt := append([]byte(nil), image...)
+	corrupt[rawStart+100] ^= 0x01
+
+	s, err := NewAndroidSparseImage(memImage(corrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(); err == nil || !strings.Contains(err.Error(), "CRC32 chunk") {
+		t.Fatalf("corrupt data before a CRC32 chunk gave %v", err)
+	}
+
+	//Data after the last CRC32 chunk is only checked by the image checksum
+	corrupt = append([]byte(nil), image...)
+	corrupt[len(corrupt)-1] ^= 0x01
+
+	s, err = NewAndroidSparseImage(memImage(corrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(); err == nil || !strings.Contains(err.Error(), "image checksum") {
+		t.Fatalf("corrupt data after the CRC32 chunk gave %v", err)
+	}
+
+	//No image checksum is no error
+	binary.LittleEndian.PutUint32(corrupt[24:], 0)
+	s, err = NewAndroidSparseImage(memImage(corrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAndroidSparseBadChunks(t *testing.T) {
+	chunks := simgTestChunks()
+	bad := map[string]func(image []byte){
+		"short RAW chunk": func(image []byte) {
+			binary.LittleEndian.PutUint32(image[androidSparseHeaderSize+4:], 4)
+		},
+		"unknown chunk type": func(image []byte) {
+			binary.LittleEndian.PutUint16(image[androidSparseHeaderSize:], 0xCAC9)
+		},
+		"wrong block count": func(image []byte) {
+			binary.LittleEndian.PutUint32(image[16:], 12)
+		},
+	}
+
+	for name, patch := range bad {
+		t.Run(name, func(t *testing.T) {
+			image, _ := simgTestImage(chunks)
+			patch(image)
+			if _, err := NewAndroidSparseImage(memImage(image)); err == nil {
+				t.Fatal("bad image read")
+			}
+		})
+	}
+}
+
+func TestNewDeviceAndroidSparse(t *testing.T) {
+	disk := readTestData(t, "ext2-1k.img.gz")
+
+	//Blocks of zeros become DONT_CARE chunks
+	chunks := make([]simgTestChunk, 0)
+	for off := 0; off < len(disk); off += simgTestBlock {
+		block := disk[off : off+simgTestBlock]
+		if bytes.Equal(block, make([]byte, simgTestBlock)) {
+			chunks = append(chunks, simgTestChunk{ANDROID_CHUNK_DONT_CARE, 1, nil})
+		} else {
+			chunks = append(chunks, simgTestChunk{ANDROID_CHUNK_RAW, 1, block})
+		}
+	}
+	image, _ := simgTestImage(chunks)
+
+	path := filepath.Join(t.TempDir(), "disk.simg")
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := NewDevice(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if !device.ReadOnly() || device.Size() != int64(len(disk)) || device.BlockSize != 1024 {
+		t.Fatalf("opened a device of %d bytes, %d byte blocks", device.Size(), device.BlockSize)
+	}
+	if inodeNo, err := device.InodeFromPath("hello"); err != nil || inodeNo == 0 {
+		t.Fatalf("hello is inode %d, %v", inodeNo, err)
+	}
+}
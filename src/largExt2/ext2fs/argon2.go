@@ -0,0 +1,268 @@
+package ext2fs
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+)
+
+// Argon2 (RFC 9106) as used by LUKS2 keyslots.
+
+const (
+	argon2d          = 0
+	argon2i          = 1
+	argon2id         = 2
+	argon2Version    = 0x13
+	argon2SyncPoints = 4
+	argon2BlockWords = 128
+)
+
+type argon2Block [argon2BlockWords]uint64
+
+// argon2Key derives a key of keyLen bytes. memory is given in KiB and
+// threads is the number of lanes.
+func argon2Key(mode int, password, salt, secret, data []byte, time, memory, threads uint32, keyLen int) []byte {
+	h0 := argon2InitHash(mode, password, salt, secret, data, time, memory, threads, keyLen)
+
+	memory = memory / (argon2SyncPoints * threads) * (argon2SyncPoints * threads)
+	if memory < 2*argon2SyncPoints*threads {
+		memory = 2 * argon2SyncPoints * threads
+	}
+
+	blocks := argon2InitBlocks(h0, memory, threads)
+	argon2ProcessBlocks(blocks, mode, time, memory, threads)
+	return argon2ExtractKey(blocks, memory, threads, keyLen)
+}
+
+func argon2InitHash(mode int, password, salt, secret, data []byte, time, memory, threads uint32, keyLen int) []byte {
+	params := make([]byte, 24)
+	binary.LittleEndian.PutUint32(params[0:], threads)
+	binary.LittleEndian.PutUint32(params[4:], uint32(keyLen))
+	binary.LittleEndian.PutUint32(params[8:], memory)
+	binary.LittleEndian.PutUint32(params[12:], time)
+	binary.LittleEndian.PutUint32(params[16:], argon2Version)
+	binary.LittleEndian.PutUint32(params[20:], uint32(mode))
+
+	parts := [][]byte{params}
+	for _, field := range [][]byte{password, salt, secret, data} {
+		length := make([]byte, 4)
+		binary.LittleEndian.PutUint32(length, uint32(len(field)))
+		parts = append(parts, length, field)
+	}
+	return blake2bSum(blake2bSize, parts...)
+}
+
+func argon2InitBlocks(h0 []byte, memory, threads uint32) []argon2Block {
+	blocks := make([]argon2Block, memory)
+	buf := make([]byte, 1024)
+	index := make([]byte, 8)
+
+	for lane := uint32(0); lane < threads; lane++ {
+		first := lane * (memory / threads)
+		binary.LittleEndian.PutUint32(index[4:], lane)
+
+		for i := uint32(0); i < 2; i++ {
+			binary.LittleEndian.PutUint32(index, i)
+			argon2Hash(buf, h0, index)
+			for j := range blocks[first+i] {
+				blocks[first+i][j] = binary.LittleEndian.Uint64(buf[8*j:])
+			}
+		}
+	}
+	return blocks
+}
+
+// argon2ProcessBlocks fills the memory pass after pass, slice after slice,
+// the lanes of a slice in parallel.
+func argon2ProcessBlocks(blocks []argon2Block, mode int, time, memory, threads uint32) {
+	laneLength := memory / threads
+	segmentLength := laneLength / argon2SyncPoints
+
+	processSegment := func(pass, slice, lane uint32, wg *sync.WaitGroup) {
+		defer wg.Done()
+
+		//Argon2id addresses the first half of the first pass like Argon2i
+		independent := mode == argon2i || (mode == argon2id && pass == 0 && slice < argon2SyncPoints/2)
+
+		var addresses, input, zero argon2Block
+		if independent {
+			input[0] = uint64(pass)
+			input[1] = uint64(lane)
+			input[2] = uint64(slice)
+			input[3] = uint64(memory)
+			input[4] = uint64(time)
+			input[5] = uint64(mode)
+		}
+
+		index := uint32(0)
+		if pass == 0 && slice == 0 {
+			//The first two blocks of each lane are already set
+			index = 2
+			if independent {
+				input[6]++
+				argon2Compress(&addresses, &input, &zero, false)
+				argon2Compress(&addresses, &addresses, &zero, false)
+			}
+		}
+
+		offset := lane*laneLength + slice*segmentLength + index
+		for index < segmentLength {
+			prev := offset - 1
+			if index == 0 && slice == 0 {
+				prev += laneLength
+			}
+
+			var random uint64
+			if independent {
+				if index%argon2BlockWords == 0 {
+					input[6]++
+					argon2Compress(&addresses, &input, &zero, false)
+					argon2Compress(&addresses, &addresses, &zero, false)
+				}
+				random = addresses[index%argon2BlockWords]
+			} else {
+				random = blocks[prev][0]
+			}
+
+			ref := argon2IndexAlpha(random, laneLength, segmentLength, threads, pass, slice, lane, index)
+			argon2Compress(&blocks[offset], &blocks[prev], &blocks[ref], pass > 0)
+			index, offset = index+1, offset+1
+		}
+	}
+
+	for pass := uint32(0); pass < time; pass++ {
+		for slice := uint32(0); slice < argon2SyncPoints; slice++ {
+			var wg sync.WaitGroup
+			for lane := uint32(0); lane < threads; lane++ {
+				wg.Add(1)
+				go processSegment(pass, slice, lane, &wg)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// argon2IndexAlpha maps a pseudo-random value to the reference block among
+// the blocks that may be referenced from the current one.
+func argon2IndexAlpha(random uint64, laneLength, segmentLength, threads, pass, slice, lane, index uint32) uint32 {
+	refLane := uint32(random>>32) % threads
+	if pass == 0 && slice == 0 {
+		refLane = lane
+	}
+
+	area, start := 3*segmentLength, ((slice+1)%argon2SyncPoints)*segmentLength
+	if lane == refLane {
+		area += index
+	}
+	if pass == 0 {
+		area, start = slice*segmentLength, 0
+		if slice == 0 || lane == refLane {
+			area += index
+		}
+	}
+	if index == 0 || lane == refLane {
+		area--
+	}
+
+	x := random & 0xFFFFFFFF
+	x = (x * x) >> 32
+	x = (x * uint64(area)) >> 32
+	return refLane*laneLength + uint32((uint64(start)+uint64(area)-(x+1))%uint64(laneLength))
+}
+
+// argon2Compress is the compression function G, its result is XORed into
+// out on the passes after the first.
+func argon2Compress(out, in1, in2 *argon2Block, xor bool) {
+	var r, t argon2Block
+	for i := range r {
+		r[i] = in1[i] ^ in2[i]
+	}
+	t = r
+
+	for i := 0; i < argon2BlockWords; i += 16 {
+		argon2Round(&t, i, i+1, i+2, i+3, i+4, i+5, i+6, i+7, i+8, i+9, i+10, i+11, i+12, i+13, i+14, i+15)
+	}
+	for i := 0; i < argon2BlockWords/8; i += 2 {
+		argon2Round(&t, i, i+1, 16+i, 16+i+1, 32+i, 32+i+1, 48+i, 48+i+1,
+			64+i, 64+i+1, 80+i, 80+i+1, 96+i, 96+i+1, 112+i, 112+i+1)
+	}
+
+	if xor {
+		for i := range t {
+			out[i] ^= r[i] ^ t[i]
+		}
+	} else {
+		for i := range t {
+			out[i] = r[i] ^ t[i]
+		}
+	}
+}
+
+// argon2Round is the BLAKE2b round with multiplications of the permutation P
+// over the 16 words at the given indexes.
+func argon2Round(t *argon2Block, i0, i1, i2, i3, i4, i5, i6, i7, i8, i9, i10, i11, i12, i13, i14, i15 int) {
+	g := func(a, b, c, d int) {
+		t[a] += t[b] + 2*uint64(uint32(t[a]))*uint64(uint32(t[b]))
+		t[d] = bits.RotateLeft64(t[d]^t[a], -32)
+		t[c] += t[d] + 2*uint64(uint32(t[c]))*uint64(uint32(t[d]))
+		t[b] = bits.RotateLeft64(t[b]^t[c], -24)
+		t[a] += t[b] + 2*uint64(uint32(t[a]))*uint64(uint32(t[b]))
+		t[d] = bits.RotateLeft64(t[d]^t[a], -16)
+		t[c] += t[d] + 2*uint64(uint32(t[c]))*uint64(uint32(t[d]))
+		t[b] = bits.RotateLeft64(t[b]^t[c], -63)
+	}
+
+	g(i0, i4, i8, i12)
+	g(i1, i5, i9, i13)
+	g(i2, i6, i10, i14)
+	g(i3, i7, i11, i15)
+	g(i0, i5, i10, i15)
+	g(i1, i6, i11, i12)
+	g(i2, i7, i8, i13)
+	g(i3, i4, i9, i14)
+}
+
+func argon2ExtractKey(blocks []argon2Block, memory, threads uint32, keyLen int) []byte {
+	laneLength := memory / threads
+	final := blocks[laneLength-1]
+	for lane := uint32(1); lane < threads; lane++ {
+		last := &blocks[lane*laneLength+laneLength-1]
+		for i := range final {
+			final[i] ^= last[i]
+		}
+	}
+
+	buf := make([]byte, 1024)
+	for i, word := range final {
+		binary.LittleEndian.PutUint64(buf[8*i:], word)
+	}
+
+	key := make([]byte, keyLen)
+	argon2Hash(key, buf)
+	return key
+}
+
+// argon2Hash is the variable length hash H' filling out.
+func argon2Hash(out []byte, parts ...[]byte) {
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(out)))
+	parts = append([][]byte{length}, parts...)
+
+	if len(out) <= blake2bSize {
+		copy(out, blake2bSum(len(out), parts...))
+		return
+	}
+
+	//Chained 64 byte hashes of which the first halves are kept, the last
+	//one is as long as the remaining bytes
+	v := blake2bSum(blake2bSize, parts...)
+	for {
+		copy(out, v[:32])
+		out = out[32:]
+		if len(out) <= blake2bSize {
+			copy(out, blake2bSum(len(out), v))
+			return
+		}
+		v = blake2bSum(blake2bSize, v)
+	}
+}
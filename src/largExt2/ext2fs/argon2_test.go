@@ -0,0 +1,34 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// The test vectors of RFC 9106 section 5.
+func TestArgon2Rfc9106(t *testing.T) {
+	password := bytes.Repeat([]byte{0x01}, 32)
+	salt := bytes.Repeat([]byte{0x02}, 16)
+	secret := bytes.Repeat([]byte{0x03}, 8)
+	data := bytes.Repeat([]byte{0x04}, 12)
+
+	vectors := []struct {
+		name string
+		mode int
+		tag  string
+	}{
+		{"Argon2d", argon2d, "512b391b6f1162975371d30919734294f868e3be3984f3c1a13a4db9fabe4acb"},
+		{"Argon2i", argon2i, "c814d9d1dc7f37aa13f0d77f2494bda1c8de6b016dd388d29952a4c4672b6ce8"},
+		{"Argon2id", argon2id, "0d640df58d78766c08c037a34a8b53c9d01ef0452d75b65eb52520e96b01e659"},
+	}
+
+	for _, vector := range vectors {
+		t.Run(vector.name, func(t *testing.T) {
+			tag := argon2Key(vector.mode, password, salt, secret, data, 3, 32, 4, 32)
+			if got := hex.EncodeToString(tag); got != vector.tag {
+				t.Fatalf("tag %s, want %s", got, vector.tag)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const EXT2_MAX_BLOCK_SIZE = EXT2_DEFAULT_BLOCK_SIZE << EXT2_MAX_LOG_SIZE
+
+// DamagedError reports a superblock or group descriptor table that can't be
+// right. The backup copies kept in other groups may still be.
+type DamagedError struct {
+	Reason string
+}
+
+func (e *DamagedError) Error() string {
+	return e.Reason
+}
+
+// BackupSuperBlock locates a backup copy of the superblock, the backup group
+// descriptor table follows it in the next block.
+type BackupSuperBlock struct {
+	Group     uint32
+	Block     uint64
+	BlockSize uint32
+}
+
+func (b BackupSuperBlock) String() string {
+	return fmt.Sprintf("Backup superblock of group %d at block %d (%d bytes blocks)", b.Group, b.Block, b.BlockSize)
+}
+
+// HasBackup reports whether the group starts with a copy of the superblock
+// and group descriptor table. With sparse_super only groups 0, 1 and the
+// powers of 3, 5 and 7 do.
+func (s *SuperBlock) HasBackup(group uint32) bool {
+	return hasBackup(group, s.HasRoCompat(EXT2_FEATURE_RO_COMPAT_SPARSE_SUPER))
+}
+
+func hasBackup(group uint32, sparseSuper bool) bool {
+	if group <= 1 || !sparseSuper {
+		return true
+	}
+	return isPowerOf(group, 3) || isPowerOf(group, 5) || isPowerOf(group, 7)
+}
+
+func isPowerOf(n, base uint32) bool {
+	for n%base == 0 {
+		n /= base
+	}
+	return n == 1
+}
+
+// BackupSuperBlocks lists the backup superblocks of the filesystem.
+func (s *SuperBlock) BackupSuperBlocks() []BackupSuperBlock {
+	blockSize := uint32(EXT2_DEFAULT_BLOCK_SIZE << s.LogBlockSize)
+	groups := uint32((s.BlocksCount64() - uint64(s.FirstDataBlock) + uint64(s.BlocksPerGroup) - 1) / uint64(s.BlocksPerGroup))
+
+	backups := make([]BackupSuperBlock, 0)
+	for group := uint32(1); group < groups; group++ {
+		if s.HasBackup(group) {
+			block := uint64(s.FirstDataBlock) + uint64(group)*uint64(s.BlocksPerGroup)
+			backups = append(backups, BackupSuperBlock{Group: group, Block: block, BlockSize: blockSize})
+		}
+	}
+	return backups
+}
+
+// check rejects a superblock whose geometry can't be right.
+func (s *SuperBlock) check() error {
+	damaged := func(what string) error {
+		return &DamagedError{Reason: fmt.Sprintf("Damaged superblock, bad %s", what)}
+	}
+
+	if s.LogBlockSize > EXT2_MAX_LOG_SIZE {
+		return damaged("block size")
+	}
+	blockSize := uint32(EXT2_DEFAULT_BLOCK_SIZE << s.LogBlockSize)
+
+	firstDataBlock := uint32(0)
+	if blockSize == EXT2_DEFAULT_BLOCK_SIZE {
+		firstDataBlock = 1
+	}
+	if s.FirstDataBlock != firstDataBlock {
+		return damaged("first data block")
+	}
+
+	if s.BlocksPerGroup == 0 || s.BlocksPerGroup > 8*blockSize {
+		return damaged("blocks per group")
+	}
+
+	if s.InodesPerGroup == 0 || s.InodesPerGroup > 8*blockSize {
+		return damaged("inodes per group")
+	}
+
+	if s.BlocksCount64() <= uint64(s.FirstDataBlock) {
+		return damaged("blocks count")
+	}
+
+	groups := (s.BlocksCount64() - uint64(s.FirstDataBlock) + uint64(s.BlocksPerGroup) - 1) / uint64(s.BlocksPerGroup)
+	if uint64(s.InodesCount) != groups*uint64(s.InodesPerGroup) {
+		return damaged("inodes count")
+	}
+
+	if s.RevLevel >= EXT2_DYNAMIC_REV && (s.InodeSize < EXT2_DEFAULT_INODE_SIZE || uint32(s.InodeSize) > blockSize || s.InodeSize&(s.InodeSize-1) != 0) {
+		return damaged("inode size")
+	}
+
+	descSize := s.GroupDescSize()
+	if s.HasIncompat(EXT4_FEATURE_INCOMPAT_64BIT) && (descSize < EXT2_MIN_DESC_SIZE_64BIT || descSize > blockSize || descSize&(descSize-1) != 0) {
+		return damaged("group descriptor size")
+	}
+
+	descBlocks := (groups + uint64(blockSize/descSize) - 1) / uint64(blockSize/descSize)
+	if s.HasIncompat(EXT2_FEATURE_INCOMPAT_META_BG) && uint64(s.FirstMetaBg) > descBlocks {
+		return damaged("first meta block group")
+	}
+
+	return nil
+}
+
+// readSuperBlock reads the superblock at off, nil when there is none.
+func readSuperBlock(r io.ReaderAt, off int64) *SuperBlock {
+	buf := make([]byte, EXT2_SUPERBLOCK_SIZE)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil
+	}
+
+	super := &SuperBlock{}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, super); err != nil {
+		return nil
+	}
+
+	if super.RevLevel == EXT2_GOOD_OLD_REV {
+		super.goodOldRev()
+	}
+
+	if super.Magic != EXT2_SUPER_MAGIC || super.check() != nil {
+		return nil
+	}
+	return super
+}
+
+// FindBackupSuperBlocks looks for the backup superblocks of the filesystem
+// starting at offset. They are listed by the primary superblock when it is
+// sane, and otherwise looked for where mke2fs puts them by default, for each
+// block size.
+func FindBackupSuperBlocks(r io.ReaderAt, offset int64) []BackupSuperBlock {
+	found := make([]BackupSuperBlock, 0)
+
+	if primary := readSuperBlock(r, offset+BASE_OFFSET); primary != nil {
+		for _, backup := range primary.BackupSuperBlocks() {
+			if readSuperBlock(r, offset+int64(backup.Block)*int64(backup.BlockSize)) != nil {
+				found = append(found, backup)
+			}
+		}
+		return found
+	}
+
+	for blockSize := uint32(EXT2_DEFAULT_BLOCK_SIZE); blockSize <= EXT2_MAX_BLOCK_SIZE; blockSize *= 2 {
+		blocksPerGroup := 8 * blockSize
+		firstDataBlock := uint32(0)
+		if blockSize == EXT2_DEFAULT_BLOCK_SIZE {
+			firstDataBlock = 1
+		}
+
+		for _, group := range sparseGroups(^uint32(0) / blocksPerGroup) {
+			block := uint64(firstDataBlock) + uint64(group)*uint64(blocksPerGroup)
+			off := offset + int64(block)*int64(blockSize)
+
+			//Past the end of the storage
+			if _, err := r.ReadAt(make([]byte, 1), off); err != nil {
+				break
+			}
+
+			super := readSuperBlock(r, off)
+			if super != nil && EXT2_DEFAULT_BLOCK_SIZE<<super.LogBlockSize == blockSize && super.BlocksPerGroup == blocksPerGroup {
+				found = append(found, BackupSuperBlock{Group: group, Block: block, BlockSize: blockSize})
+			}
+		}
+	}
+	return found
+}
+
+// sparseGroups lists the groups from 1 up to limit holding a backup with
+// sparse_super, which also hold one without it.
+func sparseGroups(limit uint32) []uint32 {
+	groups := []uint32{1}
+	for _, base := range []uint64{3, 5, 7} {
+		for group := base; group <= uint64(limit); group *= base {
+			groups = append(groups, uint32(group))
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i] < groups[j]
+	})
+	return groups
+}
+
+// findBackup points the Device at the backup superblock at block, trying
+// each block size.
+func (d *Device) findBackup(block uint64) error {
+	for blockSize := int64(EXT2_DEFAULT_BLOCK_SIZE); blockSize <= EXT2_MAX_BLOCK_SIZE; blockSize *= 2 {
+		super := readSuperBlock(d.reader, d.offset+int64(block)*blockSize)
+		if super != nil && EXT2_DEFAULT_BLOCK_SIZE<<super.LogBlockSize == blockSize {
+			d.superOffset = int64(block) * blockSize
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("No backup superblock at block %d", block))
+}
+
+// checkGroupDescriptors rejects a group descriptor table pointing outside of
+// the groups it describes.
+func (d *Device) checkGroupDescriptors(super *SuperBlock) error {
+	inodeTableBlocks := (uint64(d.InodesPerGroup)*uint64(d.InodeSize) + uint64(d.BlockSize) - 1) / uint64(d.BlockSize)
+
+	for groupNo := uint32(0); groupNo < d.BlockGroupsCount; groupNo++ {
+		group, err := d.NewGroupDescriptor(groupNo)
+		if err != nil {
+			return err
+		}
+
+		first := uint64(super.FirstDataBlock) + uint64(groupNo)*uint64(d.BlocksPerGroup)
+		last := first + uint64(d.BlocksPerGroup) - 1
+		if last >= d.BlocksCount {
+			last = d.BlocksCount - 1
+		}
+		inGroup := func(block uint64) bool {
+			return block >= first && block <= last
+		}
+
+		if !inGroup(group.BlockBitmap64()) || !inGroup(group.InodeBitmap64()) ||
+			!inGroup(group.InodeTable64()) || !inGroup(group.InodeTable64()+inodeTableBlocks-1) {
+			return &DamagedError{Reason: fmt.Sprintf("Damaged group descriptor %d", groupNo)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package ext2fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// The groups images hold several groups, with backups in groups 1 and 3
+// under sparse_super and in groups 1 and 2 without it. The 4K one has 1024
+// blocks per group instead of the default of mke2fs.
+var backupTestImages = []struct {
+	name    string
+	backups []BackupSuperBlock
+}{
+	{"ext2-1k.img.gz", []BackupSuperBlock{}},
+	{"ext2-4k.img.gz", []BackupSuperBlock{}},
+	{"ext2-1k-groups.img.gz", []BackupSuperBlock{{1, 8193, 1024}, {3, 24577, 1024}}},
+	{"ext2-1k-nosparse.img.gz", []BackupSuperBlock{{1, 8193, 1024}, {2, 16385, 1024}}},
+	{"ext2-4k-groups.img.gz", []BackupSuperBlock{{1, 1024, 4096}, {3, 3072, 4096}}},
+}
+
+// damageSuperBlock zeroes the blocks per group of the primary superblock.
+func damageSuperBlock(image []byte) {
+	binary.LittleEndian.PutUint32(image[BASE_OFFSET+32:], 0)
+}
+
+// damageGroupDescriptor points the inode table of the first group
+// descriptor of the primary table past the end of the filesystem.
+func damageGroupDescriptor(image []byte, blockSize int) {
+	table := (BASE_OFFSET/blockSize + 1) * blockSize
+	binary.LittleEndian.PutUint32(image[table+8:], 1<<30)
+}
+
+func readTestFile(t *testing.T, device *Device, name string) string {
+	t.Helper()
+
+	inodeNo, err := device.InodeFromPath(name)
+	if err != nil || inodeNo == EXT2_NULL_INO {
+		t.Fatalf("%s is inode %d, %v", name, inodeNo, err)
+	}
+	inode, err := device.NewInode(inodeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(NewInodeReader(device, inode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFindBackupSuperBlocks(t *testing.T) {
+	for _, test := range backupTestImages {
+		t.Run(test.name, func(t *testing.T) {
+			device, image := openTestImage(t, test.name)
+			super, err := device.NewSuperBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if backups := super.BackupSuperBlocks(); !reflect.DeepEqual(backups, test.backups) {
+				t.Fatalf("listed %v, want %v", backups, test.backups)
+			}
+
+			if backups := FindBackupSuperBlocks(image, 0); !reflect.DeepEqual(backups, test.backups) {
+				t.Fatalf("found %v, want %v", backups, test.backups)
+			}
+		})
+	}
+}
+
+func TestFindBackupSuperBlocksScan(t *testing.T) {
+	//Without the primary superblock the backups are looked for with the
+	//default geometry, for the groups a sparse_super filesystem has them in
+	scans := []struct {
+		name    string
+		backups []BackupSuperBlock
+	}{
+		{"ext2-1k-groups.img.gz", []BackupSuperBlock{{1, 8193, 1024}, {3, 24577, 1024}}},
+		{"ext2-1k-nosparse.img.gz", []BackupSuperBlock{{1, 8193, 1024}}},
+		{"ext2-4k-groups.img.gz", []BackupSuperBlock{}},
+	}
+
+	for _, scan := range scans {
+		t.Run(scan.name, func(t *testing.T) {
+			image := memImage(readTestData(t, scan.name))
+			damageSuperBlock(image)
+			if backups := FindBackupSuperBlocks(image, 0); !reflect.DeepEqual(backups, scan.backups) {
+				t.Fatalf("found %v, want %v", backups, scan.backups)
+			}
+		})
+	}
+}
+
+func TestFindBackup(t *testing.T) {
+	for _, test := range backupTestImages {
+		t.Run(test.name, func(t *testing.T) {
+			image := memImage(readTestData(t, test.name))
+			device := &Device{reader: image, size: int64(len(image))}
+
+			for _, backup := range test.backups {
+				if err := device.findBackup(backup.Block); err != nil {
+					t.Fatal(err)
+				}
+				if device.superOffset != int64(backup.Block)*int64(backup.BlockSize) {
+					t.Fatalf("%s read at %d", backup, device.superOffset)
+				}
+			}
+
+			//Block 2 holds the group descriptors of 1K filesystems and the
+			//inode bitmap of 4K ones
+			if err := device.findBackup(2); err == nil {
+				t.Fatalf("found a backup at block 2, at %d", device.superOffset)
+			}
+		})
+	}
+}
+
+func TestCheckGroupDescriptors(t *testing.T) {
+	for _, test := range backupTestImages {
+		t.Run(test.name, func(t *testing.T) {
+			device, image := openTestImage(t, test.name)
+			super, err := device.NewSuperBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := device.checkGroupDescriptors(super); err != nil {
+				t.Fatal(err)
+			}
+
+			damageGroupDescriptor(image, int(device.BlockSize))
+			device.cache = nil
+			var damaged *DamagedError
+			if err := device.checkGroupDescriptors(super); !errors.As(err, &damaged) {
+				t.Fatalf("checking a damaged group descriptor gave %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenBackup(t *testing.T) {
+	for _, test := range backupTestImages[2:] {
+		for _, damage := range []string{"superblock", "group descriptor"} {
+			t.Run(test.name+" "+damage, func(t *testing.T) {
+				image := memImage(readTestData(t, test.name))
+				blockSize := int(test.backups[0].BlockSize)
+				if damage == "superblock" {
+					damageSuperBlock(image)
+				} else {
+					damageGroupDescriptor(image, blockSize)
+				}
+
+				var damaged *DamagedError
+				if _, err := NewDeviceFromReaderAt(image, int64(len(image)), DeviceOptions{}); !errors.As(err, &damaged) {
+					t.Fatalf("opening a damaged %s gave %v", damage, err)
+				}
+
+				for _, backup := range test.backups {
+					device, err := NewDeviceFromReaderAt(image, int64(len(image)), DeviceOptions{BackupSuperBlock: backup.Block})
+					if err != nil {
+						t.Fatalf("opening %s: %v", backup, err)
+					}
+
+					//The primary copies are left alone
+					if !device.ReadOnly() || device.GroupDescTableBlock != backup.Block+1 || device.BlockSize != backup.BlockSize {
+						t.Fatalf("opened %s with the group descriptors at %d", backup, device.GroupDescTableBlock)
+					}
+					if data := readTestFile(t, device, "hello"); data != "hello\n" {
+						t.Fatalf("read %q from %s", data, backup)
+					}
+				}
+			})
+		}
+	}
+
+	//Group 2 only holds a backup without sparse_super
+	image := memImage(readTestData(t, "ext2-1k-groups.img.gz"))
+	if _, err := NewDeviceFromReaderAt(image, int64(len(image)), DeviceOptions{BackupSuperBlock: 16385}); err == nil {
+		t.Fatal("opened a sparse_super filesystem from group 2")
+	}
+}
@@ -1,7 +1,6 @@
 package ext2fs
 
 import (
-	"encoding/binary"
 	"errors"
 )
 
@@ -10,13 +9,27 @@ type Bitmap []byte
 func (d *Device) NewBitmap(size uint32, blockOffset int64) (Bitmap, error) {
 	bmp := make([]byte, size)
 
-	if _, err := d.file.ReadAt(bmp, blockOffset); err != nil {
+	if _, err := d.readAt(bmp, blockOffset); err != nil {
 		return nil, err
 	}
 
 	return bmp, nil
 }
 
+// newCachedBitmap reads a bitmap block through the metadata cache. The
+// returned Bitmap is a private copy the caller may modify.
+func (d *Device) newCachedBitmap(size uint32, blockNo uint64) (Bitmap, error) {
+	block, err := d.metaBlock(blockNo)
+	if err != nil {
+		return nil, err
+	}
+
+	bmp := make([]byte, size)
+	copy(bmp, block)
+
+	return bmp, nil
+}
+
 func (bmp Bitmap) IsFree(index uint32) bool {
 	return (bmp[index/8] & (1 << (index % 8))) == 0
 }
@@ -45,10 +58,11 @@ func (d *Device) NewInodeBitmap(groupNo uint32) (Bitmap, error) {
 		return nil, err
 	}
 
-	return d.NewBitmap(d.InodesPerGroup/8, d.blockOffset(group.InodeBitmap))
+	return d.newCachedBitmap(d.InodesPerGroup/8, group.InodeBitmap64())
 }
 
-func (d *Device) next(bitmap func(uint32) (Bitmap, error), groupNo uint32) (Bitmap, int, uint32, error) {
+func (d *Device) next(bitmap func(uint32) (Bitmap, error), groupNo uint32, groups uint32) (Bitmap, int, uint32, error) {
+	groupNo %= groups
 	bmp, err := bitmap(groupNo)
 	if err != nil {
 		return bmp, 0, groupNo, err
@@ -59,7 +73,7 @@ func (d *Device) next(bitmap func(uint32) (Bitmap, error), groupNo uint32) (Bitm
 		return bmp, index, groupNo, nil
 	}
 
-	for i := (groupNo + 1) % d.BlockGroupsCount; i != groupNo; i = (i + 1) % d.BlockGroupsCount {
+	for i := (groupNo + 1) % groups; i != groupNo; i = (i + 1) % groups {
 		bmp, err := bitmap(i)
 		if err != nil {
 			return bmp, 0, i, err
@@ -75,7 +89,7 @@ func (d *Device) next(bitmap func(uint32) (Bitmap, error), groupNo uint32) (Bitm
 }
 
 func (d *Device) nextInode(groupNo uint32) (Bitmap, int, uint32, error) {
-	return d.next(d.NewInodeBitmap, groupNo)
+	return d.next(d.NewInodeBitmap, groupNo, d.BlockGroupsCount)
 }
 
 func (d *Device) allocInode(groupNo uint32) (uint32, error) {
@@ -96,20 +110,12 @@ func (d *Device) allocInode(groupNo uint32) (uint32, error) {
 	bmp.Alloc(uint32(index))
 
 	//Update Group Descriptor Inode Bitmap
-	if _, err := d.seek(d.blockOffset(group.InodeBitmap) + int64(index/8)); err != nil {
-		return EXT2_NULL_INO, err
-	}
-
-	if err := binary.Write(d.file, binary.LittleEndian, bmp[index/8]); err != nil {
+	if err := d.encodeAt(bmp[index/8], d.blockOffset(group.InodeBitmap64())+int64(index/8)); err != nil {
 		return EXT2_NULL_INO, err
 	}
 
 	//Update Group Descriptor Free Inodes Count
-	if _, err := d.seek(d.groupDescriptorOffset(groupNo) + BG_FREE_INODES_COUNT); err != nil {
-		return EXT2_NULL_INO, err
-	}
-
-	if err := binary.Write(d.file, binary.LittleEndian, group.FreeInodesCount-1); err != nil {
+	if err := d.updateGroupCount(groupNo, group.FreeInodes()-1, BG_FREE_INODES_COUNT, BG_FREE_INODES_COUNT_HI); err != nil {
 		return EXT2_NULL_INO, err
 	}
 
@@ -117,6 +123,13 @@ func (d *Device) allocInode(groupNo uint32) (uint32, error) {
 }
 
 func (d *Device) AllocInode(groupNo uint32) (uint32, error) {
+	if d.readOnly {
+		return EXT2_NULL_INO, ErrReadOnly
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
 	super, err := d.NewSuperBlock()
 	if err != nil {
 		return EXT2_NULL_INO, err
@@ -131,15 +144,11 @@ func (d *Device) AllocInode(groupNo uint32) (uint32, error) {
 		return EXT2_NULL_INO, nil
 	}
 
-	if _, err := d.seek(BASE_OFFSET + S_FREE_INODES_COUNT); err != nil {
-		return EXT2_NULL_INO, err
-	}
-
-	if err := binary.Write(d.file, binary.LittleEndian, super.FreeInodesCount-1); err != nil {
+	if err := d.encodeAt(super.FreeInodesCount-1, d.superBlockOffset()+S_FREE_INODES_COUNT); err != nil {
 		return EXT2_NULL_INO, err
 	}
 
-	d.file.Sync()
+	d.Sync()
 
 	return inodeNo, nil
 }
@@ -150,14 +159,24 @@ func (d *Device) NewBlockBitmap(groupNo uint32) (Bitmap, error) {
 		return nil, err
 	}
 
-	return d.NewBitmap(d.BlocksPerGroup/8, d.blockOffset(group.BlockBitmap))
+	return d.newCachedBitmap(d.BlocksPerGroup/8, group.BlockBitmap64())
 }
 
 func (d *Device) nextBlock(groupNo uint32) (Bitmap, int, uint32, error) {
-	return d.next(d.NewBlockBitmap, groupNo)
+	return d.next(d.NewBlockBitmap, groupNo, d.blockMapGroups())
 }
 
-func (d *Device) allocBlock(groupNo uint32) (uint32, error) {
+// blockMapGroups returns the number of groups lying entirely below block
+// 2^32, the ones block maps can point into.
+func (d *Device) blockMapGroups() uint32 {
+	groups := (uint64(1)<<32 - uint64(d.FirstDataBlock)) / uint64(d.BlocksPerGroup)
+	if groups > uint64(d.BlockGroupsCount) {
+		return d.BlockGroupsCount
+	}
+	return uint32(groups)
+}
+
+func (d *Device) allocBlock(groupNo uint32) (uint64, error) {
 	bmp, index, groupNo, err := d.nextBlock(groupNo)
 	if err != nil {
 		return EXT2_NULL_BLOCK, err
@@ -175,33 +194,36 @@ func (d *Device) allocBlock(groupNo uint32) (uint32, error) {
 	bmp.Alloc(uint32(index))
 
 	//Update Group Descriptor Block Bitmap
-	if _, err := d.seek(d.blockOffset(group.BlockBitmap) + int64(index/8)); err != nil {
-		return EXT2_NULL_BLOCK, err
-	}
-
-	if err := binary.Write(d.file, binary.LittleEndian, bmp[index/8]); err != nil {
+	if err := d.encodeAt(bmp[index/8], d.blockOffset(group.BlockBitmap64())+int64(index/8)); err != nil {
 		return EXT2_NULL_BLOCK, err
 	}
 
 	//Update Group Descriptor Free Blocks Count
-	if _, err := d.seek(d.groupDescriptorOffset(groupNo) + BG_FREE_BLOCKS_COUNT); err != nil {
+	if err := d.updateGroupCount(groupNo, group.FreeBlocks()-1, BG_FREE_BLOCKS_COUNT, BG_FREE_BLOCKS_COUNT_HI); err != nil {
 		return EXT2_NULL_BLOCK, err
 	}
 
-	if err := binary.Write(d.file, binary.LittleEndian, group.FreeBlocksCount-1); err != nil {
-		return EXT2_NULL_BLOCK, err
+	return uint64(d.FirstDataBlock) + uint64(d.BlocksPerGroup)*uint64(groupNo) + uint64(index), nil
+}
+
+func (d *Device) AllocBlock(groupNo uint32) (uint64, error) {
+	if d.readOnly {
+		return EXT2_NULL_BLOCK, ErrReadOnly
 	}
 
-	return (d.BlocksPerGroup * groupNo) + uint32(index) + 1, nil
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	return d.allocBlockLocked(groupNo)
 }
 
-func (d *Device) AllocBlock(groupNo uint32) (uint32, error) {
+func (d *Device) allocBlockLocked(groupNo uint32) (uint64, error) {
 	super, err := d.NewSuperBlock()
 	if err != nil {
 		return EXT2_NULL_BLOCK, err
 	}
 
-	if super.FreeBlocksCount == 0 {
+	if super.FreeBlocksCount64() == 0 {
 		return EXT2_NULL_BLOCK, errors.New("Blocks disk limit reached")
 	}
 
@@ -210,15 +232,18 @@ func (d *Device) AllocBlock(groupNo uint32) (uint32, error) {
 		return EXT2_NULL_BLOCK, nil
 	}
 
-	if _, err := d.seek(BASE_OFFSET + S_FREE_BLOCKS_COUNT); err != nil {
+	free := super.FreeBlocksCount64() - 1
+	if err := d.encodeAt(uint32(free), d.superBlockOffset()+S_FREE_BLOCKS_COUNT); err != nil {
 		return EXT2_NULL_BLOCK, err
 	}
 
-	if err := binary.Write(d.file, binary.LittleEndian, super.FreeBlocksCount-1); err != nil {
-		return EXT2_NULL_BLOCK, err
+	if super.HasIncompat(EXT4_FEATURE_INCOMPAT_64BIT) {
+		if err := d.encodeAt(uint32(free>>32), d.superBlockOffset()+S_FREE_BLOCKS_COUNT_HI); err != nil {
+			return EXT2_NULL_BLOCK, err
+		}
 	}
 
-	d.file.Sync()
+	d.Sync()
 
 	return blockNo, nil
 }
@@ -0,0 +1,63 @@
+package ext2fs
+
+import "testing"
+
+func TestAllocBlock(t *testing.T) {
+	for _, name := range []string{"ext2-1k.img.gz", "ext2-4k.img.gz"} {
+		t.Run(name, func(t *testing.T) {
+			device, _ := openTestImage(t, name)
+
+			bmp, err := device.NewBlockBitmap(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			index := bmp.FindFree()
+			if index < 0 {
+				t.Fatal("no free block")
+			}
+
+			super, err := device.NewSuperBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			group, err := device.NewGroupDescriptor(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			block, err := device.AllocBlock(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//Bit index of the bitmap stands for block FirstDataBlock+index
+			if want := uint64(device.FirstDataBlock) + uint64(index); block != want {
+				t.Fatalf("allocated block %d, the bitmap marks block %d", block, want)
+			}
+
+			bmp, err = device.NewBlockBitmap(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bmp.IsFree(uint32(index)) {
+				t.Fatalf("block %d is still free in the bitmap", block)
+			}
+
+			after, err := device.NewSuperBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.FreeBlocksCount != super.FreeBlocksCount-1 {
+				t.Fatalf("superblock free blocks %d, want %d", after.FreeBlocksCount, super.FreeBlocksCount-1)
+			}
+
+			groupAfter, err := device.NewGroupDescriptor(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if groupAfter.FreeBlocks() != group.FreeBlocks()-1 {
+				t.Fatalf("group free blocks %d, want %d", groupAfter.FreeBlocks(), group.FreeBlocks()-1)
+			}
+		})
+	}
+}
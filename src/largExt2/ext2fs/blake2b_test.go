@@ -0,0 +1,54 @@
+package ext2fs
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// blake2bTestInput is the input of length n whose byte i is i mod 251.
+func blake2bTestInput(n int) []byte {
+	input := make([]byte, n)
+	for i := range input {
+		input[i] = byte(i % 251)
+	}
+	return input
+}
+
+// The expected hashes come from Python's hashlib.blake2b. The lengths fall
+// around the 128 byte block, whose last one is compressed as final.
+func TestBlake2b(t *testing.T) {
+	vectors := []struct {
+		length int
+		size   int
+		sum    string
+	}{
+		{0, 64, "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{1, 64, "2fa3f686df876995167e7c2e5d74c4c7b6e48f8068fe0e44208344d480f7904c36963e44115fe3eb2a3ac8694c28bcb4f5a0f3276f2e79487d8219057a506e4b"},
+		{127, 64, "b6292669ccd38d5f01caae96ba272c76a879a45743afa0725d83b9ebb26665b731f1848c52f11972b6644f554c064fa90780dbbbf3a89d4fc31f67df3e5857ef"},
+		{128, 64, "2319e3789c47e2daa5fe807f61bec2a1a6537fa03f19ff32e87eecbfd64b7e0e8ccff439ac333b040f19b0c4ddd11a61e24ac1fe0f10a039806c5dcc0da3d115"},
+		{129, 64, "f59711d44a031d5f97a9413c065d1e614c417ede998590325f49bad2fd444d3e4418be19aec4e11449ac1a57207898bc57d76a1bcf3566292c20c683a5c4648f"},
+		{1000, 64, "c11e1c0340bd7e5a1b275f1230c962fad215ecb1391486e74e31b960a2f2996381a5fad092da06841d5f26e38f6ecfeaf441acbcd1c2de61aef121e7927175f5"},
+		{1000, 32, "b372d0608f720c8c3dd41e9c8eecb10143b41abe520b616607e754bf79c08331"},
+	}
+
+	for _, vector := range vectors {
+		input := blake2bTestInput(vector.length)
+		if got := hex.EncodeToString(blake2bSum(vector.size, input)); got != vector.sum {
+			t.Fatalf("BLAKE2b-%d of %d bytes is %s, want %s", 8*vector.size, vector.length, got, vector.sum)
+		}
+
+		//The input split in parts, across block boundaries
+		var parts [][]byte
+		for rest := input; len(rest) > 0; {
+			n := 1 + len(parts)*37%130
+			if n > len(rest) {
+				n = len(rest)
+			}
+			parts = append(parts, rest[:n])
+			rest = rest[n:]
+		}
+		if got := hex.EncodeToString(blake2bSum(vector.size, parts...)); got != vector.sum {
+			t.Fatalf("BLAKE2b-%d of %d bytes in %d parts is %s, want %s", 8*vector.size, vector.length, len(parts), got, vector.sum)
+		}
+	}
+}
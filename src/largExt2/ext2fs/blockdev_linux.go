@@ -0,0 +1,18 @@
+package ext2fs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const blkGetSize64 = 0x80081272
+
+func blockDeviceSize(file *os.File) (int64, error) {
+	var size uint64
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), blkGetSize64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ext2fs
+
+import (
+	"io"
+	"os"
+)
+
+// blockDeviceSize falls back to the end offset where BLKGETSIZE64 is missing.
+func blockDeviceSize(file *os.File) (int64, error) {
+	return file.Seek(0, io.SeekEnd)
+}
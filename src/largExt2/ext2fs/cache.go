@@ -0,0 +1,179 @@
+package ext2fs
+
+import (
+	"container/list"
+	"sync"
+)
+
+const defaultCacheSize = 16 * 1024 * 1024
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Blocks    int
+	Capacity  int
+}
+
+type cacheEntry struct {
+	blockNo uint64
+	data    []byte
+}
+
+// blockCache keeps the most recently used metadata blocks of a Device. A nil
+// *blockCache is a valid, always missing cache.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[uint64]*list.Element
+	lru      *list.List
+	stats    CacheStats
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		entries:  make(map[uint64]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *blockCache) get(blockNo uint64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[blockNo]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).data, true
+}
+
+func (c *blockCache) put(blockNo uint64, data []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[blockNo]; ok {
+		elem.Value.(*cacheEntry).data = data
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	for c.lru.Len() >= c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).blockNo)
+		c.stats.Evictions++
+	}
+
+	c.entries[blockNo] = c.lru.PushFront(&cacheEntry{blockNo: blockNo, data: data})
+}
+
+// invalidate drops the cached blocks first through last, inclusive.
+func (c *blockCache) invalidate(first, last uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if int(last-first) >= len(c.entries) {
+		for blockNo, elem := range c.entries {
+			if blockNo >= first && blockNo <= last {
+				c.lru.Remove(elem)
+				delete(c.entries, blockNo)
+			}
+		}
+		return
+	}
+
+	for blockNo := first; ; blockNo++ {
+		if elem, ok := c.entries[blockNo]; ok {
+			c.lru.Remove(elem)
+			delete(c.entries, blockNo)
+		}
+		if blockNo == last {
+			break
+		}
+	}
+}
+
+func (c *blockCache) snapshot() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Blocks = c.lru.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
+
+// CacheStats reports how well the metadata block cache has been doing.
+func (d *Device) CacheStats() CacheStats {
+	return d.cache.snapshot()
+}
+
+// metaBlock returns the contents of a metadata block, going through the
+// cache or straight from the mapping. The returned slice is shared and must
+// not be modified.
+func (d *Device) metaBlock(blockNo uint64) ([]byte, error) {
+	if d.mapping != nil {
+		if data := d.mapping.slice(d.blockOffset(blockNo), int(d.BlockSize)); data != nil {
+			return data, nil
+		}
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if data, ok := d.cache.get(blockNo); ok {
+		return data, nil
+	}
+
+	data := make([]byte, d.BlockSize)
+	if _, err := d.readAtLocked(data, d.blockOffset(blockNo)); err != nil {
+		return nil, err
+	}
+
+	d.cache.put(blockNo, data)
+	return data, nil
+}
+
+// metaBytes returns size bytes of metadata at the storage offset off, going
+// through the cache when they don't cross a block boundary.
+func (d *Device) metaBytes(size int, off int64) ([]byte, error) {
+	blockNo := uint64((off - d.offset) / int64(d.BlockSize))
+	inner := int((off - d.offset) % int64(d.BlockSize))
+
+	if inner+size > int(d.BlockSize) {
+		data := make([]byte, size)
+		if _, err := d.readAt(data, off); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	block, err := d.metaBlock(blockNo)
+	if err != nil {
+		return nil, err
+	}
+
+	return block[inner : inner+size], nil
+}
@@ -0,0 +1,801 @@
+package ext2fs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	GZIP_MAGIC              = "\x1f\x8b"
+	BZIP2_MAGIC             = "BZh"
+	COMPRESSED_DEFAULT_SPAN = 32 * 1024 * 1024
+	COMPRESSED_INDEX_SUFFIX = ".idx"
+	compressedIndexMagic    = "LXIDX002"
+	indexFingerprintSize    = 1024 * 1024
+	compressedCursors       = 4
+	compressedScanChunk     = 1024 * 1024
+	bzip2BlockMagic         = 0x314159265359
+	bzip2EndMagic           = 0x177245385090
+	bzip2MagicBits          = 48
+	bzip2MaxFalseMagics     = 8
+)
+
+const (
+	formatGzip = iota + 1
+	formatBzip2
+)
+
+var formatNames = map[int]string{formatGzip: "gzip", formatBzip2: "bzip2"}
+
+// seekPoint is a position decoding can start from. For gzip it is a deflate
+// block boundary with the 32KiB of output preceding it, stored compressed.
+// For bzip2 it is a whole block of Bits bits.
+type seekPoint struct {
+	Out    int64
+	BitPos int64
+	Bits   int64
+	window []byte
+}
+
+type seekPointRecord struct {
+	Out        int64
+	BitPos     int64
+	Bits       int64
+	WindowSize uint32
+}
+
+type compressedIndexHeader struct {
+	Magic          [8]byte
+	Format         uint32
+	Fingerprint    uint32
+	CompressedSize int64
+	Size           int64
+	Span           int64
+	Points         int64
+}
+
+// CompressedImage gives random access to a gzip or bzip2 compressed image
+// through an index of seek points, built by decompressing the image once.
+// Reads keep a few decoders open so that sequential reads don't restart
+// from a seek point.
+type CompressedImage struct {
+	mu             sync.Mutex
+	r              io.ReaderAt
+	format         int
+	compressedSize int64
+	fingerprint    uint32
+	size           int64
+	span           int64
+	points         []seekPoint
+	indexLoaded    bool
+	cursors        []*gzipCursor
+	blocks         []*bzip2Cached
+	clock          uint64
+}
+
+type gzipCursor struct {
+	z    *gzipReader
+	pos  int64
+	used uint64
+}
+
+type bzip2Cached struct {
+	point int
+	data  []byte
+	used  uint64
+}
+
+// CompressionFormat returns "gzip" or "bzip2" for compressed storage and an
+// empty string for anything else.
+func CompressionFormat(r io.ReaderAt) string {
+	return formatNames[compressionFormat(r)]
+}
+
+func compressionFormat(r io.ReaderAt) int {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return 0
+	}
+
+	if string(magic[:2]) == GZIP_MAGIC && magic[2] == 8 {
+		return formatGzip
+	}
+
+	if string(magic[:3]) == BZIP2_MAGIC && magic[3] >= '1' && magic[3] <= '9' {
+		return formatBzip2
+	}
+
+	return 0
+}
+
+// NewCompressedImage indexes the compressed image r, which has size bytes,
+// with seek points every span bytes of decompressed data.
+func NewCompressedImage(r io.ReaderAt, size int64, span int64) (*CompressedImage, error) {
+	c := &CompressedImage{r: r, format: compressionFormat(r), compressedSize: size, span: span}
+	if span <= 0 {
+		c.span = COMPRESSED_DEFAULT_SPAN
+	}
+
+	var err error
+	if c.fingerprint, err = compressedFingerprint(r, size); err != nil {
+		return nil, err
+	}
+
+	switch c.format {
+	case formatGzip:
+		err = c.indexGzip()
+	case formatBzip2:
+		err = c.indexBzip2()
+	default:
+		err = errors.New("Not a gzip or bzip2 compressed image")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// OpenCompressedImage opens the compressed image r with the index saved in
+// indexPath. When the index is missing or doesn't match the image, a new
+// index is built.
+func OpenCompressedImage(r io.ReaderAt, size int64, indexPath string) (*CompressedImage, error) {
+	file, err := os.Open(indexPath)
+	if err == nil {
+		c, err := LoadCompressedImage(r, size, file)
+		file.Close()
+		if err == nil {
+			return c, nil
+		}
+	}
+	return NewCompressedImage(r, size, COMPRESSED_DEFAULT_SPAN)
+}
+
+// LoadCompressedImage opens the compressed image r with an index written by
+// WriteIndex.
+func LoadCompressedImage(r io.ReaderAt, size int64, index io.Reader) (*CompressedImage, error) {
+	in := bufio.NewReader(index)
+
+	header := compressedIndexHeader{}
+	if err := binary.Read(in, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+
+	format := compressionFormat(r)
+	if string(header.Magic[:]) != compressedIndexMagic || int(header.Format) != format {
+		return nil, errors.New("Not an index of this image")
+	}
+
+	if header.CompressedSize != size || header.Points <= 0 {
+		return nil, errors.New("Index doesn't match the image size")
+	}
+
+	//An index left over from another image of the same size would silently
+	//return the data of that image
+	sum, err := compressedFingerprint(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if header.Fingerprint != sum {
+		return nil, errors.New("Index doesn't match the image contents")
+	}
+
+	c := &CompressedImage{
+		r:              r,
+		format:         format,
+		compressedSize: size,
+		fingerprint:    sum,
+		size:           header.Size,
+		span:           header.Span,
+		indexLoaded:    true,
+	}
+
+	for i := int64(0); i < header.Points; i++ {
+		record := seekPointRecord{}
+		if err := binary.Read(in, binary.LittleEndian, &record); err != nil {
+			return nil, err
+		}
+
+		if record.WindowSize > 2*inflateWindowSize {
+			return nil, errors.New("Bad seek point in index")
+		}
+
+		point := seekPoint{Out: record.Out, BitPos: record.BitPos, Bits: record.Bits}
+		if record.WindowSize > 0 {
+			point.window = make([]byte, record.WindowSize)
+			if _, err := io.ReadFull(in, point.window); err != nil {
+				return nil, err
+			}
+		}
+		c.points = append(c.points, point)
+	}
+
+	return c, nil
+}
+
+// compressedFingerprint is the CRC-32 of the first and last MiB of the
+// compressed image, the whole of smaller images. The last MiB holds the
+// CRC-32 of the data of the last gzip member or the combined CRC of a bzip2
+// stream.
+func compressedFingerprint(r io.ReaderAt, size int64) (uint32, error) {
+	head := int64(indexFingerprintSize)
+	if head > size {
+		head = size
+	}
+	tail := size - indexFingerprintSize
+	if tail < head {
+		tail = head
+	}
+
+	sum := uint32(0)
+	for _, part := range [][2]int64{{0, head}, {tail, size}} {
+		buf := make([]byte, part[1]-part[0])
+		if n, err := r.ReadAt(buf, part[0]); err != nil && !(err == io.EOF && n == len(buf)) {
+			return 0, err
+		}
+		sum = crc32.Update(sum, crc32.IEEETable, buf)
+	}
+	return sum, nil
+}
+
+// WriteIndex saves the seek points so the image can later be opened with
+// LoadCompressedImage without decompressing it again.
+func (c *CompressedImage) WriteIndex(w io.Writer) error {
+	out := bufio.NewWriter(w)
+
+	header := compressedIndexHeader{
+		Format:         uint32(c.format),
+		Fingerprint:    c.fingerprint,
+		CompressedSize: c.compressedSize,
+		Size:           c.size,
+		Span:           c.span,
+		Points:         int64(len(c.points)),
+	}
+	copy(header.Magic[:], compressedIndexMagic)
+
+	if err := binary.Write(out, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	for _, point := range c.points {
+		record := seekPointRecord{Out: point.Out, BitPos: point.BitPos, Bits: point.Bits, WindowSize: uint32(len(point.window))}
+		if err := binary.Write(out, binary.LittleEndian, &record); err != nil {
+			return err
+		}
+		if _, err := out.Write(point.window); err != nil {
+			return err
+		}
+	}
+
+	return out.Flush()
+}
+
+// SaveIndex writes the index to a sidecar file at path.
+func (c *CompressedImage) SaveIndex(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := c.WriteIndex(file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// IndexLoaded reports whether the index was read from a file instead of
+// built from the image.
+func (c *CompressedImage) IndexLoaded() bool {
+	return c.indexLoaded
+}
+
+func (c *CompressedImage) Format() string {
+	return formatNames[c.format]
+}
+
+func (c *CompressedImage) Size() int64 {
+	return c.size
+}
+
+func (c *CompressedImage) String() string {
+	return fmt.Sprintf("%s image, %d bytes compressed, %d bytes decompressed, %d seek points",
+		c.Format(), c.compressedSize, c.size, len(c.points))
+}
+
+func (c *CompressedImage) Close() error {
+	if closer, ok := c.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *CompressedImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= c.size {
+		return 0, io.EOF
+	}
+
+	want := p
+	if int64(len(want)) > c.size-off {
+		want = want[:c.size-off]
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock++
+
+	var err error
+	if c.format == formatGzip {
+		err = c.readGzip(want, off)
+	} else {
+		err = c.readBzip2(want, off)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(want) < len(p) {
+		return len(want), io.EOF
+	}
+	return len(p), nil
+}
+
+// point returns the index of the last seek point at or before off.
+func (c *CompressedImage) point(off int64) int {
+	return sort.Search(len(c.points), func(i int) bool {
+		return c.points[i].Out > off
+	}) - 1
+}
+
+func packWindow(window []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(window)
+	w.Close()
+	return buf.Bytes()
+}
+
+func unpackWindow(packed []byte) ([]byte, error) {
+	if len(packed) == 0 {
+		return nil, nil
+	}
+	return io.ReadAll(flate.NewReader(bytes.NewReader(packed)))
+}
+
+// gzipReader decodes gzip members one after another from a deflate block
+// boundary. Member checksums are verified only when decoding started at
+// the beginning of a member.
+type gzipReader struct {
+	br          *bitReader
+	f           *inflater
+	memberStart int64
+	check       bool
+	crc         uint32
+	done        bool
+}
+
+func readGzipHeader(br *bitReader) error {
+	header := make([]byte, 10)
+	for i := range header {
+		b, err := br.getBits(8)
+		if err != nil {
+			return err
+		}
+		header[i] = byte(b)
+	}
+
+	if string(header[:2]) != GZIP_MAGIC || header[2] != 8 {
+		return errors.New("Not a gzip member")
+	}
+
+	flags := header[3]
+	if flags&0x04 != 0 {
+		extra, err := br.getBits(16)
+		if err != nil {
+			return err
+		}
+		for ; extra > 0; extra-- {
+			if _, err := br.getBits(8); err != nil {
+				return err
+			}
+		}
+	}
+
+	//File name and comment are zero terminated
+	for _, flag := range []byte{0x08, 0x10} {
+		if flags&flag == 0 {
+			continue
+		}
+		for {
+			b, err := br.getBits(8)
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				break
+			}
+		}
+	}
+
+	if flags&0x02 != 0 {
+		if _, err := br.getBits(16); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (z *gzipReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if z.done {
+			return n, io.EOF
+		}
+
+		read, err := z.f.Read(p[n:])
+		if z.check {
+			z.crc = crc32.Update(z.crc, crc32.IEEETable, p[n:n+read])
+		}
+		n += read
+
+		if err == io.EOF {
+			err = z.nextMember()
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// nextMember checks the trailer of the member just decoded and moves to the
+// next member. Anything but a gzip member after a trailer is ignored as
+// gzip itself does.
+func (z *gzipReader) nextMember() error {
+	z.br.alignByte()
+	crc, err := z.br.getBits(32)
+	if err != nil {
+		return err
+	}
+	size, err := z.br.getBits(32)
+	if err != nil {
+		return err
+	}
+
+	if z.check && (crc != z.crc || size != uint32(z.f.out-z.memberStart)) {
+		return errors.New(fmt.Sprintf("gzip checksum mismatch in member ending at byte %d", z.br.bitPos()/8))
+	}
+
+	if !z.br.more() || readGzipHeader(z.br) != nil {
+		z.done = true
+		return nil
+	}
+
+	z.f.final = false
+	z.f.state = inflateBlockStart
+	z.memberStart = z.f.out
+	z.check = true
+	z.crc = 0
+	return nil
+}
+
+func (c *CompressedImage) indexGzip() error {
+	br, err := newBitReader(c.r, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := readGzipHeader(br); err != nil {
+		return err
+	}
+
+	z := &gzipReader{br: br, f: newInflater(br, nil, 0), check: true}
+	z.f.onBlock = func(bitPos int64, out int64) {
+		if len(c.points) > 0 && out-c.points[len(c.points)-1].Out < c.span {
+			return
+		}
+		window := z.f.lastWindow(out)
+		c.points = append(c.points, seekPoint{Out: out, BitPos: bitPos, window: packWindow(window)})
+	}
+
+	buf := make([]byte, compressedScanChunk)
+	for {
+		_, err := z.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	c.size = z.f.out
+	return nil
+}
+
+func (c *CompressedImage) readGzip(p []byte, off int64) error {
+	i := c.point(off)
+	point := c.points[i]
+
+	//Reuse the closest decoder unless restarting from the seek point is
+	//cheaper
+	var cursor *gzipCursor
+	for _, candidate := range c.cursors {
+		if candidate.pos <= off && off-candidate.pos <= off-point.Out &&
+			(cursor == nil || candidate.pos > cursor.pos) {
+			cursor = candidate
+		}
+	}
+
+	if cursor == nil {
+		window, err := unpackWindow(point.window)
+		if err != nil {
+			return err
+		}
+
+		br, err := newBitReader(c.r, point.BitPos)
+		if err != nil {
+			return err
+		}
+
+		cursor = &gzipCursor{
+			z:   &gzipReader{br: br, f: newInflater(br, window, point.Out)},
+			pos: point.Out,
+		}
+		c.addCursor(cursor)
+	}
+	cursor.used = c.clock
+
+	if skip := off - cursor.pos; skip > 0 {
+		if _, err := io.CopyN(io.Discard, cursor.z, skip); err != nil {
+			c.dropCursor(cursor)
+			return err
+		}
+		cursor.pos = off
+	}
+
+	if _, err := io.ReadFull(cursor.z, p); err != nil {
+		c.dropCursor(cursor)
+		return err
+	}
+	cursor.pos += int64(len(p))
+	return nil
+}
+
+func (c *CompressedImage) addCursor(cursor *gzipCursor) {
+	if len(c.cursors) < compressedCursors {
+		c.cursors = append(c.cursors, cursor)
+		return
+	}
+
+	oldest := 0
+	for i, candidate := range c.cursors {
+		if candidate.used < c.cursors[oldest].used {
+			oldest = i
+		}
+	}
+	c.cursors[oldest] = cursor
+}
+
+func (c *CompressedImage) dropCursor(cursor *gzipCursor) {
+	for i, candidate := range c.cursors {
+		if candidate == cursor {
+			c.cursors = append(c.cursors[:i], c.cursors[i+1:]...)
+			return
+		}
+	}
+}
+
+type bzip2Magic struct {
+	pos int64
+	end bool
+}
+
+// scanBzip2Magics finds the bit positions of the block and end of stream
+// magic numbers. Blocks aren't byte aligned, and the magic numbers may
+// also occur by chance inside compressed data.
+func (c *CompressedImage) scanBzip2Magics() ([]bzip2Magic, error) {
+	magics := make([]bzip2Magic, 0)
+	buf := make([]byte, compressedScanChunk)
+	mask := uint64(1)<<bzip2MagicBits - 1
+	var reg uint64
+
+	for off := int64(0); off < c.compressedSize; off += int64(len(buf)) {
+		n, err := c.r.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		for i, b := range buf[:n] {
+			reg = reg<<8 | uint64(b)
+			consumed := (off + int64(i) + 1) * 8
+			for shift := 7; shift >= 0; shift-- {
+				value := reg >> uint(shift) & mask
+				if value != bzip2BlockMagic && value != bzip2EndMagic {
+					continue
+				}
+				start := consumed - int64(shift) - bzip2MagicBits
+				if start >= 0 {
+					magics = append(magics, bzip2Magic{pos: start, end: value == bzip2EndMagic})
+				}
+			}
+		}
+
+		if n < len(buf) {
+			break
+		}
+	}
+
+	return magics, nil
+}
+
+func (c *CompressedImage) indexBzip2() error {
+	magics, err := c.scanBzip2Magics()
+	if err != nil {
+		return err
+	}
+
+	out := int64(0)
+	for i := 0; i < len(magics); i++ {
+		if magics[i].end {
+			continue
+		}
+
+		//A block ends at the next magic number, unless that one was found
+		//by chance inside the block
+		start := magics[i].pos
+		next := -1
+		var data []byte
+		for j := i + 1; j < len(magics) && j <= i+bzip2MaxFalseMagics; j++ {
+			data, err = c.decodeBzip2Block(start, magics[j].pos-start)
+			if err == nil {
+				next = j
+				break
+			}
+		}
+
+		if next < 0 {
+			return errors.New(fmt.Sprintf("Corrupt bzip2 block at byte %d", start/8))
+		}
+
+		c.points = append(c.points, seekPoint{Out: out, BitPos: start, Bits: magics[next].pos - start})
+		out += int64(len(data))
+		i = next - 1
+	}
+
+	if len(c.points) == 0 {
+		return errors.New("No bzip2 blocks found")
+	}
+
+	c.size = out
+	return nil
+}
+
+// msbWriter packs bits most significant first as bzip2 streams do.
+type msbWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *msbWriter) write(value uint64, bits uint) {
+	w.acc = w.acc<<bits | value&(1<<bits-1)
+	w.nbits += bits
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc>>(w.nbits-8)))
+		w.nbits -= 8
+	}
+}
+
+func (w *msbWriter) flush() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc<<(8-w.nbits)))
+		w.nbits = 0
+	}
+	return w.buf
+}
+
+// decodeBzip2Block decompresses a single block by wrapping it into a stream
+// of its own, whose combined checksum is the block checksum.
+func (c *CompressedImage) decodeBzip2Block(bitPos int64, bits int64) ([]byte, error) {
+	if bits < bzip2MagicBits+32 {
+		return nil, errors.New("bzip2 block too short")
+	}
+
+	first := bitPos / 8
+	src := make([]byte, (bitPos+bits+7)/8-first+1)
+	if _, err := c.r.ReadAt(src[:len(src)-1], first); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	shift := uint(bitPos % 8)
+	byteAt := func(k int64) uint64 {
+		return uint64(src[k]<<shift | src[k+1]>>(8-shift))
+	}
+
+	w := &msbWriter{buf: make([]byte, 0, len(src)+16)}
+	w.write(uint64(BZIP2_MAGIC[0]), 8)
+	w.write(uint64(BZIP2_MAGIC[1]), 8)
+	w.write(uint64(BZIP2_MAGIC[2]), 8)
+	w.write('9', 8)
+
+	for k := int64(0); k < bits/8; k++ {
+		w.write(byteAt(k), 8)
+	}
+	if rest := uint(bits % 8); rest > 0 {
+		w.write(byteAt(bits/8)>>(8-rest), rest)
+	}
+
+	crc := byteAt(6)<<24 | byteAt(7)<<16 | byteAt(8)<<8 | byteAt(9)
+	w.write(bzip2EndMagic, bzip2MagicBits)
+	w.write(crc, 32)
+
+	return io.ReadAll(bzip2.NewReader(bytes.NewReader(w.flush())))
+}
+
+func (c *CompressedImage) readBzip2(p []byte, off int64) error {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		i := c.point(pos)
+
+		data, err := c.bzip2Block(i)
+		if err != nil {
+			return err
+		}
+
+		inner := pos - c.points[i].Out
+		if inner >= int64(len(data)) {
+			return errors.New(fmt.Sprintf("bzip2 block at byte %d is shorter than indexed", c.points[i].BitPos/8))
+		}
+		n += copy(p[n:], data[inner:])
+	}
+	return nil
+}
+
+func (c *CompressedImage) bzip2Block(i int) ([]byte, error) {
+	for _, cached := range c.blocks {
+		if cached.point == i {
+			cached.used = c.clock
+			return cached.data, nil
+		}
+	}
+
+	point := c.points[i]
+	data, err := c.decodeBzip2Block(point.BitPos, point.Bits)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := &bzip2Cached{point: i, data: data, used: c.clock}
+	if len(c.blocks) < compressedCursors {
+		c.blocks = append(c.blocks, cached)
+		return data, nil
+	}
+
+	oldest := 0
+	for j, candidate := range c.blocks {
+		if candidate.used < c.blocks[oldest].used {
+			oldest = j
+		}
+	}
+	c.blocks[oldest] = cached
+	return data, nil
+}
@@ -0,0 +1,168 @@
+package ext2fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const compressedTestSpan = 64 * 1024
+
+// gzipTestImage returns generated data and its gzip compression in three
+// members.
+func gzipTestImage(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	//Words from a small vocabulary give the deflater matches to find, the
+	//random bytes keep some blocks stored
+	rng := rand.New(rand.NewSource(1))
+	words := []string{"ext2", "inode", "block", "group", "bitmap", "superblock", "directory", "entry"}
+	var data bytes.Buffer
+	for data.Len() < 3*1024*1024 {
+		if rng.Intn(50) == 0 {
+			noise := make([]byte, rng.Intn(8192))
+			rng.Read(noise)
+			data.Write(noise)
+			continue
+		}
+		data.WriteString(words[rng.Intn(len(words))])
+		data.WriteByte(" \n"[rng.Intn(2)])
+	}
+
+	var compressed bytes.Buffer
+	plain := data.Bytes()
+	for _, part := range [][]byte{plain[:1000000], plain[1000000:1000001], plain[1000001:]} {
+		w := gzip.NewWriter(&compressed)
+		if _, err := w.Write(part); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return plain, compressed.Bytes()
+}
+
+// bzip2TestImage returns the checked-in bzip2 fixture, compressed with
+// bzip2 -1 to hold several blocks, and the data it decompresses to.
+func bzip2TestImage(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	var data strings.Builder
+	for i := 0; i < 30000; i++ {
+		fmt.Fprintf(&data, "line %d\n", i)
+	}
+	return []byte(data.String()), readTestData(t, "lines.bz2")
+}
+
+func TestCompressedGzip(t *testing.T) {
+	data, compressed := gzipTestImage(t)
+
+	c, err := NewCompressedImage(bytes.NewReader(compressed), int64(len(compressed)), compressedTestSpan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Format() != "gzip" {
+		t.Fatalf("format %q", c.Format())
+	}
+	if len(c.points) < 10 {
+		t.Fatalf("%d seek points, want several", len(c.points))
+	}
+
+	checkRandomReads(t, c, data)
+}
+
+func TestCompressedBzip2(t *testing.T) {
+	data, compressed := bzip2TestImage(t)
+
+	c, err := NewCompressedImage(bytes.NewReader(compressed), int64(len(compressed)), compressedTestSpan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Format() != "bzip2" {
+		t.Fatalf("format %q", c.Format())
+	}
+	if len(c.points) < 2 {
+		t.Fatalf("%d blocks, want several", len(c.points))
+	}
+
+	checkRandomReads(t, c, data)
+}
+
+func TestCompressedIndex(t *testing.T) {
+	images := map[string]func(*testing.T) ([]byte, []byte){"gzip": gzipTestImage, "bzip2": bzip2TestImage}
+
+	for name, image := range images {
+		t.Run(name, func(t *testing.T) {
+			data, compressed := image(t)
+			r := bytes.NewReader(compressed)
+
+			c, err := NewCompressedImage(r, int64(len(compressed)), compressedTestSpan)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(t.TempDir(), "image"+COMPRESSED_INDEX_SUFFIX)
+			if err := c.SaveIndex(path); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded, err := OpenCompressedImage(r, int64(len(compressed)), path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !loaded.IndexLoaded() {
+				t.Fatal("the saved index was not used")
+			}
+			if len(loaded.points) != len(c.points) {
+				t.Fatalf("%d seek points loaded, %d saved", len(loaded.points), len(c.points))
+			}
+
+			checkRandomReads(t, loaded, data)
+
+			//The index of an image of another size is refused
+			index, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadCompressedImage(r, int64(len(compressed))+1, bytes.NewReader(index)); err == nil {
+				t.Fatal("index loaded for an image of another size")
+			}
+
+			//So is the index of an image of the same size with other contents,
+			//at either end
+			for _, off := range []int{len(compressed) / 3, len(compressed) - 5} {
+				other := append([]byte(nil), compressed...)
+				other[off] ^= 0x55
+
+				_, err := LoadCompressedImage(bytes.NewReader(other), int64(len(other)), bytes.NewReader(index))
+				if err == nil || !strings.Contains(err.Error(), "doesn't match the image contents") {
+					t.Fatalf("index of the image loaded for another image of the same size: %v", err)
+				}
+
+				loaded, err := OpenCompressedImage(bytes.NewReader(other), int64(len(other)), path)
+				if err == nil && loaded.IndexLoaded() {
+					t.Fatal("the index of another image was used")
+				}
+			}
+		})
+	}
+}
+
+func TestCompressedGzipBadCrc(t *testing.T) {
+	_, compressed := gzipTestImage(t)
+
+	//The trailer of the last member is its CRC and size
+	compressed[len(compressed)-8] ^= 0xFF
+
+	_, err := NewCompressedImage(bytes.NewReader(compressed), int64(len(compressed)), compressedTestSpan)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("corrupt CRC gave %v", err)
+	}
+}
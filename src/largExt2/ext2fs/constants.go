@@ -11,9 +11,14 @@ const (
 	BASE_OFFSET             = 1024
 	S_FREE_BLOCKS_COUNT     = 12
 	S_FREE_INODES_COUNT     = S_FREE_BLOCKS_COUNT + 4
+	S_MAGIC                 = 56
 	BG_FREE_BLOCKS_COUNT    = 12
 	BG_FREE_INODES_COUNT    = BG_FREE_BLOCKS_COUNT + 2
 	BG_USED_DIRS_COUNT      = BG_FREE_INODES_COUNT + 2
+	S_FREE_BLOCKS_COUNT_HI  = 0x158
+	BG_FREE_BLOCKS_COUNT_HI = 0x2C
+	BG_FREE_INODES_COUNT_HI = BG_FREE_BLOCKS_COUNT_HI + 2
+	BG_USED_DIRS_COUNT_HI   = BG_FREE_INODES_COUNT_HI + 2
 	I_SIZE                  = 4
 	I_BLOCKS                = 28
 	I_BLOCK                 = 40
@@ -35,3 +40,22 @@ const (
 	S_IFCHR                 = 0020000
 	S_IFIFO                 = 0010000
 )
+
+// Revision 0 filesystems have neither the first inode nor the inode size in
+// their superblock.
+const (
+	EXT2_GOOD_OLD_FIRST_INO  = 11
+	EXT2_GOOD_OLD_INODE_SIZE = 128
+)
+
+// File types recorded in directory entries with the filetype feature.
+const (
+	EXT2_FT_UNKNOWN  = 0
+	EXT2_FT_REG_FILE = 1
+	EXT2_FT_DIR      = 2
+	EXT2_FT_CHRDEV   = 3
+	EXT2_FT_BLKDEV   = 4
+	EXT2_FT_FIFO     = 5
+	EXT2_FT_SOCK     = 6
+	EXT2_FT_SYMLINK  = 7
+)
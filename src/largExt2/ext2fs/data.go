@@ -50,25 +50,24 @@ func (d *Device) Offsets(blockOffset uint32) (dirIdx int64, indIdx int64, dindId
 	return
 }
 
-func (d *Device) ExtractBlock(block uint32, index int64) (uint32, error) {
-	buffer := make([]byte, 4)
-
+func (d *Device) ExtractBlock(block uint64, index int64) (uint64, error) {
 	if block == EXT2_NULL_BLOCK {
 		return block, errors.New("Inode block offset out of bounds")
 	}
 
-	if _, err := d.file.ReadAt(buffer, d.blockOffset(block)+index*4); err != nil {
+	buffer, err := d.metaBlock(block)
+	if err != nil {
 		return EXT2_NULL_BLOCK, err
 	}
 
-	return binary.LittleEndian.Uint32(buffer), nil
+	return uint64(binary.LittleEndian.Uint32(buffer[index*4:])), nil
 }
 
-func (d *Device) DataBlock(inode *Inode, blockOffset uint32) (uint32, error) {
+func (d *Device) DataBlock(inode *Inode, blockOffset uint32) (uint64, error) {
 	dirIdx, indIdx, dindIdx, tindIdx := d.Offsets(blockOffset)
 
 	if dirIdx != -1 {
-		block := inode.Block[dirIdx]
+		block := uint64(inode.Block[dirIdx])
 
 		if block == EXT2_NULL_BLOCK {
 			return EXT2_NULL_BLOCK, errors.New(fmt.Sprintf("Inode block offset %d out of bounds", blockOffset))
@@ -78,7 +77,7 @@ func (d *Device) DataBlock(inode *Inode, blockOffset uint32) (uint32, error) {
 	}
 
 	if tindIdx != -1 {
-		block, err := d.ExtractBlock(inode.Block[EXT2_TIND_BLOCK], tindIdx)
+		block, err := d.ExtractBlock(uint64(inode.Block[EXT2_TIND_BLOCK]), tindIdx)
 		if err != nil {
 			return block, err
 		}
@@ -92,7 +91,7 @@ func (d *Device) DataBlock(inode *Inode, blockOffset uint32) (uint32, error) {
 	}
 
 	if dindIdx != -1 {
-		block, err := d.ExtractBlock(inode.Block[EXT2_DIND_BLOCK], dindIdx)
+		block, err := d.ExtractBlock(uint64(inode.Block[EXT2_DIND_BLOCK]), dindIdx)
 		if err != nil {
 			return block, err
 		}
@@ -101,13 +100,20 @@ func (d *Device) DataBlock(inode *Inode, blockOffset uint32) (uint32, error) {
 	}
 
 	if indIdx != -1 {
-		return d.ExtractBlock(inode.Block[EXT2_IND_BLOCK], indIdx)
+		return d.ExtractBlock(uint64(inode.Block[EXT2_IND_BLOCK]), indIdx)
 	}
 
 	return EXT2_NULL_BLOCK, errors.New("No block offsets given")
 }
 
-func (d *Device) CreateDataBlock(inodeNo uint32) (uint32, error) {
+func (d *Device) CreateDataBlock(inodeNo uint32) (uint64, error) {
+	if d.readOnly {
+		return EXT2_NULL_BLOCK, ErrReadOnly
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
 	inode, err := d.NewInode(inodeNo)
 	if err != nil {
 		return EXT2_NULL_BLOCK, err
@@ -120,21 +126,17 @@ func (d *Device) CreateDataBlock(inodeNo uint32) (uint32, error) {
 		return EXT2_NULL_BLOCK, err
 	}
 
-	blockOffset := inode.Size / d.BlockSize
+	blockOffset := uint32(inode.Size64() / uint64(d.BlockSize))
 	dirIdx, indIdx, dindIdx, tindIdx := d.Offsets(blockOffset)
 
 	//Direct Blocks
 	if dirIdx != -1 {
-		newBlock, err := d.AllocBlock(groupNo)
+		newBlock, err := d.allocBlockLocked(groupNo)
 		if err != nil {
 			return EXT2_NULL_BLOCK, err
 		}
 
-		if _, err := d.seek(d.inodeOffset(group.InodeTable, inodeIdx) + I_BLOCK + 4*dirIdx); err != nil {
-			return EXT2_NULL_BLOCK, err
-		}
-
-		if err := binary.Write(d.file, binary.LittleEndian, newBlock); err != nil {
+		if err := d.encodeAt(uint32(newBlock), d.inodeOffset(group.InodeTable64(), inodeIdx)+I_BLOCK+4*dirIdx); err != nil {
 			return EXT2_NULL_BLOCK, err
 		}
 
@@ -143,20 +145,16 @@ func (d *Device) CreateDataBlock(inodeNo uint32) (uint32, error) {
 
 	//Triple Indirect Blocks
 	if tindIdx != -1 {
-		tindBlock := inode.Block[EXT2_TIND_BLOCK]
+		tindBlock := uint64(inode.Block[EXT2_TIND_BLOCK])
 
 		if tindBlock == EXT2_NULL_BLOCK {
 			//New Triple Indirect Block
-			tindBlock, err = d.AllocBlock(groupNo)
+			tindBlock, err = d.allocBlockLocked(groupNo)
 			if err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 
-			if _, err := d.seek(d.inodeOffset(group.InodeTable, inodeIdx) + I_BLOCK + 4*EXT2_TIND_BLOCK); err != nil {
-				return EXT2_NULL_BLOCK, err
-			}
-
-			if err := binary.Write(d.file, binary.LittleEndian, tindBlock); err != nil {
+			if err := d.encodeAt(uint32(tindBlock), d.inodeOffset(group.InodeTable64(), inodeIdx)+I_BLOCK+4*EXT2_TIND_BLOCK); err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 		}
@@ -168,16 +166,12 @@ func (d *Device) CreateDataBlock(inodeNo uint32) (uint32, error) {
 
 		if dindBlock == EXT2_NULL_BLOCK {
 			//New Double Indirect Block
-			dindBlock, err = d.AllocBlock(groupNo)
+			dindBlock, err = d.allocBlockLocked(groupNo)
 			if err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 
-			if _, err := d.seek(d.blockOffset(inode.Block[EXT2_TIND_BLOCK]) + 4*tindIdx); err != nil {
-				return EXT2_NULL_BLOCK, err
-			}
-
-			if err := binary.Write(d.file, binary.LittleEndian, dindBlock); err != nil {
+			if err := d.encodeAt(uint32(dindBlock), d.blockOffset(tindBlock)+4*tindIdx); err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 		}
@@ -189,31 +183,23 @@ func (d *Device) CreateDataBlock(inodeNo uint32) (uint32, error) {
 
 		if indBlock == EXT2_NULL_BLOCK {
 			//New Indirect Block
-			indBlock, err := d.AllocBlock(groupNo)
+			indBlock, err := d.allocBlockLocked(groupNo)
 			if err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 
-			if _, err := d.seek(d.blockOffset(dindBlock) + 4*dindIdx); err != nil {
-				return EXT2_NULL_BLOCK, err
-			}
-
-			if err := binary.Write(d.file, binary.LittleEndian, indBlock); err != nil {
+			if err := d.encodeAt(uint32(indBlock), d.blockOffset(dindBlock)+4*dindIdx); err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 		}
 
 		//New Direct Block
-		newBlock, err := d.AllocBlock(groupNo)
+		newBlock, err := d.allocBlockLocked(groupNo)
 		if err != nil {
 			return EXT2_NULL_BLOCK, err
 		}
 
-		if _, err := d.seek(d.blockOffset(indBlock) + 4*indIdx); err != nil {
-			return EXT2_NULL_BLOCK, err
-		}
-
-		if err := binary.Write(d.file, binary.LittleEndian, newBlock); err != nil {
+		if err := d.encodeAt(uint32(newBlock), d.blockOffset(indBlock)+4*indIdx); err != nil {
 			return EXT2_NULL_BLOCK, err
 		}
 
@@ -222,20 +208,16 @@ func (d *Device) CreateDataBlock(inodeNo uint32) (uint32, error) {
 
 	//Double Indirect Blocks
 	if dindIdx != -1 {
-		dindBlock := inode.Block[EXT2_DIND_BLOCK]
+		dindBlock := uint64(inode.Block[EXT2_DIND_BLOCK])
 
 		if dindBlock == EXT2_NULL_BLOCK {
 			//New Double Indirect Block
-			dindBlock, err = d.AllocBlock(groupNo)
+			dindBlock, err = d.allocBlockLocked(groupNo)
 			if err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 
-			if _, err := d.seek(d.inodeOffset(group.InodeTable, inodeIdx) + I_BLOCK + 4*EXT2_DIND_BLOCK); err != nil {
-				return EXT2_NULL_BLOCK, err
-			}
-
-			if err := binary.Write(d.file, binary.LittleEndian, dindBlock); err != nil {
+			if err := d.encodeAt(uint32(dindBlock), d.inodeOffset(group.InodeTable64(), inodeIdx)+I_BLOCK+4*EXT2_DIND_BLOCK); err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 		}
@@ -247,31 +229,23 @@ func (d *Device) CreateDataBlock(inodeNo uint32) (uint32, error) {
 
 		if indBlock == EXT2_NULL_BLOCK {
 			//New Indirect Block
-			indBlock, err := d.AllocBlock(groupNo)
+			indBlock, err := d.allocBlockLocked(groupNo)
 			if err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 
-			if _, err := d.seek(d.blockOffset(dindBlock) + 4*dindIdx); err != nil {
-				return EXT2_NULL_BLOCK, err
-			}
-
-			if err := binary.Write(d.file, binary.LittleEndian, indBlock); err != nil {
+			if err := d.encodeAt(uint32(indBlock), d.blockOffset(dindBlock)+4*dindIdx); err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 		}
 
 		//New Direct Block
-		newBlock, err := d.AllocBlock(groupNo)
+		newBlock, err := d.allocBlockLocked(groupNo)
 		if err != nil {
 			return EXT2_NULL_BLOCK, err
 		}
 
-		if _, err := d.seek(d.blockOffset(indBlock) + 4*indIdx); err != nil {
-			return EXT2_NULL_BLOCK, err
-		}
-
-		if err := binary.Write(d.file, binary.LittleEndian, newBlock); err != nil {
+		if err := d.encodeAt(uint32(newBlock), d.blockOffset(indBlock)+4*indIdx); err != nil {
 			return EXT2_NULL_BLOCK, err
 		}
 
@@ -279,35 +253,27 @@ func (d *Device) CreateDataBlock(inodeNo uint32) (uint32, error) {
 	}
 
 	if indIdx != -1 {
-		indBlock := inode.Block[EXT2_IND_BLOCK]
+		indBlock := uint64(inode.Block[EXT2_IND_BLOCK])
 
 		if indBlock == EXT2_NULL_BLOCK {
 			//New Indirect Block
-			indBlock, err = d.AllocBlock(groupNo)
+			indBlock, err = d.allocBlockLocked(groupNo)
 			if err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 
-			if _, err := d.seek(d.inodeOffset(group.InodeTable, inodeIdx) + I_BLOCK + 4*EXT2_IND_BLOCK); err != nil {
-				return EXT2_NULL_BLOCK, err
-			}
-
-			if err := binary.Write(d.file, binary.LittleEndian, indBlock); err != nil {
+			if err := d.encodeAt(uint32(indBlock), d.inodeOffset(group.InodeTable64(), inodeIdx)+I_BLOCK+4*EXT2_IND_BLOCK); err != nil {
 				return EXT2_NULL_BLOCK, err
 			}
 		}
 
 		//New Direct Block
-		newBlock, err := d.AllocBlock(groupNo)
+		newBlock, err := d.allocBlockLocked(groupNo)
 		if err != nil {
 			return EXT2_NULL_BLOCK, err
 		}
 
-		if _, err := d.seek(d.blockOffset(indBlock) + 4*indIdx); err != nil {
-			return EXT2_NULL_BLOCK, err
-		}
-
-		if err := binary.Write(d.file, binary.LittleEndian, newBlock); err != nil {
+		if err := d.encodeAt(uint32(newBlock), d.blockOffset(indBlock)+4*indIdx); err != nil {
 			return EXT2_NULL_BLOCK, err
 		}
 
@@ -328,7 +294,7 @@ func (d *Device) ReadData(inode *Inode, b []byte, off int64) (n int, err error)
 		return 0, nil
 	}
 
-	if off >= int64(inode.Size) {
+	if off >= int64(inode.Size64()) {
 		return 0, io.EOF
 	}
 
@@ -342,13 +308,13 @@ func (d *Device) ReadData(inode *Inode, b []byte, off int64) (n int, err error)
 		read = size
 	}
 
-	if _, err := d.file.ReadAt(b[n:n+read], d.blockOffset(blockNo)+innerOffset); err != nil {
+	if _, err := d.readAt(b[n:n+read], d.blockOffset(blockNo)+innerOffset); err != nil {
 		return n, err
 	}
 
 	n += read
 
-	if int64(n)+off >= int64(inode.Size) {
+	if int64(n)+off >= int64(inode.Size64()) {
 		return n, io.EOF
 	}
 
@@ -367,13 +333,13 @@ func (d *Device) ReadData(inode *Inode, b []byte, off int64) (n int, err error)
 			read = int(d.BlockSize)
 		}
 
-		if _, err := d.file.ReadAt(b[n:n+read], d.blockOffset(blockNo)); err != nil {
+		if _, err := d.readAt(b[n:n+read], d.blockOffset(blockNo)); err != nil {
 			return n, err
 		}
 
 		n += read
 
-		if int64(n)+off >= int64(inode.Size) {
+		if int64(n)+off >= int64(inode.Size64()) {
 			return n, io.EOF
 		}
 	}
@@ -382,6 +348,17 @@ func (d *Device) ReadData(inode *Inode, b []byte, off int64) (n int, err error)
 }
 
 func (d *Device) WriteData(inode *Inode, b []byte, off int64) (n int, err error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	return d.writeDataLocked(inode, b, off)
+}
+
+func (d *Device) writeDataLocked(inode *Inode, b []byte, off int64) (n int, err error) {
 	size := len(b)
 	blockOffset := uint32(off / int64(d.BlockSize))
 	innerOffset := off % int64(d.BlockSize)
@@ -401,7 +378,7 @@ func (d *Device) WriteData(inode *Inode, b []byte, off int64) (n int, err error)
 		write = size
 	}
 
-	if _, err := d.file.WriteAt(b[:write], d.blockOffset(blockNo)+innerOffset); err != nil {
+	if _, err := d.writeAt(b[:write], d.blockOffset(blockNo)+innerOffset); err != nil {
 		return n, err
 	}
 
@@ -423,7 +400,7 @@ func (d *Device) WriteData(inode *Inode, b []byte, off int64) (n int, err error)
 			write = int(d.BlockSize)
 		}
 
-		if _, err := d.file.WriteAt(b[:write], d.blockOffset(blockNo)); err != nil {
+		if _, err := d.writeAt(b[:write], d.blockOffset(blockNo)); err != nil {
 			return n, err
 		}
 
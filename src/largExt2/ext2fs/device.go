@@ -1,76 +1,381 @@
 package ext2fs
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"sync"
 )
 
+var ErrReadOnly = errors.New("Device is opened read-only")
+
+type DeviceOptions struct {
+	// ReadOnly opens the image with O_RDONLY. Every mutating method of a
+	// read-only Device returns ErrReadOnly.
+	ReadOnly bool
+
+	// CacheSize bounds the memory in bytes used to cache group descriptor,
+	// bitmap, inode table and indirect blocks. Zero selects a default of
+	// 16MiB, a negative size disables the cache.
+	CacheSize int64
+
+	// Offset is the byte offset of the filesystem inside the storage, for
+	// images with headers in front of the filesystem.
+	Offset int64
+
+	// Mmap maps a local image file into memory and reads metadata blocks
+	// straight from the mapping. Block devices, images larger than the
+	// address space and writable Devices are read with pread instead.
+	Mmap bool
+
+	// Degraded opens storage shorter than the filesystem instead of failing
+	// with a *TruncatedError. Reads past the end of the storage return zeros
+	// and the Device is read-only.
+	Degraded bool
+
+	// BackupSuperBlock opens the filesystem from the backup superblock at
+	// this block, and the backup group descriptor table after it, when the
+	// primary ones are damaged. The block size is found by trying each one.
+	// The Device is read-only.
+	BackupSuperBlock uint64
+}
+
+// A Device is safe for concurrent use by multiple goroutines. Reads run in
+// parallel while mutating methods are serialized, and every single read or
+// write of the storage is atomic with respect to the others.
 type Device struct {
+	mu                  sync.RWMutex
+	writeMu             sync.Mutex
 	file                *os.File
+	reader              io.ReaderAt
+	writer              io.WriterAt
+	mapping             slicer
+	size                int64
+	offset              int64
+	superOffset         int64
+	readOnly            bool
+	degraded            bool
+	fileType            bool
+	groupDescSize       uint32
+	metaBg              bool
+	firstMetaBg         uint32
+	sparseSuper         bool
+	cache               *blockCache
 	BlockSize           uint32
 	InodeSize           uint16
 	BlockGroupsCount    uint32
-	BlocksCount         uint32
+	BlocksCount         uint64
 	InodesCount         uint32
 	BlocksPerGroup      uint32
+	FirstDataBlock      uint32
 	InodesPerGroup      uint32
-	GroupDescTableBlock uint32
+	GroupDescTableBlock uint64
 	FirstIno            uint32
 }
 
 func NewDevice(path string) (*Device, error) {
-	file, err := os.OpenFile(path, os.O_RDWR, os.ModePerm)
+	return NewDeviceWithOptions(path, DeviceOptions{})
+}
+
+func NewReadOnlyDevice(path string) (*Device, error) {
+	return NewDeviceWithOptions(path, DeviceOptions{ReadOnly: true})
+}
+
+// NewDeviceWithOptions opens the image file or block device at path. An
+// http(s) URL is read through HTTP Range requests, and an nbd:// URL names
+// a device exported by an NBD server, opened read-only when the export is.
+// qcow2 images are read through their backing file chain, read-only.
+func NewDeviceWithOptions(path string, options DeviceOptions) (*Device, error) {
+	if IsHttpUrl(path) {
+		image, err := OpenHttpImage(path)
+		if err != nil {
+			return nil, err
+		}
+
+		device, err := NewDeviceFromReaderAt(image, image.Size(), options)
+		if err != nil {
+			image.Close()
+			return nil, err
+		}
+		return device, nil
+	}
+
+	if IsNbdUrl(path) {
+		client, err := OpenNbdUrl(path)
+		if err != nil {
+			return nil, err
+		}
+
+		options.ReadOnly = options.ReadOnly || client.ReadOnly()
+		device, err := NewDeviceFromReaderAt(client, client.Size(), options)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		return device, nil
+	}
+
+	flag := os.O_RDWR
+	if options.ReadOnly {
+		flag = os.O_RDONLY
+	}
+
+	file, err := os.OpenFile(path, flag, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := FileSize(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	//Android sparse and qcow2 images are expanded on the fly, read-only
+	var r io.ReaderAt = file
+	if IsQcow2(file) {
+		//The backing files are found relative to the path of the image
+		file.Close()
+		file = nil
+
+		image, err := OpenQcow2Image(path)
+		if err != nil {
+			return nil, err
+		}
+		r, size = image, image.Size()
+	} else if IsAndroidSparse(file) {
+		image, err := NewAndroidSparseImage(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		r, size = image, image.Size()
+	} else if options.Mmap && options.ReadOnly {
+		if image, err := MapFile(file); err == nil {
+			r = image
+		}
+	}
+
+	device, err := NewDeviceFromReaderAt(r, size, options)
 	if err != nil {
+		r.(io.Closer).Close()
 		return nil, err
 	}
 
-	device := &Device{file: file}
+	device.file = file
+	return device, nil
+}
+
+// NewDeviceFromReaderAt builds a Device on top of any positional reader of
+// the given size. The Device is writable only when r also implements
+// io.WriterAt and options.ReadOnly is not set. Filesystems with unknown
+// incompat features are refused, unknown ro_compat features make the Device
+// read-only. Close closes r when it implements io.Closer.
+func NewDeviceFromReaderAt(r io.ReaderAt, size int64, options DeviceOptions) (*Device, error) {
+	device := &Device{reader: r, size: size, offset: options.Offset, superOffset: BASE_OFFSET, readOnly: true}
+	if w, ok := r.(io.WriterAt); ok && !options.ReadOnly && options.BackupSuperBlock == 0 {
+		device.writer = w
+		device.readOnly = false
+	}
+
+	//Mapped storage is only read, the mapping would go stale on writes
+	if m, ok := r.(slicer); ok && device.readOnly {
+		device.mapping = m
+	}
+
+	if options.BackupSuperBlock != 0 {
+		if err := device.findBackup(options.BackupSuperBlock); err != nil {
+			return nil, err
+		}
+	}
+
 	super, err := device.NewSuperBlock()
 	if err != nil {
 		return nil, err
 	}
 
-	if super.RevLevel < EXT2_DYNAMIC_REV {
-		return nil, errors.New("ext2 filesystem must be revision 1 or higher")
+	if super.RevLevel > EXT2_DYNAMIC_REV {
+		return nil, errors.New(fmt.Sprintf("ext2 filesystem revision %d is not supported", super.RevLevel))
+	}
+
+	if err := super.check(); err != nil {
+		return nil, err
+	}
+
+	if err := super.checkFeatures(); err != nil {
+		return nil, err
+	}
+
+	//Unknown ro_compat features may be read but not written
+	if len(super.UnsupportedRoCompat()) > 0 {
+		device.writer = nil
+		device.readOnly = true
 	}
 
 	device.BlockSize = EXT2_DEFAULT_BLOCK_SIZE << super.LogBlockSize
-	device.BlockGroupsCount = 1 + ((super.BlocksCount - 1) / super.BlocksPerGroup)
-	device.BlocksCount = super.BlocksCount
+	device.BlocksCount = super.BlocksCount64()
+	device.BlockGroupsCount = uint32((device.BlocksCount - uint64(super.FirstDataBlock) + uint64(super.BlocksPerGroup) - 1) / uint64(super.BlocksPerGroup))
 	device.InodesCount = super.InodesCount
 	device.BlocksPerGroup = super.BlocksPerGroup
 	device.InodesPerGroup = super.InodesPerGroup
 	device.InodeSize = super.InodeSize
-	device.GroupDescTableBlock = super.FirstDataBlock + 1
+	device.FirstDataBlock = super.FirstDataBlock
+	device.GroupDescTableBlock = uint64(super.FirstDataBlock) + 1
+	if options.BackupSuperBlock != 0 {
+		device.GroupDescTableBlock = options.BackupSuperBlock + 1
+	}
 	device.FirstIno = super.FirstIno
+	device.fileType = super.HasIncompat(EXT2_FEATURE_INCOMPAT_FILETYPE)
+	device.groupDescSize = super.GroupDescSize()
+	device.metaBg = super.HasIncompat(EXT2_FEATURE_INCOMPAT_META_BG)
+	device.firstMetaBg = super.FirstMetaBg
+	device.sparseSuper = super.HasRoCompat(EXT2_FEATURE_RO_COMPAT_SPARSE_SUPER)
+
+	if device.Truncated() {
+		if !options.Degraded {
+			return nil, &TruncatedError{Expected: device.ExpectedSize(), Actual: size}
+		}
+		device.degraded = true
+		device.writer = nil
+		device.readOnly = true
+	}
+
+	cacheSize := options.CacheSize
+	if cacheSize == 0 {
+		cacheSize = defaultCacheSize
+	}
+
+	if cacheSize > 0 {
+		blocks := cacheSize / int64(device.BlockSize)
+		if blocks < 1 {
+			blocks = 1
+		}
+		device.cache = newBlockCache(int(blocks))
+	}
+
+	if err := device.checkGroupDescriptors(super); err != nil {
+		return nil, err
+	}
 
 	return device, nil
 }
 
+func (d *Device) ReadOnly() bool {
+	return d.readOnly
+}
+
+// Size returns the size in bytes of the storage behind the Device.
+func (d *Device) Size() int64 {
+	return d.size
+}
+
+// Offset returns the byte offset of the filesystem inside the storage.
+func (d *Device) Offset() int64 {
+	return d.offset
+}
+
 func (d *Device) Close() error {
-	return d.file.Close()
+	if closer, ok := d.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (d *Device) blockOffset(blockNo uint64) int64 {
+	return d.offset + int64(blockNo)*int64(d.BlockSize)
 }
 
-func (d *Device) blockOffset(blockNo uint32) int64 {
-	return int64(blockNo) * int64(d.BlockSize)
+func (d *Device) superBlockOffset() int64 {
+	return d.offset + d.superOffset
 }
 
-func (d *Device) inodeOffset(inodeTable uint32, index uint32) int64 {
+func (d *Device) inodeOffset(inodeTable uint64, index uint32) int64 {
 	return d.blockOffset(inodeTable) + int64(index)*int64(d.InodeSize)
 }
 
 func (d *Device) groupDescriptorOffset(index uint32) int64 {
-	return d.blockOffset(d.GroupDescTableBlock) + int64(index)*EXT2_GROUP_DESC_SIZE
+	perBlock := d.BlockSize / d.groupDescSize
+	if !d.metaBg || index/perBlock < d.firstMetaBg {
+		return d.blockOffset(d.GroupDescTableBlock) + int64(index)*int64(d.groupDescSize)
+	}
+	return d.blockOffset(d.metaGroupDescBlock(index/perBlock)) + int64(index%perBlock)*int64(d.groupDescSize)
+}
+
+func (d *Device) readAt(b []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.readAtLocked(b, off)
+}
+
+func (d *Device) readAtLocked(b []byte, off int64) (int, error) {
+	n, err := d.reader.ReadAt(b, off)
+	if err == io.EOF && n == len(b) {
+		//io.ReaderAt may report EOF along with a full read at the end of the storage
+		err = nil
+	}
+
+	if (err == io.EOF || err == io.ErrUnexpectedEOF) && d.degraded && off+int64(len(b)) > d.size {
+		zero(b[n:])
+		return len(b), nil
+	}
+	return n, err
 }
 
-func (d *Device) seek(offset int64) (int64, error) {
-	return d.file.Seek(offset, os.SEEK_SET)
+func (d *Device) writeAt(b []byte, off int64) (int, error) {
+	if d.writer == nil {
+		return 0, ErrReadOnly
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(b) > 0 && d.BlockSize != 0 && off >= d.offset {
+		first := uint64((off - d.offset) / int64(d.BlockSize))
+		last := uint64((off - d.offset + int64(len(b)) - 1) / int64(d.BlockSize))
+		d.cache.invalidate(first, last)
+	}
+
+	return d.writer.WriteAt(b, off)
+}
+
+func (d *Device) decodeAt(data interface{}, off int64) error {
+	buf := make([]byte, binary.Size(data))
+	if _, err := d.readAt(buf, off); err != nil {
+		return err
+	}
+	return binary.Read(bytes.NewReader(buf), binary.LittleEndian, data)
+}
+
+func (d *Device) decodeMeta(data interface{}, off int64) error {
+	buf, err := d.metaBytes(binary.Size(data), off)
+	if err != nil {
+		return err
+	}
+	return binary.Read(bytes.NewReader(buf), binary.LittleEndian, data)
+}
+
+func (d *Device) encodeAt(data interface{}, off int64) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, data); err != nil {
+		return err
+	}
+	_, err := d.writeAt(buf.Bytes(), off)
+	return err
 }
 
 func (d *Device) Sync() error {
-	return d.file.Sync()
+	if syncer, ok := d.writer.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
 }
 
+// File returns the image file, or nil when the Device was built from an
+// io.ReaderAt that is not a file.
 func (d *Device) File() *os.File {
 	return d.file
 }
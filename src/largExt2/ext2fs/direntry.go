@@ -80,7 +80,10 @@ func (d *Device) NewDirEntries(inodeNo uint32) (dir DirEntries, err error) {
 
 			if entry.Inode != EXT2_NULL_INO {
 				entry.NameLen = uint8(block[6])
-				entry.FileType = uint8(block[7])
+				entry.FileType, err = d.entryFileType(entry.Inode, block[7])
+				if err != nil {
+					return nil, err
+				}
 				copy(entry.Name[:entry.NameLen], block[8:8+int16(entry.NameLen)])
 				dir = append(dir, entry)
 			}
@@ -91,6 +94,38 @@ func (d *Device) NewDirEntries(inodeNo uint32) (dir DirEntries, err error) {
 	return dir, nil
 }
 
+// entryFileType returns the file type recorded in a directory entry, or the
+// one of its inode when the filesystem doesn't record them. The byte holds
+// the high bits of the name length then, always zero.
+func (d *Device) entryFileType(inodeNo uint32, recorded byte) (uint8, error) {
+	if d.fileType {
+		return recorded, nil
+	}
+
+	inode, err := d.NewInode(inodeNo)
+	if err != nil {
+		return EXT2_FT_UNKNOWN, err
+	}
+
+	switch inode.Mode & S_IFMT {
+	case S_IFREG:
+		return EXT2_FT_REG_FILE, nil
+	case S_IFDIR:
+		return EXT2_FT_DIR, nil
+	case S_IFCHR:
+		return EXT2_FT_CHRDEV, nil
+	case S_IFBLK:
+		return EXT2_FT_BLKDEV, nil
+	case S_IFIFO:
+		return EXT2_FT_FIFO, nil
+	case S_IFSOCK:
+		return EXT2_FT_SOCK, nil
+	case S_IFLNK:
+		return EXT2_FT_SYMLINK, nil
+	}
+	return EXT2_FT_UNKNOWN, nil
+}
+
 //Finds an offset for a new entry
 //Returns -1 if entry doesn't fit in existing blocks
 func (d *Device) DirEntryOffset(inode *Inode) (off int64, lastLen uint32, err error) {
@@ -126,6 +161,13 @@ func (d *Device) DirEntryOffset(inode *Inode) (off int64, lastLen uint32, err er
 }
 
 func (d *Device) AppendDirEntry(inodeNo uint32, dirEntry *DirEntry) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
 	inode, err := d.NewInode(inodeNo)
 	if err != nil {
 		return err
@@ -144,10 +186,12 @@ func (d *Device) AppendDirEntry(inodeNo uint32, dirEntry *DirEntry) error {
 	binary.LittleEndian.PutUint32(data[:4], dirEntry.Inode)
 	binary.LittleEndian.PutUint16(data[4:6], uint16(int64(d.BlockSize)-(off%int64(d.BlockSize))))
 	data[6] = byte(dirEntry.NameLen)
-	data[7] = byte(dirEntry.FileType)
+	if d.fileType {
+		data[7] = byte(dirEntry.FileType)
+	}
 	copy(data[8:8+dirEntry.NameLen], dirEntry.Name[:dirEntry.NameLen])
 
-	if _, err := d.WriteData(inode, data, off); err != nil {
+	if _, err := d.writeDataLocked(inode, data, off); err != nil {
 		return err
 	}
 
@@ -155,7 +199,7 @@ func (d *Device) AppendDirEntry(inodeNo uint32, dirEntry *DirEntry) error {
 	data = make([]byte, 2)
 	binary.LittleEndian.PutUint16(data, uint16(lastLen))
 
-	if _, err := d.WriteData(inode, data, lastOff+4); err != nil {
+	if _, err := d.writeDataLocked(inode, data, lastOff+4); err != nil {
 		return err
 	}
 
@@ -166,13 +210,9 @@ func (d *Device) AppendDirEntry(inodeNo uint32, dirEntry *DirEntry) error {
 		return err
 	}
 
-	if _, err := d.seek(d.groupDescriptorOffset(groupNo) + BG_USED_DIRS_COUNT); err != nil {
-		return err
-	}
-
-	if err := binary.Write(d.file, binary.LittleEndian, group.UsedDirsCount+1); err != nil {
+	if err := d.updateGroupCount(groupNo, group.UsedDirs()+1, BG_USED_DIRS_COUNT, BG_USED_DIRS_COUNT_HI); err != nil {
 		return err
 	}
 
-	return d.file.Sync()
+	return d.Sync()
 }
@@ -0,0 +1,577 @@
+package ext2fs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	EWF_SIGNATURE          = "EVF\x09\x0d\x0a\xff\x00"
+	EWF_CHUNK_COMPRESSED   = 0x80000000
+	ewfFileHeaderSize      = 13
+	ewfSectionHeaderSize   = 76
+	ewfTableHeaderSize     = 24
+	ewfVolumeSize          = 24
+	ewfMaxSegments         = 14971
+	ewfMaxTableEntries     = 65534
+	ewfMaxHeaderSize       = 1024 * 1024
+	ewfMaxSectorsPerChunk  = 32768
+	ewfChunkChecksumLength = 4
+)
+
+type ewfSectionHeader struct {
+	Type     [16]byte
+	Next     uint64
+	Size     uint64
+	Padding  [40]byte
+	Checksum uint32
+}
+
+type ewfVolume struct {
+	MediaType       uint8
+	Unknown         [3]uint8
+	ChunkCount      uint32
+	SectorsPerChunk uint32
+	BytesPerSector  uint32
+	SectorCount     uint64
+}
+
+// ewfChunk is where a chunk of the media is stored in the segment files.
+type ewfChunk struct {
+	segment    int
+	offset     int64
+	size       int64
+	compressed bool
+}
+
+// EwfImage reads the media stored in an Expert Witness (EnCase E01) segment
+// set. Chunks are inflated on demand, the image is read-only.
+type EwfImage struct {
+	// Header holds the case information of the header sections, keyed by
+	// the field names of libewf (case_number, examiner_name, ...).
+	Header         map[string]string
+	BytesPerSector int64
+	MD5            []byte
+	segments       []io.ReaderAt
+	chunks         []ewfChunk
+	chunkSize      int64
+	size           int64
+	mu             sync.Mutex
+	chunkNo        int64
+	chunk          []byte
+}
+
+// ewfHeaderFields names the fields of the header sections.
+var ewfHeaderFields = map[string]string{
+	"a":   "description",
+	"c":   "case_number",
+	"n":   "evidence_number",
+	"e":   "examiner_name",
+	"t":   "notes",
+	"av":  "acquiry_software_version",
+	"ov":  "acquiry_operating_system",
+	"m":   "acquiry_date",
+	"u":   "system_date",
+	"p":   "password",
+	"md":  "model",
+	"sn":  "serial_number",
+	"l":   "device_label",
+	"pid": "process_identifier",
+}
+
+// ewfSegmentParser carries the state of the sections read so far.
+type ewfSegmentParser struct {
+	image      *EwfImage
+	volume     *ewfVolume
+	sectorsEnd int64
+	tableErr   error
+	header2    bool
+}
+
+// IsEwf reports whether r starts with the signature of an EWF segment file.
+func IsEwf(r io.ReaderAt) bool {
+	signature := make([]byte, len(EWF_SIGNATURE))
+	if _, err := r.ReadAt(signature, 0); err != nil {
+		return false
+	}
+	return string(signature) == EWF_SIGNATURE
+}
+
+// EwfSegmentPath returns the path of segment number of the set whose first
+// segment is first: .E01 to .E99, then .EAA to .EZZ, .FAA and so on. The
+// case of the first extension is kept.
+func EwfSegmentPath(first string, number int) string {
+	ext := filepath.Ext(first)
+	base := first[:len(first)-len(ext)]
+
+	letter := byte('E')
+	if len(ext) > 1 {
+		letter = ext[1]
+	}
+
+	var name string
+	if number < 100 {
+		name = fmt.Sprintf("%c%02d", letter, number)
+	} else {
+		n := number - 100
+		name = string([]byte{letter + byte(n/676), byte('A' + n/26%26), byte('A' + n%26)})
+	}
+
+	if len(ext) > 1 && ext[1] >= 'a' && ext[1] <= 'z' {
+		name = strings.ToLower(name)
+	}
+	return base + "." + name
+}
+
+// NewEwfImage reads the sections of the segment files of an EWF image, given
+// in order starting with the first one.
+func NewEwfImage(segments []io.ReaderAt) (*EwfImage, error) {
+	if len(segments) == 0 {
+		return nil, errors.New("No EWF segments")
+	}
+
+	image := &EwfImage{Header: make(map[string]string), segments: segments, chunkNo: -1}
+	parser := &ewfSegmentParser{image: image}
+
+	for i, segment := range segments {
+		done, err := parser.readSegment(segment, i)
+		if err != nil {
+			return nil, err
+		}
+
+		if done != (i == len(segments)-1) {
+			if done {
+				return nil, errors.New(fmt.Sprintf("EWF segment %d is the last one, %d segments given", i+1, len(segments)))
+			}
+			return nil, errors.New(fmt.Sprintf("EWF segment %d is missing", i+2))
+		}
+	}
+
+	volume := parser.volume
+	if volume == nil {
+		return nil, errors.New("EWF image has no volume section")
+	}
+
+	if int64(len(image.chunks)) != int64(volume.ChunkCount) {
+		return nil, errors.New(fmt.Sprintf("EWF tables list %d chunks instead of %d", len(image.chunks), volume.ChunkCount))
+	}
+
+	if image.size > int64(volume.ChunkCount)*image.chunkSize {
+		return nil, errors.New(fmt.Sprintf("EWF image of %d sectors doesn't fit in %d chunks", volume.SectorCount, volume.ChunkCount))
+	}
+
+	return image, nil
+}
+
+// readSegment reads the sections of one segment file, and reports whether it
+// ends the set.
+func (p *ewfSegmentParser) readSegment(r io.ReaderAt, index int) (bool, error) {
+	fileHeader := make([]byte, ewfFileHeaderSize)
+	if _, err := r.ReadAt(fileHeader, 0); err != nil {
+		return false, err
+	}
+
+	if string(fileHeader[:len(EWF_SIGNATURE)]) != EWF_SIGNATURE {
+		return false, errors.New(fmt.Sprintf("EWF segment %d has no EWF signature", index+1))
+	}
+
+	if number := binary.LittleEndian.Uint16(fileHeader[9:]); int(number) != index+1 {
+		return false, errors.New(fmt.Sprintf("EWF segment %d is numbered %d", index+1, number))
+	}
+
+	buf := make([]byte, ewfSectionHeaderSize)
+	off := int64(ewfFileHeaderSize)
+	for {
+		if _, err := r.ReadAt(buf, off); err != nil {
+			return false, errors.New(fmt.Sprintf("Can't read EWF section at %d of segment %d: %s", off, index+1, err.Error()))
+		}
+
+		header := ewfSectionHeader{}
+		binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header)
+
+		if adler32.Checksum(buf[:ewfSectionHeaderSize-4]) != header.Checksum {
+			return false, errors.New(fmt.Sprintf("Bad EWF section checksum at %d of segment %d", off, index+1))
+		}
+
+		kind := strings.TrimRight(string(header.Type[:]), "\x00")
+		if kind != "table2" && p.tableErr != nil {
+			return false, p.tableErr
+		}
+
+		switch kind {
+		case "next":
+			return false, nil
+		case "done":
+			return true, nil
+		}
+
+		next := int64(header.Next)
+		if next <= off || header.Size < ewfSectionHeaderSize {
+			return false, errors.New(fmt.Sprintf("Bad EWF %s section at %d of segment %d", kind, off, index+1))
+		}
+
+		data := newSection(r, off+ewfSectionHeaderSize, int64(header.Size)-ewfSectionHeaderSize)
+		if err := p.readSection(kind, data, int64(header.Size)-ewfSectionHeaderSize, off, next, index); err != nil {
+			return false, err
+		}
+		off = next
+	}
+}
+
+func (p *ewfSegmentParser) readSection(kind string, data io.ReaderAt, size, off, next int64, index int) error {
+	switch kind {
+	case "header", "header2":
+		if size > ewfMaxHeaderSize {
+			return errors.New(fmt.Sprintf("EWF %s section of %d bytes is too large", kind, size))
+		}
+		return p.readHeader(kind, data, size)
+	case "volume", "disk":
+		if p.volume == nil {
+			return p.readVolume(data)
+		}
+	case "sectors":
+		p.sectorsEnd = off + ewfSectionHeaderSize + size
+	case "table":
+		p.tableErr = p.readTable(data, size, off, next, index)
+	case "table2":
+		//The mirror of the table is only read when the table is damaged
+		if p.tableErr != nil {
+			if err := p.readTable(data, size, off, next, index); err != nil {
+				return p.tableErr
+			}
+			p.tableErr = nil
+		}
+	case "hash", "digest":
+		hash := make([]byte, md5.Size)
+		if _, err := data.ReadAt(hash, 0); err != nil {
+			return err
+		}
+
+		//An unset digest is all zeros
+		if !bytes.Equal(hash, make([]byte, md5.Size)) {
+			p.image.MD5 = hash
+		}
+	}
+	return nil
+}
+
+// readHeader decodes the main category of a header section. header2 is
+// UTF-16 and takes precedence over the ASCII header.
+func (p *ewfSegmentParser) readHeader(kind string, data io.ReaderAt, size int64) error {
+	compressed := make([]byte, size)
+	if _, err := data.ReadAt(compressed, 0); err != nil {
+		return err
+	}
+
+	z, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Corrupt EWF %s section: %s", kind, err.Error()))
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(z, ewfMaxHeaderSize))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Corrupt EWF %s section: %s", kind, err.Error()))
+	}
+
+	text := string(raw)
+	if kind == "header2" {
+		if bytes.HasPrefix(raw, []byte{0xFF, 0xFE}) {
+			raw = raw[2:]
+		}
+
+		units := make([]uint16, len(raw)/2)
+		for i := range units {
+			units[i] = binary.LittleEndian.Uint16(raw[2*i:])
+		}
+		text = utf16String(units)
+		p.header2 = true
+	} else if p.header2 {
+		return nil
+	}
+
+	lines := strings.Split(strings.Replace(text, "\r", "", -1), "\n")
+	for i := 0; i+2 < len(lines); i++ {
+		if lines[i] != "main" {
+			continue
+		}
+
+		keys := strings.Split(lines[i+1], "\t")
+		values := strings.Split(lines[i+2], "\t")
+		for j, key := range keys {
+			if j >= len(values) {
+				break
+			}
+			if name, ok := ewfHeaderFields[key]; ok {
+				key = name
+			}
+			p.image.Header[key] = values[j]
+		}
+		break
+	}
+	return nil
+}
+
+func (p *ewfSegmentParser) readVolume(data io.ReaderAt) error {
+	buf := make([]byte, ewfVolumeSize)
+	if _, err := data.ReadAt(buf, 0); err != nil {
+		return err
+	}
+
+	volume := &ewfVolume{}
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, volume)
+
+	if volume.BytesPerSector == 0 || volume.SectorsPerChunk == 0 || volume.SectorsPerChunk > ewfMaxSectorsPerChunk {
+		return errors.New(fmt.Sprintf("Bad EWF geometry, %d sectors of %d bytes per chunk", volume.SectorsPerChunk, volume.BytesPerSector))
+	}
+
+	p.volume = volume
+	p.image.BytesPerSector = int64(volume.BytesPerSector)
+	p.image.chunkSize = int64(volume.SectorsPerChunk) * int64(volume.BytesPerSector)
+	p.image.size = int64(volume.SectorCount) * int64(volume.BytesPerSector)
+	return nil
+}
+
+// readTable adds the chunks listed by a table section. The size of a chunk is
+// the distance to the next one, the last one ends with the sectors section
+// holding it, or with the table section in old files that keep the chunks
+// after the table.
+func (p *ewfSegmentParser) readTable(data io.ReaderAt, size, off, next int64, index int) error {
+	if p.volume == nil {
+		return errors.New("EWF table section before the volume section")
+	}
+
+	header := make([]byte, ewfTableHeaderSize)
+	if _, err := data.ReadAt(header, 0); err != nil {
+		return err
+	}
+
+	if adler32.Checksum(header[:20]) != binary.LittleEndian.Uint32(header[20:]) {
+		return errors.New(fmt.Sprintf("Bad EWF table checksum at %d of segment %d", off, index+1))
+	}
+
+	count := int64(binary.LittleEndian.Uint32(header))
+	base := int64(binary.LittleEndian.Uint64(header[8:]))
+	if count > ewfMaxTableEntries || ewfTableHeaderSize+4*count > size {
+		return errors.New(fmt.Sprintf("Bad EWF table of %d entries at %d of segment %d", count, off, index+1))
+	}
+
+	entries := make([]byte, 4*count)
+	if _, err := data.ReadAt(entries, ewfTableHeaderSize); err != nil {
+		return err
+	}
+
+	//The entries are followed by their checksum since EnCase 3
+	if ewfTableHeaderSize+4*count+4 <= size {
+		checksum := make([]byte, 4)
+		if _, err := data.ReadAt(checksum, ewfTableHeaderSize+4*count); err != nil {
+			return err
+		}
+		if adler32.Checksum(entries) != binary.LittleEndian.Uint32(checksum) {
+			return errors.New(fmt.Sprintf("Bad EWF table entries checksum at %d of segment %d", off, index+1))
+		}
+	}
+
+	chunks := make([]ewfChunk, count)
+	for i := range chunks {
+		entry := binary.LittleEndian.Uint32(entries[4*i:])
+		chunks[i] = ewfChunk{
+			segment:    index,
+			offset:     base + int64(entry&^EWF_CHUNK_COMPRESSED),
+			compressed: entry&EWF_CHUNK_COMPRESSED != 0,
+		}
+	}
+
+	for i := range chunks {
+		end := next
+		if i+1 < len(chunks) {
+			end = chunks[i+1].offset
+		} else if p.sectorsEnd > chunks[i].offset {
+			end = p.sectorsEnd
+		}
+
+		if end <= chunks[i].offset {
+			return errors.New(fmt.Sprintf("Bad EWF chunk offset %d in segment %d", chunks[i].offset, index+1))
+		}
+		chunks[i].size = end - chunks[i].offset
+	}
+
+	p.image.chunks = append(p.image.chunks, chunks...)
+	return nil
+}
+
+// OpenEwfImage opens an EWF image from its first segment file, the others
+// are found next to it.
+func OpenEwfImage(first string) (*EwfImage, error) {
+	var files []io.ReaderAt
+	closeAll := func() {
+		for _, file := range files {
+			file.(io.Closer).Close()
+		}
+	}
+
+	for number := 1; number <= ewfMaxSegments; number++ {
+		path := first
+		if number > 1 {
+			path = EwfSegmentPath(first, number)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) && number > 1 {
+				break
+			}
+			closeAll()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	image, err := NewEwfImage(files)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return image, nil
+}
+
+func (e *EwfImage) Size() int64 {
+	return e.size
+}
+
+func (e *EwfImage) Segments() int {
+	return len(e.segments)
+}
+
+func (e *EwfImage) String() string {
+	return fmt.Sprintf("EWF image, %d bytes in %d chunks of %d bytes, %d segments", e.size, len(e.chunks), e.chunkSize, len(e.segments))
+}
+
+func (e *EwfImage) Close() error {
+	var err error
+	for _, segment := range e.segments {
+		if closer, ok := segment.(io.Closer); ok {
+			if cerr := closer.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+func (e *EwfImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= e.size {
+		return 0, io.EOF
+	}
+
+	want := p
+	if int64(len(want)) > e.size-off {
+		want = want[:e.size-off]
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := 0
+	for n < len(want) {
+		pos := off + int64(n)
+		inner := pos % e.chunkSize
+
+		chunk, err := e.readChunk(pos / e.chunkSize)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(want[n:], chunk[inner:])
+	}
+
+	if len(want) < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readChunk returns the data of a chunk. The last chunk is kept for the
+// reads that follow it.
+func (e *EwfImage) readChunk(chunkNo int64) ([]byte, error) {
+	if chunkNo == e.chunkNo {
+		return e.chunk, nil
+	}
+
+	location := e.chunks[chunkNo]
+	length := e.chunkSize
+	if rest := e.size - chunkNo*e.chunkSize; rest < length {
+		length = rest
+	}
+
+	stored := location.size
+	if !location.compressed && stored > length+ewfChunkChecksumLength {
+		stored = length + ewfChunkChecksumLength
+	}
+
+	data := make([]byte, stored)
+	read, err := e.segments[location.segment].ReadAt(data, location.offset)
+	if err != nil && !(err == io.EOF && (location.compressed || int64(read) >= length)) {
+		return nil, err
+	}
+	data = data[:read]
+
+	chunk := make([]byte, length)
+	if location.compressed {
+		z, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Corrupt EWF chunk %d: %s", chunkNo, err.Error()))
+		}
+		if _, err := io.ReadFull(z, chunk); err != nil {
+			return nil, errors.New(fmt.Sprintf("Corrupt EWF chunk %d: %s", chunkNo, err.Error()))
+		}
+	} else {
+		if int64(len(data)) < length {
+			return nil, errors.New(fmt.Sprintf("EWF chunk %d is truncated", chunkNo))
+		}
+		copy(chunk, data)
+
+		if int64(len(data)) >= length+ewfChunkChecksumLength {
+			if adler32.Checksum(chunk) != binary.LittleEndian.Uint32(data[length:]) {
+				return nil, errors.New(fmt.Sprintf("Bad EWF chunk %d checksum", chunkNo))
+			}
+		}
+	}
+
+	e.chunkNo = chunkNo
+	e.chunk = chunk
+	return chunk, nil
+}
+
+// Verify reads the whole media and checks it against the MD5 hash stored in
+// the image.
+func (e *EwfImage) Verify() error {
+	if e.MD5 == nil {
+		return errors.New("EWF image has no MD5 hash")
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(e, 0, e.size)); err != nil {
+		return err
+	}
+
+	if sum := hash.Sum(nil); !bytes.Equal(sum, e.MD5) {
+		return errors.New(fmt.Sprintf("EWF MD5 mismatch, %s computed, %s stored", hex.EncodeToString(sum), hex.EncodeToString(e.MD5)))
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package ext2fs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/binary"
+	"hash/adler32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	ewfTestSectorsPerChunk = 8
+	ewfTestChunk           = ewfTestSectorsPerChunk * SECTOR_SIZE
+	ewfTestSectors         = 5*ewfTestSectorsPerChunk - 3 //The last chunk is short
+)
+
+// ewfTestImage is a synthetic EWF image of two segments. The offsets are
+// those of the tables and the first chunk in the first segment, and of the
+// hash in the last one.
+type ewfTestImage struct {
+	segments [][]byte
+	data     []byte
+	table    int64
+	table2   int64
+	chunk    int64
+	hash     int64
+}
+
+// ewfTestSection appends a section holding data to segment and returns the
+// offset of the data.
+func ewfTestSection(segment *bytes.Buffer, kind string, data []byte) int64 {
+	off := int64(segment.Len())
+	header := ewfSectionHeader{
+		Next: uint64(off + ewfSectionHeaderSize + int64(len(data))),
+		Size: uint64(ewfSectionHeaderSize + len(data)),
+	}
+	if kind == "next" || kind == "done" {
+		header.Next = uint64(off)
+	}
+	copy(header.Type[:], kind)
+
+	raw := new(bytes.Buffer)
+	binary.Write(raw, binary.LittleEndian, header)
+	binary.LittleEndian.PutUint32(raw.Bytes()[ewfSectionHeaderSize-4:], adler32.Checksum(raw.Bytes()[:ewfSectionHeaderSize-4]))
+
+	segment.Write(raw.Bytes())
+	segment.Write(data)
+	return off + ewfSectionHeaderSize
+}
+
+func ewfTestTable(offsets []uint32) []byte {
+	table := make([]byte, ewfTableHeaderSize)
+	binary.LittleEndian.PutUint32(table, uint32(len(offsets)))
+	binary.LittleEndian.PutUint32(table[20:], adler32.Checksum(table[:20]))
+
+	entries := make([]byte, 4*len(offsets))
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint32(entries[4*i:], offset)
+	}
+
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, adler32.Checksum(entries))
+	return append(append(table, entries...), checksum...)
+}
+
+func ewfTestZlib(data []byte) []byte {
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write(data)
+	w.Close()
+	return z.Bytes()
+}
+
+// newEwfTestImage returns an image holding three chunks in its first
+// segment and two in the second. The odd chunks are compressed, the others
+// are stored with their checksum.
+func newEwfTestImage() *ewfTestImage {
+	image := &ewfTestImage{data: make([]byte, ewfTestSectors*SECTOR_SIZE)}
+	rand.New(rand.NewSource(6)).Read(image.data)
+
+	chunkNo := 0
+	for number, chunks := range []int{3, 2} {
+		var segment bytes.Buffer
+		segment.WriteString(EWF_SIGNATURE)
+		binary.Write(&segment, binary.LittleEndian, []uint8{1, uint8(number + 1), 0, 0, 0})
+
+		if number == 0 {
+			header := "1\nmain\nc\tn\ta\te\tt\tav\tov\tm\tu\tp\nCASE-7\t1\ttest disk\texaminer\t\t7.0\tLinux\t2024 1 2 3 4 5\t2024 1 2 3 4 5\t0\n\n"
+			ewfTestSection(&segment, "header", ewfTestZlib([]byte(header)))
+
+			//Only the start of the 94 byte volume section is read
+			var volume bytes.Buffer
+			binary.Write(&volume, binary.LittleEndian, ewfVolume{
+				MediaType:       1,
+				ChunkCount:      5,
+				SectorsPerChunk: ewfTestSectorsPerChunk,
+				BytesPerSector:  SECTOR_SIZE,
+				SectorCount:     ewfTestSectors,
+			})
+			volume.Write(make([]byte, 94-volume.Len()))
+			ewfTestSection(&segment, "volume", volume.Bytes())
+		}
+
+		//The chunks go in the sectors section, the table follows it
+		start := segment.Len() + ewfSectionHeaderSize
+		var sectors bytes.Buffer
+		offsets := make([]uint32, 0)
+		for i := 0; i < chunks; i++ {
+			end := (chunkNo + 1) * ewfTestChunk
+			if end > len(image.data) {
+				end = len(image.data)
+			}
+			chunk := image.data[chunkNo*ewfTestChunk : end]
+
+			offset := uint32(start + sectors.Len())
+			if chunkNo%2 == 1 {
+				offsets = append(offsets, offset|EWF_CHUNK_COMPRESSED)
+				sectors.Write(ewfTestZlib(chunk))
+			} else {
+				offsets = append(offsets, offset)
+				sectors.Write(chunk)
+				binary.Write(&sectors, binary.LittleEndian, adler32.Checksum(chunk))
+			}
+			chunkNo++
+		}
+		ewfTestSection(&segment, "sectors", sectors.Bytes())
+
+		table := ewfTestSection(&segment, "table", ewfTestTable(offsets))
+		table2 := ewfTestSection(&segment, "table2", ewfTestTable(offsets))
+		if number == 0 {
+			image.table, image.table2, image.chunk = table, table2, int64(start)
+			ewfTestSection(&segment, "next", nil)
+		} else {
+			sum := md5.Sum(image.data)
+			image.hash = ewfTestSection(&segment, "hash", append(sum[:], make([]byte, 20)...))
+			ewfTestSection(&segment, "done", nil)
+		}
+
+		image.segments = append(image.segments, segment.Bytes())
+	}
+
+	return image
+}
+
+func (image *ewfTestImage) open() (*EwfImage, error) {
+	segments := make([]io.ReaderAt, len(image.segments))
+	for i, segment := range image.segments {
+		segments[i] = memImage(segment)
+	}
+	return NewEwfImage(segments)
+}
+
+func TestEwfSegmentPath(t *testing.T) {
+	paths := []struct {
+		first  string
+		number int
+		path   string
+	}{
+		{"image.E01", 2, "image.E02"},
+		{"image.E01", 99, "image.E99"},
+		{"image.E01", 100, "image.EAA"},
+		{"image.E01", 101, "image.EAB"},
+		{"image.E01", 126, "image.EBA"},
+		{"image.E01", 775, "image.EZZ"},
+		{"image.E01", 776, "image.FAA"},
+		{"image.E01", 1452, "image.GAA"},
+		{"dir/image.e01", 9, "dir/image.e09"},
+		{"dir/image.e01", 100, "dir/image.eaa"},
+		{"dir/image.e01", 776, "dir/image.faa"},
+		{"image.s01", 100, "image.saa"},
+	}
+
+	for _, p := range paths {
+		if path := EwfSegmentPath(p.first, p.number); path != p.path {
+			t.Errorf("segment %d of %s is %s, want %s", p.number, p.first, path, p.path)
+		}
+	}
+}
+
+func TestEwf(t *testing.T) {
+	image := newEwfTestImage()
+
+	dir := t.TempDir()
+	for i, segment := range image.segments {
+		path := EwfSegmentPath(filepath.Join(dir, "image.E01"), i+1)
+		if err := os.WriteFile(path, segment, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !IsEwf(memImage(image.segments[1])) {
+		t.Fatal("segment not recognized")
+	}
+
+	e, err := OpenEwfImage(filepath.Join(dir, "image.E01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if e.Segments() != 2 || e.Size() != ewfTestSectors*SECTOR_SIZE || e.BytesPerSector != SECTOR_SIZE {
+		t.Fatalf("opened %s", e)
+	}
+	if e.Header["case_number"] != "CASE-7" || e.Header["examiner_name"] != "examiner" {
+		t.Fatalf("header %v", e.Header)
+	}
+
+	//Chunk 2 ends the first segment
+	buf := make([]byte, 2*ewfTestChunk)
+	if _, err := e.ReadAt(buf, ewfTestChunk+100); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, image.data[ewfTestChunk+100:3*ewfTestChunk+100]) {
+		t.Fatal("read across the segments returned other bytes")
+	}
+	checkRandomReads(t, e, image.data)
+
+	if err := e.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Without its last segment the image can't be read
+	os.Remove(EwfSegmentPath(filepath.Join(dir, "image.E01"), 2))
+	if _, err := OpenEwfImage(filepath.Join(dir, "image.E01")); err == nil || !strings.Contains(err.Error(), "segment 2 is missing") {
+		t.Fatalf("opening a single segment gave %v", err)
+	}
+}
+
+func TestEwfTable2(t *testing.T) {
+	image := newEwfTestImage()
+
+	//A damaged table is replaced by its mirror
+	image.segments[0][image.table+ewfTableHeaderSize] ^= 0x01
+	e, err := image.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRandomReads(t, e, image.data)
+
+	//Not when the mirror is damaged too
+	image.segments[0][image.table2+ewfTableHeaderSize+1] ^= 0x01
+	if _, err := image.open(); err == nil || !strings.Contains(err.Error(), "table entries checksum") {
+		t.Fatalf("opening with both tables damaged gave %v", err)
+	}
+}
+
+func TestEwfChunkChecksum(t *testing.T) {
+	image := newEwfTestImage()
+
+	//The first chunk is stored uncompressed, with its checksum
+	image.segments[0][image.chunk+10] ^= 0x01
+	e, err := image.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.ReadAt(make([]byte, 16), 0); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("reading a corrupt chunk gave %v", err)
+	}
+	if _, err := e.ReadAt(make([]byte, 16), ewfTestChunk); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Verify(); err == nil {
+		t.Fatal("image with a corrupt chunk verified")
+	}
+}
+
+func TestEwfVerifyMismatch(t *testing.T) {
+	image := newEwfTestImage()
+
+	image.segments[1][image.hash] ^= 0x01
+	e, err := image.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The chunks are fine, the hash isn't
+	checkRandomReads(t, e, image.data)
+	if err := e.Verify(); err == nil || !strings.Contains(err.Error(), "MD5 mismatch") {
+		t.Fatalf("verifying against a wrong hash gave %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package ext2fs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Compatible features, a filesystem using them can be read and written
+// without knowing them.
+const (
+	EXT2_FEATURE_COMPAT_DIR_PREALLOC   = 0x0001
+	EXT2_FEATURE_COMPAT_IMAGIC_INODES  = 0x0002
+	EXT3_FEATURE_COMPAT_HAS_JOURNAL    = 0x0004
+	EXT2_FEATURE_COMPAT_EXT_ATTR       = 0x0008
+	EXT2_FEATURE_COMPAT_RESIZE_INODE   = 0x0010
+	EXT2_FEATURE_COMPAT_DIR_INDEX      = 0x0020
+	EXT2_FEATURE_COMPAT_LAZY_BG        = 0x0040
+	EXT2_FEATURE_COMPAT_EXCLUDE_INODE  = 0x0080
+	EXT2_FEATURE_COMPAT_EXCLUDE_BITMAP = 0x0100
+	EXT4_FEATURE_COMPAT_SPARSE_SUPER2  = 0x0200
+	EXT4_FEATURE_COMPAT_FAST_COMMIT    = 0x0400
+	EXT4_FEATURE_COMPAT_STABLE_INODES  = 0x0800
+	EXT4_FEATURE_COMPAT_ORPHAN_FILE    = 0x1000
+)
+
+// Read-only compatible features, a filesystem using unknown ones can only be
+// read.
+const (
+	EXT2_FEATURE_RO_COMPAT_SPARSE_SUPER   = 0x0001
+	EXT2_FEATURE_RO_COMPAT_LARGE_FILE     = 0x0002
+	EXT2_FEATURE_RO_COMPAT_BTREE_DIR      = 0x0004
+	EXT4_FEATURE_RO_COMPAT_HUGE_FILE      = 0x0008
+	EXT4_FEATURE_RO_COMPAT_GDT_CSUM       = 0x0010
+	EXT4_FEATURE_RO_COMPAT_DIR_NLINK      = 0x0020
+	EXT4_FEATURE_RO_COMPAT_EXTRA_ISIZE    = 0x0040
+	EXT4_FEATURE_RO_COMPAT_HAS_SNAPSHOT   = 0x0080
+	EXT4_FEATURE_RO_COMPAT_QUOTA          = 0x0100
+	EXT4_FEATURE_RO_COMPAT_BIGALLOC       = 0x0200
+	EXT4_FEATURE_RO_COMPAT_METADATA_CSUM  = 0x0400
+	EXT4_FEATURE_RO_COMPAT_REPLICA        = 0x0800
+	EXT4_FEATURE_RO_COMPAT_READONLY       = 0x1000
+	EXT4_FEATURE_RO_COMPAT_PROJECT        = 0x2000
+	EXT4_FEATURE_RO_COMPAT_SHARED_BLOCKS  = 0x4000
+	EXT4_FEATURE_RO_COMPAT_VERITY         = 0x8000
+	EXT4_FEATURE_RO_COMPAT_ORPHAN_PRESENT = 0x10000
+)
+
+// Incompatible features, a filesystem using unknown ones can't be read.
+const (
+	EXT2_FEATURE_INCOMPAT_COMPRESSION = 0x0001
+	EXT2_FEATURE_INCOMPAT_FILETYPE    = 0x0002
+	EXT3_FEATURE_INCOMPAT_RECOVER     = 0x0004
+	EXT3_FEATURE_INCOMPAT_JOURNAL_DEV = 0x0008
+	EXT2_FEATURE_INCOMPAT_META_BG     = 0x0010
+	EXT4_FEATURE_INCOMPAT_EXTENTS     = 0x0040
+	EXT4_FEATURE_INCOMPAT_64BIT       = 0x0080
+	EXT4_FEATURE_INCOMPAT_MMP         = 0x0100
+	EXT4_FEATURE_INCOMPAT_FLEX_BG     = 0x0200
+	EXT4_FEATURE_INCOMPAT_EA_INODE    = 0x0400
+	EXT4_FEATURE_INCOMPAT_DIRDATA     = 0x1000
+	EXT4_FEATURE_INCOMPAT_CSUM_SEED   = 0x2000
+	EXT4_FEATURE_INCOMPAT_LARGEDIR    = 0x4000
+	EXT4_FEATURE_INCOMPAT_INLINE_DATA = 0x8000
+	EXT4_FEATURE_INCOMPAT_ENCRYPT     = 0x10000
+	EXT4_FEATURE_INCOMPAT_CASEFOLD    = 0x20000
+)
+
+// The features this package understands. sparse_super only drops backups it
+// never writes, and large_file only lets files grow past 2GiB.
+const (
+	EXT2_FEATURE_RO_COMPAT_SUPP = EXT2_FEATURE_RO_COMPAT_SPARSE_SUPER | EXT2_FEATURE_RO_COMPAT_LARGE_FILE
+	EXT2_FEATURE_INCOMPAT_SUPP  = EXT2_FEATURE_INCOMPAT_FILETYPE | EXT2_FEATURE_INCOMPAT_META_BG | EXT4_FEATURE_INCOMPAT_64BIT
+)
+
+// The names given to the features by e2fsprogs.
+var compatNames = map[uint32]string{
+	EXT2_FEATURE_COMPAT_DIR_PREALLOC:   "dir_prealloc",
+	EXT2_FEATURE_COMPAT_IMAGIC_INODES:  "imagic_inodes",
+	EXT3_FEATURE_COMPAT_HAS_JOURNAL:    "has_journal",
+	EXT2_FEATURE_COMPAT_EXT_ATTR:       "ext_attr",
+	EXT2_FEATURE_COMPAT_RESIZE_INODE:   "resize_inode",
+	EXT2_FEATURE_COMPAT_DIR_INDEX:      "dir_index",
+	EXT2_FEATURE_COMPAT_LAZY_BG:        "lazy_bg",
+	EXT2_FEATURE_COMPAT_EXCLUDE_INODE:  "exclude_inode",
+	EXT2_FEATURE_COMPAT_EXCLUDE_BITMAP: "exclude_bitmap",
+	EXT4_FEATURE_COMPAT_SPARSE_SUPER2:  "sparse_super2",
+	EXT4_FEATURE_COMPAT_FAST_COMMIT:    "fast_commit",
+	EXT4_FEATURE_COMPAT_STABLE_INODES:  "stable_inodes",
+	EXT4_FEATURE_COMPAT_ORPHAN_FILE:    "orphan_file",
+}
+
+var roCompatNames = map[uint32]string{
+	EXT2_FEATURE_RO_COMPAT_SPARSE_SUPER:   "sparse_super",
+	EXT2_FEATURE_RO_COMPAT_LARGE_FILE:     "large_file",
+	EXT2_FEATURE_RO_COMPAT_BTREE_DIR:      "btree_dir",
+	EXT4_FEATURE_RO_COMPAT_HUGE_FILE:      "huge_file",
+	EXT4_FEATURE_RO_COMPAT_GDT_CSUM:       "uninit_bg",
+	EXT4_FEATURE_RO_COMPAT_DIR_NLINK:      "dir_nlink",
+	EXT4_FEATURE_RO_COMPAT_EXTRA_ISIZE:    "extra_isize",
+	EXT4_FEATURE_RO_COMPAT_HAS_SNAPSHOT:   "snapshot_bitmap",
+	EXT4_FEATURE_RO_COMPAT_QUOTA:          "quota",
+	EXT4_FEATURE_RO_COMPAT_BIGALLOC:       "bigalloc",
+	EXT4_FEATURE_RO_COMPAT_METADATA_CSUM:  "metadata_csum",
+	EXT4_FEATURE_RO_COMPAT_REPLICA:        "replica",
+	EXT4_FEATURE_RO_COMPAT_READONLY:       "read-only",
+	EXT4_FEATURE_RO_COMPAT_PROJECT:        "project",
+	EXT4_FEATURE_RO_COMPAT_SHARED_BLOCKS:  "shared_blocks",
+	EXT4_FEATURE_RO_COMPAT_VERITY:         "verity",
+	EXT4_FEATURE_RO_COMPAT_ORPHAN_PRESENT: "orphan_present",
+}
+
+var incompatNames = map[uint32]string{
+	EXT2_FEATURE_INCOMPAT_COMPRESSION: "compression",
+	EXT2_FEATURE_INCOMPAT_FILETYPE:    "filetype",
+	EXT3_FEATURE_INCOMPAT_RECOVER:     "needs_recovery",
+	EXT3_FEATURE_INCOMPAT_JOURNAL_DEV: "journal_dev",
+	EXT2_FEATURE_INCOMPAT_META_BG:     "meta_bg",
+	EXT4_FEATURE_INCOMPAT_EXTENTS:     "extent",
+	EXT4_FEATURE_INCOMPAT_64BIT:       "64bit",
+	EXT4_FEATURE_INCOMPAT_MMP:         "mmp",
+	EXT4_FEATURE_INCOMPAT_FLEX_BG:     "flex_bg",
+	EXT4_FEATURE_INCOMPAT_EA_INODE:    "ea_inode",
+	EXT4_FEATURE_INCOMPAT_DIRDATA:     "dirdata",
+	EXT4_FEATURE_INCOMPAT_CSUM_SEED:   "metadata_csum_seed",
+	EXT4_FEATURE_INCOMPAT_LARGEDIR:    "large_dir",
+	EXT4_FEATURE_INCOMPAT_INLINE_DATA: "inline_data",
+	EXT4_FEATURE_INCOMPAT_ENCRYPT:     "encrypt",
+	EXT4_FEATURE_INCOMPAT_CASEFOLD:    "casefold",
+}
+
+func (s *SuperBlock) HasCompat(mask uint32) bool {
+	return s.FeatureCompat&mask != 0
+}
+
+func (s *SuperBlock) HasRoCompat(mask uint32) bool {
+	return s.FeatureRoCompat&mask != 0
+}
+
+func (s *SuperBlock) HasIncompat(mask uint32) bool {
+	return s.FeatureIncompat&mask != 0
+}
+
+// featureNames names the bits set in flags, the unnamed ones the way
+// e2fsprogs does, FEATURE_C12 for compat bit 12.
+func featureNames(flags uint32, names map[uint32]string, kind string) []string {
+	list := make([]string, 0)
+	for bit := uint(0); bit < 32; bit++ {
+		mask := uint32(1) << bit
+		if flags&mask == 0 {
+			continue
+		}
+		if name, ok := names[mask]; ok {
+			list = append(list, name)
+		} else {
+			list = append(list, fmt.Sprintf("FEATURE_%s%d", kind, bit))
+		}
+	}
+	return list
+}
+
+// FeatureNames lists the features of the filesystem, compat, then incompat,
+// then ro_compat ones.
+func (s *SuperBlock) FeatureNames() []string {
+	list := featureNames(s.FeatureCompat, compatNames, "C")
+	list = append(list, featureNames(s.FeatureIncompat, incompatNames, "I")...)
+	return append(list, featureNames(s.FeatureRoCompat, roCompatNames, "R")...)
+}
+
+// UnsupportedRoCompat lists the ro_compat features of the filesystem this
+// package doesn't understand, that keep it from writing the filesystem.
+func (s *SuperBlock) UnsupportedRoCompat() []string {
+	return featureNames(s.FeatureRoCompat&^EXT2_FEATURE_RO_COMPAT_SUPP, roCompatNames, "R")
+}
+
+// checkFeatures refuses the filesystems with incompat features this package
+// doesn't understand.
+func (s *SuperBlock) checkFeatures() error {
+	if unsupported := s.FeatureIncompat &^ EXT2_FEATURE_INCOMPAT_SUPP; unsupported != 0 {
+		names := featureNames(unsupported, incompatNames, "I")
+		return errors.New(fmt.Sprintf("Unsupported filesystem features: %s", strings.Join(names, " ")))
+	}
+	return nil
+}
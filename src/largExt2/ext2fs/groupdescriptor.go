@@ -1,11 +1,14 @@
 package ext2fs
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 )
 
+const EXT2_MIN_DESC_SIZE_64BIT = 64
+
 type GroupDescriptor struct {
 	BlockBitmap     uint32
 	InodeBitmap     uint32
@@ -15,6 +18,42 @@ type GroupDescriptor struct {
 	UsedDirsCount   uint16
 	Pad             uint16
 	Reserved        [3]uint32
+
+	/*
+		64bit filesystems only
+	*/
+	BlockBitmapHi     uint32
+	InodeBitmapHi     uint32
+	InodeTableHi      uint32
+	FreeBlocksCountHi uint16
+	FreeInodesCountHi uint16
+	UsedDirsCountHi   uint16
+	ItableUnusedHi    uint16
+	Reserved2         [3]uint32
+}
+
+func (g *GroupDescriptor) BlockBitmap64() uint64 {
+	return uint64(g.BlockBitmapHi)<<32 | uint64(g.BlockBitmap)
+}
+
+func (g *GroupDescriptor) InodeBitmap64() uint64 {
+	return uint64(g.InodeBitmapHi)<<32 | uint64(g.InodeBitmap)
+}
+
+func (g *GroupDescriptor) InodeTable64() uint64 {
+	return uint64(g.InodeTableHi)<<32 | uint64(g.InodeTable)
+}
+
+func (g *GroupDescriptor) FreeBlocks() uint32 {
+	return uint32(g.FreeBlocksCountHi)<<16 | uint32(g.FreeBlocksCount)
+}
+
+func (g *GroupDescriptor) FreeInodes() uint32 {
+	return uint32(g.FreeInodesCountHi)<<16 | uint32(g.FreeInodesCount)
+}
+
+func (g *GroupDescriptor) UsedDirs() uint32 {
+	return uint32(g.UsedDirsCountHi)<<16 | uint32(g.UsedDirsCount)
 }
 
 func (d *Device) NewGroupDescriptor(index uint32) (*GroupDescriptor, error) {
@@ -22,14 +61,50 @@ func (d *Device) NewGroupDescriptor(index uint32) (*GroupDescriptor, error) {
 		return nil, errors.New(fmt.Sprintf("Group descriptor index %d out of bounds", index))
 	}
 
-	if _, err := d.seek(d.groupDescriptorOffset(index)); err != nil {
+	data, err := d.metaBytes(int(d.groupDescSize), d.groupDescriptorOffset(index))
+	if err != nil {
 		return nil, err
 	}
 
+	//The high halves of 32 bytes descriptors read as zeros
+	buf := make([]byte, binary.Size(GroupDescriptor{}))
+	copy(buf, data)
+
 	group := &GroupDescriptor{}
-	if err := binary.Read(d.file, binary.LittleEndian, group); err != nil {
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, group); err != nil {
 		return nil, err
 	}
 
 	return group, nil
 }
+
+// metaGroupDescBlock returns the block holding the descriptors of a meta_bg
+// metagroup. They are in its first group, with copies in the second and the
+// last ones, and the copy of the second group is used when the Device was
+// opened from a backup superblock.
+func (d *Device) metaGroupDescBlock(metaGroup uint32) uint64 {
+	groupNo := metaGroup * (d.BlockSize / d.groupDescSize)
+	if d.GroupDescTableBlock != uint64(d.FirstDataBlock)+1 && groupNo+1 < d.BlockGroupsCount {
+		groupNo++
+	}
+
+	block := uint64(d.FirstDataBlock) + uint64(groupNo)*uint64(d.BlocksPerGroup)
+	if hasBackup(groupNo, d.sparseSuper) {
+		//After the superblock copy
+		block++
+	}
+	return block
+}
+
+// updateGroupCount writes a group descriptor counter, lo at off and hi at
+// hiOff, the high half only with 64 bytes descriptors.
+func (d *Device) updateGroupCount(groupNo uint32, value uint32, off int64, hiOff int64) error {
+	if err := d.encodeAt(uint16(value), d.groupDescriptorOffset(groupNo)+off); err != nil {
+		return err
+	}
+
+	if d.groupDescSize < EXT2_MIN_DESC_SIZE_64BIT {
+		return nil
+	}
+	return d.encodeAt(uint16(value>>16), d.groupDescriptorOffset(groupNo)+hiOff)
+}
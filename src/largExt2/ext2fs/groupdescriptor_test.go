@@ -0,0 +1,115 @@
+package ext2fs
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// The meta_bg image has 80 groups of 256 blocks and 32 descriptors to a
+// block, so three metagroups. Each keeps its descriptors in a block of its
+// first group, after the superblock copy when there is one, with a copy in
+// its second group.
+var metaBgTestGroups = []struct {
+	group       uint32
+	blockBitmap uint64
+	inodeTable  uint64
+}{
+	{0, 3, 5},
+	{1, 259, 261},
+	{31, 7938, 7940},
+	{32, 8194, 8196},
+	{33, 8450, 8452},
+	{63, 16130, 16132},
+	{64, 16386, 16388},
+	{65, 16642, 16644},
+	{79, 20225, 20227},
+}
+
+func checkMetaBgGroups(t *testing.T, device *Device) {
+	t.Helper()
+
+	for _, want := range metaBgTestGroups {
+		group, err := device.NewGroupDescriptor(want.group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group.BlockBitmap64() != want.blockBitmap || group.InodeTable64() != want.inodeTable {
+			t.Fatalf("group %d has its block bitmap at %d and its inode table at %d, want %d and %d",
+				want.group, group.BlockBitmap64(), group.InodeTable64(), want.blockBitmap, want.inodeTable)
+		}
+	}
+}
+
+func TestMetaBg(t *testing.T) {
+	device, _ := openTestImage(t, "ext2-meta_bg.img.gz")
+	if device.BlockGroupsCount != 80 || !device.metaBg || device.firstMetaBg != 0 {
+		t.Fatalf("opened %d groups, meta_bg %t from %d", device.BlockGroupsCount, device.metaBg, device.firstMetaBg)
+	}
+
+	blocks := map[uint32]uint64{0: 2, 1: 8193, 2: 16385}
+	for metaGroup, block := range blocks {
+		if found := device.metaGroupDescBlock(metaGroup); found != block {
+			t.Fatalf("metagroup %d descriptors at %d, want %d", metaGroup, found, block)
+		}
+	}
+
+	checkMetaBgGroups(t, device)
+	if data := readTestFile(t, device, "hello"); data != "hello\n" {
+		t.Fatalf("read %q from hello", data)
+	}
+}
+
+func TestMetaBgFirstMetaBg(t *testing.T) {
+	//The metagroups before s_first_meta_bg have their descriptors in the
+	//table after the superblock. Moving those of metagroup 1 to the second
+	//block of the table, over the block bitmap of group 0, leaves them
+	//readable only from there.
+	image := memImage(readTestData(t, "ext2-meta_bg.img.gz"))
+	binary.LittleEndian.PutUint32(image[BASE_OFFSET+0x104:], 2)
+	copy(image[3*1024:4*1024], image[8193*1024:8194*1024])
+	zero(image[8193*1024 : 8194*1024])
+
+	device, err := NewDeviceFromReaderAt(image, int64(len(image)), DeviceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.firstMetaBg != 2 {
+		t.Fatalf("first meta block group %d", device.firstMetaBg)
+	}
+	if off := device.groupDescriptorOffset(33); off != 3*1024+32 {
+		t.Fatalf("group 33 descriptor at %d", off)
+	}
+	if off := device.groupDescriptorOffset(64); off != 16385*1024 {
+		t.Fatalf("group 64 descriptor at %d", off)
+	}
+	checkMetaBgGroups(t, device)
+
+	//There are only three descriptor blocks
+	binary.LittleEndian.PutUint32(image[BASE_OFFSET+0x104:], 4)
+	if _, err := NewDeviceFromReaderAt(image, int64(len(image)), DeviceOptions{}); err == nil || !strings.Contains(err.Error(), "first meta block group") {
+		t.Fatalf("opening with the first meta block group past the descriptors gave %v", err)
+	}
+}
+
+func TestMetaBgBackup(t *testing.T) {
+	//Without the primary superblock and descriptors, the copies in the
+	//second group of each metagroup are read
+	image := memImage(readTestData(t, "ext2-meta_bg.img.gz"))
+	damageSuperBlock(image)
+	for _, block := range []int{2, 8193, 16385} {
+		zero(image[block*1024 : (block+1)*1024])
+	}
+
+	//Group 3 holds a superblock copy but no descriptors
+	for _, block := range []uint64{257, 769} {
+		device, err := NewDeviceFromReaderAt(image, int64(len(image)), DeviceOptions{BackupSuperBlock: block})
+		if err != nil {
+			t.Fatalf("opening the backup at %d: %v", block, err)
+		}
+		if found := device.metaGroupDescBlock(1); found != 8449 {
+			t.Fatalf("metagroup 1 descriptors at %d from the backup at %d", found, block)
+		}
+		checkMetaBgGroups(t, device)
+	}
+}
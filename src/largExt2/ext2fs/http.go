@@ -0,0 +1,327 @@
+package ext2fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HTTP_BLOCK_SIZE      = 64 * 1024
+	httpCacheSize        = 64 * 1024 * 1024
+	httpMaxRequestBlocks = 64
+	httpRetries          = 3
+	httpTimeout          = 60 * time.Second
+)
+
+// HttpImage reads a remote image through HTTP Range requests, read-only.
+// Reads are rounded to whole blocks kept in an LRU cache. The missing
+// adjacent blocks of a read are fetched with a single request, and
+// concurrent reads of the same block share the request fetching it.
+type HttpImage struct {
+	URL       string
+	client    *http.Client
+	size      int64
+	blockSize int64
+	etag      string
+	cache     *blockCache
+	mu        sync.Mutex
+	pending   map[int64]*httpFetch
+	requests  uint64
+}
+
+// httpFetch is a request in flight, done is closed once its blocks are
+// cached or err is set.
+type httpFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// IsHttpUrl reports whether source is an http or https URL.
+func IsHttpUrl(source string) bool {
+	lower := strings.ToLower(source)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// OpenHttpImage checks that the server of rawUrl answers Range requests and
+// learns the size of the image from the first byte request.
+func OpenHttpImage(rawUrl string) (*HttpImage, error) {
+	if _, err := url.Parse(rawUrl); err != nil {
+		return nil, err
+	}
+
+	h := &HttpImage{
+		URL:       rawUrl,
+		client:    &http.Client{Timeout: httpTimeout},
+		blockSize: HTTP_BLOCK_SIZE,
+		cache:     newBlockCache(httpCacheSize / HTTP_BLOCK_SIZE),
+		pending:   make(map[int64]*httpFetch),
+	}
+
+	resp, err := h.get(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	_, _, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+
+	//Weak validators can't be used in If-Match
+	if etag := resp.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+		h.etag = etag
+	}
+
+	h.size = size
+	return h, nil
+}
+
+// get requests the bytes [start, end) and checks that the server answered
+// with exactly that range.
+func (h *HttpImage) get(start, end int64) (*http.Response, error) {
+	req, err := http.NewRequest("GET", h.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if h.etag != "" {
+		req.Header.Set("If-Match", h.etag)
+	}
+
+	atomic.AddUint64(&h.requests, 1)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("%s: the server doesn't support range requests", h.name()))
+	case http.StatusPreconditionFailed:
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("%s: the image changed on the server", h.name()))
+	default:
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("%s: %s", h.name(), resp.Status))
+	}
+
+	first, last, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil || first != start || last != end-1 {
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("%s: asked bytes %d-%d, got %s", h.name(), start, end-1, resp.Header.Get("Content-Range")))
+	}
+
+	return resp, nil
+}
+
+// parseContentRange parses "bytes first-last/size".
+func parseContentRange(value string) (int64, int64, int64, error) {
+	bad := errors.New(fmt.Sprintf("Bad Content-Range %q", value))
+
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, 0, bad
+	}
+
+	slash := strings.Index(value, "/")
+	dash := strings.Index(value, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, bad
+	}
+
+	first, err1 := strconv.ParseInt(value[len("bytes "):dash], 10, 64)
+	last, err2 := strconv.ParseInt(value[dash+1:slash], 10, 64)
+	size, err3 := strconv.ParseInt(value[slash+1:], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || last < first || size <= last {
+		return 0, 0, 0, bad
+	}
+	return first, last, size, nil
+}
+
+// fetch reads the blocks first through last into the cache and returns
+// them, retrying failed requests.
+func (h *HttpImage) fetch(first, last int64) ([][]byte, error) {
+	start := first * h.blockSize
+	end := (last + 1) * h.blockSize
+	if end > h.size {
+		end = h.size
+	}
+
+	var err error
+	for try := 0; try < httpRetries; try++ {
+		var resp *http.Response
+		if resp, err = h.get(start, end); err != nil {
+			continue
+		}
+
+		data := make([]byte, end-start)
+		_, err = io.ReadFull(resp.Body, data)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+
+		blocks := make([][]byte, 0, last-first+1)
+		for pos := int64(0); pos < int64(len(data)); pos += h.blockSize {
+			blockEnd := pos + h.blockSize
+			if blockEnd > int64(len(data)) {
+				blockEnd = int64(len(data))
+			}
+			h.cache.put(uint64(first+int64(len(blocks))), data[pos:blockEnd])
+			blocks = append(blocks, data[pos:blockEnd])
+		}
+		return blocks, nil
+	}
+	return nil, err
+}
+
+// blocks returns the blocks first through last, fetching the missing ones.
+func (h *HttpImage) blocks(first, last int64) ([][]byte, error) {
+	blocks := make([][]byte, last-first+1)
+
+	for {
+		var waits []*httpFetch
+		var runs [][2]int64
+		fetch := &httpFetch{done: make(chan struct{})}
+
+		h.mu.Lock()
+		for blockNo := first; blockNo <= last; blockNo++ {
+			if blocks[blockNo-first] != nil {
+				continue
+			}
+			if data, ok := h.cache.get(uint64(blockNo)); ok {
+				blocks[blockNo-first] = data
+				continue
+			}
+			if other, ok := h.pending[blockNo]; ok {
+				waits = append(waits, other)
+				continue
+			}
+
+			h.pending[blockNo] = fetch
+			if n := len(runs); n > 0 && runs[n-1][1] == blockNo-1 && blockNo-runs[n-1][0] < httpMaxRequestBlocks {
+				runs[n-1][1] = blockNo
+			} else {
+				runs = append(runs, [2]int64{blockNo, blockNo})
+			}
+		}
+		h.mu.Unlock()
+
+		if len(runs) > 0 {
+			for _, run := range runs {
+				var fetched [][]byte
+				if fetched, fetch.err = h.fetch(run[0], run[1]); fetch.err != nil {
+					break
+				}
+				copy(blocks[run[0]-first:], fetched)
+			}
+
+			h.mu.Lock()
+			for _, run := range runs {
+				for blockNo := run[0]; blockNo <= run[1]; blockNo++ {
+					delete(h.pending, blockNo)
+				}
+			}
+			h.mu.Unlock()
+			close(fetch.done)
+
+			if fetch.err != nil {
+				return nil, fetch.err
+			}
+		}
+
+		if len(waits) == 0 {
+			return blocks, nil
+		}
+
+		//The blocks fetched by others are picked from the cache on the next
+		//round
+		for _, other := range waits {
+			<-other.done
+			if other.err != nil {
+				return nil, other.err
+			}
+		}
+	}
+}
+
+func (h *HttpImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= h.size {
+		return 0, io.EOF
+	}
+
+	want := p
+	if int64(len(want)) > h.size-off {
+		want = want[:h.size-off]
+	}
+
+	if len(want) == 0 {
+		return 0, nil
+	}
+
+	first := off / h.blockSize
+	last := (off + int64(len(want)) - 1) / h.blockSize
+	blocks, err := h.blocks(first, last)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i, block := range blocks {
+		inner := int64(0)
+		if i == 0 {
+			inner = off % h.blockSize
+		}
+		n += copy(want[n:], block[inner:])
+	}
+
+	if len(want) < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *HttpImage) Size() int64 {
+	return h.size
+}
+
+// Requests returns the number of HTTP requests made so far.
+func (h *HttpImage) Requests() uint64 {
+	return atomic.LoadUint64(&h.requests)
+}
+
+// CacheStats reports how well the block cache has been doing.
+func (h *HttpImage) CacheStats() CacheStats {
+	return h.cache.snapshot()
+}
+
+// name is the URL without its password.
+func (h *HttpImage) name() string {
+	if u, err := url.Parse(h.URL); err == nil {
+		return u.Redacted()
+	}
+	return h.URL
+}
+
+func (h *HttpImage) String() string {
+	return fmt.Sprintf("HTTP image %s, %d bytes", h.name(), h.size)
+}
+
+func (h *HttpImage) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,222 @@
+package ext2fs
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// httpTestServer serves an image with Range support, recording the ranges
+// asked.
+type httpTestServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	data    []byte
+	etag    string
+	ranges  []string
+	release chan struct{}
+}
+
+func newHttpTestServer(t *testing.T, data []byte) *httpTestServer {
+	s := &httpTestServer{data: data, etag: `"1"`}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *httpTestServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	data, etag, release := s.data, s.etag, s.release
+	s.mu.Unlock()
+
+	//The first byte request of OpenHttpImage is never held back
+	if release != nil && r.Header.Get("Range") != "bytes=0-0" {
+		<-release
+	}
+
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "image", time.Time{}, bytes.NewReader(data))
+}
+
+// asked returns the ranges asked since the last call.
+func (s *httpTestServer) asked() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ranges := s.ranges
+	s.ranges = nil
+	return ranges
+}
+
+// httpTestData returns size random bytes.
+func httpTestData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(3)).Read(data)
+	return data
+}
+
+func openHttpTestImage(t *testing.T, s *httpTestServer) *HttpImage {
+	t.Helper()
+
+	h, err := OpenHttpImage(s.URL + "/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	if ranges := s.asked(); len(ranges) != 1 || ranges[0] != "bytes=0-0" {
+		t.Fatalf("opening asked %q", ranges)
+	}
+	return h
+}
+
+func TestHttpImageRead(t *testing.T) {
+	//The last block is partial
+	data := httpTestData(40*HTTP_BLOCK_SIZE + 1234)
+	s := newHttpTestServer(t, data)
+	h := openHttpTestImage(t, s)
+
+	checkRandomReads(t, h, data)
+}
+
+func TestHttpImageCoalesce(t *testing.T) {
+	data := httpTestData(200 * HTTP_BLOCK_SIZE)
+	s := newHttpTestServer(t, data)
+	h := openHttpTestImage(t, s)
+
+	read := func(firstBlock, lastBlock int64, want ...string) {
+		t.Helper()
+
+		off := firstBlock*HTTP_BLOCK_SIZE + 100
+		buf := make([]byte, (lastBlock-firstBlock+1)*HTTP_BLOCK_SIZE-200)
+		if _, err := h.ReadAt(buf, off); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data[off:off+int64(len(buf))]) {
+			t.Fatalf("blocks %d-%d returned other bytes", firstBlock, lastBlock)
+		}
+
+		ranges := s.asked()
+		if strings.Join(ranges, " ") != strings.Join(want, " ") {
+			t.Fatalf("reading blocks %d-%d asked %q, want %q", firstBlock, lastBlock, ranges, want)
+		}
+	}
+
+	byteRange := func(firstBlock, lastBlock int64) string {
+		return fmt.Sprintf("bytes=%d-%d", firstBlock*HTTP_BLOCK_SIZE, (lastBlock+1)*HTTP_BLOCK_SIZE-1)
+	}
+
+	//One request for adjacent blocks, none for cached blocks
+	read(0, 9, byteRange(0, 9))
+	read(0, 9)
+	read(5, 14, byteRange(10, 14))
+
+	//The missing blocks around a cached one take a request each
+	read(20, 20, byteRange(20, 20))
+	read(18, 22, byteRange(18, 19), byteRange(21, 22))
+
+	//Long runs are split in requests of at most httpMaxRequestBlocks blocks
+	read(30, 30+httpMaxRequestBlocks+9, byteRange(30, 30+httpMaxRequestBlocks-1), byteRange(30+httpMaxRequestBlocks, 30+httpMaxRequestBlocks+9))
+
+	//The first byte request of OpenHttpImage counts too
+	if h.Requests() != 8 {
+		t.Fatalf("%d requests, want 8", h.Requests())
+	}
+}
+
+func TestHttpImageConcurrentReaders(t *testing.T) {
+	data := httpTestData(4 * HTTP_BLOCK_SIZE)
+	s := newHttpTestServer(t, data)
+	h := openHttpTestImage(t, s)
+
+	//The server holds the block back until every reader had time to ask it
+	s.mu.Lock()
+	s.release = make(chan struct{})
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			off := int64(HTTP_BLOCK_SIZE + 1000*i)
+			buf := make([]byte, 500)
+			if _, err := h.ReadAt(buf, off); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(buf, data[off:off+500]) {
+				t.Errorf("reader %d got other bytes", i)
+			}
+		}(i)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(s.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if ranges := s.asked(); len(ranges) != 1 {
+		t.Fatalf("the block was asked %d times: %q", len(ranges), ranges)
+	}
+}
+
+func TestHttpImageNoRanges(t *testing.T) {
+	data := httpTestData(HTTP_BLOCK_SIZE)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	_, err := OpenHttpImage(server.URL)
+	if err == nil || !strings.Contains(err.Error(), "doesn't support range requests") {
+		t.Fatalf("a server ignoring Range gave %v", err)
+	}
+}
+
+func TestHttpImageChanged(t *testing.T) {
+	data := httpTestData(4 * HTTP_BLOCK_SIZE)
+	s := newHttpTestServer(t, data)
+	h := openHttpTestImage(t, s)
+
+	s.mu.Lock()
+	s.data = httpTestData(5 * HTTP_BLOCK_SIZE)
+	s.etag = `"2"`
+	s.mu.Unlock()
+
+	_, err := h.ReadAt(make([]byte, 10), HTTP_BLOCK_SIZE)
+	if err == nil || !strings.Contains(err.Error(), "image changed on the server") {
+		t.Fatalf("reading a changed image gave %v", err)
+	}
+}
+
+func TestNewDeviceHttp(t *testing.T) {
+	disk := readTestData(t, "ext2-1k.img.gz")
+	s := newHttpTestServer(t, disk)
+
+	device, err := NewDevice(s.URL + "/disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if !device.ReadOnly() {
+		t.Fatal("HTTP Device is writable")
+	}
+	if device.Size() != int64(len(disk)) {
+		t.Fatalf("size %d, want %d", device.Size(), len(disk))
+	}
+}
@@ -0,0 +1,108 @@
+package ext2fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// memImage is a writable storage held in memory.
+type memImage []byte
+
+func (m memImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m memImage) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(m)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(m[off:], p), nil
+}
+
+// readTestData returns the contents of a file of testdata, gunzipped when
+// its name ends in .gz.
+func readTestData(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Ext(name) != ".gz" {
+		return data
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// openTestImage opens a writable Device on an in-memory copy of a testdata
+// image.
+func openTestImage(t *testing.T, name string) (*Device, memImage) {
+	t.Helper()
+
+	image := memImage(readTestData(t, name))
+	device, err := NewDeviceFromReaderAt(image, int64(len(image)), DeviceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device, image
+}
+
+// sizedReaderAt is storage that knows its size.
+type sizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// checkRandomReads compares random reads of r with data.
+func checkRandomReads(t *testing.T, r sizedReaderAt, data []byte) {
+	t.Helper()
+
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("size %d, want %d", r.Size(), len(data))
+	}
+
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		off := rng.Int63n(int64(len(data)))
+		buf := make([]byte, rng.Intn(100000)+1)
+
+		n, err := r.ReadAt(buf, off)
+		want := data[off:]
+		if len(want) > len(buf) {
+			want = want[:len(buf)]
+		}
+
+		if n != len(want) || (err != nil && err != io.EOF) || (n < len(buf) && err != io.EOF) {
+			t.Fatalf("ReadAt(%d bytes at %d) = %d, %v", len(buf), off, n, err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("ReadAt(%d bytes at %d) returned other bytes", len(buf), off)
+		}
+	}
+
+	if _, err := r.ReadAt(make([]byte, 1), int64(len(data))); err != io.EOF {
+		t.Fatalf("read past the end: %v", err)
+	}
+}
@@ -0,0 +1,486 @@
+package ext2fs
+
+import (
+	"errors"
+	"io"
+)
+
+// A DEFLATE decoder that, unlike compress/flate, reports the bit position of
+// every block boundary and can resume decoding from such a position given
+// the preceding window. This is what random access into gzip images needs.
+
+const (
+	inflateWindowSize = 32 * 1024
+	inflateMaxBits    = 15
+	bitReaderBuffer   = 64 * 1024
+)
+
+var errInflate = errors.New("Corrupt deflate stream")
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	codeOrder   = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// bitReader reads an LSB-first bit stream from any bit position of r.
+type bitReader struct {
+	r      io.ReaderAt
+	off    int64
+	buf    []byte
+	bufPos int
+	bufLen int
+	bits   uint64
+	nbits  uint
+	eof    bool
+	err    error
+}
+
+func newBitReader(r io.ReaderAt, bitPos int64) (*bitReader, error) {
+	br := &bitReader{r: r, off: bitPos / 8, buf: make([]byte, bitReaderBuffer)}
+	if skip := uint(bitPos % 8); skip > 0 {
+		if _, err := br.getBits(skip); err != nil {
+			return nil, err
+		}
+	}
+	return br, nil
+}
+
+func (br *bitReader) fill() {
+	for br.nbits <= 56 {
+		if br.bufPos == br.bufLen {
+			if br.eof {
+				return
+			}
+
+			n, err := br.r.ReadAt(br.buf, br.off)
+			br.off += int64(n)
+			br.bufPos = 0
+			br.bufLen = n
+			if err != nil {
+				br.eof = true
+				if err != io.EOF {
+					br.err = err
+				}
+			}
+
+			if n == 0 {
+				return
+			}
+		}
+
+		br.bits |= uint64(br.buf[br.bufPos]) << br.nbits
+		br.bufPos++
+		br.nbits += 8
+	}
+}
+
+// bitPos returns the absolute position of the next unread bit.
+func (br *bitReader) bitPos() int64 {
+	return (br.off-int64(br.bufLen-br.bufPos))*8 - int64(br.nbits)
+}
+
+func (br *bitReader) failure() error {
+	if br.err != nil {
+		return br.err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+func (br *bitReader) getBits(n uint) (uint32, error) {
+	if n == 0 {
+		return 0, nil
+	}
+
+	if br.nbits < n {
+		br.fill()
+		if br.nbits < n {
+			return 0, br.failure()
+		}
+	}
+
+	value := uint32(br.bits & (1<<n - 1))
+	br.bits >>= n
+	br.nbits -= n
+	return value, nil
+}
+
+func (br *bitReader) alignByte() {
+	drop := br.nbits % 8
+	br.bits >>= drop
+	br.nbits -= drop
+}
+
+// more reports whether any input is left after the current bit.
+func (br *bitReader) more() bool {
+	br.fill()
+	return br.nbits > 0
+}
+
+// huffman is a canonical Huffman code decoded with a single lookup table
+// indexed by the next maxLen bits. Entries hold symbol<<4 | length.
+type huffman struct {
+	table  []uint16
+	maxLen uint
+}
+
+func newHuffman(lengths []uint8) (*huffman, error) {
+	var count [inflateMaxBits + 1]int
+	maxLen := uint(0)
+	for _, length := range lengths {
+		count[length]++
+		if uint(length) > maxLen {
+			maxLen = uint(length)
+		}
+	}
+
+	if maxLen == 0 {
+		return &huffman{table: make([]uint16, 1)}, nil
+	}
+
+	var next [inflateMaxBits + 2]int
+	left := 1
+	for length := 1; length <= inflateMaxBits; length++ {
+		left <<= 1
+		left -= count[length]
+		if left < 0 {
+			return nil, errInflate
+		}
+		next[length+1] = (next[length] + count[length]) << 1
+	}
+
+	h := &huffman{table: make([]uint16, 1<<maxLen), maxLen: maxLen}
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+
+		code := next[length]
+		next[length]++
+
+		reversed := 0
+		for i := uint8(0); i < length; i++ {
+			reversed = reversed<<1 | (code>>i)&1
+		}
+
+		for i := reversed; i < len(h.table); i += 1 << length {
+			h.table[i] = uint16(symbol)<<4 | uint16(length)
+		}
+	}
+
+	return h, nil
+}
+
+func (br *bitReader) decode(h *huffman) (int, error) {
+	if br.nbits < h.maxLen {
+		br.fill()
+	}
+
+	entry := h.table[br.bits&(1<<h.maxLen-1)]
+	length := uint(entry & 0xF)
+	if length == 0 {
+		return 0, errInflate
+	}
+
+	if length > br.nbits {
+		return 0, br.failure()
+	}
+
+	br.bits >>= length
+	br.nbits -= length
+	return int(entry >> 4), nil
+}
+
+var fixedLit, fixedDist *huffman
+
+func init() {
+	lengths := make([]uint8, 288)
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLit, _ = newHuffman(lengths)
+
+	dists := make([]uint8, 30)
+	for i := range dists {
+		dists[i] = 5
+	}
+	fixedDist, _ = newHuffman(dists)
+}
+
+const (
+	inflateBlockStart = iota
+	inflateStored
+	inflateHuffman
+	inflateDone
+)
+
+// inflater decodes one raw DEFLATE stream. When onBlock is set it is called
+// at every block boundary, before the block header is read.
+type inflater struct {
+	br         *bitReader
+	window     []byte
+	wpos       int
+	out        int64
+	state      int
+	final      bool
+	storedLeft int
+	lit        *huffman
+	dist       *huffman
+	copyLen    int
+	copyDist   int
+	onBlock    func(bitPos int64, out int64)
+}
+
+// newInflater starts decoding at a block boundary with the given window of
+// preceding output, out being the position of the next output byte.
+func newInflater(br *bitReader, window []byte, out int64) *inflater {
+	f := &inflater{br: br, window: make([]byte, inflateWindowSize), out: out}
+	f.wpos = copy(f.window, window) % inflateWindowSize
+	return f
+}
+
+// lastWindow returns up to 32KiB of the most recent output.
+func (f *inflater) lastWindow(available int64) []byte {
+	size := int64(inflateWindowSize)
+	if available < size {
+		size = available
+	}
+
+	window := make([]byte, size)
+	start := (f.wpos - int(size) + inflateWindowSize) % inflateWindowSize
+	n := copy(window, f.window[start:])
+	copy(window[n:], f.window[:size-int64(n)])
+	return window
+}
+
+func (f *inflater) emit(p []byte, n int, b byte) {
+	p[n] = b
+	f.window[f.wpos] = b
+	f.wpos = (f.wpos + 1) % inflateWindowSize
+	f.out++
+}
+
+// Read returns io.EOF once the final block has been decoded.
+func (f *inflater) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if f.copyLen > 0 {
+			from := (f.wpos - f.copyDist + inflateWindowSize) % inflateWindowSize
+			for f.copyLen > 0 && n < len(p) {
+				f.emit(p, n, f.window[from])
+				from = (from + 1) % inflateWindowSize
+				n++
+				f.copyLen--
+			}
+			continue
+		}
+
+		switch f.state {
+		case inflateDone:
+			return n, io.EOF
+		case inflateBlockStart:
+			if f.final {
+				f.state = inflateDone
+				continue
+			}
+			if err := f.blockHeader(); err != nil {
+				return n, err
+			}
+		case inflateStored:
+			if f.storedLeft == 0 {
+				f.state = inflateBlockStart
+				continue
+			}
+			b, err := f.br.getBits(8)
+			if err != nil {
+				return n, err
+			}
+			f.emit(p, n, byte(b))
+			n++
+			f.storedLeft--
+		case inflateHuffman:
+			if err := f.symbol(p, &n); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (f *inflater) blockHeader() error {
+	if f.onBlock != nil {
+		f.onBlock(f.br.bitPos(), f.out)
+	}
+
+	header, err := f.br.getBits(3)
+	if err != nil {
+		return err
+	}
+
+	f.final = header&1 != 0
+	switch header >> 1 {
+	case 0:
+		f.br.alignByte()
+		length, err := f.br.getBits(16)
+		if err != nil {
+			return err
+		}
+		nlength, err := f.br.getBits(16)
+		if err != nil {
+			return err
+		}
+		if length != ^nlength&0xFFFF {
+			return errInflate
+		}
+		f.storedLeft = int(length)
+		f.state = inflateStored
+	case 1:
+		f.lit, f.dist = fixedLit, fixedDist
+		f.state = inflateHuffman
+	case 2:
+		if err := f.dynamicTables(); err != nil {
+			return err
+		}
+		f.state = inflateHuffman
+	default:
+		return errInflate
+	}
+	return nil
+}
+
+func (f *inflater) dynamicTables() error {
+	counts, err := f.br.getBits(14)
+	if err != nil {
+		return err
+	}
+
+	nlen := int(counts&0x1F) + 257
+	ndist := int(counts>>5&0x1F) + 1
+	ncode := int(counts>>10) + 4
+	if nlen > 286 || ndist > 30 {
+		return errInflate
+	}
+
+	codeLengths := make([]uint8, 19)
+	for i := 0; i < ncode; i++ {
+		length, err := f.br.getBits(3)
+		if err != nil {
+			return err
+		}
+		codeLengths[codeOrder[i]] = uint8(length)
+	}
+
+	code, err := newHuffman(codeLengths)
+	if err != nil {
+		return err
+	}
+
+	lengths := make([]uint8, nlen+ndist)
+	for i := 0; i < len(lengths); {
+		symbol, err := f.br.decode(code)
+		if err != nil {
+			return err
+		}
+
+		if symbol < 16 {
+			lengths[i] = uint8(symbol)
+			i++
+			continue
+		}
+
+		var repeat uint32
+		var value uint8
+		switch symbol {
+		case 16:
+			if i == 0 {
+				return errInflate
+			}
+			value = lengths[i-1]
+			repeat, err = f.br.getBits(2)
+			repeat += 3
+		case 17:
+			repeat, err = f.br.getBits(3)
+			repeat += 3
+		default:
+			repeat, err = f.br.getBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		}
+
+		if i+int(repeat) > len(lengths) {
+			return errInflate
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+
+	if lengths[256] == 0 {
+		return errInflate
+	}
+
+	if f.lit, err = newHuffman(lengths[:nlen]); err != nil {
+		return err
+	}
+	f.dist, err = newHuffman(lengths[nlen:])
+	return err
+}
+
+func (f *inflater) symbol(p []byte, n *int) error {
+	symbol, err := f.br.decode(f.lit)
+	if err != nil {
+		return err
+	}
+
+	if symbol < 256 {
+		f.emit(p, *n, byte(symbol))
+		*n++
+		return nil
+	}
+
+	if symbol == 256 {
+		f.state = inflateBlockStart
+		return nil
+	}
+
+	symbol -= 257
+	if symbol >= len(lengthBase) {
+		return errInflate
+	}
+
+	extra, err := f.br.getBits(uint(lengthExtra[symbol]))
+	if err != nil {
+		return err
+	}
+	f.copyLen = int(lengthBase[symbol]) + int(extra)
+
+	symbol, err = f.br.decode(f.dist)
+	if err != nil {
+		return err
+	}
+	if symbol >= len(distBase) {
+		return errInflate
+	}
+
+	extra, err = f.br.getBits(uint(distExtra[symbol]))
+	if err != nil {
+		return err
+	}
+	f.copyDist = int(distBase[symbol]) + int(extra)
+
+	return nil
+}
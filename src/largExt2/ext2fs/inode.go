@@ -104,6 +104,15 @@ func (i *Inode) Masix2() *masix2 {
 	return masix2
 }
 
+// Size64 returns the size of the inode in bytes. Regular files of large_file
+// filesystems keep the high 32 bits of their size in DirACL.
+func (i *Inode) Size64() uint64 {
+	if i.Mode&S_IFMT == S_IFREG {
+		return uint64(i.DirACL)<<32 | uint64(i.Size)
+	}
+	return uint64(i.Size)
+}
+
 func (d *Device) NewInode(inodeNo uint32) (*Inode, error) {
 	if inodeNo < 1 || inodeNo > d.InodesCount {
 		return nil, errors.New(fmt.Sprintf("Inode %d out of bounds", inodeNo))
@@ -120,12 +129,8 @@ func (d *Device) NewInode(inodeNo uint32) (*Inode, error) {
 		return nil, errors.New(fmt.Sprintf("Inode table index %d out of bounds", inodeIndex))
 	}
 
-	if _, err := d.seek(d.inodeOffset(group.InodeTable, inodeIndex)); err != nil {
-		return nil, err
-	}
-
 	inode := &Inode{}
-	if err := binary.Read(d.file, binary.LittleEndian, inode); err != nil {
+	if err := d.decodeMeta(inode, d.inodeOffset(group.InodeTable64(), inodeIndex)); err != nil {
 		return nil, err
 	}
 
@@ -180,6 +185,13 @@ func (d *Device) InodeFromPath(p string) (uint32, error) {
 }
 
 func (d *Device) CreateDirInode(parent, inodeNo uint32) (*Inode, error) {
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
 	groupNo := (inodeNo - 1) / d.InodesPerGroup
 
 	group, err := d.NewGroupDescriptor(groupNo)
@@ -196,15 +208,11 @@ func (d *Device) CreateDirInode(parent, inodeNo uint32) (*Inode, error) {
 		Blocks:     2,
 	}
 
-	block, err := d.AllocBlock(groupNo)
-	inode.Block[0] = block
+	block, err := d.allocBlockLocked(groupNo)
+	inode.Block[0] = uint32(block)
 
 	//Write Inode
-	if _, err := d.seek(d.inodeOffset(group.InodeTable, (inodeNo-1)%d.InodesPerGroup)); err != nil {
-		return nil, err
-	}
-
-	if err := binary.Write(d.file, binary.LittleEndian, inode); err != nil {
+	if err := d.encodeAt(inode, d.inodeOffset(group.InodeTable64(), (inodeNo-1)%d.InodesPerGroup)); err != nil {
 		return nil, err
 	}
 
@@ -213,7 +221,9 @@ func (d *Device) CreateDirInode(parent, inodeNo uint32) (*Inode, error) {
 		binary.LittleEndian.PutUint32(data[:4], entry.Inode)
 		binary.LittleEndian.PutUint16(data[4:6], entry.RecLen)
 		data[6] = byte(entry.NameLen)
-		data[7] = byte(entry.FileType)
+		if d.fileType {
+			data[7] = byte(entry.FileType)
+		}
 		copy(data[8:8+entry.NameLen], entry.Name[:entry.NameLen])
 
 		return data
@@ -229,11 +239,11 @@ func (d *Device) CreateDirInode(parent, inodeNo uint32) (*Inode, error) {
 
 	copy(inodeEntry.Name[:inodeEntry.NameLen], []byte("."))
 
-	if _, err = d.file.WriteAt(encode(inodeEntry), d.blockOffset(block)); err != nil {
+	if _, err = d.writeAt(encode(inodeEntry), d.blockOffset(block)); err != nil {
 		return nil, err
 	}
 
-	if err := d.file.Sync(); err != nil {
+	if err := d.Sync(); err != nil {
 		return nil, err
 	}
 
@@ -246,14 +256,21 @@ func (d *Device) CreateDirInode(parent, inodeNo uint32) (*Inode, error) {
 
 	copy(parentEntry.Name[:parentEntry.NameLen], []byte(".."))
 
-	if _, err = d.file.WriteAt(encode(parentEntry), d.blockOffset(block)+int64(inodeEntry.RecLen)); err != nil {
+	if _, err = d.writeAt(encode(parentEntry), d.blockOffset(block)+int64(inodeEntry.RecLen)); err != nil {
 		return nil, err
 	}
 
-	return inode, d.file.Sync()
+	return inode, d.Sync()
 }
 
 func (d *Device) CreateFileInode(inodeNo uint32) (*Inode, error) {
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
 	groupNo := (inodeNo - 1) / d.InodesPerGroup
 
 	group, err := d.NewGroupDescriptor(groupNo)
@@ -270,21 +287,24 @@ func (d *Device) CreateFileInode(inodeNo uint32) (*Inode, error) {
 		Blocks:     0,
 	}
 
-	block, err := d.AllocBlock(groupNo)
-	inode.Block[0] = block
-
-	if _, err := d.seek(d.inodeOffset(group.InodeTable, (inodeNo-1)%d.InodesPerGroup)); err != nil {
-		return nil, err
-	}
+	block, err := d.allocBlockLocked(groupNo)
+	inode.Block[0] = uint32(block)
 
-	if err := binary.Write(d.file, binary.LittleEndian, inode); err != nil {
+	if err := d.encodeAt(inode, d.inodeOffset(group.InodeTable64(), (inodeNo-1)%d.InodesPerGroup)); err != nil {
 		return nil, err
 	}
 
-	return inode, d.file.Sync()
+	return inode, d.Sync()
 }
 
 func (d *Device) UpdateInode(inodeNo uint32, value interface{}, offset int64) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
 	groupNo := (inodeNo - 1) / d.InodesPerGroup
 	inodeIdx := (inodeNo - 1) % d.InodesPerGroup
 
@@ -293,11 +313,7 @@ func (d *Device) UpdateInode(inodeNo uint32, value interface{}, offset int64) er
 		return err
 	}
 
-	if _, err := d.seek(d.inodeOffset(group.InodeTable, inodeIdx) + offset); err != nil {
-		return err
-	}
-
-	if err := binary.Write(d.file, binary.LittleEndian, value); err != nil {
+	if err := d.encodeAt(value, d.inodeOffset(group.InodeTable64(), inodeIdx)+offset); err != nil {
 		return err
 	}
 
@@ -0,0 +1,44 @@
+package ext2fs
+
+import (
+	"io"
+	"testing"
+)
+
+func TestInodeSize64(t *testing.T) {
+	device, _ := openTestImage(t, "ext2-1k.img.gz")
+
+	inodeNo, err := device.InodeFromPath("hello")
+	if err != nil || inodeNo == EXT2_NULL_INO {
+		t.Fatalf("hello is inode %d, %v", inodeNo, err)
+	}
+	inode, err := device.NewInode(inodeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inode.Size64() != 6 {
+		t.Fatalf("hello is %d bytes", inode.Size64())
+	}
+
+	//A size of 1<<32 bytes only fits with its high half in DirACL
+	inode.Size, inode.DirACL = 0, 1
+	if inode.Size64() != 1<<32 {
+		t.Fatalf("large file is %d bytes", inode.Size64())
+	}
+
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(NewInodeReader(device, inode), buf); err != nil || string(buf) != "hello\n" {
+		t.Fatalf("read %q from the large file, %v", buf, err)
+	}
+
+	//Only regular files have the high half, DirACL is something else for
+	//directories
+	root, err := device.NewInode(EXT2_ROOT_INO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.DirACL = 1
+	if root.Size64() != uint64(root.Size) {
+		t.Fatalf("directory is %d bytes", root.Size64())
+	}
+}
@@ -0,0 +1,756 @@
+package ext2fs
+
+import (
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	LUKS_MAGIC             = "LUKS\xba\xbe"
+	LUKS2_SECONDARY_MAGIC  = "SKUL\xba\xbe"
+	LUKS_KEY_ENABLED       = 0x00AC71F3
+	LUKS_SECTOR_SIZE       = 512
+	luks1HeaderSize        = 592
+	luks2BinaryHeaderSize  = 4096
+	luks2MaxHeaderSize     = 4 * 1024 * 1024
+	luksMaxStripes         = 65536
+	luksMaxArgon2Memory    = 4 * 1024 * 1024
+	luksMaxArgon2Threads   = 16
+	luks2ChecksumAlgorithm = "sha256"
+)
+
+// luks2SecondaryOffsets are the places of the second LUKS2 header copy, used
+// when the first one is unreadable.
+var luks2SecondaryOffsets = []int64{0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
+
+type luks1KeySlot struct {
+	Active            uint32
+	Iterations        uint32
+	Salt              [32]byte
+	KeyMaterialOffset uint32
+	Stripes           uint32
+}
+
+type luks1Header struct {
+	Magic              [6]byte
+	Version            uint16
+	CipherName         [32]byte
+	CipherMode         [32]byte
+	HashSpec           [32]byte
+	PayloadOffset      uint32
+	KeyBytes           uint32
+	MkDigest           [20]byte
+	MkDigestSalt       [32]byte
+	MkDigestIterations uint32
+	UUID               [40]byte
+	KeySlots           [8]luks1KeySlot
+}
+
+type luks2BinaryHeader struct {
+	Magic       [6]byte
+	Version     uint16
+	HdrSize     uint64
+	SeqID       uint64
+	Label       [48]byte
+	ChecksumAlg [32]byte
+	Salt        [64]byte
+	UUID        [40]byte
+	Subsystem   [48]byte
+	HdrOffset   uint64
+	Padding     [184]byte
+	Csum        [64]byte
+}
+
+// luksKeySlot is how a keyslot derives the key of its area, and how the
+// volume key is split in the area.
+type luksKeySlot struct {
+	name       string
+	kdf        string
+	hash       string
+	iterations int
+	memory     int
+	threads    int
+	salt       []byte
+	areaOffset int64
+	areaCipher string
+	areaKey    int
+	stripes    int
+	afHash     string
+}
+
+// luksDigest checks a candidate volume key.
+type luksDigest struct {
+	hash       string
+	iterations int
+	salt       []byte
+	digest     []byte
+}
+
+// LuksHeader is a LUKS1 or LUKS2 header, describing the encrypted payload and
+// the keyslots that unlock it.
+type LuksHeader struct {
+	Version    int
+	UUID       string
+	Label      string
+	Cipher     string
+	KeySize    int
+	Offset     int64
+	Size       int64
+	SectorSize int64
+	IvTweak    int64
+	keySlots   []luksKeySlot
+	digest     luksDigest
+}
+
+// LuksVolume decrypts the payload of an unlocked LUKS device, read-only.
+type LuksVolume struct {
+	Header *LuksHeader
+	r      io.ReaderAt
+	cipher *xtsCipher
+	plain  bool
+	size   int64
+}
+
+// luksNumber is a JSON number that LUKS2 may also store as a string.
+type luksNumber int64
+
+func (n *luksNumber) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), "\""), 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Bad LUKS2 number %s", string(data)))
+	}
+	*n = luksNumber(value)
+	return nil
+}
+
+type luks2Metadata struct {
+	KeySlots map[string]struct {
+		Type    string     `json:"type"`
+		KeySize luksNumber `json:"key_size"`
+		AF      struct {
+			Type    string     `json:"type"`
+			Stripes luksNumber `json:"stripes"`
+			Hash    string     `json:"hash"`
+		} `json:"af"`
+		Area struct {
+			Type       string     `json:"type"`
+			Offset     luksNumber `json:"offset"`
+			Encryption string     `json:"encryption"`
+			KeySize    luksNumber `json:"key_size"`
+		} `json:"area"`
+		KDF struct {
+			Type       string     `json:"type"`
+			Hash       string     `json:"hash"`
+			Iterations luksNumber `json:"iterations"`
+			Time       luksNumber `json:"time"`
+			Memory     luksNumber `json:"memory"`
+			CPUs       luksNumber `json:"cpus"`
+			Salt       string     `json:"salt"`
+		} `json:"kdf"`
+	} `json:"keyslots"`
+	Segments map[string]struct {
+		Type       string     `json:"type"`
+		Offset     luksNumber `json:"offset"`
+		Size       string     `json:"size"`
+		IvTweak    luksNumber `json:"iv_tweak"`
+		Encryption string     `json:"encryption"`
+		SectorSize luksNumber `json:"sector_size"`
+	} `json:"segments"`
+	Digests map[string]struct {
+		Type       string     `json:"type"`
+		KeySlots   []string   `json:"keyslots"`
+		Segments   []string   `json:"segments"`
+		Hash       string     `json:"hash"`
+		Iterations luksNumber `json:"iterations"`
+		Salt       string     `json:"salt"`
+		Digest     string     `json:"digest"`
+	} `json:"digests"`
+}
+
+// IsLuks reports whether r starts with a LUKS header.
+func IsLuks(r io.ReaderAt) bool {
+	magic := make([]byte, len(LUKS_MAGIC))
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return string(magic) == LUKS_MAGIC
+}
+
+// ReadLuksHeader reads the LUKS header at the start of r. Of the two LUKS2
+// header copies, the valid one with the highest sequence number is used.
+func ReadLuksHeader(r io.ReaderAt) (*LuksHeader, error) {
+	buf := make([]byte, 8)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+
+	if string(buf[:len(LUKS_MAGIC)]) != LUKS_MAGIC {
+		return nil, errors.New("Not a LUKS device")
+	}
+
+	switch version := binary.BigEndian.Uint16(buf[6:]); version {
+	case 1:
+		return readLuks1Header(r)
+	case 2:
+		return readLuks2Header(r)
+	default:
+		return nil, errors.New(fmt.Sprintf("LUKS version %d is not supported", version))
+	}
+}
+
+func readLuks1Header(r io.ReaderAt) (*LuksHeader, error) {
+	buf := make([]byte, luks1HeaderSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+
+	header := luks1Header{}
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, &header)
+
+	h := &LuksHeader{
+		Version:    1,
+		UUID:       cString(header.UUID[:]),
+		Cipher:     cString(header.CipherName[:]) + "-" + cString(header.CipherMode[:]),
+		KeySize:    int(header.KeyBytes),
+		Offset:     int64(header.PayloadOffset) * LUKS_SECTOR_SIZE,
+		SectorSize: LUKS_SECTOR_SIZE,
+		digest: luksDigest{
+			hash:       cString(header.HashSpec[:]),
+			iterations: int(header.MkDigestIterations),
+			salt:       header.MkDigestSalt[:],
+			digest:     header.MkDigest[:],
+		},
+	}
+
+	for i, slot := range header.KeySlots {
+		if slot.Active != LUKS_KEY_ENABLED {
+			continue
+		}
+		h.keySlots = append(h.keySlots, luksKeySlot{
+			name:       strconv.Itoa(i),
+			kdf:        "pbkdf2",
+			hash:       h.digest.hash,
+			iterations: int(slot.Iterations),
+			salt:       append([]byte{}, slot.Salt[:]...),
+			areaOffset: int64(slot.KeyMaterialOffset) * LUKS_SECTOR_SIZE,
+			areaCipher: h.Cipher,
+			areaKey:    h.KeySize,
+			stripes:    int(slot.Stripes),
+			afHash:     h.digest.hash,
+		})
+	}
+
+	return h, nil
+}
+
+func readLuks2Header(r io.ReaderAt) (*LuksHeader, error) {
+	primary, primaryErr := readLuks2BinaryHeader(r, 0)
+
+	var secondary *luks2BinaryHeader
+	var secondaryErr error
+	offsets := luks2SecondaryOffsets
+	if primary != nil {
+		offsets = []int64{int64(primary.HdrSize)}
+	}
+	for _, off := range offsets {
+		if secondary, secondaryErr = readLuks2BinaryHeader(r, off); secondary != nil {
+			break
+		}
+	}
+
+	header := primary
+	if header == nil || (secondary != nil && secondary.SeqID > primary.SeqID) {
+		header = secondary
+	}
+
+	if header == nil {
+		if primaryErr != nil {
+			return nil, primaryErr
+		}
+		return nil, secondaryErr
+	}
+
+	metadata := make([]byte, header.HdrSize-luks2BinaryHeaderSize)
+	if _, err := r.ReadAt(metadata, int64(header.HdrOffset)+luks2BinaryHeaderSize); err != nil {
+		return nil, err
+	}
+
+	h, err := parseLuks2Metadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	h.UUID = cString(header.UUID[:])
+	h.Label = cString(header.Label[:])
+	return h, nil
+}
+
+// readLuks2BinaryHeader reads the header copy at off and checks its checksum
+// over the binary header and the JSON area.
+func readLuks2BinaryHeader(r io.ReaderAt, off int64) (*luks2BinaryHeader, error) {
+	buf := make([]byte, luks2BinaryHeaderSize)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+
+	header := &luks2BinaryHeader{}
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, header)
+
+	magic := LUKS_MAGIC
+	if off != 0 {
+		magic = LUKS2_SECONDARY_MAGIC
+	}
+
+	if string(header.Magic[:]) != magic || header.Version != 2 || int64(header.HdrOffset) != off {
+		return nil, errors.New(fmt.Sprintf("No LUKS2 header at %d", off))
+	}
+
+	if header.HdrSize <= luks2BinaryHeaderSize || header.HdrSize > luks2MaxHeaderSize {
+		return nil, errors.New(fmt.Sprintf("Bad LUKS2 header size %d at %d", header.HdrSize, off))
+	}
+
+	if alg := cString(header.ChecksumAlg[:]); alg != luks2ChecksumAlgorithm {
+		return nil, errors.New(fmt.Sprintf("LUKS2 header checksum %s is not supported", alg))
+	}
+
+	area := make([]byte, header.HdrSize)
+	if _, err := r.ReadAt(area, off); err != nil {
+		return nil, err
+	}
+
+	//The checksum covers the header with the checksum field zeroed
+	csumOffset := 448
+	zero(area[csumOffset : csumOffset+len(header.Csum)])
+	sum := sha256.Sum256(area)
+	if !bytes.Equal(sum[:], header.Csum[:len(sum)]) {
+		return nil, errors.New(fmt.Sprintf("Bad LUKS2 header checksum at %d", off))
+	}
+
+	return header, nil
+}
+
+// parseLuks2Metadata reads the single crypt segment of the JSON metadata, its
+// digest and the keyslots that digest covers.
+func parseLuks2Metadata(text []byte) (*LuksHeader, error) {
+	metadata := luks2Metadata{}
+	if err := json.Unmarshal(bytes.TrimRight(text, "\x00"), &metadata); err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad LUKS2 metadata: %s", err.Error()))
+	}
+
+	if len(metadata.Segments) != 1 {
+		return nil, errors.New(fmt.Sprintf("LUKS2 devices with %d segments are not supported", len(metadata.Segments)))
+	}
+
+	h := &LuksHeader{Version: 2}
+	var segmentName string
+	for name, segment := range metadata.Segments {
+		if segment.Type != "crypt" {
+			return nil, errors.New(fmt.Sprintf("LUKS2 %s segments are not supported", segment.Type))
+		}
+
+		segmentName = name
+		h.Cipher = segment.Encryption
+		h.Offset = int64(segment.Offset)
+		h.IvTweak = int64(segment.IvTweak)
+		h.SectorSize = int64(segment.SectorSize)
+		if segment.Size != "dynamic" {
+			size, err := strconv.ParseInt(segment.Size, 10, 64)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Bad LUKS2 segment size %s", segment.Size))
+			}
+			h.Size = size
+		}
+	}
+
+	if h.SectorSize < LUKS_SECTOR_SIZE || h.SectorSize > 4096 || h.SectorSize&(h.SectorSize-1) != 0 {
+		return nil, errors.New(fmt.Sprintf("Bad LUKS2 sector size %d", h.SectorSize))
+	}
+
+	var slotNames []string
+	for _, digest := range metadata.Digests {
+		if !containsString(digest.Segments, segmentName) {
+			continue
+		}
+
+		if digest.Type != "pbkdf2" {
+			return nil, errors.New(fmt.Sprintf("LUKS2 %s digests are not supported", digest.Type))
+		}
+
+		h.digest.hash = digest.Hash
+		h.digest.iterations = int(digest.Iterations)
+		salt, err := base64.StdEncoding.DecodeString(digest.Salt)
+		if err != nil {
+			return nil, errors.New("Bad LUKS2 digest salt")
+		}
+		value, err := base64.StdEncoding.DecodeString(digest.Digest)
+		if err != nil {
+			return nil, errors.New("Bad LUKS2 digest")
+		}
+		h.digest.salt, h.digest.digest = salt, value
+		slotNames = digest.KeySlots
+	}
+
+	if h.digest.digest == nil {
+		return nil, errors.New("LUKS2 segment has no digest")
+	}
+
+	sort.Strings(slotNames)
+	for _, name := range slotNames {
+		slot, ok := metadata.KeySlots[name]
+		if !ok || slot.Type != "luks2" || slot.Area.Type != "raw" || slot.AF.Type != "luks1" {
+			continue
+		}
+
+		salt, err := base64.StdEncoding.DecodeString(slot.KDF.Salt)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Bad LUKS2 keyslot %s salt", name))
+		}
+
+		//Argon2 counts passes where PBKDF2 counts iterations
+		iterations := slot.KDF.Iterations
+		if slot.KDF.Type != "pbkdf2" {
+			iterations = slot.KDF.Time
+		}
+
+		//The volume key of the segment is the same whatever keyslot holds it
+		if len(h.keySlots) > 0 && int(slot.KeySize) != h.KeySize {
+			return nil, errors.New(fmt.Sprintf("LUKS2 keyslots %s and %s disagree on the key size, %d and %d bytes", h.keySlots[0].name, name, h.KeySize, slot.KeySize))
+		}
+
+		h.KeySize = int(slot.KeySize)
+		h.keySlots = append(h.keySlots, luksKeySlot{
+			name:       name,
+			kdf:        slot.KDF.Type,
+			hash:       slot.KDF.Hash,
+			iterations: int(iterations),
+			memory:     int(slot.KDF.Memory),
+			threads:    int(slot.KDF.CPUs),
+			salt:       salt,
+			areaOffset: int64(slot.Area.Offset),
+			areaCipher: slot.Area.Encryption,
+			areaKey:    int(slot.Area.KeySize),
+			stripes:    int(slot.AF.Stripes),
+			afHash:     slot.AF.Hash,
+		})
+	}
+
+	return h, nil
+}
+
+// luksKeySizeValid reports whether size is the size of an aes-xts key, two
+// AES-128, AES-192 or AES-256 keys.
+func luksKeySizeValid(size int) bool {
+	return size == 32 || size == 48 || size == 64
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// cString returns the text of a zero padded field.
+func cString(field []byte) string {
+	if end := bytes.IndexByte(field, 0); end >= 0 {
+		field = field[:end]
+	}
+	return string(field)
+}
+
+func (h *LuksHeader) KeySlots() int {
+	return len(h.keySlots)
+}
+
+func (h *LuksHeader) String() string {
+	return fmt.Sprintf("LUKS%d %s, %d bit key, %d keyslots, UUID %s", h.Version, h.Cipher, h.KeySize*8, len(h.keySlots), h.UUID)
+}
+
+// Unlock tries the passphrase, or key file contents, on every keyslot and
+// returns the decrypted payload of r, which holds size bytes.
+func (h *LuksHeader) Unlock(r io.ReaderAt, size int64, passphrase []byte) (*LuksVolume, error) {
+	if !luksKeySizeValid(h.KeySize) {
+		return nil, errors.New(fmt.Sprintf("Bad LUKS key size of %d bytes", h.KeySize))
+	}
+
+	if _, _, err := newLuksCipher(h.Cipher, make([]byte, h.KeySize)); err != nil {
+		return nil, err
+	}
+
+	//A keyslot that can't be tried doesn't stop the others from opening
+	var slotErr error
+	for _, slot := range h.keySlots {
+		key, err := h.unlockSlot(r, slot, passphrase)
+		if err != nil {
+			slotErr = err
+			continue
+		}
+		if key != nil {
+			return h.NewVolume(r, size, key)
+		}
+	}
+
+	if slotErr != nil {
+		return nil, errors.New(fmt.Sprintf("No LUKS keyslot matches the passphrase, last error: %s", slotErr.Error()))
+	}
+	return nil, errors.New("No LUKS keyslot matches the passphrase")
+}
+
+// unlockSlot returns the volume key held by a keyslot, or nil when the
+// passphrase doesn't open it.
+func (h *LuksHeader) unlockSlot(r io.ReaderAt, slot luksKeySlot, passphrase []byte) ([]byte, error) {
+	if slot.stripes < 1 || slot.stripes > luksMaxStripes {
+		return nil, errors.New(fmt.Sprintf("Bad LUKS keyslot %s with %d stripes", slot.name, slot.stripes))
+	}
+
+	if !luksKeySizeValid(slot.areaKey) {
+		return nil, errors.New(fmt.Sprintf("Bad LUKS keyslot %s key size of %d bytes", slot.name, slot.areaKey))
+	}
+
+	areaKey, err := slot.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	areaCipher, plain, err := newLuksCipher(slot.areaCipher, areaKey)
+	if err != nil {
+		return nil, err
+	}
+
+	//The split key is stored in whole sectors numbered from the area start
+	length := h.KeySize * slot.stripes
+	sectors := (length + LUKS_SECTOR_SIZE - 1) / LUKS_SECTOR_SIZE
+	material := make([]byte, sectors*LUKS_SECTOR_SIZE)
+	if _, err := r.ReadAt(material, slot.areaOffset); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < sectors; i++ {
+		sector := material[i*LUKS_SECTOR_SIZE : (i+1)*LUKS_SECTOR_SIZE]
+		areaCipher.decrypt(sector, sector, luksIv(uint64(i), plain))
+	}
+
+	newHash, err := luksHash(slot.afHash)
+	if err != nil {
+		return nil, err
+	}
+
+	key := afMerge(material[:length], h.KeySize, slot.stripes, newHash)
+	ok, err := h.digest.check(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (slot luksKeySlot) deriveKey(passphrase []byte) ([]byte, error) {
+	switch slot.kdf {
+	case "pbkdf2":
+		newHash, err := luksHash(slot.hash)
+		if err != nil {
+			return nil, err
+		}
+		return pbkdf2.Key(newHash, string(passphrase), slot.salt, slot.iterations, slot.areaKey)
+	case "argon2i", "argon2id":
+		if slot.memory < 1 || slot.memory > luksMaxArgon2Memory || slot.threads < 1 || slot.threads > luksMaxArgon2Threads || slot.iterations < 1 {
+			return nil, errors.New(fmt.Sprintf("Bad %s parameters in LUKS keyslot %s", slot.kdf, slot.name))
+		}
+
+		mode := argon2id
+		if slot.kdf == "argon2i" {
+			mode = argon2i
+		}
+		return argon2Key(mode, passphrase, slot.salt, nil, nil, uint32(slot.iterations), uint32(slot.memory), uint32(slot.threads), slot.areaKey), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("LUKS keyslot %s uses unsupported %s", slot.name, slot.kdf))
+	}
+}
+
+func (d luksDigest) check(key []byte) (bool, error) {
+	newHash, err := luksHash(d.hash)
+	if err != nil {
+		return false, err
+	}
+
+	digest, err := pbkdf2.Key(newHash, string(key), d.salt, d.iterations, len(d.digest))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(digest, d.digest) == 1, nil
+}
+
+func luksHash(name string) (func() hash.Hash, error) {
+	switch strings.ToLower(name) {
+	case "sha1":
+		return sha1.New, nil
+	case "sha224":
+		return sha256.New224, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha384":
+		return sha512.New384, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("LUKS hash %s is not supported", name))
+	}
+}
+
+// newLuksCipher returns the cipher for an aes-xts-plain64 or aes-xts-plain
+// specification, and whether its IV is truncated to 32 bits.
+func newLuksCipher(spec string, key []byte) (*xtsCipher, bool, error) {
+	var plain bool
+	switch spec {
+	case "aes-xts-plain64":
+	case "aes-xts-plain":
+		plain = true
+	default:
+		return nil, false, errors.New(fmt.Sprintf("LUKS cipher %s is not supported", spec))
+	}
+
+	cipher, err := newXtsCipher(key)
+	return cipher, plain, err
+}
+
+func luksIv(sector uint64, plain bool) uint64 {
+	if plain {
+		return sector & 0xFFFFFFFF
+	}
+	return sector
+}
+
+// afMerge recovers the key that the anti-forensic splitter spread over
+// stripes, each stripe but the last being diffused into the next.
+func afMerge(material []byte, keySize, stripes int, newHash func() hash.Hash) []byte {
+	key := make([]byte, keySize)
+	for i := 0; i < stripes; i++ {
+		stripe := material[i*keySize : (i+1)*keySize]
+		for j := range key {
+			key[j] ^= stripe[j]
+		}
+		if i < stripes-1 {
+			key = afDiffuse(key, newHash)
+		}
+	}
+	return key
+}
+
+func afDiffuse(data []byte, newHash func() hash.Hash) []byte {
+	h := newHash()
+	out := make([]byte, len(data))
+	index := make([]byte, 4)
+
+	for i := 0; i*h.Size() < len(data); i++ {
+		block := data[i*h.Size():]
+		if len(block) > h.Size() {
+			block = block[:h.Size()]
+		}
+
+		h.Reset()
+		binary.BigEndian.PutUint32(index, uint32(i))
+		h.Write(index)
+		h.Write(block)
+		copy(out[i*h.Size():], h.Sum(nil)[:len(block)])
+	}
+	return out
+}
+
+// NewVolume decrypts the payload of r with the volume key.
+func (h *LuksHeader) NewVolume(r io.ReaderAt, size int64, key []byte) (*LuksVolume, error) {
+	cipher, plain, err := newLuksCipher(h.Cipher, key)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeSize := h.Size
+	if volumeSize == 0 {
+		volumeSize = size - h.Offset
+	}
+	volumeSize -= volumeSize % h.SectorSize
+
+	if volumeSize <= 0 || h.Offset+volumeSize > size {
+		return nil, errors.New(fmt.Sprintf("LUKS payload of %d bytes at %d doesn't fit in %d bytes", volumeSize, h.Offset, size))
+	}
+
+	return &LuksVolume{Header: h, r: r, cipher: cipher, plain: plain, size: volumeSize}, nil
+}
+
+// OpenLuksVolume reads the LUKS header of r and unlocks it with passphrase.
+func OpenLuksVolume(r io.ReaderAt, size int64, passphrase []byte) (*LuksVolume, error) {
+	header, err := ReadLuksHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return header.Unlock(r, size, passphrase)
+}
+
+func (v *LuksVolume) Size() int64 {
+	return v.size
+}
+
+func (v *LuksVolume) String() string {
+	return fmt.Sprintf("%s, %d bytes", v.Header.String(), v.size)
+}
+
+func (v *LuksVolume) Close() error {
+	if closer, ok := v.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (v *LuksVolume) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= v.size {
+		return 0, io.EOF
+	}
+
+	want := p
+	if int64(len(want)) > v.size-off {
+		want = want[:v.size-off]
+	}
+
+	//Whole sectors are read and decrypted, then the asked range is copied
+	sectorSize := v.Header.SectorSize
+	start := off - off%sectorSize
+	end := off + int64(len(want))
+	if rest := end % sectorSize; rest != 0 {
+		end += sectorSize - rest
+	}
+
+	buf := make([]byte, end-start)
+	if _, err := v.r.ReadAt(buf, v.Header.Offset+start); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	for pos := int64(0); pos < int64(len(buf)); pos += sectorSize {
+		//The IV counts 512 byte sectors in units of the sector size
+		sector := (uint64(start+pos)/LUKS_SECTOR_SIZE + uint64(v.Header.IvTweak)) / uint64(sectorSize/LUKS_SECTOR_SIZE)
+		v.cipher.decrypt(buf[pos:pos+sectorSize], buf[pos:pos+sectorSize], luksIv(sector, v.plain))
+	}
+
+	n := copy(want, buf[off-start:])
+	if len(want) < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
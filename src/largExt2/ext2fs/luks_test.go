@@ -0,0 +1,378 @@
+package ext2fs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	luksTestKeySize    = 64
+	luksTestStripes    = 4000
+	luksTestIterations = 1000
+	luksTestAreaSize   = luksTestKeySize * luksTestStripes
+	luksTestPayload    = 64 * 1024
+)
+
+// luksTestSlot describes a keyslot of a generated header. A slot with bad
+// parameters can't be tried at all. A LUKS2 keyslot may state another key
+// size than that of the volume key.
+type luksTestSlot struct {
+	passphrase string
+	bad        bool
+	keySize    int
+}
+
+// xtsEncrypt encrypts the data units of unitSize bytes in place, the first
+// one being unit number first.
+func xtsEncrypt(t *testing.T, key, data []byte, unitSize int, first uint64) {
+	t.Helper()
+
+	dataCipher, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tweakCipher, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for pos := 0; pos < len(data); pos += unitSize {
+		var tweak [aes.BlockSize]byte
+		binary.LittleEndian.PutUint64(tweak[:], first+uint64(pos/unitSize))
+		tweakCipher.Encrypt(tweak[:], tweak[:])
+
+		for i := pos; i < pos+unitSize; i += aes.BlockSize {
+			block := data[i : i+aes.BlockSize]
+			for j := range block {
+				block[j] ^= tweak[j]
+			}
+			dataCipher.Encrypt(block, block)
+			for j := range block {
+				block[j] ^= tweak[j]
+			}
+
+			carry := tweak[aes.BlockSize-1] >> 7
+			for j := aes.BlockSize - 1; j > 0; j-- {
+				tweak[j] = tweak[j]<<1 | tweak[j-1]>>7
+			}
+			tweak[0] = tweak[0]<<1 ^ carry*0x87
+		}
+	}
+}
+
+// afSplit spreads key over stripes the way afMerge expects.
+func afSplit(rng *rand.Rand, key []byte, stripes int) []byte {
+	material := make([]byte, len(key)*stripes)
+	d := make([]byte, len(key))
+	for i := 0; i < stripes-1; i++ {
+		stripe := material[i*len(key) : (i+1)*len(key)]
+		rng.Read(stripe)
+		for j := range d {
+			d[j] ^= stripe[j]
+		}
+		d = afDiffuse(d, sha256.New)
+	}
+
+	last := material[(stripes-1)*len(key):]
+	for j := range last {
+		last[j] = d[j] ^ key[j]
+	}
+	return material
+}
+
+// luksKeyArea returns the encrypted key material of a keyslot.
+func luksKeyArea(t *testing.T, rng *rand.Rand, areaKey, volumeKey []byte) []byte {
+	material := afSplit(rng, volumeKey, luksTestStripes)
+	xtsEncrypt(t, areaKey, material, LUKS_SECTOR_SIZE, 0)
+	return material
+}
+
+func pbkdf2Sha256(t *testing.T, password, salt []byte, keyLen int) []byte {
+	t.Helper()
+
+	key, err := pbkdf2.Key(sha256.New, string(password), salt, luksTestIterations, keyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func randomBytes(rng *rand.Rand, n int) []byte {
+	data := make([]byte, n)
+	rng.Read(data)
+	return data
+}
+
+// luks1TestImage returns a LUKS1 aes-xts-plain64 device holding payload,
+// with the keyslots given.
+func luks1TestImage(t *testing.T, slots []luksTestSlot, payload []byte) memImage {
+	rng := rand.New(rand.NewSource(1))
+	volumeKey := randomBytes(rng, luksTestKeySize)
+
+	//The keyslot areas follow the header, aligned to 4KiB
+	areaSectors := (luksTestAreaSize/LUKS_SECTOR_SIZE + 7) &^ 7
+	payloadSector := 8 + len(slots)*areaSectors
+
+	header := luks1Header{
+		Version:            1,
+		PayloadOffset:      uint32(payloadSector),
+		KeyBytes:           luksTestKeySize,
+		MkDigestIterations: luksTestIterations,
+	}
+	copy(header.Magic[:], LUKS_MAGIC)
+	copy(header.CipherName[:], "aes")
+	copy(header.CipherMode[:], "xts-plain64")
+	copy(header.HashSpec[:], "sha256")
+	copy(header.UUID[:], "2d1e4b4a-6c1a-4c43-9e5a-5a3e6f1d0b71")
+	copy(header.MkDigestSalt[:], randomBytes(rng, 32))
+	copy(header.MkDigest[:], pbkdf2Sha256(t, volumeKey, header.MkDigestSalt[:], len(header.MkDigest)))
+
+	image := make(memImage, payloadSector*LUKS_SECTOR_SIZE+len(payload))
+	for i := range header.KeySlots {
+		header.KeySlots[i].Active = 0x0000DEAD
+	}
+
+	for i, slot := range slots {
+		keySlot := &header.KeySlots[i]
+		keySlot.Active = LUKS_KEY_ENABLED
+		keySlot.Iterations = luksTestIterations
+		keySlot.KeyMaterialOffset = uint32(8 + i*areaSectors)
+		keySlot.Stripes = luksTestStripes
+		copy(keySlot.Salt[:], randomBytes(rng, len(keySlot.Salt)))
+
+		if slot.bad {
+			keySlot.Stripes = 0
+			continue
+		}
+
+		areaKey := pbkdf2Sha256(t, []byte(slot.passphrase), keySlot.Salt[:], luksTestKeySize)
+		copy(image[int(keySlot.KeyMaterialOffset)*LUKS_SECTOR_SIZE:], luksKeyArea(t, rng, areaKey, volumeKey))
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &header)
+	copy(image, buf.Bytes())
+
+	data := append([]byte{}, payload...)
+	xtsEncrypt(t, volumeKey, data, LUKS_SECTOR_SIZE, 0)
+	copy(image[payloadSector*LUKS_SECTOR_SIZE:], data)
+	return image
+}
+
+// luks2TestImage returns a LUKS2 aes-xts-plain64 device with 4KiB sectors
+// holding payload, with argon2id keyslots. A bad keyslot asks for a KDF that
+// is not supported.
+func luks2TestImage(t *testing.T, slots []luksTestSlot, payload []byte) memImage {
+	const hdrSize = 16 * 1024
+	const sectorSize = 4096
+	const areaStart = 2 * hdrSize
+
+	rng := rand.New(rand.NewSource(2))
+	volumeKey := randomBytes(rng, luksTestKeySize)
+
+	areaSize := (luksTestAreaSize + sectorSize - 1) &^ (sectorSize - 1)
+	payloadOffset := areaStart + len(slots)*areaSize
+	image := make(memImage, payloadOffset+len(payload))
+
+	keySlots := map[string]interface{}{}
+	slotNames := []string{}
+	for i, slot := range slots {
+		name := strconv.Itoa(i)
+		salt := randomBytes(rng, 32)
+		offset := areaStart + i*areaSize
+
+		kdf := map[string]interface{}{"type": "argon2id", "time": 2, "memory": 64, "cpus": 2, "salt": base64.StdEncoding.EncodeToString(salt)}
+		if slot.bad {
+			kdf["type"] = "scrypt"
+		} else {
+			areaKey := argon2Key(argon2id, []byte(slot.passphrase), salt, nil, nil, 2, 64, 2, luksTestKeySize)
+			copy(image[offset:], luksKeyArea(t, rng, areaKey, volumeKey))
+		}
+
+		keySize := luksTestKeySize
+		if slot.keySize != 0 {
+			keySize = slot.keySize
+		}
+
+		keySlots[name] = map[string]interface{}{
+			"type":     "luks2",
+			"key_size": keySize,
+			"af":       map[string]interface{}{"type": "luks1", "stripes": luksTestStripes, "hash": "sha256"},
+			"area": map[string]interface{}{
+				"type":       "raw",
+				"offset":     strconv.Itoa(offset),
+				"size":       strconv.Itoa(areaSize),
+				"encryption": "aes-xts-plain64",
+				"key_size":   luksTestKeySize,
+			},
+			"kdf": kdf,
+		}
+		slotNames = append(slotNames, name)
+	}
+
+	digestSalt := randomBytes(rng, 32)
+	metadata := map[string]interface{}{
+		"keyslots": keySlots,
+		"segments": map[string]interface{}{
+			"0": map[string]interface{}{
+				"type":        "crypt",
+				"offset":      strconv.Itoa(payloadOffset),
+				"size":        "dynamic",
+				"iv_tweak":    "0",
+				"encryption":  "aes-xts-plain64",
+				"sector_size": sectorSize,
+			},
+		},
+		"digests": map[string]interface{}{
+			"0": map[string]interface{}{
+				"type":       "pbkdf2",
+				"keyslots":   slotNames,
+				"segments":   []string{"0"},
+				"hash":       "sha256",
+				"iterations": luksTestIterations,
+				"salt":       base64.StdEncoding.EncodeToString(digestSalt),
+				"digest":     base64.StdEncoding.EncodeToString(pbkdf2Sha256(t, volumeKey, digestSalt, 32)),
+			},
+		},
+		"config": map[string]interface{}{"json_size": strconv.Itoa(hdrSize - luks2BinaryHeaderSize), "keyslots_size": strconv.Itoa(payloadOffset - areaStart)},
+	}
+
+	text, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := luks2BinaryHeader{Version: 2, HdrSize: hdrSize, SeqID: 1}
+	copy(header.Magic[:], LUKS_MAGIC)
+	copy(header.Label[:], "test")
+	copy(header.ChecksumAlg[:], luks2ChecksumAlgorithm)
+	copy(header.UUID[:], "7f0c3b1e-8a52-4f0d-b3a4-0c6e9d2f5e18")
+
+	area := make([]byte, hdrSize)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &header)
+	copy(area, buf.Bytes())
+	copy(area[luks2BinaryHeaderSize:], text)
+	sum := sha256.Sum256(area)
+	copy(area[448:], sum[:])
+	copy(image, area)
+
+	//IVs count 512 byte sectors in units of the sector size
+	data := append([]byte{}, payload...)
+	xtsEncrypt(t, volumeKey, data, sectorSize, 0)
+	copy(image[payloadOffset:], data)
+	return image
+}
+
+func luksTestPayloadData() []byte {
+	return randomBytes(rand.New(rand.NewSource(3)), luksTestPayload)
+}
+
+// checkLuksUnlock unlocks image with passphrase and compares reads of the
+// volume with payload.
+func checkLuksUnlock(t *testing.T, image memImage, passphrase string, payload []byte) {
+	t.Helper()
+
+	volume, err := OpenLuksVolume(image, int64(len(image)), []byte(passphrase))
+	if err != nil {
+		t.Fatalf("passphrase %q: %v", passphrase, err)
+	}
+
+	if volume.Size() != int64(len(payload)) {
+		t.Fatalf("volume of %d bytes, want %d", volume.Size(), len(payload))
+	}
+
+	//Reads within a sector, across sectors and of the whole volume
+	for _, read := range [][2]int{{0, 16}, {100, 1000}, {4000, 9000}, {0, len(payload)}, {len(payload) - 10, 10}} {
+		buf := make([]byte, read[1])
+		if _, err := volume.ReadAt(buf, int64(read[0])); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, payload[read[0]:read[0]+read[1]]) {
+			t.Fatalf("%d bytes at %d decrypt to other data", read[1], read[0])
+		}
+	}
+}
+
+func checkLuksRefused(t *testing.T, image memImage, passphrase string) {
+	t.Helper()
+
+	_, err := OpenLuksVolume(image, int64(len(image)), []byte(passphrase))
+	if err == nil || !strings.Contains(err.Error(), "No LUKS keyslot matches") {
+		t.Fatalf("passphrase %q gave %v", passphrase, err)
+	}
+}
+
+func TestLuks1Unlock(t *testing.T) {
+	payload := luksTestPayloadData()
+	image := luks1TestImage(t, []luksTestSlot{{passphrase: "first"}, {passphrase: "second"}}, payload)
+
+	header, err := ReadLuksHeader(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 1 || header.Cipher != "aes-xts-plain64" || header.KeySize != luksTestKeySize || header.KeySlots() != 2 {
+		t.Fatalf("header read as %s", header)
+	}
+
+	checkLuksUnlock(t, image, "first", payload)
+	checkLuksUnlock(t, image, "second", payload)
+	checkLuksRefused(t, image, "third")
+}
+
+func TestLuks2Argon2idUnlock(t *testing.T) {
+	payload := luksTestPayloadData()
+	image := luks2TestImage(t, []luksTestSlot{{passphrase: "first"}, {passphrase: "second"}}, payload)
+
+	header, err := ReadLuksHeader(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Label != "test" || header.SectorSize != 4096 || header.KeySlots() != 2 {
+		t.Fatalf("header read as %s", header)
+	}
+
+	checkLuksUnlock(t, image, "first", payload)
+	checkLuksUnlock(t, image, "second", payload)
+	checkLuksRefused(t, image, "third")
+}
+
+func TestLuksUnlockAfterBadSlot(t *testing.T) {
+	payload := luksTestPayloadData()
+	slots := []luksTestSlot{{bad: true}, {passphrase: "second"}}
+
+	for name, image := range map[string]memImage{"LUKS1": luks1TestImage(t, slots, payload), "LUKS2": luks2TestImage(t, slots, payload)} {
+		t.Run(name, func(t *testing.T) {
+			checkLuksUnlock(t, image, "second", payload)
+			checkLuksRefused(t, image, "third")
+		})
+	}
+}
+
+func TestLuksBadKeySize(t *testing.T) {
+	payload := luksTestPayloadData()
+
+	//The LUKS1 key size is refused before a key of that size is made
+	image := luks1TestImage(t, []luksTestSlot{{passphrase: "first"}}, payload)
+	binary.BigEndian.PutUint32(image[108:], 0xFFFFFFF0)
+	_, err := OpenLuksVolume(image, int64(len(image)), []byte("first"))
+	if err == nil || !strings.Contains(err.Error(), "Bad LUKS key size") {
+		t.Fatalf("LUKS1 key size of 0xFFFFFFF0 bytes gave %v", err)
+	}
+
+	//The keyslots of a LUKS2 segment hold the same volume key
+	image = luks2TestImage(t, []luksTestSlot{{passphrase: "first"}, {passphrase: "second", keySize: 32}}, payload)
+	_, err = ReadLuksHeader(image)
+	if err == nil || !strings.Contains(err.Error(), "disagree on the key size") {
+		t.Fatalf("LUKS2 keyslots of 64 and 32 byte keys gave %v", err)
+	}
+}
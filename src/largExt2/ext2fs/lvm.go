@@ -0,0 +1,456 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	LVM_LABEL_ID         = "LABELONE"
+	LVM_LABEL_TYPE       = "LVM2 001"
+	LVM_LABEL_SCAN       = 4
+	LVM_MDA_MAGIC        = " LVM2 x[5A%r0N*>"
+	LVM_MDA_HEADER_SIZE  = 512
+	LVM_RAW_LOCN_IGNORED = 1
+	LVM_ID_LEN           = 32
+)
+
+type lvmLabelHeader struct {
+	ID       [8]byte
+	SectorXL uint64
+	CrcXL    uint32
+	OffsetXL uint32
+	Type     [8]byte
+}
+
+type lvmDiskLocn struct {
+	Offset uint64
+	Size   uint64
+}
+
+type lvmMdaHeader struct {
+	Checksum uint32
+	Magic    [16]byte
+	Version  uint32
+	Start    uint64
+	Size     uint64
+}
+
+type lvmRawLocn struct {
+	Offset   uint64
+	Size     uint64
+	Checksum uint32
+	Flags    uint32
+}
+
+type LvmPhysicalVolume struct {
+	UUID       string
+	Name       string
+	DeviceSize int64
+	PeStart    int64
+	PeCount    int64
+	r          io.ReaderAt
+	metadata   []lvmDiskLocn
+}
+
+type LvmStripe struct {
+	PV          *LvmPhysicalVolume
+	StartExtent int64
+}
+
+type LvmSegment struct {
+	StartExtent int64
+	ExtentCount int64
+	Type        string
+	StripeSize  int64
+	Stripes     []LvmStripe
+}
+
+type LvmVolumeGroup struct {
+	Name            string
+	UUID            string
+	Seqno           int64
+	ExtentSize      int64
+	PhysicalVolumes []*LvmPhysicalVolume
+	LogicalVolumes  []*LvmLogicalVolume
+}
+
+// LvmLogicalVolume reads a logical volume made of linear and striped
+// segments straight from its physical volumes.
+type LvmLogicalVolume struct {
+	Name     string
+	UUID     string
+	Segments []LvmSegment
+	vg       *LvmVolumeGroup
+}
+
+// ReadLvmLabel reads the LVM2 physical volume label of r. Storage without a
+// label returns nil and no error.
+func ReadLvmLabel(r io.ReaderAt) (*LvmPhysicalVolume, error) {
+	sector := make([]byte, SECTOR_SIZE)
+
+	for i := int64(0); i < LVM_LABEL_SCAN; i++ {
+		if _, err := r.ReadAt(sector, i*SECTOR_SIZE); err != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		label := lvmLabelHeader{}
+		binary.Read(bytes.NewReader(sector), binary.LittleEndian, &label)
+		if string(label.ID[:]) != LVM_LABEL_ID || string(label.Type[:]) != LVM_LABEL_TYPE {
+			continue
+		}
+
+		if int64(label.OffsetXL)+LVM_ID_LEN+8 > SECTOR_SIZE {
+			return nil, errors.New("Bad LVM label")
+		}
+
+		header := sector[label.OffsetXL:]
+		pv := &LvmPhysicalVolume{
+			UUID:       string(header[:LVM_ID_LEN]),
+			DeviceSize: int64(binary.LittleEndian.Uint64(header[LVM_ID_LEN:])),
+			r:          r,
+		}
+
+		//Data areas and metadata areas are two zero terminated lists
+		locns := header[LVM_ID_LEN+8:]
+		lists := 0
+		for len(locns) >= 16 && lists < 2 {
+			locn := lvmDiskLocn{
+				Offset: binary.LittleEndian.Uint64(locns),
+				Size:   binary.LittleEndian.Uint64(locns[8:]),
+			}
+			locns = locns[16:]
+
+			if locn.Offset == 0 {
+				lists++
+				continue
+			}
+
+			if lists == 1 {
+				pv.metadata = append(pv.metadata, locn)
+			}
+		}
+
+		return pv, nil
+	}
+
+	return nil, nil
+}
+
+// readMetadata returns the current text metadata of the first usable
+// metadata area of the physical volume.
+func (pv *LvmPhysicalVolume) readMetadata() (string, error) {
+	var lastErr error = errors.New("No LVM metadata area")
+
+	for _, mda := range pv.metadata {
+		buf := make([]byte, LVM_MDA_HEADER_SIZE)
+		if _, err := pv.r.ReadAt(buf, int64(mda.Offset)); err != nil {
+			lastErr = err
+			continue
+		}
+
+		header := lvmMdaHeader{}
+		binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header)
+		if string(header.Magic[:]) != LVM_MDA_MAGIC {
+			lastErr = errors.New("Bad LVM metadata area header")
+			continue
+		}
+
+		locn := lvmRawLocn{}
+		binary.Read(bytes.NewReader(buf[binary.Size(header):]), binary.LittleEndian, &locn)
+		if locn.Offset == 0 || locn.Size == 0 || locn.Flags&LVM_RAW_LOCN_IGNORED != 0 {
+			lastErr = errors.New("Empty LVM metadata area")
+			continue
+		}
+
+		if locn.Offset >= header.Size || locn.Size > header.Size {
+			lastErr = errors.New("Bad LVM metadata location")
+			continue
+		}
+
+		text := make([]byte, locn.Size)
+		first := locn.Size
+
+		//The metadata area is a ring buffer after its header
+		if locn.Offset+locn.Size > header.Size {
+			first = header.Size - locn.Offset
+		}
+
+		if _, err := pv.r.ReadAt(text[:first], int64(header.Start+locn.Offset)); err != nil {
+			lastErr = err
+			continue
+		}
+
+		if first < locn.Size {
+			if _, err := pv.r.ReadAt(text[first:], int64(header.Start+LVM_MDA_HEADER_SIZE)); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+
+		return string(text), nil
+	}
+
+	return "", lastErr
+}
+
+// ReadLvmVolumeGroups reads the volume groups described by the metadata of
+// the given physical volumes. Physical volumes that are not among pvs are
+// listed without storage, and logical volumes on them can't be read.
+func ReadLvmVolumeGroups(pvs []io.ReaderAt) ([]*LvmVolumeGroup, error) {
+	labels := make(map[string]*LvmPhysicalVolume)
+	groups := make(map[string]*LvmVolumeGroup)
+	order := make([]string, 0)
+
+	for i, r := range pvs {
+		pv, err := ReadLvmLabel(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if pv == nil {
+			return nil, errors.New(fmt.Sprintf("Physical volume %d has no LVM label", i))
+		}
+
+		labels[pv.UUID] = pv
+
+		text, err := pv.readMetadata()
+		if err != nil {
+			//Physical volumes may be created without a metadata copy
+			continue
+		}
+
+		vg, err := parseLvmVolumeGroup(text)
+		if err != nil {
+			return nil, err
+		}
+
+		if old, ok := groups[vg.UUID]; !ok {
+			order = append(order, vg.UUID)
+			groups[vg.UUID] = vg
+		} else if vg.Seqno > old.Seqno {
+			groups[vg.UUID] = vg
+		}
+	}
+
+	result := make([]*LvmVolumeGroup, 0, len(order))
+	for _, id := range order {
+		vg := groups[id]
+		for _, pv := range vg.PhysicalVolumes {
+			if label, ok := labels[pv.UUID]; ok {
+				pv.r = label.r
+				pv.DeviceSize = label.DeviceSize
+			}
+		}
+		result = append(result, vg)
+	}
+
+	return result, nil
+}
+
+func parseLvmVolumeGroup(text string) (*LvmVolumeGroup, error) {
+	root, err := parseLvmConfig(text)
+	if err != nil {
+		return nil, err
+	}
+
+	names := root.children()
+	if len(names) != 1 {
+		return nil, errors.New("LVM metadata must describe one volume group")
+	}
+
+	name := names[0]
+	section := root.sections[name]
+
+	vg := &LvmVolumeGroup{
+		Name:       name,
+		UUID:       strings.Replace(section.str("id"), "-", "", -1),
+		Seqno:      section.int("seqno"),
+		ExtentSize: section.int("extent_size") * SECTOR_SIZE,
+	}
+
+	if vg.ExtentSize <= 0 {
+		return nil, errors.New(fmt.Sprintf("Bad extent size in volume group %s", name))
+	}
+
+	byName := make(map[string]*LvmPhysicalVolume)
+	pvs := section.child("physical_volumes")
+	for _, pvName := range pvs.children() {
+		pvSection := pvs.child(pvName)
+		pv := &LvmPhysicalVolume{
+			UUID:       strings.Replace(pvSection.str("id"), "-", "", -1),
+			Name:       pvName,
+			DeviceSize: pvSection.int("dev_size") * SECTOR_SIZE,
+			PeStart:    pvSection.int("pe_start") * SECTOR_SIZE,
+			PeCount:    pvSection.int("pe_count"),
+		}
+		byName[pvName] = pv
+		vg.PhysicalVolumes = append(vg.PhysicalVolumes, pv)
+	}
+
+	lvs := section.child("logical_volumes")
+	for _, lvName := range lvs.children() {
+		lvSection := lvs.child(lvName)
+		lv := &LvmLogicalVolume{
+			Name: lvName,
+			UUID: lvSection.str("id"),
+			vg:   vg,
+		}
+
+		for i := int64(1); i <= lvSection.int("segment_count"); i++ {
+			segSection, ok := lvSection.sections[fmt.Sprintf("segment%d", i)]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("Logical volume %s misses segment %d", lvName, i))
+			}
+
+			segment := LvmSegment{
+				StartExtent: segSection.int("start_extent"),
+				ExtentCount: segSection.int("extent_count"),
+				Type:        segSection.str("type"),
+				StripeSize:  segSection.int("stripe_size") * SECTOR_SIZE,
+			}
+
+			stripes := segSection.list("stripes")
+			for j := 0; j+1 < len(stripes); j += 2 {
+				pvName, _ := stripes[j].(string)
+				start, _ := stripes[j+1].(int64)
+				pv, ok := byName[pvName]
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("Logical volume %s uses unknown physical volume %s", lvName, pvName))
+				}
+				segment.Stripes = append(segment.Stripes, LvmStripe{PV: pv, StartExtent: start})
+			}
+
+			lv.Segments = append(lv.Segments, segment)
+		}
+
+		sort.Slice(lv.Segments, func(i, j int) bool {
+			return lv.Segments[i].StartExtent < lv.Segments[j].StartExtent
+		})
+		vg.LogicalVolumes = append(vg.LogicalVolumes, lv)
+	}
+
+	return vg, nil
+}
+
+func (vg *LvmVolumeGroup) LogicalVolume(name string) *LvmLogicalVolume {
+	for _, lv := range vg.LogicalVolumes {
+		if lv.Name == name {
+			return lv
+		}
+	}
+	return nil
+}
+
+func (vg *LvmVolumeGroup) String() string {
+	present := 0
+	for _, pv := range vg.PhysicalVolumes {
+		if pv.r != nil {
+			present++
+		}
+	}
+	return fmt.Sprintf("Volume group %s, %d of %d physical volumes, extent size %d, %d logical volumes",
+		vg.Name, present, len(vg.PhysicalVolumes), vg.ExtentSize, len(vg.LogicalVolumes))
+}
+
+func (lv *LvmLogicalVolume) String() string {
+	types := make([]string, 0, len(lv.Segments))
+	for _, segment := range lv.Segments {
+		types = append(types, fmt.Sprintf("%s/%d", segment.Type, len(segment.Stripes)))
+	}
+	return fmt.Sprintf("Logical volume %s/%s, %d bytes, segments %s", lv.vg.Name, lv.Name, lv.Size(), strings.Join(types, " "))
+}
+
+func (lv *LvmLogicalVolume) Size() int64 {
+	extents := int64(0)
+	for _, segment := range lv.Segments {
+		extents += segment.ExtentCount
+	}
+	return extents * lv.vg.ExtentSize
+}
+
+// Check reports why the logical volume can't be read, or nil if it can.
+func (lv *LvmLogicalVolume) Check() error {
+	for _, segment := range lv.Segments {
+		if segment.Type != "striped" && segment.Type != "linear" {
+			return errors.New(fmt.Sprintf("Unsupported %s segment in logical volume %s", segment.Type, lv.Name))
+		}
+
+		if len(segment.Stripes) == 0 || segment.ExtentCount%int64(len(segment.Stripes)) != 0 {
+			return errors.New(fmt.Sprintf("Bad stripes in logical volume %s", lv.Name))
+		}
+
+		if len(segment.Stripes) > 1 && segment.StripeSize <= 0 {
+			return errors.New(fmt.Sprintf("Bad stripe size in logical volume %s", lv.Name))
+		}
+
+		for _, stripe := range segment.Stripes {
+			if stripe.PV.r == nil {
+				return errors.New(fmt.Sprintf("Logical volume %s needs missing physical volume %s", lv.Name, stripe.PV.Name))
+			}
+		}
+	}
+	return nil
+}
+
+func (lv *LvmLogicalVolume) ReadAt(p []byte, off int64) (int, error) {
+	if err := lv.Check(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		extent := pos / lv.vg.ExtentSize
+
+		i := sort.Search(len(lv.Segments), func(i int) bool {
+			return lv.Segments[i].StartExtent+lv.Segments[i].ExtentCount > extent
+		})
+
+		if i == len(lv.Segments) || lv.Segments[i].StartExtent > extent {
+			if i == len(lv.Segments) {
+				return n, io.EOF
+			}
+			return n, errors.New(fmt.Sprintf("Logical volume %s has no segment for extent %d", lv.Name, extent))
+		}
+
+		segment := lv.Segments[i]
+		inner := pos - segment.StartExtent*lv.vg.ExtentSize
+		segmentEnd := segment.ExtentCount * lv.vg.ExtentSize
+		stripes := int64(len(segment.Stripes))
+
+		var stripe LvmStripe
+		var stripeOff, piece int64
+		if stripes == 1 {
+			stripe = segment.Stripes[0]
+			stripeOff = inner
+			piece = segmentEnd - inner
+		} else {
+			chunk := inner / segment.StripeSize
+			stripe = segment.Stripes[chunk%stripes]
+			stripeOff = (chunk/stripes)*segment.StripeSize + inner%segment.StripeSize
+			piece = segment.StripeSize - inner%segment.StripeSize
+		}
+
+		if piece > int64(len(p)-n) {
+			piece = int64(len(p) - n)
+		}
+
+		pvOff := stripe.PV.PeStart + stripe.StartExtent*lv.vg.ExtentSize + stripeOff
+		read, err := stripe.PV.r.ReadAt(p[n:n+int(piece)], pvOff)
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
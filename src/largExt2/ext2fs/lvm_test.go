@@ -0,0 +1,51 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// lvmTestLabel returns storage with an LVM label in its second sector, the
+// physical volume header at offsetXL in the label sector.
+func lvmTestLabel(offsetXL uint32) memImage {
+	image := make(memImage, 4*SECTOR_SIZE)
+
+	label := lvmLabelHeader{SectorXL: 1, OffsetXL: offsetXL}
+	copy(label.ID[:], LVM_LABEL_ID)
+	copy(label.Type[:], LVM_LABEL_TYPE)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, label)
+	copy(image[SECTOR_SIZE:], buf.Bytes())
+
+	if int64(offsetXL)+LVM_ID_LEN+8 <= SECTOR_SIZE {
+		header := image[SECTOR_SIZE+int64(offsetXL):]
+		copy(header, strings.Repeat("u", LVM_ID_LEN))
+		binary.LittleEndian.PutUint64(header[LVM_ID_LEN:], 1<<30)
+	}
+	return image
+}
+
+func TestReadLvmLabel(t *testing.T) {
+	pv, err := ReadLvmLabel(lvmTestLabel(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv == nil || pv.UUID != strings.Repeat("u", LVM_ID_LEN) || pv.DeviceSize != 1<<30 {
+		t.Fatalf("read %+v", pv)
+	}
+
+	//Offsets near 4G wrap around in 32 bits
+	for _, offsetXL := range []uint32{SECTOR_SIZE - LVM_ID_LEN - 7, SECTOR_SIZE, 0xFFFFFFF0, 0xFFFFFFFF} {
+		if _, err := ReadLvmLabel(lvmTestLabel(offsetXL)); err == nil {
+			t.Fatalf("label header at %d accepted", offsetXL)
+		}
+	}
+
+	pv, err = ReadLvmLabel(make(memImage, 4*SECTOR_SIZE))
+	if pv != nil || err != nil {
+		t.Fatalf("storage without label gave %v, %v", pv, err)
+	}
+}
@@ -0,0 +1,216 @@
+package ext2fs
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// lvmSection is a parsed section of the LVM2 text metadata format, where
+// values are strings, integers or lists of both.
+type lvmSection struct {
+	values   map[string]interface{}
+	sections map[string]*lvmSection
+	order    []string
+}
+
+type lvmParser struct {
+	text string
+	pos  int
+}
+
+func newLvmSection() *lvmSection {
+	return &lvmSection{
+		values:   make(map[string]interface{}),
+		sections: make(map[string]*lvmSection),
+	}
+}
+
+func parseLvmConfig(text string) (*lvmSection, error) {
+	p := &lvmParser{text: text}
+	root, err := p.section(true)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("LVM metadata: %s at offset %d", err.Error(), p.pos))
+	}
+	return root, nil
+}
+
+func (s *lvmSection) str(key string) string {
+	value, _ := s.values[key].(string)
+	return value
+}
+
+func (s *lvmSection) int(key string) int64 {
+	value, _ := s.values[key].(int64)
+	return value
+}
+
+func (s *lvmSection) list(key string) []interface{} {
+	value, _ := s.values[key].([]interface{})
+	return value
+}
+
+// children returns the names of the subsections in file order.
+func (s *lvmSection) children() []string {
+	names := make([]string, 0, len(s.sections))
+	for _, key := range s.order {
+		if _, ok := s.sections[key]; ok {
+			names = append(names, key)
+		}
+	}
+	return names
+}
+
+func (s *lvmSection) child(key string) *lvmSection {
+	if child, ok := s.sections[key]; ok {
+		return child
+	}
+	return newLvmSection()
+}
+
+func (p *lvmParser) skip() {
+	for p.pos < len(p.text) {
+		switch c := p.text[p.pos]; {
+		case c == '#':
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == 0:
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *lvmParser) peek() byte {
+	p.skip()
+	if p.pos >= len(p.text) {
+		return 0
+	}
+	return p.text[p.pos]
+}
+
+func isLvmIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == '+' || c == '-'
+}
+
+func (p *lvmParser) ident() (string, error) {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.text) && isLvmIdentChar(p.text[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", errors.New("identifier expected")
+	}
+	return p.text[start:p.pos], nil
+}
+
+func (p *lvmParser) section(root bool) (*lvmSection, error) {
+	s := newLvmSection()
+	for {
+		c := p.peek()
+		if c == 0 {
+			if root {
+				return s, nil
+			}
+			return nil, errors.New("unterminated section")
+		}
+
+		if c == '}' {
+			if root {
+				return nil, errors.New("unexpected '}'")
+			}
+			p.pos++
+			return s, nil
+		}
+
+		key, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+
+		switch p.peek() {
+		case '{':
+			p.pos++
+			child, err := p.section(false)
+			if err != nil {
+				return nil, err
+			}
+			s.sections[key] = child
+		case '=':
+			p.pos++
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			s.values[key] = value
+		default:
+			return nil, errors.New("'=' or '{' expected")
+		}
+		s.order = append(s.order, key)
+	}
+}
+
+func (p *lvmParser) value() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		return p.quoted()
+	case c == '[':
+		p.pos++
+		list := make([]interface{}, 0)
+		for {
+			if p.peek() == ']' {
+				p.pos++
+				return list, nil
+			}
+
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+
+			if p.peek() == ',' {
+				p.pos++
+			}
+		}
+	default:
+		start := p.pos
+		for p.pos < len(p.text) && isLvmIdentChar(p.text[p.pos]) {
+			p.pos++
+		}
+		token := p.text[start:p.pos]
+		if number, err := strconv.ParseInt(token, 10, 64); err == nil {
+			return number, nil
+		}
+		if _, err := strconv.ParseFloat(token, 64); err == nil {
+			return token, nil
+		}
+		return nil, errors.New(fmt.Sprintf("bad value %q", token))
+	}
+}
+
+func (p *lvmParser) quoted() (string, error) {
+	p.pos++
+	var str strings.Builder
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return str.String(), nil
+		case '\\':
+			if p.pos < len(p.text) {
+				str.WriteByte(p.text[p.pos])
+				p.pos++
+			}
+		default:
+			str.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated string")
+}
@@ -0,0 +1,542 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	MD_SB_MAGIC         = 0xA92B4EFC
+	MD_SB_BYTES         = 4096
+	MD_RESERVED_BYTES   = 64 * 1024
+	MD_SB_1_2_OFFSET    = 4096
+	MD_SB_90_THIS_DISK  = 992
+	MD_SB_1_ROLES       = 256
+	MD_ROLE_SPARE       = 0xFFFF
+	MD_ROLE_FAULTY      = 0xFFFE
+	MD_LEVEL_LINEAR     = -1
+	MD_LEVEL_RAID0      = 0
+	MD_LEVEL_RAID1      = 1
+	MD_LEVEL_RAID5      = 5
+	MD_LEFT_ASYMMETRIC  = 0
+	MD_RIGHT_ASYMMETRIC = 1
+	MD_LEFT_SYMMETRIC   = 2
+	MD_RIGHT_SYMMETRIC  = 3
+	MD_PARITY_0         = 4
+	MD_PARITY_N         = 5
+)
+
+// MdSuperBlock is the part of a Linux md RAID member superblock needed to
+// put the member back into its array.
+type MdSuperBlock struct {
+	Version    string
+	UUID       [16]byte
+	Name       string
+	Level      int32
+	Layout     uint32
+	ChunkSize  int64
+	RaidDisks  uint32
+	Role       int
+	Events     uint64
+	DataOffset int64
+	DataSize   int64
+}
+
+type mdSuperBlock1 struct {
+	Magic            uint32
+	MajorVersion     uint32
+	FeatureMap       uint32
+	Pad0             uint32
+	SetUUID          [16]byte
+	SetName          [32]byte
+	CTime            uint64
+	Level            int32
+	Layout           uint32
+	Size             uint64
+	ChunkSize        uint32
+	RaidDisks        uint32
+	BitmapOffset     uint32
+	NewLevel         uint32
+	ReshapePosition  uint64
+	DeltaDisks       uint32
+	NewLayout        uint32
+	NewChunk         uint32
+	NewOffset        uint32
+	DataOffset       uint64
+	DataSize         uint64
+	SuperOffset      uint64
+	RecoveryOffset   uint64
+	DevNumber        uint32
+	CntCorrectedRead uint32
+	DeviceUUID       [16]byte
+	DevFlags         uint8
+	BBLogShift       uint8
+	BBLogSize        uint16
+	BBLogOffset      uint32
+	UTime            uint64
+	Events           uint64
+	ResyncOffset     uint64
+	SbCsum           uint32
+	MaxDev           uint32
+	Pad3             [32]byte
+}
+
+// ReadMdSuperBlock looks for an md superblock of any version on a member of
+// the given size. A member without superblock returns nil and no error.
+func ReadMdSuperBlock(r io.ReaderAt, size int64) (*MdSuperBlock, error) {
+	end1 := ((size/SECTOR_SIZE - 16) &^ 7) * SECTOR_SIZE
+	for _, location := range []struct {
+		version string
+		offset  int64
+	}{{"1.1", 0}, {"1.2", MD_SB_1_2_OFFSET}, {"1.0", end1}} {
+		if location.offset < 0 {
+			continue
+		}
+
+		sb, err := readMdSuperBlock1(r, location.offset)
+		if err != nil {
+			return nil, err
+		}
+
+		if sb != nil {
+			sb.Version = location.version
+			return sb, nil
+		}
+	}
+
+	offset90 := (size &^ (MD_RESERVED_BYTES - 1)) - MD_RESERVED_BYTES
+	if offset90 < 0 {
+		return nil, nil
+	}
+
+	return readMdSuperBlock90(r, offset90)
+}
+
+func readMdSuperBlock1(r io.ReaderAt, offset int64) (*MdSuperBlock, error) {
+	buf := make([]byte, MD_SB_BYTES)
+	if n, err := r.ReadAt(buf, offset); n < MD_SB_1_ROLES {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	raw := &mdSuperBlock1{}
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, raw)
+
+	if raw.Magic != MD_SB_MAGIC || raw.MajorVersion != 1 {
+		return nil, nil
+	}
+
+	sb := &MdSuperBlock{
+		UUID:       raw.SetUUID,
+		Name:       strings.TrimRight(string(raw.SetName[:]), "\x00"),
+		Level:      raw.Level,
+		Layout:     raw.Layout,
+		ChunkSize:  int64(raw.ChunkSize) * SECTOR_SIZE,
+		RaidDisks:  raw.RaidDisks,
+		Role:       -1,
+		Events:     raw.Events,
+		DataOffset: int64(raw.DataOffset) * SECTOR_SIZE,
+		DataSize:   int64(raw.DataSize) * SECTOR_SIZE,
+	}
+
+	//Size is the used part of the data area, it is left zero for raid0
+	if raw.Size != 0 && int64(raw.Size)*SECTOR_SIZE < sb.DataSize {
+		sb.DataSize = int64(raw.Size) * SECTOR_SIZE
+	}
+
+	if roleOffset := MD_SB_1_ROLES + 2*int(raw.DevNumber); roleOffset+2 <= len(buf) {
+		role := binary.LittleEndian.Uint16(buf[roleOffset:])
+		if role != MD_ROLE_SPARE && role != MD_ROLE_FAULTY {
+			sb.Role = int(role)
+		}
+	}
+
+	return sb, nil
+}
+
+func readMdSuperBlock90(r io.ReaderAt, offset int64) (*MdSuperBlock, error) {
+	words := make([]uint32, MD_SB_BYTES/4)
+	buf := make([]byte, MD_SB_BYTES)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, words)
+
+	if words[0] != MD_SB_MAGIC || words[1] != 0 || words[2] != 90 {
+		return nil, nil
+	}
+
+	sb := &MdSuperBlock{
+		Version:   "0.90",
+		Level:     int32(words[7]),
+		Layout:    words[64],
+		ChunkSize: int64(words[65]),
+		RaidDisks: words[10],
+		Role:      int(words[MD_SB_90_THIS_DISK+3]),
+		Events:    uint64(words[40])<<32 | uint64(words[39]),
+		DataSize:  int64(words[8]) * 1024,
+	}
+
+	for i, word := range []uint32{words[5], words[13], words[14], words[15]} {
+		binary.LittleEndian.PutUint32(sb.UUID[4*i:], word)
+	}
+
+	return sb, nil
+}
+
+func (sb *MdSuperBlock) String() string {
+	str := fmt.Sprintf("md %s raid%d, %d disks", sb.Version, sb.Level, sb.RaidDisks)
+	if sb.Level == MD_LEVEL_LINEAR {
+		str = fmt.Sprintf("md %s linear, %d disks", sb.Version, sb.RaidDisks)
+	}
+	if sb.Name != "" {
+		str += fmt.Sprintf(" %q", sb.Name)
+	}
+	return str + fmt.Sprintf(", chunk %d, layout %d, member role %d, data at %d (%d bytes)",
+		sb.ChunkSize, sb.Layout, sb.Role, sb.DataOffset, sb.DataSize)
+}
+
+// MdArray is a read-only virtual block device reassembled from the members
+// of a raid0, raid1 or raid5 md array. A raid5 array can miss one member.
+type MdArray struct {
+	Level     int32
+	Layout    uint32
+	ChunkSize int64
+	RaidDisks int
+	// Events is the event count of the freshest members.
+	Events uint64
+	// Members holds the superblock of every member by role, nil when the
+	// member is missing.
+	Members []*MdSuperBlock
+	// Stale holds the members left out because they missed events of the
+	// array, their data is older than the one of the other members.
+	Stale   []*MdSuperBlock
+	data    []io.ReaderAt
+	closers []io.Closer
+	size    int64
+}
+
+// AssembleMdArray puts members of one md array back together. Members are
+// given in any order, their roles are taken from their superblocks. As md
+// does, members whose event count lags behind are left out of the array.
+func AssembleMdArray(members []io.ReaderAt, sizes []int64) (*MdArray, error) {
+	if len(members) == 0 || len(members) != len(sizes) {
+		return nil, errors.New("No md members given")
+	}
+
+	sbs := make([]*MdSuperBlock, len(members))
+	var fresh *MdSuperBlock
+	for i, member := range members {
+		sb, err := ReadMdSuperBlock(member, sizes[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if sb == nil {
+			return nil, errors.New(fmt.Sprintf("Member %d has no md superblock", i))
+		}
+
+		if fresh == nil || sb.Events > fresh.Events {
+			fresh = sb
+		}
+		sbs[i] = sb
+	}
+
+	array := &MdArray{
+		Level:     fresh.Level,
+		Layout:    fresh.Layout,
+		ChunkSize: fresh.ChunkSize,
+		RaidDisks: int(fresh.RaidDisks),
+		Events:    fresh.Events,
+		Members:   make([]*MdSuperBlock, fresh.RaidDisks),
+		data:      make([]io.ReaderAt, fresh.RaidDisks),
+	}
+
+	for i, sb := range sbs {
+		if sb.UUID != fresh.UUID {
+			return nil, errors.New(fmt.Sprintf("Member %d belongs to another array", i))
+		}
+
+		if closer, ok := members[i].(io.Closer); ok {
+			array.closers = append(array.closers, closer)
+		}
+
+		if sb.Events < array.Events {
+			array.Stale = append(array.Stale, sb)
+			continue
+		}
+
+		if sb.Role < 0 || sb.Role >= array.RaidDisks {
+			return nil, errors.New(fmt.Sprintf("Member %d is a spare or faulty", i))
+		}
+
+		if array.Members[sb.Role] != nil {
+			return nil, errors.New(fmt.Sprintf("Member %d duplicates role %d", i, sb.Role))
+		}
+
+		array.Members[sb.Role] = sb
+		array.data[sb.Role] = newSection(members[i], sb.DataOffset, sb.DataSize)
+	}
+
+	if err := array.setSize(); err != nil {
+		if len(array.Stale) > 0 {
+			return nil, errors.New(fmt.Sprintf("%s, %d stale members were left out", err.Error(), len(array.Stale)))
+		}
+		return nil, err
+	}
+
+	return array, nil
+}
+
+// OpenMdArray opens the member image files of an md array. A raid1 member
+// can be opened alone.
+func OpenMdArray(paths []string) (*MdArray, error) {
+	members := make([]io.ReaderAt, 0, len(paths))
+	sizes := make([]int64, 0, len(paths))
+
+	closeAll := func() {
+		for _, member := range members {
+			member.(io.Closer).Close()
+		}
+	}
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		size, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			file.Close()
+			closeAll()
+			return nil, err
+		}
+
+		members = append(members, file)
+		sizes = append(sizes, size)
+	}
+
+	array, err := AssembleMdArray(members, sizes)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	return array, nil
+}
+
+func (a *MdArray) missing() int {
+	count := 0
+	for _, sb := range a.Members {
+		if sb == nil {
+			count++
+		}
+	}
+	return count
+}
+
+func (a *MdArray) setSize() error {
+	memberSize := int64(-1)
+	for _, sb := range a.Members {
+		if sb != nil && (memberSize < 0 || sb.DataSize < memberSize) {
+			memberSize = sb.DataSize
+		}
+	}
+
+	if a.Level != MD_LEVEL_RAID1 && a.ChunkSize <= 0 {
+		return errors.New("Bad md chunk size")
+	}
+
+	switch a.Level {
+	case MD_LEVEL_RAID1:
+		a.size = memberSize
+	case MD_LEVEL_RAID0:
+		if a.missing() > 0 {
+			return errors.New(fmt.Sprintf("raid0 array is missing %d of %d members", a.missing(), a.RaidDisks))
+		}
+		for _, sb := range a.Members {
+			if sb.DataSize != memberSize {
+				return errors.New("raid0 members of different sizes are not supported")
+			}
+		}
+		memberSize -= memberSize % a.ChunkSize
+		a.size = memberSize * int64(a.RaidDisks)
+	case MD_LEVEL_RAID5:
+		if a.missing() > 1 {
+			return errors.New(fmt.Sprintf("raid5 array is missing %d of %d members", a.missing(), a.RaidDisks))
+		}
+		if a.RaidDisks < 2 || a.Layout > MD_PARITY_N {
+			return errors.New(fmt.Sprintf("Unsupported raid5 geometry, %d disks layout %d", a.RaidDisks, a.Layout))
+		}
+		memberSize -= memberSize % a.ChunkSize
+		a.size = memberSize * int64(a.RaidDisks-1)
+	default:
+		return errors.New(fmt.Sprintf("Unsupported md raid level %d", a.Level))
+	}
+
+	return nil
+}
+
+func (a *MdArray) String() string {
+	str := fmt.Sprintf("md raid%d, %d of %d members, chunk %d, layout %d, %d bytes",
+		a.Level, a.RaidDisks-a.missing(), a.RaidDisks, a.ChunkSize, a.Layout, a.size)
+	for _, sb := range a.Stale {
+		str += fmt.Sprintf(", stale member role %d left out at %d of %d events", sb.Role, sb.Events, a.Events)
+	}
+	return str
+}
+
+func (a *MdArray) Size() int64 {
+	return a.size
+}
+
+func (a *MdArray) Close() error {
+	var err error
+	for _, closer := range a.closers {
+		if cerr := closer.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (a *MdArray) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= a.size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if max := a.size - off; int64(len(p)) > max {
+		p = p[:max]
+		eof = io.EOF
+	}
+
+	if a.Level == MD_LEVEL_RAID1 {
+		n, err := a.readMirror(p, off)
+		if err == nil {
+			err = eof
+		}
+		return n, err
+	}
+
+	n := 0
+	for n < len(p) {
+		disk, diskOff := a.locate(off + int64(n))
+
+		piece := a.ChunkSize - (off+int64(n))%a.ChunkSize
+		if piece > int64(len(p)-n) {
+			piece = int64(len(p) - n)
+		}
+
+		if err := a.readChunk(p[n:n+int(piece)], disk, diskOff); err != nil {
+			return n, err
+		}
+
+		n += int(piece)
+	}
+
+	return n, eof
+}
+
+func (a *MdArray) readMirror(p []byte, off int64) (int, error) {
+	var lastErr error
+	for _, member := range a.data {
+		if member == nil {
+			continue
+		}
+
+		n, err := member.ReadAt(p, off)
+		if err == nil || (err == io.EOF && n == len(p)) {
+			return n, nil
+		}
+		lastErr = err
+	}
+	return 0, lastErr
+}
+
+// locate maps an array offset to a member role and the offset inside the
+// data area of that member.
+func (a *MdArray) locate(off int64) (int, int64) {
+	chunk := off / a.ChunkSize
+	inner := off % a.ChunkSize
+	disks := int64(a.RaidDisks)
+
+	if a.Level == MD_LEVEL_RAID0 {
+		return int(chunk % disks), (chunk/disks)*a.ChunkSize + inner
+	}
+
+	dataDisks := disks - 1
+	stripe := chunk / dataDisks
+	index := chunk % dataDisks
+
+	var parity, disk int64
+	switch a.Layout {
+	case MD_LEFT_ASYMMETRIC:
+		parity = dataDisks - stripe%disks
+		disk = index
+		if disk >= parity {
+			disk++
+		}
+	case MD_RIGHT_ASYMMETRIC:
+		parity = stripe % disks
+		disk = index
+		if disk >= parity {
+			disk++
+		}
+	case MD_LEFT_SYMMETRIC:
+		parity = dataDisks - stripe%disks
+		disk = (parity + 1 + index) % disks
+	case MD_RIGHT_SYMMETRIC:
+		parity = stripe % disks
+		disk = (parity + 1 + index) % disks
+	case MD_PARITY_0:
+		disk = index + 1
+	case MD_PARITY_N:
+		disk = index
+	}
+
+	return int(disk), stripe*a.ChunkSize + inner
+}
+
+// readChunk reads from one member, rebuilding the data from the other
+// members and the parity when the member is missing.
+func (a *MdArray) readChunk(p []byte, disk int, off int64) error {
+	if a.data[disk] != nil {
+		_, err := a.data[disk].ReadAt(p, off)
+		return err
+	}
+
+	for i := range p {
+		p[i] = 0
+	}
+
+	buf := make([]byte, len(p))
+	for i, member := range a.data {
+		if i == disk {
+			continue
+		}
+
+		if _, err := member.ReadAt(buf, off); err != nil {
+			return err
+		}
+
+		for j := range buf {
+			p[j] ^= buf[j]
+		}
+	}
+
+	return nil
+}
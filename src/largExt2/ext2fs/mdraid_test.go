@@ -0,0 +1,274 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+const (
+	mdTestChunk      = 4096
+	mdTestMemberSize = 64 * 1024 //Data area of a member, 0.90 wants 64K
+	mdTestDataOffset = 8 * 1024  //Data offset of the 1.1 and 1.2 members
+	mdTestParity     = -1
+)
+
+// mdTestLayouts places the chunks of four raid5 stripes on four disks, as
+// drawn in the md documentation. The numbers are the data chunks of the
+// stripe.
+var mdTestLayouts = map[uint32][4][4]int{
+	MD_LEFT_ASYMMETRIC:  {{0, 1, 2, mdTestParity}, {0, 1, mdTestParity, 2}, {0, mdTestParity, 1, 2}, {mdTestParity, 0, 1, 2}},
+	MD_RIGHT_ASYMMETRIC: {{mdTestParity, 0, 1, 2}, {0, mdTestParity, 1, 2}, {0, 1, mdTestParity, 2}, {0, 1, 2, mdTestParity}},
+	MD_LEFT_SYMMETRIC:   {{0, 1, 2, mdTestParity}, {1, 2, mdTestParity, 0}, {2, mdTestParity, 0, 1}, {mdTestParity, 0, 1, 2}},
+	MD_RIGHT_SYMMETRIC:  {{mdTestParity, 0, 1, 2}, {2, mdTestParity, 0, 1}, {1, 2, mdTestParity, 0}, {0, 1, 2, mdTestParity}},
+	MD_PARITY_0:         {{mdTestParity, 0, 1, 2}, {mdTestParity, 0, 1, 2}, {mdTestParity, 0, 1, 2}, {mdTestParity, 0, 1, 2}},
+	MD_PARITY_N:         {{0, 1, 2, mdTestParity}, {0, 1, 2, mdTestParity}, {0, 1, 2, mdTestParity}, {0, 1, 2, mdTestParity}},
+}
+
+type mdTestArray struct {
+	version string
+	level   int32
+	layout  uint32
+	disks   int
+}
+
+// mdTestData splits data into the data areas of the members of array.
+func mdTestData(array mdTestArray, data []byte) [][]byte {
+	areas := make([][]byte, array.disks)
+	for i := range areas {
+		areas[i] = make([]byte, mdTestMemberSize)
+	}
+	chunk := func(n int) []byte {
+		return data[n*mdTestChunk : (n+1)*mdTestChunk]
+	}
+
+	for stripe := 0; stripe < mdTestMemberSize/mdTestChunk; stripe++ {
+		off := stripe * mdTestChunk
+		switch array.level {
+		case MD_LEVEL_RAID1:
+			for _, area := range areas {
+				copy(area[off:], data[off:off+mdTestChunk])
+			}
+		case MD_LEVEL_RAID0:
+			for disk, area := range areas {
+				copy(area[off:], chunk(stripe*array.disks+disk))
+			}
+		case MD_LEVEL_RAID5:
+			row := mdTestLayouts[array.layout][stripe%4]
+			for disk, area := range areas {
+				if row[disk] != mdTestParity {
+					copy(area[off:], chunk(stripe*(array.disks-1)+row[disk]))
+					continue
+				}
+				for n := 0; n < array.disks-1; n++ {
+					for i, b := range chunk(stripe*(array.disks-1) + n) {
+						area[off+i] ^= b
+					}
+				}
+			}
+		}
+	}
+	return areas
+}
+
+// mdTestMember returns a member image holding area with a superblock of
+// the version of array.
+func mdTestMember(t *testing.T, array mdTestArray, role int, events uint64, area []byte) memImage {
+	t.Helper()
+
+	uuid := [16]byte{0x12, 0x34, 0x56, 0x78, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	chunk := uint32(mdTestChunk)
+	if array.level == MD_LEVEL_RAID1 {
+		chunk = 0
+	}
+
+	if array.version == "0.90" {
+		member := make(memImage, mdTestMemberSize+MD_RESERVED_BYTES)
+		copy(member, area)
+
+		words := make([]uint32, MD_SB_BYTES/4)
+		words[0], words[1], words[2] = MD_SB_MAGIC, 0, 90
+		words[5] = binary.LittleEndian.Uint32(uuid[0:])
+		words[13] = binary.LittleEndian.Uint32(uuid[4:])
+		words[14] = binary.LittleEndian.Uint32(uuid[8:])
+		words[15] = binary.LittleEndian.Uint32(uuid[12:])
+		words[7] = uint32(array.level)
+		words[8] = mdTestMemberSize / 1024
+		words[10] = uint32(array.disks)
+		words[39], words[40] = uint32(events), uint32(events>>32)
+		words[64], words[65] = array.layout, chunk
+		words[MD_SB_90_THIS_DISK+3] = uint32(role)
+
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, words)
+		copy(member[mdTestMemberSize:], buf.Bytes())
+		return member
+	}
+
+	sb := mdSuperBlock1{
+		Magic:        MD_SB_MAGIC,
+		MajorVersion: 1,
+		SetUUID:      uuid,
+		Level:        array.level,
+		Layout:       array.layout,
+		ChunkSize:    chunk / SECTOR_SIZE,
+		RaidDisks:    uint32(array.disks),
+		DataSize:     mdTestMemberSize / SECTOR_SIZE,
+		DevNumber:    uint32(role) + 1,
+		Events:       events,
+	}
+	copy(sb.SetName[:], "test:0")
+	if array.level != MD_LEVEL_RAID0 {
+		sb.Size = mdTestMemberSize / SECTOR_SIZE
+	}
+
+	var member memImage
+	var sbOffset int64
+	switch array.version {
+	case "1.0":
+		member = make(memImage, mdTestMemberSize+8*1024)
+		sbOffset = mdTestMemberSize
+	case "1.1":
+		member = make(memImage, mdTestDataOffset+mdTestMemberSize)
+		sb.DataOffset = mdTestDataOffset / SECTOR_SIZE
+	case "1.2":
+		member = make(memImage, mdTestDataOffset+mdTestMemberSize)
+		sbOffset = MD_SB_1_2_OFFSET
+		sb.DataOffset = mdTestDataOffset / SECTOR_SIZE
+	default:
+		t.Fatalf("unknown md version %s", array.version)
+	}
+	copy(member[sb.DataOffset*SECTOR_SIZE:], area)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, sb)
+	buf.Write(make([]byte, MD_SB_1_ROLES-buf.Len()))
+	//The role of device 0 is a spare, the members are devices 1 and up
+	binary.Write(buf, binary.LittleEndian, uint16(MD_ROLE_SPARE))
+	for i := 0; i < array.disks; i++ {
+		binary.Write(buf, binary.LittleEndian, uint16(i))
+	}
+	copy(member[sbOffset:], buf.Bytes())
+	return member
+}
+
+func (array mdTestArray) dataSize() int {
+	switch array.level {
+	case MD_LEVEL_RAID1:
+		return mdTestMemberSize
+	case MD_LEVEL_RAID0:
+		return mdTestMemberSize * array.disks
+	}
+	return mdTestMemberSize * (array.disks - 1)
+}
+
+func assembleMdTest(members []memImage) (*MdArray, error) {
+	readers := make([]io.ReaderAt, len(members))
+	sizes := make([]int64, len(members))
+	for i, member := range members {
+		readers[i] = member
+		sizes[i] = int64(len(member))
+	}
+	return AssembleMdArray(readers, sizes)
+}
+
+func TestMdArray(t *testing.T) {
+	arrays := []mdTestArray{
+		{"1.2", MD_LEVEL_RAID0, 0, 3},
+		{"0.90", MD_LEVEL_RAID0, 0, 2},
+		{"1.0", MD_LEVEL_RAID1, 0, 2},
+		{"1.1", MD_LEVEL_RAID1, 0, 3},
+		{"1.2", MD_LEVEL_RAID5, MD_LEFT_ASYMMETRIC, 4},
+		{"1.1", MD_LEVEL_RAID5, MD_RIGHT_ASYMMETRIC, 4},
+		{"1.0", MD_LEVEL_RAID5, MD_LEFT_SYMMETRIC, 4},
+		{"0.90", MD_LEVEL_RAID5, MD_RIGHT_SYMMETRIC, 4},
+		{"1.2", MD_LEVEL_RAID5, MD_PARITY_0, 4},
+		{"1.2", MD_LEVEL_RAID5, MD_PARITY_N, 4},
+	}
+
+	for _, array := range arrays {
+		name := fmt.Sprintf("%s raid%d layout %d", array.version, array.level, array.layout)
+		t.Run(name, func(t *testing.T) {
+			data := make([]byte, array.dataSize())
+			rand.New(rand.NewSource(int64(array.level))).Read(data)
+
+			members := make([]memImage, array.disks)
+			for role, area := range mdTestData(array, data) {
+				members[role] = mdTestMember(t, array, role, 10, area)
+			}
+
+			//The members are given in another order than their roles
+			members[0], members[1] = members[1], members[0]
+
+			sb, err := ReadMdSuperBlock(members[0], int64(len(members[0])))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sb == nil || sb.Version != array.version || sb.Role != 1 || sb.DataSize != mdTestMemberSize {
+				t.Fatalf("read superblock %v", sb)
+			}
+
+			md, err := assembleMdTest(members)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRandomReads(t, md, data)
+
+			//Each member in turn is missing
+			for missing := range members {
+				others := append(append([]memImage(nil), members[:missing]...), members[missing+1:]...)
+				md, err := assembleMdTest(others)
+				if array.level == MD_LEVEL_RAID0 {
+					if err == nil {
+						t.Fatal("raid0 assembled without a member")
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkRandomReads(t, md, data)
+			}
+		})
+	}
+}
+
+func TestMdArrayStaleMember(t *testing.T) {
+	array := mdTestArray{"1.2", MD_LEVEL_RAID5, MD_LEFT_SYMMETRIC, 4}
+	data := make([]byte, array.dataSize())
+	rand.New(rand.NewSource(1)).Read(data)
+
+	//The member of role 2 was out of the array while it got written
+	old := make([]byte, len(data))
+	members := make([]memImage, array.disks)
+	areas := mdTestData(array, data)
+	for role, area := range mdTestData(array, old) {
+		if role == 2 {
+			members[role] = mdTestMember(t, array, role, 7, area)
+		} else {
+			members[role] = mdTestMember(t, array, role, 12, areas[role])
+		}
+	}
+
+	md, err := assembleMdTest(members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md.Stale) != 1 || md.Stale[0].Role != 2 || md.Members[2] != nil || md.Events != 12 {
+		t.Fatalf("assembled %s", md)
+	}
+	if !strings.Contains(md.String(), "stale member role 2") {
+		t.Fatalf("the stale member isn't reported by %q", md.String())
+	}
+	checkRandomReads(t, md, data)
+
+	//Without a fresh member too, the array can't be rebuilt
+	_, err = assembleMdTest(append(members[:1:1], members[2:]...))
+	if err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Fatalf("assembling with a stale and a missing member gave %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package ext2fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// MappedImage reads a local image file through a read-only memory mapping,
+// a read copies from memory instead of making a system call. The file must
+// not shrink while mapped, touching a page past its new end kills the
+// process.
+type MappedImage struct {
+	file *os.File
+	data []byte
+}
+
+// slicer is storage that can hand out its bytes without copying them.
+type slicer interface {
+	// slice returns n bytes at off, or nil when they are not mapped.
+	slice(off int64, n int) []byte
+}
+
+// MapFile maps the regular file. Block devices, empty files and files larger
+// than the address space are refused, they are read with pread instead. The
+// MappedImage owns the file once mapped.
+func MapFile(file *os.File) (*MappedImage, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, errors.New(fmt.Sprintf("%s is not a regular file, not mapped", file.Name()))
+	}
+
+	size := info.Size()
+	if size == 0 || size > int64(^uint(0)>>1) {
+		return nil, errors.New(fmt.Sprintf("%s size %d can't be mapped", file.Name(), size))
+	}
+
+	data, err := mmapFile(file, int(size))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't map %s: %s", file.Name(), err.Error()))
+	}
+
+	return &MappedImage{file: file, data: data}, nil
+}
+
+func (m *MappedImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MappedImage) slice(off int64, n int) []byte {
+	if off < 0 || n < 0 || off+int64(n) > int64(len(m.data)) {
+		return nil
+	}
+	return m.data[off : off+int64(n) : off+int64(n)]
+}
+
+func (m *MappedImage) Size() int64 {
+	return int64(len(m.data))
+}
+
+func (m *MappedImage) String() string {
+	return fmt.Sprintf("%s mapped, %d bytes", m.file.Name(), len(m.data))
+}
+
+func (m *MappedImage) Close() error {
+	err := munmap(m.data)
+	m.data = nil
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package ext2fs
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported on this system")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
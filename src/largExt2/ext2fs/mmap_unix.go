@@ -0,0 +1,16 @@
+//go:build unix
+
+package ext2fs
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,629 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	NBD_DEFAULT_PORT = "10809"
+
+	nbdMagic            = 0x4e42444d41474943
+	nbdOptionMagic      = 0x49484156454F5054
+	nbdReplyOptionMagic = 0x3e889045565a9
+	nbdRequestMagic     = 0x25609513
+	nbdSimpleReplyMagic = 0x67446698
+	nbdStructuredMagic  = 0x668e33ef
+
+	nbdFlagFixedNewstyle = 1 << 0
+	nbdFlagNoZeroes      = 1 << 1
+
+	nbdOptExportName      = 1
+	nbdOptGo              = 7
+	nbdOptStructuredReply = 8
+
+	nbdRepAck      = 1
+	nbdRepInfo     = 3
+	nbdRepErrUnsup = 1<<31 + 1
+	nbdInfoExport  = 0
+
+	nbdFlagHasFlags  = 1 << 0
+	nbdFlagReadOnly  = 1 << 1
+	nbdFlagSendFlush = 1 << 2
+
+	nbdCmdRead  = 0
+	nbdCmdWrite = 1
+	nbdCmdDisc  = 2
+	nbdCmdFlush = 3
+
+	nbdReplyFlagDone       = 1 << 0
+	nbdReplyTypeNone       = 0
+	nbdReplyTypeOffsetData = 1
+	nbdReplyTypeOffsetHole = 2
+	nbdReplyTypeError      = 1 << 15
+
+	//Larger reads are split into pipelined requests of this size
+	nbdMaxRequest = 1024 * 1024
+)
+
+type nbdRequestHeader struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Offset uint64
+	Length uint32
+}
+
+type nbdOptionReply struct {
+	Magic  uint64
+	Option uint32
+	Type   uint32
+	Length uint32
+}
+
+type nbdStructuredReply struct {
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Length uint32
+}
+
+// nbdRequest is a request waiting for its reply. Read data lands in buf,
+// which holds the bytes from off.
+type nbdRequest struct {
+	buf  []byte
+	off  int64
+	err  error
+	done chan struct{}
+}
+
+// NbdClient reads, and writes unless the export is read-only, a device
+// exported by an NBD server. Requests are pipelined: they are sent without
+// waiting for the replies, which a single goroutine dispatches by handle.
+type NbdClient struct {
+	Export     string
+	conn       net.Conn
+	size       int64
+	flags      uint16
+	structured bool
+	sendMu     sync.Mutex
+	mu         sync.Mutex
+	pending    map[uint64]*nbdRequest
+	handle     uint64
+	err        error
+}
+
+// IsNbdUrl reports whether source is an nbd:// URL.
+func IsNbdUrl(source string) bool {
+	lower := strings.ToLower(source)
+	return strings.HasPrefix(lower, "nbd://") || strings.HasPrefix(lower, "nbd+unix://")
+}
+
+// OpenNbdUrl connects to nbd://host[:port]/export, or to
+// nbd+unix:///export?socket=path for a Unix socket.
+func OpenNbdUrl(rawUrl string) (*NbdClient, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	export := strings.TrimPrefix(u.Path, "/")
+	switch strings.ToLower(u.Scheme) {
+	case "nbd":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), NBD_DEFAULT_PORT)
+		}
+		return DialNbd("tcp", host, export)
+	case "nbd+unix":
+		socket := u.Query().Get("socket")
+		if socket == "" {
+			return nil, errors.New(fmt.Sprintf("%s names no socket", rawUrl))
+		}
+		return DialNbd("unix", socket, export)
+	default:
+		return nil, errors.New(fmt.Sprintf("%s is not an NBD URL", rawUrl))
+	}
+}
+
+// DialNbd connects to the NBD server at address and opens export.
+func DialNbd(network, address, export string) (*NbdClient, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewNbdClient(conn, export)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewNbdClient runs the fixed newstyle handshake on conn. The export is
+// opened with NBD_OPT_GO, or NBD_OPT_EXPORT_NAME on servers that don't know
+// it, and structured replies are used when the server offers them.
+func NewNbdClient(conn net.Conn, export string) (*NbdClient, error) {
+	c := &NbdClient{Export: export, conn: conn, pending: make(map[uint64]*nbdRequest)}
+
+	var greeting struct {
+		Magic       uint64
+		OptionMagic uint64
+		Flags       uint16
+	}
+	if err := binary.Read(conn, binary.BigEndian, &greeting); err != nil {
+		return nil, err
+	}
+
+	if greeting.Magic != nbdMagic || greeting.OptionMagic != nbdOptionMagic {
+		return nil, errors.New("Not a newstyle NBD server")
+	}
+
+	if greeting.Flags&nbdFlagFixedNewstyle == 0 {
+		return nil, errors.New("NBD server doesn't support fixed newstyle negotiation")
+	}
+
+	clientFlags := uint32(nbdFlagFixedNewstyle)
+	noZeroes := greeting.Flags&nbdFlagNoZeroes != 0
+	if noZeroes {
+		clientFlags |= nbdFlagNoZeroes
+	}
+	if err := binary.Write(conn, binary.BigEndian, clientFlags); err != nil {
+		return nil, err
+	}
+
+	replyType, _, err := c.option(nbdOptStructuredReply, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.structured = replyType == nbdRepAck
+
+	data := new(bytes.Buffer)
+	binary.Write(data, binary.BigEndian, uint32(len(export)))
+	data.WriteString(export)
+	binary.Write(data, binary.BigEndian, uint16(0))
+
+	replyType, info, err := c.option(nbdOptGo, data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	switch replyType {
+	case nbdRepAck:
+		if info == nil {
+			return nil, errors.New("NBD server sent no export information")
+		}
+		c.size = int64(binary.BigEndian.Uint64(info[2:]))
+		c.flags = binary.BigEndian.Uint16(info[10:])
+	case nbdRepErrUnsup:
+		if err := c.exportName(noZeroes); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nbdOptionError(export, replyType)
+	}
+
+	go c.receive()
+	return c, nil
+}
+
+// option sends an option and reads its replies up to the final one, which
+// is returned with the export information of an NBD_REP_INFO if any.
+func (c *NbdClient) option(option uint32, data []byte) (uint32, []byte, error) {
+	header := struct {
+		Magic  uint64
+		Option uint32
+		Length uint32
+	}{nbdOptionMagic, option, uint32(len(data))}
+	if err := binary.Write(c.conn, binary.BigEndian, header); err != nil {
+		return 0, nil, err
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		return 0, nil, err
+	}
+
+	var info []byte
+	for {
+		reply := nbdOptionReply{}
+		if err := binary.Read(c.conn, binary.BigEndian, &reply); err != nil {
+			return 0, nil, err
+		}
+
+		if reply.Magic != nbdReplyOptionMagic || reply.Option != option {
+			return 0, nil, errors.New("Bad NBD option reply")
+		}
+
+		payload := make([]byte, reply.Length)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			return 0, nil, err
+		}
+
+		if reply.Type != nbdRepInfo {
+			return reply.Type, info, nil
+		}
+
+		//Other information types are ignored
+		if len(payload) >= 12 && binary.BigEndian.Uint16(payload) == nbdInfoExport {
+			info = payload
+		}
+	}
+}
+
+// exportName opens the export the old way, the server closes the connection
+// when it doesn't exist.
+func (c *NbdClient) exportName(noZeroes bool) error {
+	header := struct {
+		Magic  uint64
+		Option uint32
+		Length uint32
+	}{nbdOptionMagic, nbdOptExportName, uint32(len(c.Export))}
+	if err := binary.Write(c.conn, binary.BigEndian, header); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(c.conn, c.Export); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 10)
+	if !noZeroes {
+		reply = make([]byte, 10+124)
+	}
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		return errors.New(fmt.Sprintf("NBD export %q refused", c.Export))
+	}
+
+	c.size = int64(binary.BigEndian.Uint64(reply))
+	c.flags = binary.BigEndian.Uint16(reply[8:])
+	return nil
+}
+
+func nbdOptionError(export string, replyType uint32) error {
+	names := map[uint32]string{
+		1<<31 + 2: "denied by policy",
+		1<<31 + 3: "invalid",
+		1<<31 + 4: "not supported on this platform",
+		1<<31 + 5: "TLS required",
+		1<<31 + 6: "unknown export",
+		1<<31 + 7: "server shutting down",
+	}
+
+	if name, ok := names[replyType]; ok {
+		return errors.New(fmt.Sprintf("NBD export %q: %s", export, name))
+	}
+	return errors.New(fmt.Sprintf("NBD export %q: error 0x%08X", export, replyType))
+}
+
+// receive dispatches the replies to the waiting requests until the
+// connection fails or is closed, which fails every request left.
+func (c *NbdClient) receive() {
+	var err error
+	for err == nil {
+		if c.structured {
+			err = c.receiveStructured()
+		} else {
+			err = c.receiveSimple()
+		}
+	}
+
+	c.mu.Lock()
+	c.err = err
+	for handle, request := range c.pending {
+		request.err = err
+		close(request.done)
+		delete(c.pending, handle)
+	}
+	c.mu.Unlock()
+}
+
+func (c *NbdClient) request(handle uint64) (*nbdRequest, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	request, ok := c.pending[handle]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("NBD reply to unknown handle %d", handle))
+	}
+	return request, nil
+}
+
+func (c *NbdClient) finish(handle uint64, request *nbdRequest) {
+	c.mu.Lock()
+	delete(c.pending, handle)
+	c.mu.Unlock()
+	close(request.done)
+}
+
+func (c *NbdClient) receiveSimple() error {
+	var magic uint32
+	if err := binary.Read(c.conn, binary.BigEndian, &magic); err != nil {
+		return err
+	}
+
+	if magic != nbdSimpleReplyMagic {
+		return errors.New("Bad NBD reply magic")
+	}
+	return c.simpleReply()
+}
+
+// simpleReply reads a simple reply, past its magic.
+func (c *NbdClient) simpleReply() error {
+	var reply struct {
+		Error  uint32
+		Handle uint64
+	}
+	if err := binary.Read(c.conn, binary.BigEndian, &reply); err != nil {
+		return err
+	}
+
+	request, err := c.request(reply.Handle)
+	if err != nil {
+		return err
+	}
+
+	//Once structured replies are negotiated, the data of a read only comes
+	//in chunks
+	if c.structured && request.buf != nil {
+		return errors.New("Simple NBD reply to a read after structured replies were negotiated")
+	}
+
+	//Only successful reads carry data
+	if reply.Error != 0 {
+		request.err = nbdError(reply.Error)
+	} else if request.buf != nil {
+		if _, err := io.ReadFull(c.conn, request.buf); err != nil {
+			return err
+		}
+	}
+
+	c.finish(reply.Handle, request)
+	return nil
+}
+
+func (c *NbdClient) receiveStructured() error {
+	var magic uint32
+	if err := binary.Read(c.conn, binary.BigEndian, &magic); err != nil {
+		return err
+	}
+
+	//Servers may still answer the other requests with simple replies
+	if magic == nbdSimpleReplyMagic {
+		return c.simpleReply()
+	}
+	if magic != nbdStructuredMagic {
+		return errors.New("Bad NBD reply magic")
+	}
+
+	reply := nbdStructuredReply{}
+	if err := binary.Read(c.conn, binary.BigEndian, &reply); err != nil {
+		return err
+	}
+
+	request, err := c.request(reply.Handle)
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, reply.Length)
+	if _, err := io.ReadFull(c.conn, payload); err != nil {
+		return err
+	}
+
+	switch {
+	case reply.Type == nbdReplyTypeNone:
+	case reply.Type == nbdReplyTypeOffsetData || reply.Type == nbdReplyTypeOffsetHole:
+		if len(payload) < 8 || request.buf == nil {
+			return errors.New("Bad NBD data chunk")
+		}
+
+		start := int64(binary.BigEndian.Uint64(payload)) - request.off
+		length := int64(len(payload) - 8)
+		if reply.Type == nbdReplyTypeOffsetHole {
+			if len(payload) != 12 {
+				return errors.New("Bad NBD hole chunk")
+			}
+			length = int64(binary.BigEndian.Uint32(payload[8:]))
+		}
+
+		if start < 0 || start+length > int64(len(request.buf)) {
+			return errors.New("NBD chunk outside of the request")
+		}
+
+		if reply.Type == nbdReplyTypeOffsetHole {
+			zero(request.buf[start : start+length])
+		} else {
+			copy(request.buf[start:], payload[8:])
+		}
+	case reply.Type&nbdReplyTypeError != 0:
+		if len(payload) < 4 {
+			return errors.New("Bad NBD error chunk")
+		}
+		request.err = nbdError(binary.BigEndian.Uint32(payload))
+	default:
+		return errors.New(fmt.Sprintf("Unknown NBD reply type %d", reply.Type))
+	}
+
+	if reply.Flags&nbdReplyFlagDone != 0 {
+		c.finish(reply.Handle, request)
+	}
+	return nil
+}
+
+func nbdError(code uint32) error {
+	names := map[uint32]string{1: "EPERM", 5: "EIO", 12: "ENOMEM", 22: "EINVAL", 28: "ENOSPC", 75: "EOVERFLOW", 95: "ENOTSUP", 108: "ESHUTDOWN"}
+	if name, ok := names[code]; ok {
+		return errors.New("NBD server error " + name)
+	}
+	return errors.New(fmt.Sprintf("NBD server error %d", code))
+}
+
+// send queues a request, buf receives the data of a read.
+func (c *NbdClient) send(command uint16, off int64, length int, data []byte, buf []byte) (*nbdRequest, error) {
+	request := &nbdRequest{buf: buf, off: off, done: make(chan struct{})}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.handle++
+	handle := c.handle
+	c.pending[handle] = request
+	c.mu.Unlock()
+
+	header := nbdRequestHeader{
+		Magic:  nbdRequestMagic,
+		Type:   command,
+		Handle: handle,
+		Offset: uint64(off),
+		Length: uint32(length),
+	}
+
+	packet := new(bytes.Buffer)
+	binary.Write(packet, binary.BigEndian, header)
+	packet.Write(data)
+
+	c.sendMu.Lock()
+	_, err := c.conn.Write(packet.Bytes())
+	c.sendMu.Unlock()
+
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, handle)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return request, nil
+}
+
+// nbdWait waits for the replies of all requests and returns the first error.
+func nbdWait(requests []*nbdRequest) error {
+	var err error
+	for _, request := range requests {
+		<-request.done
+		if request.err != nil && err == nil {
+			err = request.err
+		}
+	}
+	return err
+}
+
+func (c *NbdClient) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= c.size {
+		return 0, io.EOF
+	}
+
+	want := p
+	if int64(len(want)) > c.size-off {
+		want = want[:c.size-off]
+	}
+
+	//All pieces are sent before the first reply is waited for
+	requests := make([]*nbdRequest, 0, len(want)/nbdMaxRequest+1)
+	for n := 0; n < len(want); n += nbdMaxRequest {
+		piece := want[n:]
+		if len(piece) > nbdMaxRequest {
+			piece = piece[:nbdMaxRequest]
+		}
+
+		request, err := c.send(nbdCmdRead, off+int64(n), len(piece), nil, piece)
+		if err != nil {
+			nbdWait(requests)
+			return 0, err
+		}
+		requests = append(requests, request)
+	}
+
+	if err := nbdWait(requests); err != nil {
+		return 0, err
+	}
+
+	if len(want) < len(p) {
+		return len(want), io.EOF
+	}
+	return len(want), nil
+}
+
+func (c *NbdClient) WriteAt(p []byte, off int64) (int, error) {
+	if c.ReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	if off < 0 || off+int64(len(p)) > c.size {
+		return 0, errors.New(fmt.Sprintf("NBD write of %d bytes at %d is beyond the %d bytes export", len(p), off, c.size))
+	}
+
+	requests := make([]*nbdRequest, 0, len(p)/nbdMaxRequest+1)
+	for n := 0; n < len(p); n += nbdMaxRequest {
+		piece := p[n:]
+		if len(piece) > nbdMaxRequest {
+			piece = piece[:nbdMaxRequest]
+		}
+
+		request, err := c.send(nbdCmdWrite, off+int64(n), len(piece), piece, nil)
+		if err != nil {
+			nbdWait(requests)
+			return 0, err
+		}
+		requests = append(requests, request)
+	}
+
+	if err := nbdWait(requests); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sync asks the server to flush the writes it acknowledged, when it
+// supports flushing.
+func (c *NbdClient) Sync() error {
+	if c.flags&nbdFlagSendFlush == 0 {
+		return nil
+	}
+
+	request, err := c.send(nbdCmdFlush, 0, 0, nil, nil)
+	if err != nil {
+		return err
+	}
+	return nbdWait([]*nbdRequest{request})
+}
+
+// ReadOnly reports whether the server exports the device read-only.
+func (c *NbdClient) ReadOnly() bool {
+	return c.flags&nbdFlagHasFlags != 0 && c.flags&nbdFlagReadOnly != 0
+}
+
+func (c *NbdClient) Size() int64 {
+	return c.size
+}
+
+func (c *NbdClient) String() string {
+	mode := "read-write"
+	if c.ReadOnly() {
+		mode = "read-only"
+	}
+	return fmt.Sprintf("NBD export %q, %d bytes, %s", c.Export, c.size, mode)
+}
+
+// Close sends NBD_CMD_DISC, which has no reply, and closes the connection.
+func (c *NbdClient) Close() error {
+	header := nbdRequestHeader{Magic: nbdRequestMagic, Type: nbdCmdDisc}
+
+	c.sendMu.Lock()
+	binary.Write(c.conn, binary.BigEndian, header)
+	c.sendMu.Unlock()
+
+	return c.conn.Close()
+}
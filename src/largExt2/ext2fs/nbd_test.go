@@ -0,0 +1,584 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Structured replies of nbdTestServer split reads in chunks of this size.
+const nbdTestChunk = 16 * 1024
+
+// nbdTestServer exports data under the name export. The options are set
+// before start.
+type nbdTestServer struct {
+	export     string
+	readOnly   bool
+	structured bool //Offer structured replies
+	noGo       bool //Answer NBD_OPT_GO with NBD_REP_ERR_UNSUP
+	zeroes     bool //Leave out NBD_FLAG_NO_ZEROES
+	reverse    int  //Hold reads back until this many came, reply last first
+	silent     bool //Never reply to a request
+	simpleRead bool //Answer reads with simple replies even when structured
+
+	listener net.Listener
+	got      chan nbdRequestHeader
+	mu       sync.Mutex
+	data     []byte
+	flushes  int
+	conns    []net.Conn
+}
+
+// start listens on a loopback port and returns the URL of the export.
+func (s *nbdTestServer) start(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = listener
+	s.got = make(chan nbdRequestHeader, 1024)
+
+	var wg sync.WaitGroup
+	accepting := make(chan struct{})
+	go func() {
+		defer close(accepting)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				s.serve(conn)
+			}()
+		}
+	}()
+
+	t.Cleanup(func() {
+		listener.Close()
+		<-accepting
+		s.drop()
+		wg.Wait()
+	})
+	return "nbd://" + listener.Addr().String() + "/" + s.export
+}
+
+// drop closes the connections of the clients.
+func (s *nbdTestServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *nbdTestServer) snapshot() ([]byte, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]byte(nil), s.data...), s.flushes
+}
+
+func (s *nbdTestServer) transmissionFlags() uint16 {
+	flags := uint16(nbdFlagHasFlags | nbdFlagSendFlush)
+	if s.readOnly {
+		flags |= nbdFlagReadOnly
+	}
+	return flags
+}
+
+func nbdOptionReplyTo(conn net.Conn, option, replyType uint32, payload []byte) error {
+	packet := new(bytes.Buffer)
+	binary.Write(packet, binary.BigEndian, nbdOptionReply{nbdReplyOptionMagic, option, replyType, uint32(len(payload))})
+	packet.Write(payload)
+	_, err := conn.Write(packet.Bytes())
+	return err
+}
+
+// serve runs the handshake, then the transmission phase.
+func (s *nbdTestServer) serve(conn net.Conn) {
+	greeting := struct {
+		Magic       uint64
+		OptionMagic uint64
+		Flags       uint16
+	}{nbdMagic, nbdOptionMagic, nbdFlagFixedNewstyle}
+	if !s.zeroes {
+		greeting.Flags |= nbdFlagNoZeroes
+	}
+	if binary.Write(conn, binary.BigEndian, greeting) != nil {
+		return
+	}
+
+	var clientFlags uint32
+	if binary.Read(conn, binary.BigEndian, &clientFlags) != nil {
+		return
+	}
+
+	structured := false
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if binary.Read(conn, binary.BigEndian, &header) != nil {
+			return
+		}
+		data := make([]byte, header.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		var err error
+		switch {
+		case header.Option == nbdOptStructuredReply && s.structured:
+			structured = true
+			err = nbdOptionReplyTo(conn, header.Option, nbdRepAck, nil)
+		case header.Option == nbdOptGo && !s.noGo:
+			name := string(data[4 : 4+binary.BigEndian.Uint32(data)])
+			if name != s.export {
+				err = nbdOptionReplyTo(conn, header.Option, 1<<31+6, nil)
+				break
+			}
+
+			info := make([]byte, 12)
+			binary.BigEndian.PutUint16(info, nbdInfoExport)
+			binary.BigEndian.PutUint64(info[2:], uint64(len(s.data)))
+			binary.BigEndian.PutUint16(info[10:], s.transmissionFlags())
+			if err = nbdOptionReplyTo(conn, header.Option, nbdRepInfo, info); err == nil {
+				err = nbdOptionReplyTo(conn, header.Option, nbdRepAck, nil)
+			}
+			if err == nil {
+				s.transmit(conn, structured)
+				return
+			}
+		case header.Option == nbdOptExportName:
+			if string(data) != s.export {
+				return
+			}
+
+			reply := make([]byte, 10)
+			if clientFlags&nbdFlagNoZeroes == 0 {
+				reply = make([]byte, 10+124)
+			}
+			binary.BigEndian.PutUint64(reply, uint64(len(s.data)))
+			binary.BigEndian.PutUint16(reply[8:], s.transmissionFlags())
+			if _, err := conn.Write(reply); err == nil {
+				s.transmit(conn, structured)
+			}
+			return
+		default:
+			err = nbdOptionReplyTo(conn, header.Option, nbdRepErrUnsup, nil)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *nbdTestServer) transmit(conn net.Conn, structured bool) {
+	var held []nbdRequestHeader
+	for {
+		request := nbdRequestHeader{}
+		if binary.Read(conn, binary.BigEndian, &request) != nil {
+			return
+		}
+
+		var payload []byte
+		if request.Type == nbdCmdWrite {
+			payload = make([]byte, request.Length)
+			if _, err := io.ReadFull(conn, payload); err != nil {
+				return
+			}
+		}
+
+		select {
+		case s.got <- request:
+		default:
+		}
+		if s.silent {
+			continue
+		}
+
+		var reply []byte
+		switch request.Type {
+		case nbdCmdRead:
+			if s.reverse == 0 {
+				reply = s.readReply(request, structured && !s.simpleRead)
+				break
+			}
+
+			held = append(held, request)
+			if len(held) < s.reverse {
+				continue
+			}
+			for i := len(held) - 1; i >= 0; i-- {
+				reply = append(reply, s.readReply(held[i], structured)...)
+			}
+			held = nil
+		case nbdCmdWrite:
+			s.mu.Lock()
+			copy(s.data[request.Offset:], payload)
+			s.mu.Unlock()
+			reply = nbdDoneReply(request.Handle)
+		case nbdCmdFlush:
+			s.mu.Lock()
+			s.flushes++
+			s.mu.Unlock()
+			reply = nbdDoneReply(request.Handle)
+		case nbdCmdDisc:
+			return
+		}
+
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// nbdDoneReply is a successful reply without data. It is a simple reply
+// even when structured replies were negotiated, as qemu-nbd sends for writes
+// and flushes.
+func nbdDoneReply(handle uint64) []byte {
+	packet := new(bytes.Buffer)
+	binary.Write(packet, binary.BigEndian, []uint32{nbdSimpleReplyMagic, 0})
+	binary.Write(packet, binary.BigEndian, handle)
+	return packet.Bytes()
+}
+
+// readReply answers a read with a simple reply, or with chunks sent last
+// first, zero chunks as holes, and the first one done.
+func (s *nbdTestServer) readReply(request nbdRequestHeader, structured bool) []byte {
+	s.mu.Lock()
+	data := append([]byte(nil), s.data[request.Offset:request.Offset+uint64(request.Length)]...)
+	s.mu.Unlock()
+
+	packet := new(bytes.Buffer)
+	if !structured {
+		binary.Write(packet, binary.BigEndian, []uint32{nbdSimpleReplyMagic, 0})
+		binary.Write(packet, binary.BigEndian, request.Handle)
+		packet.Write(data)
+		return packet.Bytes()
+	}
+
+	for start := (len(data) - 1) / nbdTestChunk * nbdTestChunk; start >= 0; start -= nbdTestChunk {
+		chunk := data[start:]
+		if len(chunk) > nbdTestChunk {
+			chunk = chunk[:nbdTestChunk]
+		}
+
+		reply := nbdStructuredReply{Type: nbdReplyTypeOffsetData, Handle: request.Handle, Length: uint32(8 + len(chunk))}
+		if start == 0 {
+			reply.Flags = nbdReplyFlagDone
+		}
+		hole := bytes.Count(chunk, []byte{0}) == len(chunk)
+		if hole {
+			reply.Type = nbdReplyTypeOffsetHole
+			reply.Length = 12
+		}
+
+		binary.Write(packet, binary.BigEndian, uint32(nbdStructuredMagic))
+		binary.Write(packet, binary.BigEndian, reply)
+		binary.Write(packet, binary.BigEndian, request.Offset+uint64(start))
+		if hole {
+			binary.Write(packet, binary.BigEndian, uint32(len(chunk)))
+		} else {
+			packet.Write(chunk)
+		}
+	}
+	return packet.Bytes()
+}
+
+// nbdTestData returns size random bytes, with runs of zeroes for holes.
+func nbdTestData(size int) []byte {
+	rng := rand.New(rand.NewSource(4))
+	data := make([]byte, size)
+	rng.Read(data)
+	for off := 0; off+2*nbdTestChunk <= size; off += 3 * nbdTestChunk {
+		zero(data[off : off+2*nbdTestChunk])
+	}
+	return data
+}
+
+func openNbdTestClient(t *testing.T, s *nbdTestServer) *NbdClient {
+	t.Helper()
+
+	client, err := OpenNbdUrl(s.start(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// checkFullRead reads the whole export at once, in pipelined requests.
+func checkFullRead(t *testing.T, client *NbdClient, data []byte) {
+	t.Helper()
+
+	buf := make([]byte, len(data))
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ReadAt(buf, 0)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the read of the whole export hangs")
+	}
+
+	if !bytes.Equal(buf, data) {
+		t.Fatal("the read of the whole export returned other bytes")
+	}
+}
+
+func TestNbdSimpleReplies(t *testing.T) {
+	data := nbdTestData(3*nbdMaxRequest + 777)
+	client := openNbdTestClient(t, &nbdTestServer{export: "disk", data: data})
+
+	if client.structured {
+		t.Fatal("structured replies used without the server offering them")
+	}
+	if client.Size() != int64(len(data)) || client.ReadOnly() {
+		t.Fatalf("opened %s", client)
+	}
+
+	checkRandomReads(t, client, data)
+	checkFullRead(t, client, data)
+}
+
+func TestNbdStructuredReplies(t *testing.T) {
+	data := nbdTestData(3*nbdMaxRequest + 777)
+	client := openNbdTestClient(t, &nbdTestServer{export: "disk", data: data, structured: true})
+
+	if !client.structured {
+		t.Fatal("structured replies not used")
+	}
+
+	checkRandomReads(t, client, data)
+	checkFullRead(t, client, data)
+}
+
+func TestNbdSimpleReplyToStructuredRead(t *testing.T) {
+	data := nbdTestData(nbdMaxRequest)
+	client := openNbdTestClient(t, &nbdTestServer{export: "disk", data: data, structured: true, simpleRead: true})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ReadAt(make([]byte, 100), 0)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "Simple NBD reply to a read") {
+			t.Fatalf("simple reply to a read gave %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the read hangs")
+	}
+}
+
+func TestNbdOutOfOrderReplies(t *testing.T) {
+	for _, structured := range []bool{false, true} {
+		data := nbdTestData(4 * nbdMaxRequest)
+		s := &nbdTestServer{export: "disk", data: data, structured: structured, reverse: 4}
+		client := openNbdTestClient(t, s)
+
+		//The server replies once it got all four requests of the read
+		checkFullRead(t, client, data)
+		if len(s.got) != 4 {
+			t.Fatalf("the read took %d requests, want 4", len(s.got))
+		}
+	}
+}
+
+func TestNbdExportNameFallback(t *testing.T) {
+	for _, zeroes := range []bool{false, true} {
+		data := nbdTestData(nbdMaxRequest)
+		client := openNbdTestClient(t, &nbdTestServer{export: "disk", data: data, noGo: true, zeroes: zeroes})
+
+		if client.Size() != int64(len(data)) {
+			t.Fatalf("size %d, want %d", client.Size(), len(data))
+		}
+		checkRandomReads(t, client, data)
+	}
+}
+
+func TestNbdUnknownExport(t *testing.T) {
+	for _, noGo := range []bool{false, true} {
+		s := &nbdTestServer{export: "disk", data: nbdTestData(nbdMaxRequest), noGo: noGo}
+		url := strings.TrimSuffix(s.start(t), "disk") + "other"
+
+		client, err := OpenNbdUrl(url)
+		if err == nil {
+			client.Close()
+			t.Fatal("unknown export opened")
+		}
+	}
+}
+
+func TestNbdWrite(t *testing.T) {
+	data := nbdTestData(3 * nbdMaxRequest)
+	s := &nbdTestServer{export: "disk", data: append([]byte(nil), data...), structured: true}
+	client := openNbdTestClient(t, s)
+
+	//Larger than a request, to be split
+	p := bytes.Repeat([]byte("written "), nbdMaxRequest/4)
+	off := int64(nbdMaxRequest / 2)
+	if n, err := client.WriteAt(p, off); n != len(p) || err != nil {
+		t.Fatalf("WriteAt = %d, %v", n, err)
+	}
+	if err := client.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(data[off:], p)
+	written, flushes := s.snapshot()
+	if !bytes.Equal(written, data) {
+		t.Fatal("the export holds other bytes")
+	}
+	if flushes != 1 {
+		t.Fatalf("%d flushes, want 1", flushes)
+	}
+
+	checkRandomReads(t, client, data)
+
+	if _, err := client.WriteAt(p, int64(len(data))-1); err == nil {
+		t.Fatal("write past the end accepted")
+	}
+}
+
+func TestNewDeviceNbd(t *testing.T) {
+	disk := readTestData(t, "ext2-1k.img.gz")
+	s := &nbdTestServer{export: "disk", data: disk, structured: true}
+
+	device, err := NewDevice(s.start(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if device.ReadOnly() {
+		t.Fatal("NBD Device of a writable export is read-only")
+	}
+
+	inodeNo, err := device.InodeFromPath("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inodeNo == EXT2_NULL_INO {
+		t.Fatal("hello not found in the root directory")
+	}
+	inode, err := device.NewInode(inodeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := device.WriteData(inode, []byte("HELLO\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	written, flushes := s.snapshot()
+	if flushes != 1 {
+		t.Fatalf("%d flushes, want 1", flushes)
+	}
+
+	//The export read on its own holds the write
+	check, err := NewDeviceFromReaderAt(memImage(written), int64(len(written)), DeviceOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode, err = check.NewInode(inodeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(NewInodeReader(check, inode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "HELLO\n" {
+		t.Fatalf("hello holds %q", data)
+	}
+}
+
+func TestNewDeviceNbdReadOnly(t *testing.T) {
+	disk := readTestData(t, "ext2-1k.img.gz")
+	s := &nbdTestServer{export: "disk", data: disk, readOnly: true}
+	url := s.start(t)
+
+	device, err := NewDevice(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if !device.ReadOnly() {
+		t.Fatal("NBD Device of a read-only export is writable")
+	}
+	if _, err := device.AllocBlock(0); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("AllocBlock on a read-only export gave %v", err)
+	}
+
+	client, err := OpenNbdUrl(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.WriteAt([]byte{1}, 0); err != ErrReadOnly {
+		t.Fatalf("WriteAt on a read-only export gave %v", err)
+	}
+}
+
+func TestNbdConnectionDrop(t *testing.T) {
+	data := nbdTestData(2 * nbdMaxRequest)
+	s := &nbdTestServer{export: "disk", data: data, structured: true, silent: true}
+	client := openNbdTestClient(t, s)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ReadAt(make([]byte, len(data)), 0)
+		done <- err
+	}()
+
+	//Both requests of the read are pending when the connection drops
+	<-s.got
+	<-s.got
+	s.drop()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("the read succeeded without replies")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the pending read hangs after the connection dropped")
+	}
+
+	if _, err := client.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Fatal("read on a dropped connection succeeded")
+	}
+}
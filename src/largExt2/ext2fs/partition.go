@@ -0,0 +1,363 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	SECTOR_SIZE          = 512
+	MBR_SIGNATURE        = 0xAA55
+	MBR_SIGNATURE_OFFSET = 510
+	MBR_TABLE_OFFSET     = 446
+	MBR_ENTRIES          = 4
+	MBR_MAX_LOGICAL      = 128
+	MBR_GPT_PROTECTIVE   = 0xEE
+	GPT_SIGNATURE        = "EFI PART"
+	GPT_MAX_ENTRIES      = 1024
+	GPT_MAX_ENTRY_SIZE   = 4096
+)
+
+type Partition struct {
+	Index  int
+	Scheme string
+	Type   string
+	Name   string
+	Start  int64
+	Size   int64
+}
+
+type mbrEntry struct {
+	Status   uint8
+	CHSFirst [3]uint8
+	Type     uint8
+	CHSLast  [3]uint8
+	LBAFirst uint32
+	Sectors  uint32
+}
+
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC      uint32
+	Reserved       uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesLBA     uint64
+	EntriesCount   uint32
+	EntrySize      uint32
+	EntriesCRC     uint32
+}
+
+type gptEntry struct {
+	TypeGUID   [16]byte
+	UniqueGUID [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [36]uint16
+}
+
+var mbrTypeNames = map[uint8]string{
+	0x05: "Extended",
+	0x07: "HPFS/NTFS/exFAT",
+	0x0B: "W95 FAT32",
+	0x0C: "W95 FAT32 (LBA)",
+	0x0F: "W95 Extended (LBA)",
+	0x82: "Linux swap",
+	0x83: "Linux",
+	0x85: "Linux extended",
+	0x8E: "Linux LVM",
+	0xEE: "GPT protective",
+	0xEF: "EFI System",
+	0xFD: "Linux raid autodetect",
+}
+
+var gptTypeNames = map[string]string{
+	"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": "EFI System",
+	"21686148-6449-6E6F-744E-656564454649": "BIOS boot",
+	"EBD0A0A2-B9E5-4433-87C0-68B6B72699C7": "Microsoft basic data",
+	"0FC63DAF-8483-4772-8E79-3D69D8477DE4": "Linux filesystem",
+	"0657FD6D-A4AB-43C4-84E5-0933C84B4F4F": "Linux swap",
+	"A19D880F-05FC-4D3B-A006-743F0F84911E": "Linux RAID",
+	"E6D6D379-F507-44C2-A23C-238F2A3DF928": "Linux LVM",
+}
+
+func (p Partition) TypeName() string {
+	var name string
+	if p.Scheme == "gpt" {
+		name = gptTypeNames[p.Type]
+	} else {
+		var code uint8
+		fmt.Sscanf(p.Type, "0x%02X", &code)
+		name = mbrTypeNames[code]
+	}
+
+	if name == "" {
+		return "Unknown"
+	}
+	return name
+}
+
+func (p Partition) String() string {
+	str := fmt.Sprintf("Partition %d (%s %s, %s) at %d, %d bytes", p.Index, p.Scheme, p.Type, p.TypeName(), p.Start, p.Size)
+	if p.Name != "" {
+		str += fmt.Sprintf(" %q", p.Name)
+	}
+	return str
+}
+
+// ReadPartitions lists the partitions of a whole-disk image. Both MBR, with
+// extended and logical partitions, and GPT partition tables are understood.
+// An image without a partition table has no partitions.
+func ReadPartitions(r io.ReaderAt, size int64) ([]Partition, error) {
+	sector := make([]byte, SECTOR_SIZE)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		return nil, err
+	}
+
+	entries, ok := parseMBR(sector)
+	if !ok {
+		return nil, nil
+	}
+
+	for _, entry := range entries {
+		if entry.Type == MBR_GPT_PROTECTIVE {
+			return readGPT(r, size)
+		}
+	}
+
+	return readMBR(r, entries)
+}
+
+// NewPartitionReader returns the contents of a partition of r.
+func NewPartitionReader(r io.ReaderAt, partition Partition) io.ReaderAt {
+	return newSection(r, partition.Start, partition.Size)
+}
+
+// NewPartitionDevice opens the ext2 filesystem held in a partition of r.
+func NewPartitionDevice(r io.ReaderAt, partition Partition, options DeviceOptions) (*Device, error) {
+	return NewDeviceFromReaderAt(NewPartitionReader(r, partition), partition.Size, options)
+}
+
+// HasSuperBlock reports whether an ext2 superblock magic number is found for
+// a filesystem starting at offset.
+func HasSuperBlock(r io.ReaderAt, offset int64) bool {
+	magic := make([]byte, 2)
+	if _, err := r.ReadAt(magic, offset+BASE_OFFSET+S_MAGIC); err != nil {
+		return false
+	}
+
+	return binary.LittleEndian.Uint16(magic) == EXT2_SUPER_MAGIC
+}
+
+func parseMBR(sector []byte) ([MBR_ENTRIES]mbrEntry, bool) {
+	var entries [MBR_ENTRIES]mbrEntry
+
+	if binary.LittleEndian.Uint16(sector[MBR_SIGNATURE_OFFSET:]) != MBR_SIGNATURE {
+		return entries, false
+	}
+
+	table := sector[MBR_TABLE_OFFSET:MBR_SIGNATURE_OFFSET]
+	if err := binary.Read(bytes.NewReader(table), binary.LittleEndian, &entries); err != nil {
+		return entries, false
+	}
+
+	//A boot sector that is not an MBR usually has garbage in the status bytes
+	for _, entry := range entries {
+		if entry.Status != 0x00 && entry.Status != 0x80 {
+			return entries, false
+		}
+	}
+
+	return entries, true
+}
+
+func isExtended(partitionType uint8) bool {
+	return partitionType == 0x05 || partitionType == 0x0F || partitionType == 0x85
+}
+
+func mbrPartition(index int, entry mbrEntry, baseLBA uint64) Partition {
+	return Partition{
+		Index:  index,
+		Scheme: "mbr",
+		Type:   fmt.Sprintf("0x%02X", entry.Type),
+		Start:  int64(baseLBA+uint64(entry.LBAFirst)) * SECTOR_SIZE,
+		Size:   int64(entry.Sectors) * SECTOR_SIZE,
+	}
+}
+
+func readMBR(r io.ReaderAt, entries [MBR_ENTRIES]mbrEntry) ([]Partition, error) {
+	partitions := make([]Partition, 0)
+	var extended *mbrEntry
+
+	for i := range entries {
+		if entries[i].Type == 0 || entries[i].Sectors == 0 {
+			continue
+		}
+
+		if isExtended(entries[i].Type) {
+			extended = &entries[i]
+			continue
+		}
+
+		partitions = append(partitions, mbrPartition(i+1, entries[i], 0))
+	}
+
+	if extended == nil {
+		return partitions, nil
+	}
+
+	//Logical partitions are chained through extended boot records, whose
+	//links are relative to the start of the extended partition
+	sector := make([]byte, SECTOR_SIZE)
+	ebrLBA := uint64(extended.LBAFirst)
+	for index := 5; index < 5+MBR_MAX_LOGICAL; index++ {
+		if _, err := r.ReadAt(sector, int64(ebrLBA)*SECTOR_SIZE); err != nil {
+			return partitions, err
+		}
+
+		ebr, ok := parseMBR(sector)
+		if !ok {
+			return partitions, errors.New(fmt.Sprintf("Bad extended boot record at sector %d", ebrLBA))
+		}
+
+		if ebr[0].Type != 0 && ebr[0].Sectors != 0 {
+			partitions = append(partitions, mbrPartition(index, ebr[0], ebrLBA))
+		}
+
+		if ebr[1].Sectors == 0 || !isExtended(ebr[1].Type) {
+			break
+		}
+
+		ebrLBA = uint64(extended.LBAFirst) + uint64(ebr[1].LBAFirst)
+	}
+
+	return partitions, nil
+}
+
+func readGPT(r io.ReaderAt, size int64) ([]Partition, error) {
+	var lastErr error
+
+	for _, sectorSize := range []int64{SECTOR_SIZE, 4096} {
+		//Fall back to the backup header in the last sector
+		for _, lba := range []int64{1, size/sectorSize - 1} {
+			header, err := readGPTHeader(r, lba*sectorSize)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			partitions, err := readGPTEntries(r, header, sectorSize)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			return partitions, nil
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("No GPT header found")
+	}
+
+	return nil, lastErr
+}
+
+func readGPTHeader(r io.ReaderAt, offset int64) (*gptHeader, error) {
+	buf := make([]byte, SECTOR_SIZE)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+
+	header := &gptHeader{}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+
+	if string(header.Signature[:]) != GPT_SIGNATURE {
+		return nil, errors.New("No GPT signature")
+	}
+
+	if header.HeaderSize < uint32(binary.Size(header)) || header.HeaderSize > SECTOR_SIZE {
+		return nil, errors.New(fmt.Sprintf("Bad GPT header size %d", header.HeaderSize))
+	}
+
+	binary.LittleEndian.PutUint32(buf[16:20], 0)
+	if crc32.ChecksumIEEE(buf[:header.HeaderSize]) != header.HeaderCRC {
+		return nil, errors.New("GPT header checksum mismatch")
+	}
+
+	return header, nil
+}
+
+func readGPTEntries(r io.ReaderAt, header *gptHeader, sectorSize int64) ([]Partition, error) {
+	//Entries are a multiple of 128 bytes
+	minSize := uint32(binary.Size(gptEntry{}))
+	if header.EntriesCount > GPT_MAX_ENTRIES || header.EntrySize < minSize || header.EntrySize > GPT_MAX_ENTRY_SIZE || header.EntrySize%minSize != 0 {
+		return nil, errors.New(fmt.Sprintf("Bad GPT partition entry array of %d entries of %d bytes", header.EntriesCount, header.EntrySize))
+	}
+
+	entrySize := int64(header.EntrySize)
+	table := make([]byte, int64(header.EntriesCount)*entrySize)
+	if _, err := r.ReadAt(table, int64(header.EntriesLBA)*sectorSize); err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(table) != header.EntriesCRC {
+		return nil, errors.New("GPT partition entries checksum mismatch")
+	}
+
+	partitions := make([]Partition, 0)
+	for i := int64(0); i < int64(header.EntriesCount); i++ {
+		entry := gptEntry{}
+		raw := table[i*entrySize : (i+1)*entrySize]
+		if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &entry); err != nil {
+			return nil, err
+		}
+
+		if entry.TypeGUID == [16]byte{} || entry.LastLBA < entry.FirstLBA {
+			continue
+		}
+
+		partitions = append(partitions, Partition{
+			Index:  int(i) + 1,
+			Scheme: "gpt",
+			Type:   guidString(entry.TypeGUID),
+			Name:   utf16String(entry.Name[:]),
+			Start:  int64(entry.FirstLBA) * sectorSize,
+			Size:   int64(entry.LastLBA-entry.FirstLBA+1) * sectorSize,
+		})
+	}
+
+	return partitions, nil
+}
+
+// guidString formats a GUID stored in the mixed-endian on-disk layout.
+func guidString(guid [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(guid[0:4]),
+		binary.LittleEndian.Uint16(guid[4:6]),
+		binary.LittleEndian.Uint16(guid[6:8]),
+		guid[8:10], guid[10:16])
+}
+
+func utf16String(units []uint16) string {
+	for i, unit := range units {
+		if unit == 0 {
+			units = units[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(units))
+}
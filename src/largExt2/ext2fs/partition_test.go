@@ -0,0 +1,216 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// The ext2 partition of the test disks starts at this sector.
+const partitionTestStart = 64
+
+// sectorImage is sparse storage, the sectors it doesn't hold read as zeroes.
+type sectorImage map[int64][]byte
+
+func (s sectorImage) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		pos := off + int64(i)
+		if sector, ok := s[pos/SECTOR_SIZE]; ok {
+			p[i] = sector[pos%SECTOR_SIZE]
+		} else {
+			p[i] = 0
+		}
+	}
+	return len(p), nil
+}
+
+func mbrTestSector(entries ...mbrEntry) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(make([]byte, MBR_TABLE_OFFSET))
+	binary.Write(buf, binary.LittleEndian, entries)
+	buf.Write(make([]byte, MBR_SIGNATURE_OFFSET-buf.Len()))
+	binary.Write(buf, binary.LittleEndian, uint16(MBR_SIGNATURE))
+	return buf.Bytes()
+}
+
+// gptTestDisk returns a GPT disk holding fs in its first partition. The
+// header is patched by patch before its checksums are computed.
+func gptTestDisk(fs []byte, patch func(header *gptHeader)) memImage {
+	const entries = 128
+	sectors := int64(partitionTestStart) + int64(len(fs))/SECTOR_SIZE + 33
+	disk := make(memImage, sectors*SECTOR_SIZE)
+
+	copy(disk, mbrTestSector(mbrEntry{Type: MBR_GPT_PROTECTIVE, LBAFirst: 1, Sectors: uint32(sectors - 1)}))
+	copy(disk[partitionTestStart*SECTOR_SIZE:], fs)
+
+	entry := gptEntry{
+		TypeGUID:   [16]byte{0xAF, 0x3D, 0xC6, 0x0F, 0x83, 0x84, 0x72, 0x47, 0x8E, 0x79, 0x3D, 0x69, 0xD8, 0x47, 0x7D, 0xE4},
+		UniqueGUID: [16]byte{1},
+		FirstLBA:   partitionTestStart,
+		LastLBA:    uint64(partitionTestStart) + uint64(len(fs))/SECTOR_SIZE - 1,
+	}
+	copy(entry.Name[:], utf16.Encode([]rune("root")))
+
+	table := new(bytes.Buffer)
+	binary.Write(table, binary.LittleEndian, entry)
+	table.Write(make([]byte, (entries-1)*binary.Size(entry)))
+	copy(disk[2*SECTOR_SIZE:], table.Bytes())
+
+	header := gptHeader{
+		Revision:       0x10000,
+		HeaderSize:     uint32(binary.Size(gptHeader{})),
+		CurrentLBA:     1,
+		BackupLBA:      uint64(sectors - 1),
+		FirstUsableLBA: 34,
+		LastUsableLBA:  uint64(sectors - 34),
+		EntriesLBA:     2,
+		EntriesCount:   entries,
+		EntrySize:      uint32(binary.Size(entry)),
+	}
+	copy(header.Signature[:], GPT_SIGNATURE)
+	if patch != nil {
+		patch(&header)
+	}
+
+	end := int64(header.EntriesCount) * int64(header.EntrySize)
+	if end > int64(len(disk))-2*SECTOR_SIZE {
+		end = int64(len(disk)) - 2*SECTOR_SIZE
+	}
+	header.EntriesCRC = crc32.ChecksumIEEE(disk[2*SECTOR_SIZE : 2*SECTOR_SIZE+end])
+
+	raw := new(bytes.Buffer)
+	binary.Write(raw, binary.LittleEndian, header)
+	header.HeaderCRC = crc32.ChecksumIEEE(raw.Bytes())
+	raw.Reset()
+	binary.Write(raw, binary.LittleEndian, header)
+	copy(disk[SECTOR_SIZE:], raw.Bytes())
+
+	return disk
+}
+
+func gptTestHeader(t *testing.T, disk memImage) *gptHeader {
+	t.Helper()
+
+	header, err := readGPTHeader(disk, SECTOR_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestReadPartitionsGPT(t *testing.T) {
+	fs := readTestData(t, "ext2-1k.img.gz")
+	disk := gptTestDisk(fs, nil)
+
+	partitions, err := ReadPartitions(disk, int64(len(disk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 1 {
+		t.Fatalf("%d partitions, want 1", len(partitions))
+	}
+
+	partition := partitions[0]
+	if partition.Scheme != "gpt" || partition.TypeName() != "Linux filesystem" || partition.Name != "root" {
+		t.Fatalf("read %s", partition)
+	}
+	if partition.Start != partitionTestStart*SECTOR_SIZE || partition.Size != int64(len(fs)) {
+		t.Fatalf("partition at %d, %d bytes", partition.Start, partition.Size)
+	}
+
+	device, err := NewPartitionDevice(disk, partition, DeviceOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.BlockSize != 1024 {
+		t.Fatalf("block size %d", device.BlockSize)
+	}
+}
+
+func TestReadPartitionsGPTBadEntrySize(t *testing.T) {
+	fs := readTestData(t, "ext2-1k.img.gz")
+
+	//The first one wraps the size of the table to zero in 32 bits
+	for _, size := range []uint32{0x80000000, 0x80000080, 200, 64, 8192} {
+		disk := gptTestDisk(fs, func(header *gptHeader) {
+			header.EntriesCount = 2
+			header.EntrySize = size
+		})
+
+		//ReadPartitions then reports the missing backup header instead
+		_, err := readGPTEntries(disk, gptTestHeader(t, disk), SECTOR_SIZE)
+		if err == nil || !strings.Contains(err.Error(), "Bad GPT partition entry array") {
+			t.Fatalf("entries of %d bytes gave %v", size, err)
+		}
+		if _, err := ReadPartitions(disk, int64(len(disk))); err == nil {
+			t.Fatalf("entries of %d bytes accepted", size)
+		}
+	}
+
+	//A larger entry size is fine
+	disk := gptTestDisk(fs, func(header *gptHeader) {
+		header.EntriesCount = 4
+		header.EntrySize = 256
+	})
+	partitions, err := ReadPartitions(disk, int64(len(disk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 1 || partitions[0].Start != partitionTestStart*SECTOR_SIZE {
+		t.Fatalf("read %v", partitions)
+	}
+}
+
+func TestReadPartitionsMBRExtended(t *testing.T) {
+	const extendedLBA = 0x10
+
+	//The logical partitions lie beyond 2TiB, past what 32 bits of sectors
+	//can hold once the extended partition start is added
+	disk := sectorImage{
+		0: mbrTestSector(
+			mbrEntry{Type: 0x83, LBAFirst: 63, Sectors: 1000},
+			mbrEntry{Type: 0x05, LBAFirst: extendedLBA, Sectors: 0xFFFFFFF0},
+		),
+		extendedLBA: mbrTestSector(
+			mbrEntry{Type: 0x83, LBAFirst: 0xFFFFFFF0, Sectors: 100},
+			mbrEntry{Type: 0x05, LBAFirst: 0xFFFFFF00, Sectors: 200},
+		),
+		extendedLBA + 0xFFFFFF00: mbrTestSector(
+			mbrEntry{Type: 0x83, LBAFirst: 0x100, Sectors: 100},
+		),
+	}
+
+	partitions, err := ReadPartitions(disk, 1<<45)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		index int
+		start int64
+	}{
+		{1, 63},
+		{5, extendedLBA + 0xFFFFFFF0},
+		{6, extendedLBA + 0xFFFFFF00 + 0x100},
+	}
+	if len(partitions) != len(want) {
+		t.Fatalf("read %v", partitions)
+	}
+	for i, partition := range partitions {
+		if partition.Index != want[i].index || partition.Start != want[i].start*SECTOR_SIZE {
+			t.Fatalf("partition %d is %s, want index %d at sector %d", i, partition, want[i].index, want[i].start)
+		}
+	}
+}
+
+func TestReadPartitionsNone(t *testing.T) {
+	fs := readTestData(t, "ext2-1k.img.gz")
+
+	partitions, err := ReadPartitions(memImage(fs), int64(len(fs)))
+	if err != nil || len(partitions) != 0 {
+		t.Fatalf("an unpartitioned image gave %v, %v", partitions, err)
+	}
+}
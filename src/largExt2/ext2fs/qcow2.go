@@ -0,0 +1,572 @@
+package ext2fs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	QCOW2_MAGIC             = 0x514649FB
+	QCOW2_MIN_CLUSTER_BITS  = 9
+	QCOW2_MAX_CLUSTER_BITS  = 21
+	QCOW2_MAX_BACKING_DEPTH = 16
+	QCOW2_V2_HEADER_SIZE    = 72
+	QCOW2_V3_HEADER_SIZE    = 104
+	qcow2OffsetMask         = 0x00FFFFFFFFFFFE00
+	qcow2CompressedFlag     = 1 << 62
+	qcow2ZeroFlag           = 1
+	qcow2IncompatDirty      = 1 << 0
+	qcow2IncompatCorrupt    = 1 << 1
+	qcow2IncompatKnown      = qcow2IncompatDirty | qcow2IncompatCorrupt
+	qcow2ExtEnd             = 0
+	qcow2ExtBackingFormat   = 0xE2792ACA
+	qcow2MaxBackingName     = 1023
+	qcow2L2Tables           = 32
+)
+
+type qcow2RawHeader struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	/*
+		Version 3 headers only
+	*/
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+	CompressionType      uint8
+}
+
+// Qcow2Header is the part of a qcow2 image header needed to read the image.
+type Qcow2Header struct {
+	Version       uint32
+	ClusterBits   uint32
+	Size          int64
+	BackingFile   string
+	BackingFormat string
+	Dirty         bool
+	Corrupt       bool
+	l1Size        uint32
+	l1Offset      int64
+}
+
+// Qcow2Image reads the guest disk of a qcow2 version 2 or 3 image. Clusters
+// the image does not allocate are read from the backing file, or as zeros
+// when there is none.
+type Qcow2Image struct {
+	Header     *Qcow2Header
+	r          io.ReaderAt
+	backing    io.ReaderAt
+	l1         []uint64
+	mu         sync.Mutex
+	l2         map[int64]*qcow2Table
+	clock      uint64
+	compressed int64
+	cluster    []byte
+}
+
+type qcow2Table struct {
+	entries []uint64
+	used    uint64
+}
+
+// ReadQcow2Header reads the header of a qcow2 image. Anything else returns
+// nil and no error.
+func ReadQcow2Header(r io.ReaderAt) (*Qcow2Header, error) {
+	buf := make([]byte, QCOW2_V3_HEADER_SIZE+8)
+	if n, err := r.ReadAt(buf, 0); n < QCOW2_V2_HEADER_SIZE {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	raw := &qcow2RawHeader{}
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, raw)
+
+	if raw.Magic != QCOW2_MAGIC {
+		return nil, nil
+	}
+
+	if raw.Version != 2 && raw.Version != 3 {
+		return nil, errors.New(fmt.Sprintf("qcow2 version %d is not supported", raw.Version))
+	}
+
+	if raw.Version == 2 {
+		raw.IncompatibleFeatures = 0
+		raw.HeaderLength = QCOW2_V2_HEADER_SIZE
+		raw.CompressionType = 0
+	} else if raw.HeaderLength <= QCOW2_V3_HEADER_SIZE {
+		raw.CompressionType = 0
+	}
+
+	if raw.ClusterBits < QCOW2_MIN_CLUSTER_BITS || raw.ClusterBits > QCOW2_MAX_CLUSTER_BITS {
+		return nil, errors.New(fmt.Sprintf("Bad qcow2 cluster size 2^%d", raw.ClusterBits))
+	}
+
+	if raw.CryptMethod != 0 {
+		return nil, errors.New("Encrypted qcow2 images are not supported")
+	}
+
+	//External data files, extended L2 entries and zstd compression
+	if unknown := raw.IncompatibleFeatures &^ qcow2IncompatKnown; unknown != 0 {
+		return nil, errors.New(fmt.Sprintf("Unsupported qcow2 incompatible features 0x%X", unknown))
+	}
+
+	if raw.CompressionType != 0 {
+		return nil, errors.New(fmt.Sprintf("Unsupported qcow2 compression type %d", raw.CompressionType))
+	}
+
+	header := &Qcow2Header{
+		Version:     raw.Version,
+		ClusterBits: raw.ClusterBits,
+		Size:        int64(raw.Size),
+		Dirty:       raw.IncompatibleFeatures&qcow2IncompatDirty != 0,
+		Corrupt:     raw.IncompatibleFeatures&qcow2IncompatCorrupt != 0,
+		l1Size:      raw.L1Size,
+		l1Offset:    int64(raw.L1TableOffset),
+	}
+
+	if raw.BackingFileOffset != 0 {
+		if raw.BackingFileSize > qcow2MaxBackingName {
+			return nil, errors.New("qcow2 backing file name too long")
+		}
+
+		name := make([]byte, raw.BackingFileSize)
+		if _, err := r.ReadAt(name, int64(raw.BackingFileOffset)); err != nil {
+			return nil, err
+		}
+		header.BackingFile = string(name)
+	}
+
+	if err := header.readExtensions(r, int64(raw.HeaderLength)); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// readExtensions looks for the backing file format among the header
+// extensions that follow the header in the first cluster.
+func (h *Qcow2Header) readExtensions(r io.ReaderAt, off int64) error {
+	end := int64(1) << h.ClusterBits
+	ext := make([]byte, 8)
+
+	for off+8 <= end {
+		if _, err := r.ReadAt(ext, off); err != nil {
+			return err
+		}
+
+		extType := binary.BigEndian.Uint32(ext)
+		length := int64(binary.BigEndian.Uint32(ext[4:]))
+		if extType == qcow2ExtEnd {
+			return nil
+		}
+
+		if off+8+length > end {
+			return errors.New("Bad qcow2 header extension")
+		}
+
+		if extType == qcow2ExtBackingFormat {
+			format := make([]byte, length)
+			if _, err := r.ReadAt(format, off+8); err != nil {
+				return err
+			}
+			h.BackingFormat = string(format)
+		}
+
+		off += 8 + (length+7)&^7
+	}
+
+	return nil
+}
+
+func (h *Qcow2Header) ClusterSize() int64 {
+	return int64(1) << h.ClusterBits
+}
+
+// NewQcow2Image reads the qcow2 image r of size bytes. Reads of clusters r
+// does not allocate go to backing, which is nil when the image has no
+// backing file.
+func NewQcow2Image(r io.ReaderAt, size int64, backing io.ReaderAt) (*Qcow2Image, error) {
+	header, err := ReadQcow2Header(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if header == nil {
+		return nil, errors.New("Not a qcow2 image")
+	}
+
+	if header.BackingFile != "" && backing == nil {
+		return nil, errors.New(fmt.Sprintf("qcow2 image needs its backing file %s", header.BackingFile))
+	}
+
+	//Every L1 entry maps a whole L2 table of 8 byte entries
+	entries := header.ClusterSize() / 8
+	needed := (header.Size + entries*header.ClusterSize() - 1) / (entries * header.ClusterSize())
+	if int64(header.l1Size) < needed {
+		return nil, errors.New(fmt.Sprintf("qcow2 L1 table of %d entries is too small for %d bytes", header.l1Size, header.Size))
+	}
+
+	//The table is read whole, it has to fit in the file
+	if header.l1Offset < 0 || 8*int64(header.l1Size) > size-header.l1Offset {
+		return nil, errors.New(fmt.Sprintf("qcow2 L1 table of %d entries at %d is past the end of the %d byte image", header.l1Size, header.l1Offset, size))
+	}
+
+	buf := make([]byte, 8*int64(header.l1Size))
+	if _, err := r.ReadAt(buf, header.l1Offset); err != nil {
+		return nil, err
+	}
+
+	l1 := make([]uint64, header.l1Size)
+	for i := range l1 {
+		l1[i] = binary.BigEndian.Uint64(buf[8*i:])
+	}
+
+	return &Qcow2Image{
+		Header:     header,
+		r:          r,
+		backing:    backing,
+		l1:         l1,
+		l2:         make(map[int64]*qcow2Table),
+		compressed: -1,
+	}, nil
+}
+
+// OpenQcow2Image opens a qcow2 image file and the chain of its backing
+// files. Relative backing file names are found next to the image naming
+// them.
+func OpenQcow2Image(path string) (*Qcow2Image, error) {
+	return openQcow2Image(path, 0)
+}
+
+func openQcow2Image(path string, depth int) (*Qcow2Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := ReadQcow2Header(file)
+	if err == nil && header == nil {
+		err = errors.New(fmt.Sprintf("%s is not a qcow2 image", path))
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var backing io.ReaderAt
+	if header.BackingFile != "" {
+		if depth >= QCOW2_MAX_BACKING_DEPTH {
+			file.Close()
+			return nil, errors.New(fmt.Sprintf("Backing file chain of %s is too long", path))
+		}
+
+		backingPath := header.BackingFile
+		if !filepath.IsAbs(backingPath) {
+			backingPath = filepath.Join(filepath.Dir(path), backingPath)
+		}
+
+		backing, err = openQcow2Backing(backingPath, header.BackingFormat, depth+1)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	var image *Qcow2Image
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		image, err = NewQcow2Image(file, size, backing)
+	}
+
+	if err != nil {
+		file.Close()
+		if closer, ok := backing.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+
+	return image, nil
+}
+
+// openQcow2Backing opens a backing file, which is either raw or qcow2. A
+// backing file declared raw is not probed.
+func openQcow2Backing(path string, format string, depth int) (io.ReaderAt, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "raw" {
+		return file, nil
+	}
+
+	header, err := ReadQcow2Header(file)
+	if err != nil || header == nil {
+		if format == "qcow2" && err == nil {
+			err = errors.New(fmt.Sprintf("%s is not a qcow2 image", path))
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+
+	file.Close()
+	return openQcow2Image(path, depth)
+}
+
+// Backing returns the backing file of the image, or nil.
+func (q *Qcow2Image) Backing() io.ReaderAt {
+	return q.backing
+}
+
+func (q *Qcow2Image) Size() int64 {
+	return q.Header.Size
+}
+
+func (q *Qcow2Image) String() string {
+	str := fmt.Sprintf("qcow2 v%d image, %d bytes, %d byte clusters", q.Header.Version, q.Header.Size, q.Header.ClusterSize())
+	if q.Header.BackingFile != "" {
+		str += fmt.Sprintf(", backing file %s", q.Header.BackingFile)
+	}
+	if q.Header.Dirty {
+		str += ", dirty"
+	}
+	if q.Header.Corrupt {
+		str += ", marked corrupt"
+	}
+	return str
+}
+
+func (q *Qcow2Image) Close() error {
+	var err error
+	for _, r := range []io.ReaderAt{q.r, q.backing} {
+		if closer, ok := r.(io.Closer); ok {
+			if cerr := closer.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+func (q *Qcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= q.Header.Size {
+		return 0, io.EOF
+	}
+
+	want := p
+	if int64(len(want)) > q.Header.Size-off {
+		want = want[:q.Header.Size-off]
+	}
+
+	clusterSize := q.Header.ClusterSize()
+	n := 0
+	for n < len(want) {
+		pos := off + int64(n)
+		inner := pos & (clusterSize - 1)
+
+		piece := want[n:]
+		if int64(len(piece)) > clusterSize-inner {
+			piece = piece[:clusterSize-inner]
+		}
+
+		if err := q.readCluster(piece, pos); err != nil {
+			return n, err
+		}
+		n += len(piece)
+	}
+
+	if len(want) < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readCluster fills p, which doesn't cross a cluster boundary, from the
+// guest offset pos.
+func (q *Qcow2Image) readCluster(p []byte, pos int64) error {
+	entry, err := q.l2Entry(pos)
+	if err != nil {
+		return err
+	}
+
+	inner := pos & (q.Header.ClusterSize() - 1)
+
+	if entry&qcow2CompressedFlag != 0 {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		cluster, err := q.compressedCluster(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, cluster[inner:])
+		return nil
+	}
+
+	if q.Header.Version >= 3 && entry&qcow2ZeroFlag != 0 {
+		zero(p)
+		return nil
+	}
+
+	host := int64(entry & qcow2OffsetMask)
+	if host == 0 {
+		return q.readBacking(p, pos)
+	}
+
+	n, err := q.r.ReadAt(p, host+inner)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return err
+}
+
+// readBacking reads unallocated clusters. The guest disk may be larger than
+// the backing file, the rest reads as zeros.
+func (q *Qcow2Image) readBacking(p []byte, pos int64) error {
+	if q.backing == nil {
+		zero(p)
+		return nil
+	}
+
+	n, err := q.backing.ReadAt(p, pos)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	zero(p[n:])
+	return nil
+}
+
+// l2Entry returns the L2 table entry mapping the cluster at the guest
+// offset pos, zero when no L2 table is allocated for it.
+func (q *Qcow2Image) l2Entry(pos int64) (uint64, error) {
+	entries := q.Header.ClusterSize() / 8
+	cluster := pos >> q.Header.ClusterBits
+	l1Index := cluster / entries
+
+	if l1Index >= int64(len(q.l1)) {
+		return 0, nil
+	}
+
+	tableOffset := int64(q.l1[l1Index] & qcow2OffsetMask)
+	if tableOffset == 0 {
+		return 0, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	table, err := q.l2Table(tableOffset)
+	if err != nil {
+		return 0, err
+	}
+
+	return table[cluster%entries], nil
+}
+
+func (q *Qcow2Image) l2Table(offset int64) ([]uint64, error) {
+	q.clock++
+
+	if table, ok := q.l2[offset]; ok {
+		table.used = q.clock
+		return table.entries, nil
+	}
+
+	buf := make([]byte, q.Header.ClusterSize())
+	if _, err := q.r.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	entries := make([]uint64, len(buf)/8)
+	for i := range entries {
+		entries[i] = binary.BigEndian.Uint64(buf[8*i:])
+	}
+
+	if len(q.l2) >= qcow2L2Tables {
+		var oldest int64
+		var used uint64
+		for candidate, table := range q.l2 {
+			if used == 0 || table.used < used {
+				oldest, used = candidate, table.used
+			}
+		}
+		delete(q.l2, oldest)
+	}
+
+	q.l2[offset] = &qcow2Table{entries: entries, used: q.clock}
+	return entries, nil
+}
+
+// compressedCluster inflates a compressed cluster. The last one is kept as
+// consecutive reads usually hit the same cluster.
+func (q *Qcow2Image) compressedCluster(entry uint64) ([]byte, error) {
+	offsetBits := 62 - (q.Header.ClusterBits - 8)
+	offset := int64(entry & (1<<offsetBits - 1))
+	sectors := int64(entry>>offsetBits) & (1<<(q.Header.ClusterBits-8) - 1)
+
+	if offset == q.compressed {
+		return q.cluster, nil
+	}
+
+	size := (sectors+1)*SECTOR_SIZE - offset%SECTOR_SIZE
+	data := make([]byte, size)
+	n, err := q.r.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	cluster := make([]byte, q.Header.ClusterSize())
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(data[:n])), cluster); err != nil {
+		return nil, errors.New(fmt.Sprintf("Corrupt compressed qcow2 cluster at %d: %s", offset, err.Error()))
+	}
+
+	q.compressed = offset
+	q.cluster = cluster
+	return cluster, nil
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
+
+// IsQcow2 reports whether r starts with the qcow2 magic number.
+func IsQcow2(r io.ReaderAt) bool {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return binary.BigEndian.Uint32(magic) == QCOW2_MAGIC
+}
@@ -0,0 +1,113 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeQcow2 writes disk as a qcow2 version 2 image with 64KiB clusters,
+// leaving its all-zero clusters unallocated.
+func writeQcow2(t *testing.T, path string, disk []byte) {
+	t.Helper()
+
+	const clusterBits = 16
+	const clusterSize = 1 << clusterBits
+
+	//Header, L1 table and a single L2 table, then the data clusters
+	image := make([]byte, 3*clusterSize)
+	header := qcow2RawHeader{
+		Magic:         QCOW2_MAGIC,
+		Version:       2,
+		ClusterBits:   clusterBits,
+		Size:          uint64(len(disk)),
+		L1Size:        1,
+		L1TableOffset: clusterSize,
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &header)
+	copy(image, buf.Bytes()[:QCOW2_V2_HEADER_SIZE])
+	binary.BigEndian.PutUint64(image[clusterSize:], 2*clusterSize)
+
+	for i := 0; i*clusterSize < len(disk); i++ {
+		cluster := make([]byte, clusterSize)
+		copy(cluster, disk[i*clusterSize:])
+		if bytes.Equal(cluster, make([]byte, clusterSize)) {
+			continue
+		}
+		binary.BigEndian.PutUint64(image[2*clusterSize+8*i:], uint64(len(image)))
+		image = append(image, cluster...)
+	}
+
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewDeviceQcow2(t *testing.T) {
+	disk := readTestData(t, "ext2-1k.img.gz")
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	writeQcow2(t, path, disk)
+
+	device, err := NewDevice(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if !device.ReadOnly() {
+		t.Fatal("qcow2 Device is writable")
+	}
+	if device.Size() != int64(len(disk)) {
+		t.Fatalf("size %d, want %d", device.Size(), len(disk))
+	}
+
+	entries, err := device.NewDirEntries(EXT2_ROOT_INO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.NameStr() != "hello" {
+			continue
+		}
+
+		inode, err := device.NewInode(entry.Inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(NewInodeReader(device, inode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello\n" {
+			t.Fatalf("hello holds %q", data)
+		}
+		return
+	}
+	t.Fatal("hello not found in the root directory")
+}
+
+func TestOpenQcow2ImageBadL1Size(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	writeQcow2(t, path, readTestData(t, "ext2-1k.img.gz"))
+
+	image, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//An L1 table of 30GiB, far larger than the file
+	binary.BigEndian.PutUint32(image[36:], 0xF0000000)
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenQcow2Image(path)
+	if err == nil || !strings.Contains(err.Error(), "past the end") {
+		t.Fatalf("huge L1 table gave %v", err)
+	}
+}
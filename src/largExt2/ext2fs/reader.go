@@ -9,8 +9,8 @@ type InodeReader struct {
 
 func (r *InodeReader) Read(p []byte) (n int, err error) {
 	n, err = r.Device.ReadData(r.Inode, p, r.CurrPos)
-	if int64(n)+r.CurrPos > int64(r.Inode.Size) {
-		n = int(int64(r.Inode.Size) - r.CurrPos)
+	if int64(n)+r.CurrPos > int64(r.Inode.Size64()) {
+		n = int(int64(r.Inode.Size64()) - r.CurrPos)
 	}
 	r.CurrPos += int64(n)
 	return
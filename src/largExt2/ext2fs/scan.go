@@ -0,0 +1,160 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+const (
+	scanChunkSize     = 1024 * 1024
+	EXT2_MAX_LOG_SIZE = 6
+)
+
+type SuperBlockCandidate struct {
+	// Offset is the byte offset of the filesystem start, suitable for
+	// DeviceOptions.Offset.
+	Offset int64
+	Score  int
+	// Copies counts the superblocks, primary or backup, found for Offset.
+	Copies int
+	Super  *SuperBlock
+}
+
+// ScanSuperBlocks searches the first limit bytes of r for plausible ext2
+// superblocks. Backup superblocks found at their expected places vote for
+// the same filesystem start, so candidates are returned best first.
+func ScanSuperBlocks(r io.ReaderAt, limit int64) ([]SuperBlockCandidate, error) {
+	magic := []byte{EXT2_SUPER_MAGIC & 0xFF, EXT2_SUPER_MAGIC >> 8}
+	byOffset := make(map[int64]*SuperBlockCandidate)
+
+	chunk := make([]byte, scanChunkSize+len(magic)-1)
+	for pos := int64(0); pos < limit; pos += scanChunkSize {
+		n, err := r.ReadAt(chunk, pos)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		for i := 0; i+len(magic) <= n; {
+			found := bytes.Index(chunk[i:n], magic)
+			if found < 0 {
+				break
+			}
+
+			i += found
+			superOffset := pos + int64(i) - S_MAGIC
+			i++
+
+			if superOffset < 0 || superOffset >= limit {
+				continue
+			}
+
+			super := &SuperBlock{}
+			buf := make([]byte, EXT2_SUPERBLOCK_SIZE)
+			if _, err := r.ReadAt(buf, superOffset); err != nil {
+				continue
+			}
+			binary.Read(bytes.NewReader(buf), binary.LittleEndian, super)
+
+			score := super.plausibility()
+			if score < 0 {
+				continue
+			}
+
+			start := superOffset - super.location()
+			if start < 0 {
+				continue
+			}
+
+			candidate, ok := byOffset[start]
+			if !ok {
+				candidate = &SuperBlockCandidate{Offset: start}
+				byOffset[start] = candidate
+			}
+
+			candidate.Copies++
+			if candidate.Super == nil || super.BlockGroupNr == 0 {
+				candidate.Super = super
+				candidate.Score = score
+			}
+		}
+
+		if n < scanChunkSize {
+			break
+		}
+	}
+
+	candidates := make([]SuperBlockCandidate, 0, len(byOffset))
+	for _, candidate := range byOffset {
+		candidate.Score += candidate.Copies - 1
+		candidates = append(candidates, *candidate)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Offset < candidates[j].Offset
+	})
+
+	return candidates, nil
+}
+
+// location returns the byte offset of this superblock copy from the start
+// of its filesystem, using the group number a backup records.
+func (s *SuperBlock) location() int64 {
+	if s.BlockGroupNr == 0 {
+		return BASE_OFFSET
+	}
+
+	blockSize := int64(EXT2_DEFAULT_BLOCK_SIZE) << s.LogBlockSize
+	return (int64(s.BlockGroupNr)*int64(s.BlocksPerGroup) + int64(s.FirstDataBlock)) * blockSize
+}
+
+// plausibility scores how much a structure carrying the ext2 magic number
+// looks like a real superblock. Structures failing the hard requirements
+// score -1.
+func (s *SuperBlock) plausibility() int {
+	if s.Magic != EXT2_SUPER_MAGIC || s.LogBlockSize > EXT2_MAX_LOG_SIZE || s.RevLevel > EXT2_DYNAMIC_REV {
+		return -1
+	}
+
+	blockSize := uint32(EXT2_DEFAULT_BLOCK_SIZE) << s.LogBlockSize
+	if s.BlocksPerGroup == 0 || s.BlocksPerGroup > 8*blockSize || s.BlocksPerGroup%8 != 0 {
+		return -1
+	}
+
+	if s.InodesPerGroup == 0 || s.InodesPerGroup > 8*blockSize || s.BlocksCount == 0 {
+		return -1
+	}
+
+	score := 0
+	groups := 1 + (s.BlocksCount-1)/s.BlocksPerGroup
+
+	if s.BlocksPerGroup == 8*blockSize {
+		score++
+	}
+
+	if s.InodesCount == s.InodesPerGroup*groups {
+		score++
+	}
+
+	if (blockSize == EXT2_DEFAULT_BLOCK_SIZE && s.FirstDataBlock == 1) || (blockSize > EXT2_DEFAULT_BLOCK_SIZE && s.FirstDataBlock == 0) {
+		score++
+	}
+
+	if s.FreeBlocksCount <= s.BlocksCount && s.FreeInodesCount <= s.InodesCount {
+		score++
+	}
+
+	if s.RevLevel == EXT2_GOOD_OLD_REV || (s.InodeSize >= EXT2_DEFAULT_INODE_SIZE && uint32(s.InodeSize) <= blockSize && s.InodeSize&(s.InodeSize-1) == 0) {
+		score++
+	}
+
+	if uint32(s.BlockGroupNr) < groups {
+		score++
+	}
+
+	return score
+}
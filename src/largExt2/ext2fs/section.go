@@ -0,0 +1,82 @@
+package ext2fs
+
+import (
+	"errors"
+	"io"
+)
+
+// section exposes the byte range [off, off+size) of r as storage of its own.
+type section struct {
+	r    io.ReaderAt
+	off  int64
+	size int64
+}
+
+// writableSection is a section of storage that also implements io.WriterAt.
+type writableSection struct {
+	*section
+	w io.WriterAt
+}
+
+// newSection returns a view of size bytes of r starting at off. The view is
+// writable when r is.
+func newSection(r io.ReaderAt, off, size int64) io.ReaderAt {
+	s := &section{r: r, off: off, size: size}
+	if w, ok := r.(io.WriterAt); ok {
+		return &writableSection{section: s, w: w}
+	}
+	return s
+}
+
+func (s *section) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= s.size {
+		return 0, io.EOF
+	}
+
+	if max := s.size - off; int64(len(p)) > max {
+		n, err := s.r.ReadAt(p[:max], s.off+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+
+	return s.r.ReadAt(p, s.off+off)
+}
+
+func (s *section) Size() int64 {
+	return s.size
+}
+
+func (s *section) Close() error {
+	if closer, ok := s.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *writableSection) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.size {
+		return 0, errors.New("Write outside of section")
+	}
+
+	return s.w.WriteAt(p, s.off+off)
+}
+
+func (s *writableSection) Sync() error {
+	if syncer, ok := s.w.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (s *section) slice(off int64, n int) []byte {
+	if m, ok := s.r.(slicer); ok && off >= 0 && off+int64(n) <= s.size {
+		return m.slice(s.off+off, n)
+	}
+	return nil
+}
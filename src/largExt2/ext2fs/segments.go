@@ -0,0 +1,145 @@
+package ext2fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// SegmentedImage presents the ordered segment files of a split raw image
+// (image.001, image.002, ...) as one contiguous read-only storage.
+type SegmentedImage struct {
+	segments []*os.File
+	starts   []int64
+	size     int64
+}
+
+// IsFirstSegment reports whether path names the first segment of a split
+// image, that is its extension is a zero padded 0 or 1.
+func IsFirstSegment(path string) bool {
+	ext := filepath.Ext(path)
+	if len(ext) < 3 {
+		return false
+	}
+
+	number, err := strconv.Atoi(ext[1:])
+	return err == nil && ext[1] == '0' && (number == 0 || number == 1)
+}
+
+// FindSegments lists the segments of a split image starting from its first
+// segment, up to the first number that has no file.
+func FindSegments(first string) ([]string, error) {
+	ext := filepath.Ext(first)
+	base := first[:len(first)-len(ext)]
+	width := len(ext) - 1
+
+	number, err := strconv.Atoi(ext[1:])
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s is not an image segment", first))
+	}
+
+	paths := make([]string, 0)
+	for ; ; number++ {
+		path := fmt.Sprintf("%s.%0*d", base, width, number)
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) && len(paths) > 0 {
+				return paths, nil
+			}
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+}
+
+func OpenSegments(paths []string) (*SegmentedImage, error) {
+	image := &SegmentedImage{}
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			image.Close()
+			return nil, err
+		}
+
+		size, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			file.Close()
+			image.Close()
+			return nil, err
+		}
+
+		image.segments = append(image.segments, file)
+		image.starts = append(image.starts, image.size)
+		image.size += size
+	}
+
+	return image, nil
+}
+
+// OpenSegmentedImage opens a split image from the path of its first segment.
+func OpenSegmentedImage(first string) (*SegmentedImage, error) {
+	paths, err := FindSegments(first)
+	if err != nil {
+		return nil, err
+	}
+	return OpenSegments(paths)
+}
+
+func (s *SegmentedImage) Size() int64 {
+	return s.size
+}
+
+func (s *SegmentedImage) Segments() int {
+	return len(s.segments)
+}
+
+func (s *SegmentedImage) Close() error {
+	var err error
+	for _, segment := range s.segments {
+		if cerr := segment.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *SegmentedImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= s.size {
+			return n, io.EOF
+		}
+
+		//Last segment starting at or before pos
+		i := sort.Search(len(s.starts), func(i int) bool {
+			return s.starts[i] > pos
+		}) - 1
+
+		end := s.size
+		if i+1 < len(s.starts) {
+			end = s.starts[i+1]
+		}
+
+		piece := p[n:]
+		if int64(len(piece)) > end-pos {
+			piece = piece[:end-pos]
+		}
+
+		read, err := s.segments[i].ReadAt(piece, pos-s.starts[i])
+		n += read
+		if err != nil && !(err == io.EOF && read == len(piece)) {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
@@ -1,7 +1,6 @@
 package ext2fs
 
 import (
-	"encoding/binary"
 	"errors"
 )
 
@@ -53,17 +52,34 @@ type SuperBlock struct {
 	PreallocBlocks    uint8
 	PreallocDirBlocks uint8
 	Padding1          uint16
-	Reserved          [204]uint32
+
+	/*
+		Journaling and ext4 fields
+	*/
+	JournalUUID       [16]uint8
+	JournalInum       uint32
+	JournalDev        uint32
+	LastOrphan        uint32
+	HashSeed          [4]uint32
+	DefHashVersion    uint8
+	JnlBackupType     uint8
+	DescSize          uint16
+	DefaultMountOpts  uint32
+	FirstMetaBg       uint32
+	MkfsTime          uint32
+	JnlBlocks         [17]uint32
+	BlocksCountHi     uint32
+	RBlocksCountHi    uint32
+	FreeBlocksCountHi uint32
+	MinExtraIsize     uint16
+	WantExtraIsize    uint16
+	Flags             uint32
+	Reserved          [167]uint32
 }
 
 func (d *Device) NewSuperBlock() (*SuperBlock, error) {
-	_, err := d.seek(BASE_OFFSET)
-	if err != nil {
-		return nil, err
-	}
-
 	super := &SuperBlock{}
-	if err := binary.Read(d.file, binary.LittleEndian, super); err != nil {
+	if err := d.decodeAt(super, d.superBlockOffset()); err != nil {
 		return nil, err
 	}
 
@@ -71,5 +87,53 @@ func (d *Device) NewSuperBlock() (*SuperBlock, error) {
 		return nil, errors.New("Not an ext2 filesystem")
 	}
 
+	if super.RevLevel == EXT2_GOOD_OLD_REV {
+		super.goodOldRev()
+	}
+
 	return super, nil
 }
+
+// BlocksCount64 returns the number of blocks, with its high half on 64bit
+// filesystems.
+func (s *SuperBlock) BlocksCount64() uint64 {
+	if !s.HasIncompat(EXT4_FEATURE_INCOMPAT_64BIT) {
+		return uint64(s.BlocksCount)
+	}
+	return uint64(s.BlocksCountHi)<<32 | uint64(s.BlocksCount)
+}
+
+// FreeBlocksCount64 returns the number of free blocks, with its high half on
+// 64bit filesystems.
+func (s *SuperBlock) FreeBlocksCount64() uint64 {
+	if !s.HasIncompat(EXT4_FEATURE_INCOMPAT_64BIT) {
+		return uint64(s.FreeBlocksCount)
+	}
+	return uint64(s.FreeBlocksCountHi)<<32 | uint64(s.FreeBlocksCount)
+}
+
+// GroupDescSize returns the size of a group descriptor, DescSize on 64bit
+// filesystems.
+func (s *SuperBlock) GroupDescSize() uint32 {
+	if !s.HasIncompat(EXT4_FEATURE_INCOMPAT_64BIT) {
+		return EXT2_GROUP_DESC_SIZE
+	}
+	return uint32(s.DescSize)
+}
+
+// goodOldRev drops whatever a revision 0 superblock holds in place of the
+// EXT2_DYNAMIC_REV fields, and sets the fixed first inode and inode size.
+func (s *SuperBlock) goodOldRev() {
+	s.FirstIno = EXT2_GOOD_OLD_FIRST_INO
+	s.InodeSize = EXT2_GOOD_OLD_INODE_SIZE
+	s.BlockGroupNr = 0
+	s.FeatureCompat = 0
+	s.FeatureIncompat = 0
+	s.FeatureRoCompat = 0
+	s.UUID = [16]uint8{}
+	s.VolumeName = [16]byte{}
+	s.LastMounted = [64]byte{}
+	s.AlgorithmUsageBitmap = 0
+	s.PreallocBlocks = 0
+	s.PreallocDirBlocks = 0
+}
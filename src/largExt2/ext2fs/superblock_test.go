@@ -0,0 +1,149 @@
+package ext2fs
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// rawFileType returns the byte after the name length of the entry of the
+// directory inodeNo named name, as it is stored in its first block.
+func rawFileType(t *testing.T, device *Device, image memImage, inodeNo uint32, name string) byte {
+	t.Helper()
+
+	inode, err := device.NewInode(inodeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := image[device.blockOffset(uint64(inode.Block[0])):][:device.BlockSize]
+	for off := 0; off+8 < len(block); {
+		recLen := int(binary.LittleEndian.Uint16(block[off+4:]))
+		nameLen := int(block[off+6])
+		if string(block[off+8:off+8+nameLen]) == name {
+			return block[off+7]
+		}
+		if recLen == 0 {
+			break
+		}
+		off += recLen
+	}
+
+	t.Fatalf("no entry %s in directory %d", name, inodeNo)
+	return 0
+}
+
+// openGoodOldRev opens the revision 0 image with the fields past the
+// revision level cleared, mke2fs fills them in where older tools left them
+// alone. The incompat features claim filetype, which isn't there.
+func openGoodOldRev(t *testing.T) (*Device, memImage) {
+	t.Helper()
+
+	image := memImage(readTestData(t, "ext2-rev0.img.gz"))
+	zero(image[BASE_OFFSET+84 : BASE_OFFSET+104])
+	binary.LittleEndian.PutUint32(image[BASE_OFFSET+96:], EXT2_FEATURE_INCOMPAT_FILETYPE)
+
+	device, err := NewDeviceFromReaderAt(image, int64(len(image)), DeviceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device, image
+}
+
+func TestGoodOldRev(t *testing.T) {
+	device, image := openGoodOldRev(t)
+
+	super, err := device.NewSuperBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if super.RevLevel != EXT2_GOOD_OLD_REV || super.InodeSize != EXT2_GOOD_OLD_INODE_SIZE || super.FirstIno != EXT2_GOOD_OLD_FIRST_INO {
+		t.Fatalf("revision %d superblock with %d byte inodes from %d", super.RevLevel, super.InodeSize, super.FirstIno)
+	}
+	if device.InodeSize != EXT2_GOOD_OLD_INODE_SIZE || device.FirstIno != EXT2_GOOD_OLD_FIRST_INO || device.ReadOnly() {
+		t.Fatalf("opened with %d byte inodes from %d", device.InodeSize, device.FirstIno)
+	}
+
+	//Inodes past the first one of the table are only found with the right
+	//inode size
+	if data := readTestFile(t, device, "hello"); data != "hello\n" {
+		t.Fatalf("read %q from hello", data)
+	}
+
+	//Without the filetype feature the types come from the inodes
+	dir, err := device.NewDirEntries(EXT2_ROOT_INO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]uint8{".": EXT2_FT_DIR, "..": EXT2_FT_DIR, "lost+found": EXT2_FT_DIR, "hello": EXT2_FT_REG_FILE, "sub": EXT2_FT_DIR, "link": EXT2_FT_SYMLINK}
+	for _, entry := range dir {
+		if entry.FileType != types[entry.NameStr()] {
+			t.Errorf("%s has type %d, want %d", entry.NameStr(), entry.FileType, types[entry.NameStr()])
+		}
+		delete(types, entry.NameStr())
+	}
+	if len(types) != 0 {
+		t.Fatalf("missing entries %v", types)
+	}
+	if rawFileType(t, device, image, EXT2_ROOT_INO, "hello") != 0 {
+		t.Fatal("revision 0 directory entry with a file type")
+	}
+}
+
+func TestGoodOldRevWrite(t *testing.T) {
+	images := []struct {
+		name     string
+		fileType bool
+	}{
+		{"ext2-rev0.img.gz", false},
+		{"ext2-1k.img.gz", true},
+	}
+
+	for _, test := range images {
+		t.Run(test.name, func(t *testing.T) {
+			var device *Device
+			var image memImage
+			if test.fileType {
+				device, image = openTestImage(t, test.name)
+			} else {
+				device, image = openGoodOldRev(t)
+			}
+
+			//The high byte of the name length of the entries of revision 0
+			//directories stays zero
+			const inodeNo = 15
+			if _, err := device.CreateDirInode(EXT2_ROOT_INO, inodeNo); err != nil {
+				t.Fatal(err)
+			}
+			entry := &DirEntry{Inode: inodeNo, RecLen: 12, NameLen: 3, FileType: EXT2_FT_DIR}
+			copy(entry.Name[:], "new")
+			if err := device.AppendDirEntry(EXT2_ROOT_INO, entry); err != nil {
+				t.Fatal(err)
+			}
+
+			want := byte(0)
+			if test.fileType {
+				want = EXT2_FT_DIR
+			}
+			for _, raw := range []byte{
+				rawFileType(t, device, image, EXT2_ROOT_INO, "new"),
+				rawFileType(t, device, image, inodeNo, "."),
+				rawFileType(t, device, image, inodeNo, ".."),
+			} {
+				if raw != want {
+					t.Fatalf("wrote file type %d, want %d", raw, want)
+				}
+			}
+
+			dir, err := device.NewDirEntries(inodeNo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dir) != 2 || dir[0].FileType != EXT2_FT_DIR || dir[1].FileType != EXT2_FT_DIR {
+				t.Fatalf("read back %v", dir.Ls())
+			}
+			if inodeNo, err := device.InodeFromPath("new"); err != nil || inodeNo != 15 {
+				t.Fatalf("new is inode %d, %v", inodeNo, err)
+			}
+		})
+	}
+}
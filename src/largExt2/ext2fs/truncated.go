@@ -0,0 +1,125 @@
+package ext2fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// TruncatedError reports storage shorter than the filesystem it holds.
+type TruncatedError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("Image is truncated, the filesystem needs %d bytes but the storage has %d, %d bytes are missing",
+		e.Expected, e.Actual, e.Expected-e.Actual)
+}
+
+// FileSize returns the size of an image file, or the size of a block device
+// as reported by the kernel.
+func FileSize(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if info.Mode()&os.ModeDevice != 0 {
+		return blockDeviceSize(file)
+	}
+	return info.Size(), nil
+}
+
+// ExpectedSize returns the size in bytes the storage needs to hold the whole
+// filesystem.
+func (d *Device) ExpectedSize() int64 {
+	return d.offset + int64(d.BlocksCount)*int64(d.BlockSize)
+}
+
+// Truncated reports whether the storage ends before the filesystem does. Only
+// a Device opened with the Degraded option can be truncated.
+func (d *Device) Truncated() bool {
+	return d.size < d.ExpectedSize()
+}
+
+func (d *Device) blockMissing(blockNo uint64) bool {
+	return d.blockOffset(blockNo)+int64(d.BlockSize) > d.size
+}
+
+// MissingBlocks counts the blocks of the inode past the end of a truncated
+// storage. A missing indirect block counts along with every data block it
+// maps, their numbers being lost with it.
+func (d *Device) MissingBlocks(inode *Inode) (uint64, error) {
+	if !d.Truncated() || (inode.IsLnk() && inode.Blocks == 0) {
+		return 0, nil
+	}
+
+	perBlock := uint64(d.BlockSize / 4)
+	remaining := (inode.Size64() + uint64(d.BlockSize) - 1) / uint64(d.BlockSize)
+	missing := uint64(0)
+
+	var walk func(blockNo uint32, depth int) error
+	walk = func(blockNo uint32, depth int) error {
+		span := uint64(1)
+		for i := 0; i < depth; i++ {
+			span *= perBlock
+		}
+		if span > remaining {
+			span = remaining
+		}
+
+		if blockNo == EXT2_NULL_BLOCK {
+			remaining -= span
+			return nil
+		}
+
+		if d.blockMissing(uint64(blockNo)) {
+			if depth > 0 {
+				missing++
+			}
+			missing += span
+			remaining -= span
+			return nil
+		}
+
+		if depth == 0 {
+			remaining--
+			return nil
+		}
+
+		pointers, err := d.metaBlock(uint64(blockNo))
+		if err != nil {
+			return err
+		}
+
+		for i := uint32(0); i < d.BlockSize/4 && remaining > 0; i++ {
+			if err := walk(binary.LittleEndian.Uint32(pointers[4*i:]), depth-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i, blockNo := range inode.Block {
+		if remaining == 0 {
+			break
+		}
+
+		depth := 0
+		switch i {
+		case EXT2_IND_BLOCK:
+			depth = 1
+		case EXT2_DIND_BLOCK:
+			depth = 2
+		case EXT2_TIND_BLOCK:
+			depth = 3
+		}
+
+		if err := walk(blockNo, depth); err != nil {
+			return missing, err
+		}
+	}
+
+	return missing, nil
+}
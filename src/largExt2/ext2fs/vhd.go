@@ -0,0 +1,515 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	VHD_FOOTER_COOKIE    = "conectix"
+	VHD_DYNAMIC_COOKIE   = "cxsparse"
+	VHD_FOOTER_SIZE      = 512
+	VHD_DYNAMIC_SIZE     = 1024
+	VHD_TYPE_FIXED       = 2
+	VHD_TYPE_DYNAMIC     = 3
+	VHD_TYPE_DIFFERENCE  = 4
+	VHD_UNUSED_BLOCK     = 0xFFFFFFFF
+	VHD_MAX_PARENT_DEPTH = 16
+	VHD_LOCATOR_W2RU     = 0x57327275
+	VHD_LOCATOR_W2KU     = 0x57326B75
+	VHD_LOCATOR_MACX     = 0x4D616358
+	vhdMaxBlockSize      = 256 * 1024 * 1024
+)
+
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      uint32
+	OriginalSize       uint64
+	CurrentSize        uint64
+	DiskGeometry       uint32
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+type vhdParentLocator struct {
+	PlatformCode       uint32
+	PlatformDataSpace  uint32
+	PlatformDataLength uint32
+	Reserved           uint32
+	PlatformDataOffset uint64
+}
+
+type vhdDynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueID    [16]byte
+	ParentTimeStamp   uint32
+	Reserved1         uint32
+	ParentUnicodeName [256]uint16
+	ParentLocators    [8]vhdParentLocator
+	Reserved2         [256]byte
+}
+
+// VhdImage reads the disk of a fixed, dynamic or differencing VHD image.
+// Sectors a differencing disk doesn't hold are read from its parent.
+type VhdImage struct {
+	DiskType   uint32
+	UniqueID   [16]byte
+	ParentID   [16]byte
+	ParentName string
+	r          io.ReaderAt
+	parent     io.ReaderAt
+	size       int64
+	blockSize  int64
+	bitmapSize int64
+	bat        []uint32
+	locators   []string
+	mu         sync.Mutex
+	bitmapNo   int64
+	bitmap     []byte
+}
+
+// vhdChecksum is the one's complement of the sum of all bytes of a header
+// but its checksum field.
+func vhdChecksum(buf []byte, checksumOffset int) uint32 {
+	var sum uint32
+	for i, b := range buf {
+		if i >= checksumOffset && i < checksumOffset+4 {
+			continue
+		}
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+// readVhdFooter reads the footer at the end of the image, or the copy a
+// dynamic image keeps at its start. It returns nil when neither is found.
+func readVhdFooter(r io.ReaderAt, size int64) (*vhdFooter, error) {
+	for _, off := range []int64{size - VHD_FOOTER_SIZE, 0} {
+		if off < 0 {
+			continue
+		}
+
+		buf := make([]byte, VHD_FOOTER_SIZE)
+		if _, err := r.ReadAt(buf, off); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		footer := &vhdFooter{}
+		binary.Read(bytes.NewReader(buf), binary.BigEndian, footer)
+		if string(footer.Cookie[:]) != VHD_FOOTER_COOKIE {
+			continue
+		}
+
+		if footer.Checksum != vhdChecksum(buf, 64) {
+			continue
+		}
+
+		return footer, nil
+	}
+
+	return nil, nil
+}
+
+// IsVhd reports whether r of the given size is a VHD image.
+func IsVhd(r io.ReaderAt, size int64) bool {
+	footer, err := readVhdFooter(r, size)
+	return err == nil && footer != nil
+}
+
+// NewVhdImage reads the VHD image r of the given size. parent is the image
+// a differencing disk is based on and nil for other disk types.
+func NewVhdImage(r io.ReaderAt, size int64, parent io.ReaderAt) (*VhdImage, error) {
+	v, err := newVhdImage(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.DiskType == VHD_TYPE_DIFFERENCE && parent == nil {
+		return nil, errors.New(fmt.Sprintf("Differencing VHD image needs its parent %s", v.ParentName))
+	}
+
+	v.parent = parent
+	return v, nil
+}
+
+func newVhdImage(r io.ReaderAt, size int64) (*VhdImage, error) {
+	footer, err := readVhdFooter(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if footer == nil {
+		return nil, errors.New("Not a VHD image")
+	}
+
+	v := &VhdImage{
+		DiskType: footer.DiskType,
+		UniqueID: footer.UniqueID,
+		r:        r,
+		size:     int64(footer.CurrentSize),
+		bitmapNo: -1,
+	}
+
+	switch footer.DiskType {
+	case VHD_TYPE_FIXED:
+		if v.size > size-VHD_FOOTER_SIZE {
+			return nil, errors.New(fmt.Sprintf("Fixed VHD image is truncated, %d bytes of %d", size-VHD_FOOTER_SIZE, v.size))
+		}
+		return v, nil
+	case VHD_TYPE_DYNAMIC, VHD_TYPE_DIFFERENCE:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported VHD disk type %d", footer.DiskType))
+	}
+
+	if err := v.readDynamicHeader(int64(footer.DataOffset)); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *VhdImage) readDynamicHeader(off int64) error {
+	buf := make([]byte, VHD_DYNAMIC_SIZE)
+	if _, err := v.r.ReadAt(buf, off); err != nil {
+		return err
+	}
+
+	header := &vhdDynamicHeader{}
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, header)
+
+	if string(header.Cookie[:]) != VHD_DYNAMIC_COOKIE {
+		return errors.New("VHD dynamic disk header not found")
+	}
+
+	if header.Checksum != vhdChecksum(buf, 36) {
+		return errors.New("VHD dynamic disk header checksum mismatch")
+	}
+
+	blockSize := int64(header.BlockSize)
+	if blockSize < SECTOR_SIZE || blockSize > vhdMaxBlockSize || blockSize&(blockSize-1) != 0 {
+		return errors.New(fmt.Sprintf("Bad VHD block size %d", blockSize))
+	}
+
+	v.blockSize = blockSize
+	v.bitmapSize = (blockSize/SECTOR_SIZE/8 + SECTOR_SIZE - 1) &^ (SECTOR_SIZE - 1)
+	v.ParentID = header.ParentUniqueID
+	v.ParentName = utf16String(header.ParentUnicodeName[:])
+
+	if blocks := (v.size + blockSize - 1) / blockSize; int64(header.MaxTableEntries) < blocks {
+		return errors.New(fmt.Sprintf("VHD block table of %d entries is too small for %d bytes", header.MaxTableEntries, v.size))
+	}
+
+	table := make([]byte, 4*int64(header.MaxTableEntries))
+	if _, err := v.r.ReadAt(table, int64(header.TableOffset)); err != nil {
+		return err
+	}
+
+	v.bat = make([]uint32, header.MaxTableEntries)
+	for i := range v.bat {
+		v.bat[i] = binary.BigEndian.Uint32(table[4*i:])
+	}
+
+	if v.DiskType == VHD_TYPE_DIFFERENCE {
+		for _, locator := range header.ParentLocators {
+			if path := v.readLocator(locator); path != "" {
+				v.locators = append(v.locators, path)
+			}
+		}
+	}
+
+	return nil
+}
+
+// readLocator returns the parent path a parent locator entry holds. Windows
+// paths are UTF-16LE, Mac OS X paths are file URLs.
+func (v *VhdImage) readLocator(locator vhdParentLocator) string {
+	if locator.PlatformDataLength == 0 || locator.PlatformDataLength > 64*1024 {
+		return ""
+	}
+
+	data := make([]byte, locator.PlatformDataLength)
+	if _, err := v.r.ReadAt(data, int64(locator.PlatformDataOffset)); err != nil {
+		return ""
+	}
+
+	switch locator.PlatformCode {
+	case VHD_LOCATOR_W2RU, VHD_LOCATOR_W2KU:
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = binary.LittleEndian.Uint16(data[2*i:])
+		}
+		return strings.ReplaceAll(utf16String(units), "\\", "/")
+	case VHD_LOCATOR_MACX:
+		return strings.TrimPrefix(strings.TrimRight(string(data), "\x00"), "file://")
+	}
+
+	return ""
+}
+
+// ParentPaths lists where the parent of a differencing disk at path may be,
+// best first. Only files next to the child are considered.
+func (v *VhdImage) ParentPaths(path string) []string {
+	dir := filepath.Dir(path)
+	paths := make([]string, 0)
+	seen := make(map[string]bool)
+
+	add := func(name string) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return
+		}
+		candidate := filepath.Join(dir, filepath.Base(name))
+		if !seen[candidate] {
+			seen[candidate] = true
+			paths = append(paths, candidate)
+		}
+	}
+
+	for _, locator := range v.locators {
+		add(locator)
+	}
+	add(v.ParentName)
+
+	return paths
+}
+
+// OpenVhdImage opens a VHD image file. The parents of differencing disks
+// are found through their parent locators, next to the child.
+func OpenVhdImage(path string) (*VhdImage, error) {
+	return openVhdImage(path, nil, 0)
+}
+
+func openVhdImage(path string, expectedID *[16]byte, depth int) (*VhdImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	v, err := newVhdImage(file, size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if expectedID != nil && v.UniqueID != *expectedID {
+		file.Close()
+		return nil, errors.New(fmt.Sprintf("%s is not the parent VHD image, its unique id differs", path))
+	}
+
+	if v.DiskType != VHD_TYPE_DIFFERENCE {
+		return v, nil
+	}
+
+	if depth >= VHD_MAX_PARENT_DEPTH {
+		file.Close()
+		return nil, errors.New(fmt.Sprintf("Parent chain of %s is too long", path))
+	}
+
+	var parentErr error
+	for _, candidate := range v.ParentPaths(path) {
+		if _, err := os.Stat(candidate); err != nil {
+			continue
+		}
+
+		parent, err := openVhdImage(candidate, &v.ParentID, depth+1)
+		if err != nil {
+			parentErr = err
+			continue
+		}
+
+		v.parent = parent
+		return v, nil
+	}
+
+	file.Close()
+	if parentErr != nil {
+		return nil, parentErr
+	}
+	return nil, errors.New(fmt.Sprintf("Parent %s of differencing VHD image %s not found next to it", v.ParentName, path))
+}
+
+// Parent returns the parent of a differencing disk, or nil.
+func (v *VhdImage) Parent() io.ReaderAt {
+	return v.parent
+}
+
+func (v *VhdImage) Size() int64 {
+	return v.size
+}
+
+func (v *VhdImage) String() string {
+	switch v.DiskType {
+	case VHD_TYPE_FIXED:
+		return fmt.Sprintf("fixed VHD image, %d bytes", v.size)
+	case VHD_TYPE_DYNAMIC:
+		return fmt.Sprintf("dynamic VHD image, %d bytes, %d byte blocks", v.size, v.blockSize)
+	}
+	return fmt.Sprintf("differencing VHD image, %d bytes, %d byte blocks, parent %s", v.size, v.blockSize, v.ParentName)
+}
+
+func (v *VhdImage) Close() error {
+	var err error
+	for _, r := range []io.ReaderAt{v.r, v.parent} {
+		if closer, ok := r.(io.Closer); ok {
+			if cerr := closer.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+func (v *VhdImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= v.size {
+		return 0, io.EOF
+	}
+
+	want := p
+	if int64(len(want)) > v.size-off {
+		want = want[:v.size-off]
+	}
+
+	if v.DiskType == VHD_TYPE_FIXED {
+		n, err := v.r.ReadAt(want, off)
+		if err == io.EOF && n == len(want) {
+			err = nil
+		}
+		if err != nil {
+			return n, err
+		}
+	} else {
+		n := 0
+		for n < len(want) {
+			pos := off + int64(n)
+			inner := pos % v.blockSize
+
+			piece := want[n:]
+			if int64(len(piece)) > v.blockSize-inner {
+				piece = piece[:v.blockSize-inner]
+			}
+
+			if err := v.readBlock(piece, pos/v.blockSize, inner); err != nil {
+				return n, err
+			}
+			n += len(piece)
+		}
+	}
+
+	if len(want) < len(p) {
+		return len(want), io.EOF
+	}
+	return len(p), nil
+}
+
+// readBlock fills p from a block, sector runs present in this image from
+// the block data and the others from the parent, or as zeros.
+func (v *VhdImage) readBlock(p []byte, blockNo int64, inner int64) error {
+	pos := blockNo*v.blockSize + inner
+
+	sector := v.bat[blockNo]
+	if sector == VHD_UNUSED_BLOCK {
+		return v.readParent(p, pos)
+	}
+
+	bitmap, err := v.blockBitmap(blockNo, int64(sector)*SECTOR_SIZE)
+	if err != nil {
+		return err
+	}
+
+	data := int64(sector)*SECTOR_SIZE + v.bitmapSize
+	present := func(at int64) bool {
+		s := at / SECTOR_SIZE
+		return bitmap[s/8]&(0x80>>uint(s%8)) != 0
+	}
+
+	for len(p) > 0 {
+		run := SECTOR_SIZE - inner%SECTOR_SIZE
+		here := present(inner)
+		for run < int64(len(p)) && present(inner+run) == here {
+			run += SECTOR_SIZE
+		}
+		if run > int64(len(p)) {
+			run = int64(len(p))
+		}
+
+		if here {
+			n, err := v.r.ReadAt(p[:run], data+inner)
+			if err != nil && !(err == io.EOF && n == int(run)) {
+				return err
+			}
+		} else if err := v.readParent(p[:run], blockNo*v.blockSize+inner); err != nil {
+			return err
+		}
+
+		p = p[run:]
+		inner += run
+	}
+
+	return nil
+}
+
+func (v *VhdImage) readParent(p []byte, pos int64) error {
+	if v.parent == nil {
+		zero(p)
+		return nil
+	}
+
+	n, err := v.parent.ReadAt(p, pos)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	zero(p[n:])
+	return nil
+}
+
+// blockBitmap returns the sector bitmap in front of a block. The last one
+// is kept for the reads that follow it.
+func (v *VhdImage) blockBitmap(blockNo int64, off int64) ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if blockNo == v.bitmapNo {
+		return v.bitmap, nil
+	}
+
+	bitmap := make([]byte, v.bitmapSize)
+	if _, err := v.r.ReadAt(bitmap, off); err != nil {
+		return nil, err
+	}
+
+	v.bitmapNo = blockNo
+	v.bitmap = bitmap
+	return bitmap, nil
+}
@@ -0,0 +1,334 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+const (
+	vhdTestBlock   = 16 * 1024
+	vhdTestSectors = vhdTestBlock / SECTOR_SIZE
+	vhdTestSize    = 5*vhdTestBlock + vhdTestBlock/2 //The last block is partly past the end
+)
+
+var (
+	vhdTestBaseID  = [16]byte{0xBA, 0x5E}
+	vhdTestChildID = [16]byte{0xC4, 0x1D}
+)
+
+type vhdTestLocator struct {
+	code uint32
+	path string
+}
+
+// vhdTestParent names the parent of a differencing disk.
+type vhdTestParent struct {
+	id       [16]byte
+	name     string
+	locators []vhdTestLocator
+}
+
+func vhdTestEncode(data interface{}) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, data)
+	return buf.Bytes()
+}
+
+func vhdTestFooter(diskType uint32, size int, dataOffset uint64, id [16]byte) []byte {
+	footer := vhdFooter{
+		Features:          2,
+		FileFormatVersion: 0x10000,
+		DataOffset:        dataOffset,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          diskType,
+		UniqueID:          id,
+	}
+	copy(footer.Cookie[:], VHD_FOOTER_COOKIE)
+
+	buf := vhdTestEncode(footer)
+	binary.BigEndian.PutUint32(buf[64:], vhdChecksum(buf, 64))
+	return buf
+}
+
+func vhdTestFixed(data []byte, id [16]byte) []byte {
+	return append(append([]byte(nil), data...), vhdTestFooter(VHD_TYPE_FIXED, len(data), ^uint64(0), id)...)
+}
+
+// vhdTestDynamic returns a dynamic VHD image of data, or a differencing one
+// when parent is set. Only the sectors present reports are stored, the
+// others of a stored block hold garbage. Blocks without any sector present
+// are left unused.
+func vhdTestDynamic(data []byte, id [16]byte, present func(sector int) bool, parent *vhdTestParent) []byte {
+	blocks := (len(data) + vhdTestBlock - 1) / vhdTestBlock
+	tableSize := (4*blocks + SECTOR_SIZE - 1) &^ (SECTOR_SIZE - 1)
+
+	//Footer copy, dynamic disk header and block table
+	image := make([]byte, 3*SECTOR_SIZE+tableSize)
+
+	diskType := uint32(VHD_TYPE_DYNAMIC)
+	header := vhdDynamicHeader{
+		DataOffset:      ^uint64(0),
+		TableOffset:     3 * SECTOR_SIZE,
+		HeaderVersion:   0x10000,
+		MaxTableEntries: uint32(blocks),
+		BlockSize:       vhdTestBlock,
+	}
+	copy(header.Cookie[:], VHD_DYNAMIC_COOKIE)
+
+	if parent != nil {
+		diskType = VHD_TYPE_DIFFERENCE
+		header.ParentUniqueID = parent.id
+		copy(header.ParentUnicodeName[:], utf16.Encode([]rune(parent.name)))
+
+		for i, locator := range parent.locators {
+			raw := []byte(locator.path)
+			if locator.code != VHD_LOCATOR_MACX {
+				raw = raw[:0]
+				for _, unit := range utf16.Encode([]rune(locator.path)) {
+					raw = append(raw, byte(unit), byte(unit>>8))
+				}
+			}
+
+			header.ParentLocators[i] = vhdParentLocator{
+				PlatformCode:       locator.code,
+				PlatformDataSpace:  1,
+				PlatformDataLength: uint32(len(raw)),
+				PlatformDataOffset: uint64(len(image)),
+			}
+			sector := make([]byte, SECTOR_SIZE)
+			copy(sector, raw)
+			image = append(image, sector...)
+		}
+	}
+
+	for b := 0; b < blocks; b++ {
+		bitmap := make([]byte, SECTOR_SIZE)
+		block := bytes.Repeat([]byte{0xEE}, vhdTestBlock)
+		for s := 0; s < vhdTestSectors; s++ {
+			sector := b*vhdTestSectors + s
+			if !present(sector) || sector*SECTOR_SIZE >= len(data) {
+				continue
+			}
+			bitmap[s/8] |= 0x80 >> uint(s%8)
+			copy(block[s*SECTOR_SIZE:(s+1)*SECTOR_SIZE], data[sector*SECTOR_SIZE:])
+		}
+
+		entry := uint32(VHD_UNUSED_BLOCK)
+		if !bytes.Equal(bitmap, make([]byte, SECTOR_SIZE)) {
+			entry = uint32(len(image) / SECTOR_SIZE)
+			image = append(append(image, bitmap...), block...)
+		}
+		binary.BigEndian.PutUint32(image[3*SECTOR_SIZE+4*b:], entry)
+	}
+
+	raw := vhdTestEncode(header)
+	binary.BigEndian.PutUint32(raw[36:], vhdChecksum(raw, 36))
+	copy(image[SECTOR_SIZE:], raw)
+
+	footer := vhdTestFooter(diskType, len(data), SECTOR_SIZE, id)
+	copy(image, footer)
+	return append(image, footer...)
+}
+
+func vhdTestData(seed int64) []byte {
+	data := make([]byte, vhdTestSize)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// vhdTestMixed marks the sectors a child holds. Its first block mixes
+// present and parent sectors, the second is all parent, the third all
+// present and the fourth has runs of five sectors of each.
+func vhdTestMixed(sector int) bool {
+	switch (sector / vhdTestSectors) % 4 {
+	case 0:
+		return sector%3 != 0
+	case 1:
+		return false
+	case 2:
+		return true
+	}
+	return (sector/5)%2 == 0
+}
+
+func writeVhdTest(t *testing.T, path string, image []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVhdFixed(t *testing.T) {
+	data := vhdTestData(1)
+	image := vhdTestFixed(data, vhdTestBaseID)
+
+	if !IsVhd(memImage(image), int64(len(image))) {
+		t.Fatal("fixed image not recognized")
+	}
+
+	v, err := NewVhdImage(memImage(image), int64(len(image)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.DiskType != VHD_TYPE_FIXED || v.UniqueID != vhdTestBaseID {
+		t.Fatalf("opened %s", v)
+	}
+	checkRandomReads(t, v, data)
+
+	//The footer names more data than the image holds
+	truncated := append(append([]byte(nil), data[:len(data)/2]...), image[len(data):]...)
+	if _, err := NewVhdImage(memImage(truncated), int64(len(truncated)), nil); err == nil {
+		t.Fatal("truncated fixed image opened")
+	}
+}
+
+func TestVhdDynamic(t *testing.T) {
+	//The third block is all zeros and left unused
+	data := vhdTestData(2)
+	zero(data[2*vhdTestBlock : 3*vhdTestBlock])
+	image := vhdTestDynamic(data, vhdTestBaseID, func(sector int) bool {
+		return sector/vhdTestSectors != 2
+	}, nil)
+
+	path := filepath.Join(t.TempDir(), "disk.vhd")
+	writeVhdTest(t, path, image)
+
+	v, err := OpenVhdImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	if v.DiskType != VHD_TYPE_DYNAMIC || v.bat[2] != VHD_UNUSED_BLOCK {
+		t.Fatalf("opened %s", v)
+	}
+	checkRandomReads(t, v, data)
+
+	//The copy of the footer at the start is used when the last one is gone
+	v, err = NewVhdImage(memImage(image[:len(image)-VHD_FOOTER_SIZE]), int64(len(image)-VHD_FOOTER_SIZE), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRandomReads(t, v, data)
+}
+
+func TestVhdDifferencing(t *testing.T) {
+	for _, base := range []string{"fixed", "dynamic"} {
+		t.Run(base, func(t *testing.T) {
+			dir := t.TempDir()
+
+			parentData := vhdTestData(3)
+			if base == "fixed" {
+				writeVhdTest(t, filepath.Join(dir, "base.vhd"), vhdTestFixed(parentData, vhdTestBaseID))
+			} else {
+				all := func(int) bool { return true }
+				writeVhdTest(t, filepath.Join(dir, "base.vhd"), vhdTestDynamic(parentData, vhdTestBaseID, all, nil))
+			}
+
+			childData := vhdTestData(4)
+			parent := &vhdTestParent{
+				id:       vhdTestBaseID,
+				name:     "base.vhd",
+				locators: []vhdTestLocator{{VHD_LOCATOR_W2KU, "C:\\images\\base.vhd"}},
+			}
+			writeVhdTest(t, filepath.Join(dir, "child.vhd"), vhdTestDynamic(childData, vhdTestChildID, vhdTestMixed, parent))
+
+			v, err := OpenVhdImage(filepath.Join(dir, "child.vhd"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer v.Close()
+
+			if v.DiskType != VHD_TYPE_DIFFERENCE || v.ParentID != vhdTestBaseID || v.Parent() == nil {
+				t.Fatalf("opened %s", v)
+			}
+
+			want := make([]byte, vhdTestSize)
+			for s := 0; s < vhdTestSize/SECTOR_SIZE; s++ {
+				from := parentData
+				if vhdTestMixed(s) {
+					from = childData
+				}
+				copy(want[s*SECTOR_SIZE:(s+1)*SECTOR_SIZE], from[s*SECTOR_SIZE:])
+			}
+			checkRandomReads(t, v, want)
+		})
+	}
+}
+
+func TestVhdParentPaths(t *testing.T) {
+	parent := &vhdTestParent{
+		id:   vhdTestBaseID,
+		name: "base.vhd",
+		locators: []vhdTestLocator{
+			{VHD_LOCATOR_W2RU, ".\\old.vhd"},
+			{VHD_LOCATOR_W2KU, "D:\\vms\\base.vhd"},
+			{VHD_LOCATOR_MACX, "file:///Users/me/other.vhd"},
+		},
+	}
+	image := vhdTestDynamic(vhdTestData(5), vhdTestChildID, vhdTestMixed, parent)
+
+	v, err := NewVhdImage(memImage(image), int64(len(image)), memImage(vhdTestFixed(vhdTestData(3), vhdTestBaseID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Locators come first, every candidate is next to the child
+	dir := filepath.Join("images", "vm")
+	want := []string{filepath.Join(dir, "old.vhd"), filepath.Join(dir, "base.vhd"), filepath.Join(dir, "other.vhd")}
+	if paths := v.ParentPaths(filepath.Join(dir, "child.vhd")); !reflect.DeepEqual(paths, want) {
+		t.Fatalf("parent paths %v, want %v", paths, want)
+	}
+
+	//Without its parent a differencing disk can't be read
+	if _, err := NewVhdImage(memImage(image), int64(len(image)), nil); err == nil {
+		t.Fatal("differencing disk opened without a parent")
+	}
+}
+
+func TestVhdParentUniqueID(t *testing.T) {
+	dir := t.TempDir()
+
+	//The first locator names a disk that isn't the parent
+	parent := &vhdTestParent{
+		id:       vhdTestBaseID,
+		name:     "base.vhd",
+		locators: []vhdTestLocator{{VHD_LOCATOR_W2KU, "C:\\images\\stale.vhd"}},
+	}
+	writeVhdTest(t, filepath.Join(dir, "child.vhd"), vhdTestDynamic(vhdTestData(6), vhdTestChildID, vhdTestMixed, parent))
+	writeVhdTest(t, filepath.Join(dir, "stale.vhd"), vhdTestFixed(vhdTestData(7), [16]byte{0x57}))
+
+	_, err := OpenVhdImage(filepath.Join(dir, "child.vhd"))
+	if err == nil || !strings.Contains(err.Error(), "unique id differs") {
+		t.Fatalf("opening with the wrong parent gave %v", err)
+	}
+
+	//The next candidate is
+	parentData := vhdTestData(3)
+	writeVhdTest(t, filepath.Join(dir, "base.vhd"), vhdTestFixed(parentData, vhdTestBaseID))
+
+	v, err := OpenVhdImage(filepath.Join(dir, "child.vhd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	if parent, ok := v.Parent().(*VhdImage); !ok || parent.UniqueID != vhdTestBaseID {
+		t.Fatalf("opened the parent %v", v.Parent())
+	}
+
+	os.Remove(filepath.Join(dir, "base.vhd"))
+	os.Remove(filepath.Join(dir, "stale.vhd"))
+	if _, err := OpenVhdImage(filepath.Join(dir, "child.vhd")); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("opening without a parent gave %v", err)
+	}
+}
@@ -0,0 +1,607 @@
+package ext2fs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	VMDK_SPARSE_MAGIC     = 0x564D444B
+	VMDK_DESCRIPTOR_MAGIC = "# Disk DescriptorFile"
+	VMDK_GD_AT_END        = 0xFFFFFFFFFFFFFFFF
+	VMDK_FLAG_ZERO_GRAINS = 1 << 2
+	VMDK_FLAG_COMPRESSED  = 1 << 16
+	VMDK_COMPRESS_DEFLATE = 1
+	VMDK_NO_PARENT        = "ffffffff"
+	vmdkFooterOffset      = 2 * SECTOR_SIZE
+	vmdkGrainMarkerSize   = 12
+	vmdkZeroGrain         = 1
+	vmdkMaxDescriptorSize = 1024 * 1024
+	vmdkMaxGrainSectors   = 2048
+	vmdkGrainTables       = 256
+)
+
+type vmdkSparseHeader struct {
+	Magic              uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]uint8
+}
+
+// VmdkSparseExtent reads a hosted sparse extent, either monolithicSparse or
+// streamOptimized with deflate compressed grains. Grains that are not
+// allocated read as zeros.
+type VmdkSparseExtent struct {
+	r          io.ReaderAt
+	header     vmdkSparseHeader
+	grainSize  int64
+	gd         []uint32
+	mu         sync.Mutex
+	gts        map[uint32]*vmdkGrainTable
+	clock      uint64
+	grainNo    int64
+	grain      []byte
+	descriptor string
+}
+
+type vmdkGrainTable struct {
+	entries []uint32
+	used    uint64
+}
+
+// VmdkImage presents the extents named by a VMDK descriptor as one disk.
+type VmdkImage struct {
+	CreateType string
+	extents    []io.ReaderAt
+	starts     []int64
+	size       int64
+	closers    []io.Closer
+}
+
+type vmdkExtentLine struct {
+	sectors int64
+	kind    string
+	file    string
+	offset  int64
+}
+
+// IsVmdk reports whether r is a VMDK sparse extent or descriptor file.
+func IsVmdk(r io.ReaderAt) bool {
+	buf := make([]byte, len(VMDK_DESCRIPTOR_MAGIC))
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint32(buf) == VMDK_SPARSE_MAGIC || string(buf) == VMDK_DESCRIPTOR_MAGIC
+}
+
+// NewVmdkSparseExtent reads the sparse extent r of the given size. The
+// grain directory of a streamOptimized extent is found through the footer
+// at the end of the extent.
+func NewVmdkSparseExtent(r io.ReaderAt, size int64) (*VmdkSparseExtent, error) {
+	e := &VmdkSparseExtent{r: r, gts: make(map[uint32]*vmdkGrainTable), grainNo: -1}
+	if err := e.readHeader(0); err != nil {
+		return nil, err
+	}
+
+	if e.header.GdOffset == VMDK_GD_AT_END {
+		if size < vmdkFooterOffset+SECTOR_SIZE {
+			return nil, errors.New("VMDK stream is too short for a footer")
+		}
+		if err := e.readHeader(size - vmdkFooterOffset); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.header.Flags&VMDK_FLAG_COMPRESSED != 0 && e.header.CompressAlgorithm != VMDK_COMPRESS_DEFLATE {
+		return nil, errors.New(fmt.Sprintf("Unsupported VMDK compression algorithm %d", e.header.CompressAlgorithm))
+	}
+
+	if e.header.GrainSize == 0 || e.header.GrainSize > vmdkMaxGrainSectors || e.header.GrainSize&(e.header.GrainSize-1) != 0 {
+		return nil, errors.New(fmt.Sprintf("Bad VMDK grain size of %d sectors", e.header.GrainSize))
+	}
+
+	if e.header.NumGTEsPerGT == 0 || e.header.GdOffset == 0 || e.header.GdOffset == VMDK_GD_AT_END {
+		return nil, errors.New("VMDK extent has no grain directory")
+	}
+	e.grainSize = int64(e.header.GrainSize) * SECTOR_SIZE
+
+	if e.header.Capacity > uint64(math.MaxInt64/SECTOR_SIZE) {
+		return nil, errors.New(fmt.Sprintf("Bad VMDK capacity of %d sectors", e.header.Capacity))
+	}
+
+	grains := (int64(e.header.Capacity) + int64(e.header.GrainSize) - 1) / int64(e.header.GrainSize)
+	tables := (grains + int64(e.header.NumGTEsPerGT) - 1) / int64(e.header.NumGTEsPerGT)
+
+	//The grain directory is read whole, it has to fit in the extent
+	if e.header.GdOffset > uint64(size/SECTOR_SIZE) || 4*tables > size-int64(e.header.GdOffset)*SECTOR_SIZE {
+		return nil, errors.New(fmt.Sprintf("VMDK grain directory of %d entries at sector %d is past the end of the %d byte extent", tables, e.header.GdOffset, size))
+	}
+
+	buf := make([]byte, 4*tables)
+	if _, err := r.ReadAt(buf, int64(e.header.GdOffset)*SECTOR_SIZE); err != nil {
+		return nil, err
+	}
+
+	e.gd = make([]uint32, tables)
+	for i := range e.gd {
+		e.gd[i] = binary.LittleEndian.Uint32(buf[4*i:])
+	}
+
+	if e.header.DescriptorOffset != 0 && e.header.DescriptorSize > 0 && e.header.DescriptorSize*SECTOR_SIZE <= vmdkMaxDescriptorSize {
+		text := make([]byte, e.header.DescriptorSize*SECTOR_SIZE)
+		if _, err := r.ReadAt(text, int64(e.header.DescriptorOffset)*SECTOR_SIZE); err != nil {
+			return nil, err
+		}
+		e.descriptor = strings.TrimRight(string(text), "\x00")
+	}
+
+	return e, nil
+}
+
+func (e *VmdkSparseExtent) readHeader(off int64) error {
+	buf := make([]byte, SECTOR_SIZE)
+	if _, err := e.r.ReadAt(buf, off); err != nil {
+		return err
+	}
+
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, &e.header)
+	if e.header.Magic != VMDK_SPARSE_MAGIC {
+		return errors.New("Not a VMDK sparse extent")
+	}
+	return nil
+}
+
+// Size returns the capacity of the extent in bytes.
+func (e *VmdkSparseExtent) Size() int64 {
+	return int64(e.header.Capacity) * SECTOR_SIZE
+}
+
+// Descriptor returns the descriptor embedded in the extent, if any.
+func (e *VmdkSparseExtent) Descriptor() string {
+	return e.descriptor
+}
+
+func (e *VmdkSparseExtent) Close() error {
+	if closer, ok := e.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (e *VmdkSparseExtent) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	if off >= e.Size() {
+		return 0, io.EOF
+	}
+
+	want := p
+	if int64(len(want)) > e.Size()-off {
+		want = want[:e.Size()-off]
+	}
+
+	n := 0
+	for n < len(want) {
+		pos := off + int64(n)
+		inner := pos % e.grainSize
+
+		piece := want[n:]
+		if int64(len(piece)) > e.grainSize-inner {
+			piece = piece[:e.grainSize-inner]
+		}
+
+		if err := e.readGrain(piece, pos/e.grainSize, inner); err != nil {
+			return n, err
+		}
+		n += len(piece)
+	}
+
+	if len(want) < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (e *VmdkSparseExtent) readGrain(p []byte, grainNo int64, inner int64) error {
+	sector, err := e.grainSector(grainNo)
+	if err != nil {
+		return err
+	}
+
+	if sector == 0 || (sector == vmdkZeroGrain && e.header.Flags&VMDK_FLAG_ZERO_GRAINS != 0) {
+		zero(p)
+		return nil
+	}
+
+	if e.header.Flags&VMDK_FLAG_COMPRESSED == 0 {
+		n, err := e.r.ReadAt(p, int64(sector)*SECTOR_SIZE+inner)
+		if err == io.EOF && n == len(p) {
+			err = nil
+		}
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	grain, err := e.compressedGrain(grainNo, int64(sector)*SECTOR_SIZE)
+	if err != nil {
+		return err
+	}
+	copy(p, grain[inner:])
+	return nil
+}
+
+// grainSector looks up the sector of a grain in its grain table.
+func (e *VmdkSparseExtent) grainSector(grainNo int64) (uint32, error) {
+	perTable := int64(e.header.NumGTEsPerGT)
+	if grainNo/perTable >= int64(len(e.gd)) {
+		return 0, nil
+	}
+
+	tableSector := e.gd[grainNo/perTable]
+	if tableSector == 0 {
+		return 0, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.clock++
+
+	table, ok := e.gts[tableSector]
+	if !ok {
+		buf := make([]byte, 4*perTable)
+		if _, err := e.r.ReadAt(buf, int64(tableSector)*SECTOR_SIZE); err != nil {
+			return 0, err
+		}
+
+		table = &vmdkGrainTable{entries: make([]uint32, perTable)}
+		for i := range table.entries {
+			table.entries[i] = binary.LittleEndian.Uint32(buf[4*i:])
+		}
+
+		if len(e.gts) >= vmdkGrainTables {
+			var oldest uint32
+			var used uint64
+			for candidate, t := range e.gts {
+				if used == 0 || t.used < used {
+					oldest, used = candidate, t.used
+				}
+			}
+			delete(e.gts, oldest)
+		}
+		e.gts[tableSector] = table
+	}
+
+	table.used = e.clock
+	return table.entries[grainNo%perTable], nil
+}
+
+// compressedGrain inflates the grain stored after a grain marker at off.
+// The last grain is kept for the reads that follow it.
+func (e *VmdkSparseExtent) compressedGrain(grainNo int64, off int64) ([]byte, error) {
+	if grainNo == e.grainNo {
+		return e.grain, nil
+	}
+
+	marker := make([]byte, vmdkGrainMarkerSize)
+	if _, err := e.r.ReadAt(marker, off); err != nil {
+		return nil, err
+	}
+
+	size := int64(binary.LittleEndian.Uint32(marker[8:]))
+	if size == 0 || size > 2*e.grainSize+SECTOR_SIZE {
+		return nil, errors.New(fmt.Sprintf("Bad VMDK compressed grain size %d at %d", size, off))
+	}
+
+	data := make([]byte, size)
+	n, err := e.r.ReadAt(data, off+vmdkGrainMarkerSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	z, err := zlib.NewReader(bytes.NewReader(data[:n]))
+	if err != nil {
+		return nil, err
+	}
+
+	//The last grain of an extent may be shorter
+	grain := make([]byte, e.grainSize)
+	if _, err := io.ReadFull(z, grain); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.New(fmt.Sprintf("Corrupt VMDK grain %d: %s", grainNo, err.Error()))
+	}
+
+	e.grainNo = grainNo
+	e.grain = grain
+	return grain, nil
+}
+
+// parseVmdkDescriptor returns the create type and the extents of a
+// descriptor. Delta disks are refused as their parent isn't read.
+func parseVmdkDescriptor(text string) (string, []vmdkExtentLine, error) {
+	createType := ""
+	extents := make([]vmdkExtentLine, 0)
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if eq := strings.Index(line, "="); eq >= 0 && !strings.Contains(line[:eq], "\"") {
+			key := strings.TrimSpace(line[:eq])
+			value := strings.Trim(strings.TrimSpace(line[eq+1:]), "\"")
+			switch key {
+			case "createType":
+				createType = value
+			case "parentCID":
+				if strings.ToLower(value) != VMDK_NO_PARENT {
+					return "", nil, errors.New("VMDK delta disks with a parent are not supported")
+				}
+			}
+			continue
+		}
+
+		extent, err := parseVmdkExtentLine(line)
+		if err != nil {
+			return "", nil, err
+		}
+		extents = append(extents, extent)
+	}
+
+	return createType, extents, nil
+}
+
+// parseVmdkExtentLine parses an extent line such as
+// RW 4192256 SPARSE "disk-s001.vmdk" or RW 2048 FLAT "disk-flat.vmdk" 0.
+func parseVmdkExtentLine(line string) (vmdkExtentLine, error) {
+	extent := vmdkExtentLine{}
+	bad := errors.New(fmt.Sprintf("Bad VMDK extent line %q", line))
+
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return extent, bad
+	}
+
+	sectors, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || sectors < 0 {
+		return extent, bad
+	}
+	extent.sectors = sectors
+	extent.kind = fields[2]
+
+	if extent.kind == "ZERO" {
+		return extent, nil
+	}
+
+	first := strings.Index(line, "\"")
+	last := strings.LastIndex(line, "\"")
+	if first < 0 || last <= first {
+		return extent, bad
+	}
+	extent.file = line[first+1 : last]
+
+	if rest := strings.TrimSpace(line[last+1:]); rest != "" {
+		if extent.offset, err = strconv.ParseInt(rest, 10, 64); err != nil {
+			return extent, bad
+		}
+	}
+
+	return extent, nil
+}
+
+// OpenVmdkImage opens a monolithicSparse or streamOptimized VMDK file, or a
+// descriptor file naming sparse, flat and zero extents. Extent files are
+// found next to the descriptor.
+func OpenVmdkImage(path string) (*VmdkImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	magic := make([]byte, 4)
+	if _, err := file.ReadAt(magic, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(magic) == VMDK_SPARSE_MAGIC {
+		extent, err := NewVmdkSparseExtent(file, size)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		//The embedded descriptor only names the extent itself
+		createType, _, err := parseVmdkDescriptor(extent.Descriptor())
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		image := &VmdkImage{CreateType: createType}
+		image.add(extent, extent.Size(), extent)
+		return image, nil
+	}
+
+	defer file.Close()
+	if size > vmdkMaxDescriptorSize {
+		return nil, errors.New(fmt.Sprintf("%s is too large for a VMDK descriptor", path))
+	}
+
+	text := make([]byte, size)
+	if _, err := file.ReadAt(text, 0); err != nil {
+		return nil, err
+	}
+
+	createType, extents, err := parseVmdkDescriptor(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(extents) == 0 {
+		return nil, errors.New(fmt.Sprintf("VMDK descriptor %s names no extents", path))
+	}
+
+	image := &VmdkImage{CreateType: createType}
+	for _, line := range extents {
+		if err := image.openExtent(line, filepath.Dir(path)); err != nil {
+			image.Close()
+			return nil, err
+		}
+	}
+
+	return image, nil
+}
+
+func (v *VmdkImage) openExtent(line vmdkExtentLine, dir string) error {
+	size := line.sectors * SECTOR_SIZE
+	if line.kind == "ZERO" {
+		v.add(zeroExtent{}, size, nil)
+		return nil
+	}
+
+	path := line.file
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	switch line.kind {
+	case "FLAT", "VMFS":
+		v.add(newSection(file, line.offset*SECTOR_SIZE, size), size, file)
+	case "SPARSE":
+		fileSize, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		extent, err := NewVmdkSparseExtent(file, fileSize)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		v.add(newSection(extent, 0, size), size, file)
+	default:
+		file.Close()
+		return errors.New(fmt.Sprintf("Unsupported VMDK extent type %s", line.kind))
+	}
+
+	return nil
+}
+
+func (v *VmdkImage) add(extent io.ReaderAt, size int64, closer io.Closer) {
+	v.extents = append(v.extents, extent)
+	v.starts = append(v.starts, v.size)
+	v.size += size
+	if closer != nil {
+		v.closers = append(v.closers, closer)
+	}
+}
+
+func (v *VmdkImage) Size() int64 {
+	return v.size
+}
+
+func (v *VmdkImage) Extents() int {
+	return len(v.extents)
+}
+
+func (v *VmdkImage) String() string {
+	return fmt.Sprintf("VMDK %s image, %d bytes in %d extents", v.CreateType, v.size, len(v.extents))
+}
+
+func (v *VmdkImage) Close() error {
+	var err error
+	for _, closer := range v.closers {
+		if cerr := closer.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (v *VmdkImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= v.size {
+			return n, io.EOF
+		}
+
+		//Last extent starting at or before pos
+		i := sort.Search(len(v.starts), func(i int) bool {
+			return v.starts[i] > pos
+		}) - 1
+
+		end := v.size
+		if i+1 < len(v.starts) {
+			end = v.starts[i+1]
+		}
+
+		piece := p[n:]
+		if int64(len(piece)) > end-pos {
+			piece = piece[:end-pos]
+		}
+
+		read, err := v.extents[i].ReadAt(piece, pos-v.starts[i])
+		n += read
+		if err != nil && !(err == io.EOF && read == len(piece)) {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// zeroExtent is a VMDK ZERO extent.
+type zeroExtent struct{}
+
+func (zeroExtent) ReadAt(p []byte, off int64) (int, error) {
+	zero(p)
+	return len(p), nil
+}
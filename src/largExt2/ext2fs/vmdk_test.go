@@ -0,0 +1,297 @@
+package ext2fs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	vmdkTestGrainSectors = 8
+	vmdkTestGrain        = vmdkTestGrainSectors * SECTOR_SIZE
+	vmdkTestGTEs         = 16 //Small grain tables, so the directory holds several
+)
+
+// vmdkTestData returns random data of grains, some of them zeros. The
+// grains of the second grain table are all zeros and the last grain is
+// short.
+func vmdkTestData(grains int) []byte {
+	rng := rand.New(rand.NewSource(3))
+	data := make([]byte, grains*vmdkTestGrain-3*SECTOR_SIZE)
+	for i := 0; i < grains; i++ {
+		if i%5 == 0 || i/vmdkTestGTEs == 1 {
+			continue
+		}
+		end := (i + 1) * vmdkTestGrain
+		if end > len(data) {
+			end = len(data)
+		}
+		rng.Read(data[i*vmdkTestGrain : end])
+	}
+	return data
+}
+
+// vmdkTestSparse returns a sparse extent holding data, streamOptimized with
+// its grain directory in the footer when compressed is set. The descriptor
+// is embedded when not empty.
+func vmdkTestSparse(t *testing.T, data []byte, compressed bool, descriptor string) []byte {
+	t.Helper()
+
+	header := vmdkSparseHeader{
+		Magic:             VMDK_SPARSE_MAGIC,
+		Version:           1,
+		Flags:             VMDK_FLAG_ZERO_GRAINS,
+		Capacity:          uint64(len(data) / SECTOR_SIZE),
+		GrainSize:         vmdkTestGrainSectors,
+		NumGTEsPerGT:      vmdkTestGTEs,
+		SingleEndLineChar: '\n',
+		NonEndLineChar:    ' ',
+	}
+	if compressed {
+		header.Version = 3
+		header.Flags |= VMDK_FLAG_COMPRESSED
+		header.CompressAlgorithm = VMDK_COMPRESS_DEFLATE
+	}
+
+	image := make([]byte, SECTOR_SIZE)
+	sector := func() uint64 {
+		return uint64(len(image) / SECTOR_SIZE)
+	}
+	pad := func() {
+		image = append(image, make([]byte, (SECTOR_SIZE-len(image)%SECTOR_SIZE)%SECTOR_SIZE)...)
+	}
+
+	if descriptor != "" {
+		header.DescriptorOffset = sector()
+		image = append(image, descriptor...)
+		pad()
+		header.DescriptorSize = sector() - header.DescriptorOffset
+	}
+
+	//A grain table entry of 1 marks a zero grain, no grain starts there
+	if sector() < 2 {
+		image = append(image, make([]byte, SECTOR_SIZE)...)
+	}
+
+	grains := (len(data) + vmdkTestGrain - 1) / vmdkTestGrain
+	gts := make([]uint32, (grains+vmdkTestGTEs-1)/vmdkTestGTEs*vmdkTestGTEs)
+	for i := range gts[:grains] {
+		grain := make([]byte, vmdkTestGrain)
+		copy(grain, data[i*vmdkTestGrain:])
+
+		if bytes.Equal(grain, make([]byte, vmdkTestGrain)) {
+			//Zero grains are either unallocated or marked as zeros, those
+			//of the second table are all unallocated
+			if i%2 == 1 && i/vmdkTestGTEs != 1 {
+				gts[i] = vmdkZeroGrain
+			}
+			continue
+		}
+
+		gts[i] = uint32(sector())
+		if !compressed {
+			image = append(image, grain...)
+			continue
+		}
+
+		var z bytes.Buffer
+		w := zlib.NewWriter(&z)
+		w.Write(grain)
+		w.Close()
+
+		marker := make([]byte, vmdkGrainMarkerSize)
+		binary.LittleEndian.PutUint64(marker, uint64(i*vmdkTestGrainSectors))
+		binary.LittleEndian.PutUint32(marker[8:], uint32(z.Len()))
+		image = append(append(image, marker...), z.Bytes()...)
+		pad()
+	}
+
+	//Grain tables whose grains are all unallocated are left out
+	gd := make([]uint32, len(gts)/vmdkTestGTEs)
+	for i := range gd {
+		table := gts[i*vmdkTestGTEs : (i+1)*vmdkTestGTEs]
+		if bytes.Equal(vmdkTestWords(table), make([]byte, 4*vmdkTestGTEs)) {
+			continue
+		}
+		gd[i] = uint32(sector())
+		image = append(image, vmdkTestWords(table)...)
+		pad()
+	}
+
+	gdOffset := sector()
+	image = append(image, vmdkTestWords(gd)...)
+	pad()
+
+	if !compressed {
+		header.GdOffset = gdOffset
+		copy(image, vmdkTestHeader(header))
+		return image
+	}
+
+	//The header at the start only says the directory is at the end, the
+	//footer after a footer marker has its offset
+	header.GdOffset = VMDK_GD_AT_END
+	copy(image, vmdkTestHeader(header))
+
+	marker := make([]byte, SECTOR_SIZE)
+	binary.LittleEndian.PutUint64(marker, 1)
+	binary.LittleEndian.PutUint32(marker[12:], 3)
+	header.GdOffset = gdOffset
+	image = append(append(image, marker...), vmdkTestHeader(header)...)
+
+	//End of stream marker
+	return append(image, make([]byte, SECTOR_SIZE)...)
+}
+
+func vmdkTestWords(words []uint32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, words)
+	return buf.Bytes()
+}
+
+func vmdkTestHeader(header vmdkSparseHeader) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, header)
+	return buf.Bytes()
+}
+
+func vmdkTestDescriptor(createType string, extents ...string) string {
+	return "# Disk DescriptorFile\nversion=1\nCID=12345678\nparentCID=ffffffff\ncreateType=\"" + createType + "\"\n\n# Extent description\n" + strings.Join(extents, "\n") + "\n"
+}
+
+func writeVmdkTest(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVmdkSparse(t *testing.T) {
+	for _, createType := range []string{"monolithicSparse", "streamOptimized"} {
+		t.Run(createType, func(t *testing.T) {
+			data := vmdkTestData(3*vmdkTestGTEs + 5)
+			descriptor := vmdkTestDescriptor(createType, "RW 5 SPARSE \"disk.vmdk\"")
+			image := vmdkTestSparse(t, data, createType == "streamOptimized", descriptor)
+
+			path := filepath.Join(t.TempDir(), "disk.vmdk")
+			writeVmdkTest(t, path, image)
+			if !IsVmdk(memImage(image)) {
+				t.Fatal("sparse extent not recognized")
+			}
+
+			vmdk, err := OpenVmdkImage(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vmdk.Close()
+
+			if vmdk.CreateType != createType || vmdk.Extents() != 1 {
+				t.Fatalf("opened %s", vmdk)
+			}
+			checkRandomReads(t, vmdk, data)
+		})
+	}
+}
+
+func TestVmdkStreamOptimizedCorruptGrain(t *testing.T) {
+	data := vmdkTestData(vmdkTestGTEs)
+	image := vmdkTestSparse(t, data, true, "")
+
+	extent, err := NewVmdkSparseExtent(memImage(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The zlib header of the second grain follows its marker
+	sector, err := extent.grainSector(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image[int(sector)*SECTOR_SIZE+vmdkGrainMarkerSize] ^= 0xFF
+
+	extent, err = NewVmdkSparseExtent(memImage(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extent.ReadAt(make([]byte, SECTOR_SIZE), vmdkTestGrain); err == nil {
+		t.Fatal("corrupt grain read")
+	}
+}
+
+func TestVmdkDescriptor(t *testing.T) {
+	dir := t.TempDir()
+
+	//A sparse extent, a flat one 16 sectors into its file and zeros
+	sparse := vmdkTestData(vmdkTestGTEs + 3)
+	flat := make([]byte, 128*SECTOR_SIZE)
+	rand.New(rand.NewSource(4)).Read(flat)
+
+	writeVmdkTest(t, filepath.Join(dir, "disk-s001.vmdk"), vmdkTestSparse(t, sparse, false, ""))
+	writeVmdkTest(t, filepath.Join(dir, "disk-flat.vmdk"), append(make([]byte, 16*SECTOR_SIZE), flat...))
+	writeVmdkTest(t, filepath.Join(dir, "disk.vmdk"), []byte(vmdkTestDescriptor("custom",
+		"RW "+strconv.Itoa(len(sparse)/SECTOR_SIZE)+" SPARSE \"disk-s001.vmdk\"",
+		"RW 128 FLAT \"disk-flat.vmdk\" 16",
+		"RW 64 ZERO",
+	)))
+
+	vmdk, err := OpenVmdkImage(filepath.Join(dir, "disk.vmdk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.CreateType != "custom" || vmdk.Extents() != 3 {
+		t.Fatalf("opened %s", vmdk)
+	}
+
+	data := append(append(append([]byte(nil), sparse...), flat...), make([]byte, 64*SECTOR_SIZE)...)
+	checkRandomReads(t, vmdk, data)
+
+	//Delta disks are refused
+	delta := strings.Replace(vmdkTestDescriptor("monolithicFlat", "RW 128 FLAT \"disk-flat.vmdk\" 16"), "parentCID=ffffffff", "parentCID=1234abcd", 1)
+	writeVmdkTest(t, filepath.Join(dir, "delta.vmdk"), []byte(delta))
+	if _, err := OpenVmdkImage(filepath.Join(dir, "delta.vmdk")); err == nil {
+		t.Fatal("delta disk opened")
+	}
+}
+
+func TestVmdkSparseBadGrainDirectory(t *testing.T) {
+	image := vmdkTestSparse(t, vmdkTestData(vmdkTestGTEs), false, "")
+
+	var header vmdkSparseHeader
+	binary.Read(bytes.NewReader(image), binary.LittleEndian, &header)
+
+	patches := map[string]func(header *vmdkSparseHeader){
+		"directory past the end": func(header *vmdkSparseHeader) {
+			header.GdOffset = uint64(len(image))
+		},
+		"directory offset wrapping": func(header *vmdkSparseHeader) {
+			header.GdOffset = 1 << 62
+		},
+		"capacity larger than the file": func(header *vmdkSparseHeader) {
+			header.Capacity = 1 << 50
+		},
+		"capacity overflowing": func(header *vmdkSparseHeader) {
+			header.Capacity = 1 << 63
+		},
+	}
+
+	for name, patch := range patches {
+		t.Run(name, func(t *testing.T) {
+			bad := header
+			patch(&bad)
+			patched := append(vmdkTestHeader(bad), image[SECTOR_SIZE:]...)
+
+			if _, err := NewVmdkSparseExtent(memImage(patched), int64(len(patched))); err == nil {
+				t.Fatal("bad extent opened")
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package ext2fs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// xtsCipher decrypts AES-XTS data units (IEEE 1619) the way dm-crypt does
+// with the plain64 IV, the unit number being the little-endian tweak.
+type xtsCipher struct {
+	data  cipher.Block
+	tweak cipher.Block
+}
+
+// newXtsCipher splits key into the data key and the tweak key.
+func newXtsCipher(key []byte) (*xtsCipher, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, errors.New(fmt.Sprintf("Bad AES-XTS key size %d", len(key)))
+	}
+
+	data, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+
+	tweak, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &xtsCipher{data: data, tweak: tweak}, nil
+}
+
+// decrypt decrypts the data unit src into dst, its length must be a multiple
+// of the AES block size.
+func (x *xtsCipher) decrypt(dst, src []byte, unit uint64) {
+	var tweak [aes.BlockSize]byte
+	binary.LittleEndian.PutUint64(tweak[:], unit)
+	x.tweak.Encrypt(tweak[:], tweak[:])
+
+	for i := 0; i+aes.BlockSize <= len(src); i += aes.BlockSize {
+		block := dst[i : i+aes.BlockSize]
+		for j := range block {
+			block[j] = src[i+j] ^ tweak[j]
+		}
+		x.data.Decrypt(block, block)
+		for j := range block {
+			block[j] ^= tweak[j]
+		}
+
+		//Multiply the tweak by x in GF(2^128)
+		carry := tweak[aes.BlockSize-1] >> 7
+		for j := aes.BlockSize - 1; j > 0; j-- {
+			tweak[j] = tweak[j]<<1 | tweak[j-1]>>7
+		}
+		tweak[0] = tweak[0]<<1 ^ carry*0x87
+	}
+}
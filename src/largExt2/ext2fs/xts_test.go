@@ -0,0 +1,61 @@
+package ext2fs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// The XTS-AES-128 test vectors 1 and 2 of IEEE 1619.
+func TestXtsIeee1619(t *testing.T) {
+	vectors := []struct {
+		key        string
+		unit       uint64
+		plaintext  string
+		ciphertext string
+	}{
+		{
+			"00000000000000000000000000000000" + "00000000000000000000000000000000",
+			0,
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"917cf69ebd68b2ec9b9fe9a3eadda692cd43d2f59598ed858c02c2652fbf922e",
+		},
+		{
+			"11111111111111111111111111111111" + "22222222222222222222222222222222",
+			0x3333333333,
+			"4444444444444444444444444444444444444444444444444444444444444444",
+			"c454185e6a16936e39334038acef838bfb186fff7480adc4289382ecd6d394f0",
+		},
+	}
+
+	for i, vector := range vectors {
+		key, _ := hex.DecodeString(vector.key)
+		plaintext, _ := hex.DecodeString(vector.plaintext)
+		ciphertext, _ := hex.DecodeString(vector.ciphertext)
+
+		x, err := newXtsCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := make([]byte, len(ciphertext))
+		x.decrypt(out, ciphertext, vector.unit)
+		if !bytes.Equal(out, plaintext) {
+			t.Fatalf("vector %d decrypts to %x", i+1, out)
+		}
+
+		//In place, as LuksVolume decrypts
+		x.decrypt(ciphertext, ciphertext, vector.unit)
+		if !bytes.Equal(ciphertext, plaintext) {
+			t.Fatalf("vector %d decrypts in place to %x", i+1, ciphertext)
+		}
+	}
+}
+
+func TestXtsKeySize(t *testing.T) {
+	for _, size := range []int{16, 31, 33, 128} {
+		if _, err := newXtsCipher(make([]byte, size)); err == nil {
+			t.Fatalf("%d byte key accepted", size)
+		}
+	}
+}
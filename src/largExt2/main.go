@@ -2,18 +2,36 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"largExt2/ext2fs"
 	"os"
+	"strconv"
+	"strings"
 )
 
 var verbose = false
 var latin1 = false
+var partition = 0
+var offset int64 = 0
+var scan = false
+var saveIndex = true
+var verify = false
+var mmap = false
+var degraded = false
+var useBackups = false
+var backupBlock uint64 = 0
+var members []string
+var physicalVolumes []string
+var logicalVolume = ""
+var keyFile = ""
+var passphraseFd = -1
 var dirs = 0
 var files = 0
 var bytes int64 = 0
+var damaged []string
 
 func main() {
 	flag.Parse()
@@ -32,28 +50,67 @@ func main() {
 				verbose = true
 			case "latin1":
 				latin1 = true
+			case "scan":
+				scan = true
+			case "noindex":
+				saveIndex = false
+			case "verify":
+				verify = true
+			case "mmap":
+				mmap = true
+			case "degraded":
+				degraded = true
+			case "backup":
+				useBackups = true
 			default:
-				help()
-				return
+				if !parseOption(args[i]) {
+					help()
+					return
+				}
 			}
 		}
 	}
 
-	device, err := ext2fs.NewDevice(source)
+	device, err := openDevice(source)
 	if err != nil {
 		fmt.Printf("Can't open %s: %s\n", source, err.Error())
+		var truncated *ext2fs.TruncatedError
+		if errors.As(err, &truncated) {
+			fmt.Println("Give the degraded parameter to extract what is left of it")
+		}
+		var damaged *ext2fs.DamagedError
+		if errors.As(err, &damaged) {
+			fmt.Println("Give the backup parameter to open it from a backup superblock")
+		}
 		return
 	}
 	defer device.Close()
+	if device.Truncated() {
+		fmt.Printf("WARNING: %s is truncated, %d of %d bytes are present, the missing ones read as zeros\n",
+			source, device.Size(), device.ExpectedSize())
+	}
 	superBlock, _ := device.NewSuperBlock()
-	size := uint64(superBlock.BlocksCount) * uint64(device.BlockSize)
-	free := uint64(superBlock.FreeBlocksCount) * uint64(device.BlockSize)
+	size := superBlock.BlocksCount64() * uint64(device.BlockSize)
+	free := superBlock.FreeBlocksCount64() * uint64(device.BlockSize)
 	report(fmt.Sprintf("Size %d\n", size))
 	report(fmt.Sprintf("Used %d\n", size-free))
 	report(fmt.Sprintf("Free %d\n\n", free))
 	report(fmt.Sprintf("Block Size %d\n\n", device.BlockSize))
+	features := strings.Join(superBlock.FeatureNames(), " ")
+	if features == "" {
+		features = "(none)"
+	}
+	report(fmt.Sprintf("Features %s\n", features))
 	err = dumpDirInode(device, dest, ext2fs.EXT2_ROOT_INO)
 	fmt.Printf("Written %d files (total %d bytes) in %d directories\n", files, bytes, dirs)
+	if len(damaged) > 0 {
+		fmt.Printf("%d files and directories lie partly past the end of the image:\n", len(damaged))
+		for _, file := range damaged {
+			fmt.Println(file)
+		}
+	}
+	stats := device.CacheStats()
+	report(fmt.Sprintf("Metadata cache %d hits, %d misses, %d evictions\n", stats.Hits, stats.Misses, stats.Evictions))
 	if err != nil {
 		fmt.Println(err.Error())
 		panic(err)
@@ -61,11 +118,84 @@ func main() {
 }
 
 func help() {
-	fmt.Println("Usage: largeExt2 [verbose] [latin1] source destination")
+	fmt.Println("Usage: largeExt2 [verbose] [latin1] [partition=N] [offset=N] [scan] [noindex] [verify] [mmap] [degraded] [backup[=N]] [member=path]... [pv=path]... [lv=VG/LV] [keyfile=path] [passfd=N] source destination")
 	fmt.Println("\nDumps all files from EXT2 image source (block device or file) to destination.")
-	fmt.Println("Destination must be a directory and the process must have a read-write access to source.")
+	fmt.Println("Destination must be a directory and the process must have a read access to source.")
 	fmt.Println("verbose parameter turns on file copy and directory logging.")
 	fmt.Println("latin1 parameter converts source file names from latin1 to utf8.")
+	fmt.Println("A split image (image.001, image.002, ...) is given by its first segment.")
+	fmt.Println("mmap parameter maps an image file into memory instead of reading it with system calls.")
+	fmt.Println("source may be an http(s) URL of a raw image, read with Range requests.")
+	fmt.Println("source may be an NBD export, nbd://host[:port]/export or nbd+unix:///export?socket=path.")
+	fmt.Println("gzip and bzip2 compressed images are read directly after indexing them once.")
+	fmt.Println("The index is saved next to the image as image.gz.idx unless noindex is given.")
+	fmt.Println("qcow2 images are read directly, backing files are looked up next to the image.")
+	fmt.Println("VMDK images are given by their sparse extent or descriptor file.")
+	fmt.Println("VHD images are read directly, the parent of a differencing VHD must be next to it.")
+	fmt.Println("Android sparse images are expanded while reading, simg2img is not needed.")
+	fmt.Println("EWF images are given by their first segment (image.E01).")
+	fmt.Println("verify parameter checks E01 and Android sparse images against their stored hashes first.")
+	fmt.Println("partition parameter selects a partition of a whole-disk MBR or GPT image.")
+	fmt.Println("Without it the single ext2 partition of a whole-disk image is used.")
+	fmt.Println("offset parameter gives the byte offset of the filesystem inside source.")
+	fmt.Println("member parameters add the other members of the md array source belongs to.")
+	fmt.Println("A raid1 member is read alone, a raid5 array may miss one member.")
+	fmt.Println("pv parameters add the other physical volumes of the LVM volume group in source.")
+	fmt.Println("lv parameter selects a logical volume, by default the single ext2 one is used.")
+	fmt.Println("LUKS devices are unlocked with a passphrase typed on the terminal.")
+	fmt.Println("keyfile parameter unlocks them with the contents of a key file instead.")
+	fmt.Println("passfd parameter reads the passphrase line from file descriptor N instead.")
+	fmt.Println("degraded parameter extracts a truncated image, reading the missing part as zeros.")
+	fmt.Println("The files that lost data are listed at the end.")
+	fmt.Println("backup parameter opens the filesystem from the first sane backup superblock")
+	fmt.Println("when the primary superblock or group descriptors are damaged, backup=N from block N.")
+	fmt.Println("scan parameter searches the first GiB of source for the filesystem when none is found.")
+}
+
+func parseOption(arg string) bool {
+	eq := strings.Index(arg, "=")
+	if eq < 0 {
+		return false
+	}
+
+	value := arg[eq+1:]
+	switch arg[:eq] {
+	case "partition":
+		index, err := strconv.Atoi(value)
+		if err != nil || index < 1 {
+			return false
+		}
+		partition = index
+	case "offset":
+		off, err := strconv.ParseInt(value, 0, 64)
+		if err != nil || off < 0 {
+			return false
+		}
+		offset = off
+	case "member":
+		members = append(members, value)
+	case "pv":
+		physicalVolumes = append(physicalVolumes, value)
+	case "lv":
+		logicalVolume = value
+	case "backup":
+		block, err := strconv.ParseUint(value, 0, 64)
+		if err != nil || block == 0 {
+			return false
+		}
+		backupBlock = block
+	case "keyfile":
+		keyFile = value
+	case "passfd":
+		fd, err := strconv.Atoi(value)
+		if err != nil || fd < 0 {
+			return false
+		}
+		passphraseFd = fd
+	default:
+		return false
+	}
+	return true
 }
 
 func dumpDir(device *ext2fs.Device, dir *ext2fs.DirEntry, path string) error {
@@ -82,6 +212,11 @@ func dumpDirInode(device *ext2fs.Device, target string, inode uint32) error {
 	if err != nil {
 		return err
 	}
+	if dir, err := device.NewInode(inode); err == nil {
+		if missing, _ := device.MissingBlocks(dir); missing > 0 {
+			damaged = append(damaged, fmt.Sprintf("%s/ (%d blocks missing)", target, missing))
+		}
+	}
 	directories := make([]*ext2fs.DirEntry, 0)
 	for _, entry := range dirEntries {
 		switch entry.FileType {
@@ -111,7 +246,7 @@ func dumpDirInode(device *ext2fs.Device, target string, inode uint32) error {
 func dumpFile(destDir string, entry *ext2fs.DirEntry, device *ext2fs.Device) error {
 	name := fileName(entry)
 	inode, err := device.NewInode(entry.Inode)
-	report(fmt.Sprintf("Dump file %s to %s (%d bytes)\n", name, destDir, inode.Size))
+	report(fmt.Sprintf("Dump file %s to %s (%d bytes)\n", name, destDir, inode.Size64()))
 	if err != nil {
 		return err
 	}
@@ -119,9 +254,24 @@ func dumpFile(destDir string, entry *ext2fs.DirEntry, device *ext2fs.Device) err
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 	writer := bufio.NewWriter(file)
 	reader := ext2fs.NewInodeReader(device, inode)
 	written, err := io.Copy(writer, reader)
+	if missing, _ := device.MissingBlocks(inode); missing > 0 {
+		damaged = append(damaged, fmt.Sprintf("%s/%s (%d blocks missing)", destDir, name, missing))
+
+		//The block numbers of the rest go with a missing indirect block, the
+		//reader stops there and the rest reads as zeros too. A failed copy
+		//keeps its error.
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err == nil && written < int64(inode.Size64()) {
+			err = file.Truncate(int64(inode.Size64()))
+			written = int64(inode.Size64())
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"largExt2/ext2fs"
+	"os"
+)
+
+const scanLimit = 1024 * 1024 * 1024
+
+type storage interface {
+	io.ReaderAt
+	io.Closer
+}
+
+func openDevice(source string) (*ext2fs.Device, error) {
+	r, size, err := openStorage(source)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := openPartitioned(r, size)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return device, nil
+}
+
+// openStorage opens source, reassembling the md array it is a member of.
+func openStorage(source string) (storage, int64, error) {
+	r, size, err := openImage(source)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	md, err := ext2fs.ReadMdSuperBlock(r, size)
+	if err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+
+	if md == nil {
+		if len(members) > 0 {
+			r.Close()
+			return nil, 0, errors.New(fmt.Sprintf("%s is not an md array member", source))
+		}
+		return r, size, nil
+	}
+
+	report(fmt.Sprintf("%s: %s", source, md.String()))
+
+	images := []io.ReaderAt{r}
+	sizes := []int64{size}
+	closeAll := func() {
+		for _, image := range images {
+			image.(io.Closer).Close()
+		}
+	}
+
+	for _, member := range members {
+		image, size, err := openImage(member)
+		if err != nil {
+			closeAll()
+			return nil, 0, err
+		}
+		images = append(images, image)
+		sizes = append(sizes, size)
+	}
+
+	array, err := ext2fs.AssembleMdArray(images, sizes)
+	if err != nil {
+		closeAll()
+		return nil, 0, err
+	}
+
+	report(array.String() + "\n")
+	return array, array.Size(), nil
+}
+
+// openImage opens an image file, or all segments of a split image given its
+// first segment, decompressing gzip and bzip2 images and reading the guest
+// disk of virtual disk images. Remote images are read raw.
+func openImage(path string) (storage, int64, error) {
+	r, size, err := openRaw(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	//Virtual disks and compressed images look for files next to the image
+	if ext2fs.IsHttpUrl(path) || ext2fs.IsNbdUrl(path) {
+		return r, size, nil
+	}
+
+	disk, err := openVirtualDisk(r, size, path)
+	if disk != nil || err != nil {
+		r.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		report(fmt.Sprintf("%s: %s", path, disk.String()))
+
+		if err := verifyDisk(disk, path); err != nil {
+			disk.Close()
+			return nil, 0, err
+		}
+		return disk, disk.Size(), nil
+	}
+
+	if ext2fs.CompressionFormat(r) == "" {
+		return r, size, nil
+	}
+
+	image, err := openCompressed(r, size, path)
+	if err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+	return image, image.Size(), nil
+}
+
+// virtualDisk is the guest disk of a virtual disk image.
+type virtualDisk interface {
+	storage
+	Size() int64
+	String() string
+}
+
+// openVirtualDisk opens the virtual disk image at path when r holds one of
+// the formats read by ext2fs, and returns nil for anything else.
+func openVirtualDisk(r io.ReaderAt, size int64, path string) (virtualDisk, error) {
+	var disk virtualDisk
+	var err error
+
+	switch {
+	case ext2fs.IsQcow2(r):
+		disk, err = ext2fs.OpenQcow2Image(path)
+	case ext2fs.IsVmdk(r):
+		disk, err = ext2fs.OpenVmdkImage(path)
+	case ext2fs.IsVhd(r, size):
+		disk, err = ext2fs.OpenVhdImage(path)
+	case ext2fs.IsEwf(r):
+		disk, err = ext2fs.OpenEwfImage(path)
+	case ext2fs.IsAndroidSparse(r):
+		disk, err = ext2fs.OpenAndroidSparseImage(path)
+	default:
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return disk, nil
+}
+
+// verifiable is an image that stores hashes of its data.
+type verifiable interface {
+	Verify() error
+}
+
+// verifyDisk checks the disk against its stored hashes when asked to.
+func verifyDisk(disk virtualDisk, path string) error {
+	image, ok := disk.(verifiable)
+	if !verify || !ok {
+		return nil
+	}
+
+	fmt.Printf("Verifying %s, this reads the whole image once\n", path)
+	if err := image.Verify(); err != nil {
+		return err
+	}
+	fmt.Printf("%s verified\n", path)
+	return nil
+}
+
+func openRaw(path string) (storage, int64, error) {
+	if ext2fs.IsHttpUrl(path) {
+		image, err := ext2fs.OpenHttpImage(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		report(image.String())
+		return image, image.Size(), nil
+	}
+
+	if ext2fs.IsNbdUrl(path) {
+		client, err := ext2fs.OpenNbdUrl(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		report(client.String())
+		return client, client.Size(), nil
+	}
+
+	if ext2fs.IsFirstSegment(path) {
+		image, err := ext2fs.OpenSegmentedImage(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		report(fmt.Sprintf("%s: %d segments, %d bytes", path, image.Segments(), image.Size()))
+		return image, image.Size(), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := ext2fs.FileSize(file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	if mmap {
+		image, err := ext2fs.MapFile(file)
+		if err == nil {
+			report(image.String())
+			return image, size, nil
+		}
+		report(fmt.Sprintf("%s, reading it with pread", err.Error()))
+	}
+
+	return file, size, nil
+}
+
+// openCompressed opens a compressed image with the index next to it, or
+// builds the index and saves it there for the next run.
+func openCompressed(r io.ReaderAt, size int64, path string) (*ext2fs.CompressedImage, error) {
+	indexPath := path + ext2fs.COMPRESSED_INDEX_SUFFIX
+	if _, err := os.Stat(indexPath); err != nil {
+		fmt.Printf("Indexing %s image %s, this reads the whole image once\n", ext2fs.CompressionFormat(r), path)
+	}
+
+	image, err := ext2fs.OpenCompressedImage(r, size, indexPath)
+	if err != nil {
+		return nil, err
+	}
+	report(fmt.Sprintf("%s: %s", path, image.String()))
+
+	if !image.IndexLoaded() && saveIndex {
+		if err := image.SaveIndex(indexPath); err != nil {
+			fmt.Printf("Can't save index %s: %s\n", indexPath, err.Error())
+		} else {
+			report(fmt.Sprintf("Saved index %s", indexPath))
+		}
+	}
+	return image, nil
+}
+
+// openPartitioned opens the filesystem at the start of r or at the given
+// offset, or the selected or single ext2 partition of a whole-disk image.
+func openPartitioned(r io.ReaderAt, size int64) (*ext2fs.Device, error) {
+	options := ext2fs.DeviceOptions{ReadOnly: true, Degraded: degraded}
+
+	if offset != 0 {
+		options.Offset = offset
+		return newDevice(r, size, options)
+	}
+
+	if partition == 0 && hasFilesystem(r) {
+		return newDevice(r, size, options)
+	}
+
+	if partition == 0 && isPhysicalVolume(r) {
+		return openLogicalVolume(r, options)
+	}
+
+	if partition == 0 && ext2fs.IsLuks(r) {
+		return openLuks(r, size, options)
+	}
+
+	partitions, err := ext2fs.ReadPartitions(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]ext2fs.Partition, 0)
+	for _, p := range partitions {
+		report(p.String())
+		if partition == p.Index {
+			return openPartition(r, size, p, options)
+		}
+		contents := ext2fs.NewPartitionReader(r, p)
+		if hasFilesystem(contents) || isPhysicalVolume(contents) || ext2fs.IsLuks(contents) {
+			candidates = append(candidates, p)
+		}
+	}
+
+	if partition != 0 {
+		return nil, errors.New(fmt.Sprintf("No partition %d", partition))
+	}
+
+	switch len(candidates) {
+	case 0:
+		if scan {
+			return openScanned(r, size, options)
+		}
+		return nil, errors.New("Not an ext2 filesystem and no ext2 partition found, try the scan or backup parameter")
+	case 1:
+		report(fmt.Sprintf("Using partition %d\n", candidates[0].Index))
+		return openPartition(r, size, candidates[0], options)
+	}
+
+	for _, p := range candidates {
+		fmt.Println(p.String())
+	}
+	return nil, errors.New("Several ext2 partitions found, select one with partition=N")
+}
+
+// openPartition opens the filesystem of a partition, or of the logical volume
+// it holds when the partition is an LVM physical volume, or of the LUKS
+// device it holds. A partition running past the end of a truncated image is
+// cut at the end of the image.
+func openPartition(r io.ReaderAt, size int64, p ext2fs.Partition, options ext2fs.DeviceOptions) (*ext2fs.Device, error) {
+	if p.Start+p.Size > size && p.Start < size {
+		report(fmt.Sprintf("Partition %d ends %d bytes past the end of the image", p.Index, p.Start+p.Size-size))
+		p.Size = size - p.Start
+	}
+
+	contents := ext2fs.NewPartitionReader(r, p)
+	if !hasFilesystem(contents) && isPhysicalVolume(contents) {
+		return openLogicalVolume(contents, options)
+	}
+	if !hasFilesystem(contents) && ext2fs.IsLuks(contents) {
+		return openLuks(contents, p.Size, options)
+	}
+	return newDevice(contents, p.Size, options)
+}
+
+// hasFilesystem reports whether r holds an ext2 filesystem, or only backup
+// superblocks of one when they are to be tried.
+func hasFilesystem(r io.ReaderAt) bool {
+	if ext2fs.HasSuperBlock(r, 0) {
+		return true
+	}
+	return (useBackups || backupBlock != 0) && len(ext2fs.FindBackupSuperBlocks(r, 0)) > 0
+}
+
+// newDevice opens the filesystem of r, from the backup superblock given or
+// from the first sane backup when asked to and the primary one is damaged.
+func newDevice(r io.ReaderAt, size int64, options ext2fs.DeviceOptions) (*ext2fs.Device, error) {
+	if backupBlock != 0 {
+		options.BackupSuperBlock = backupBlock
+		return ext2fs.NewDeviceFromReaderAt(r, size, options)
+	}
+
+	device, err := ext2fs.NewDeviceFromReaderAt(r, size, options)
+	var truncated *ext2fs.TruncatedError
+	if err == nil || !useBackups || errors.As(err, &truncated) {
+		return device, err
+	}
+
+	for _, backup := range ext2fs.FindBackupSuperBlocks(r, options.Offset) {
+		options.BackupSuperBlock = backup.Block
+		device, backupErr := ext2fs.NewDeviceFromReaderAt(r, size, options)
+		if backupErr == nil {
+			fmt.Printf("%s\nUsing the backup superblock of group %d at block %d\n", err.Error(), backup.Group, backup.Block)
+			return device, nil
+		}
+		report(fmt.Sprintf("%s: %s", backup.String(), backupErr.Error()))
+	}
+	return nil, err
+}
+
+func isPhysicalVolume(r io.ReaderAt) bool {
+	pv, err := ext2fs.ReadLvmLabel(r)
+	return err == nil && pv != nil
+}
+
+// volume is a logical volume that closes all its physical volumes.
+type volume struct {
+	*ext2fs.LvmLogicalVolume
+	closers []io.Closer
+}
+
+func (v *volume) Close() error {
+	var err error
+	for _, closer := range v.closers {
+		if cerr := closer.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// openLogicalVolume lists the volume groups found on r and the pv
+// parameters, and opens the selected or single ext2 logical volume.
+func openLogicalVolume(r io.ReaderAt, options ext2fs.DeviceOptions) (*ext2fs.Device, error) {
+	pvs := []io.ReaderAt{r}
+	opened := make([]io.Closer, 0)
+
+	closeAll := func() {
+		for _, closer := range opened {
+			closer.Close()
+		}
+	}
+
+	for _, path := range physicalVolumes {
+		file, err := os.Open(path)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		pvs = append(pvs, file)
+		opened = append(opened, file)
+	}
+
+	groups, err := ext2fs.ReadLvmVolumeGroups(pvs)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	candidates := make([]*ext2fs.LvmLogicalVolume, 0)
+	for _, vg := range groups {
+		fmt.Println(vg.String())
+		for _, lv := range vg.LogicalVolumes {
+			fmt.Println(lv.String())
+			if logicalVolume == lv.Name || logicalVolume == vg.Name+"/"+lv.Name {
+				candidates = []*ext2fs.LvmLogicalVolume{lv}
+				break
+			}
+			if logicalVolume == "" && lv.Check() == nil && (hasFilesystem(lv) || ext2fs.IsLuks(lv)) {
+				candidates = append(candidates, lv)
+			}
+		}
+		if logicalVolume != "" && len(candidates) > 0 {
+			break
+		}
+	}
+	fmt.Println()
+
+	if len(candidates) != 1 {
+		closeAll()
+		if logicalVolume != "" {
+			return nil, errors.New(fmt.Sprintf("No logical volume %s", logicalVolume))
+		}
+		if len(candidates) == 0 {
+			return nil, errors.New("No readable ext2 logical volume found")
+		}
+		return nil, errors.New("Several ext2 logical volumes found, select one with lv=VG/LV")
+	}
+
+	lv := candidates[0]
+	if err := lv.Check(); err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	closers := opened
+	if closer, ok := r.(io.Closer); ok {
+		closers = append(closers, closer)
+	}
+
+	var device *ext2fs.Device
+	if ext2fs.IsLuks(lv) {
+		device, err = openLuks(&volume{lv, closers}, lv.Size(), options)
+	} else {
+		device, err = newDevice(&volume{lv, closers}, lv.Size(), options)
+	}
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return device, nil
+}
+
+// openLuks unlocks the LUKS device r and opens the filesystem, or the logical
+// volume, it holds.
+func openLuks(r io.ReaderAt, size int64, options ext2fs.DeviceOptions) (*ext2fs.Device, error) {
+	header, err := ext2fs.ReadLuksHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	report(header.String())
+
+	passphrase, err := readPassphrase(header.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	luks, err := header.Unlock(r, size, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	report(luks.String() + "\n")
+
+	if !hasFilesystem(luks) && isPhysicalVolume(luks) {
+		return openLogicalVolume(luks, options)
+	}
+	return newDevice(luks, luks.Size(), options)
+}
+
+// openScanned opens the most plausible filesystem found by searching the
+// start of r for superblocks.
+func openScanned(r io.ReaderAt, size int64, options ext2fs.DeviceOptions) (*ext2fs.Device, error) {
+	limit := size
+	if limit > scanLimit {
+		limit = scanLimit
+	}
+
+	candidates, err := ext2fs.ScanSuperBlocks(r, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range candidates {
+		report(fmt.Sprintf("Superblock candidate at offset %d (score %d, %d copies)", candidate.Offset, candidate.Score, candidate.Copies))
+	}
+
+	for _, candidate := range candidates {
+		options.Offset = candidate.Offset
+		device, err := ext2fs.NewDeviceFromReaderAt(r, size, options)
+		if err == nil {
+			report(fmt.Sprintf("Using filesystem at offset %d\n", candidate.Offset))
+			return device, nil
+		}
+		report(fmt.Sprintf("Can't open filesystem at offset %d: %s", candidate.Offset, err.Error()))
+	}
+
+	return nil, errors.New("No ext2 superblock found")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// readPassphrase returns the contents of the key file, the first line read
+// from the passphrase file descriptor, or the passphrase typed on the
+// terminal.
+func readPassphrase(device string) ([]byte, error) {
+	if keyFile != "" {
+		return os.ReadFile(keyFile)
+	}
+
+	if passphraseFd >= 0 {
+		file := os.NewFile(uintptr(passphraseFd), "passphrase")
+		if file == nil {
+			return nil, errors.New(fmt.Sprintf("Bad passphrase file descriptor %d", passphraseFd))
+		}
+		return readLine(file)
+	}
+
+	fmt.Printf("Enter passphrase for LUKS device %s: ", device)
+	setEcho(false)
+	passphrase, err := readLine(os.Stdin)
+	setEcho(true)
+	fmt.Println()
+	return passphrase, err
+}
+
+func readLine(r io.Reader) ([]byte, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		return nil, errors.New("Can't read the passphrase: " + err.Error())
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// setEcho turns the echo of the terminal on stdin on or off, nothing is done
+// when stdin isn't a terminal.
+func setEcho(on bool) {
+	mode := "-echo"
+	if on {
+		mode = "echo"
+	}
+
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}